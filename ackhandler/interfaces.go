@@ -3,6 +3,7 @@ package ackhandler
 import (
 	"time"
 
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
 )
@@ -19,6 +20,8 @@ type SentPacketHandler interface {
 	GetLargestObserved() protocol.PacketNumber
 
 	CongestionAllowsSending() bool
+	GetCongestionWindow() protocol.ByteCount
+	GetRTTStats() *congestion.RTTStats
 	CheckForError() error
 
 	TimeToFirstRTO() time.Duration
@@ -282,6 +282,15 @@ func (h *sentPacketHandler) CongestionAllowsSending() bool {
 	return h.BytesInFlight() <= h.congestion.GetCongestionWindow()
 }
 
+func (h *sentPacketHandler) GetCongestionWindow() protocol.ByteCount {
+	return h.congestion.GetCongestionWindow()
+}
+
+// GetRTTStats gets the RTT estimates, they are updated with every ACK
+func (h *sentPacketHandler) GetRTTStats() *congestion.RTTStats {
+	return h.rttStats
+}
+
 func (h *sentPacketHandler) CheckForError() error {
 	length := len(h.retransmissionQueue) + len(h.packetHistory)
 	if uint32(length) > protocol.MaxTrackedSentPackets {
@@ -0,0 +1,68 @@
+package quic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// A BindErrorKind is the reason why the server couldn't listen on an address
+type BindErrorKind int
+
+const (
+	// BindErrorOther is any reason not covered by the other kinds
+	BindErrorOther BindErrorKind = iota
+	// BindErrorAddressInUse means that another socket is already bound to the address
+	BindErrorAddressInUse
+	// BindErrorPermissionDenied means that we are not allowed to bind to the address, e.g. to a privileged port
+	BindErrorPermissionDenied
+	// BindErrorInvalidAddress means that the address couldn't be resolved or isn't a local address
+	BindErrorInvalidAddress
+)
+
+func (k BindErrorKind) String() string {
+	switch k {
+	case BindErrorAddressInUse:
+		return "address in use"
+	case BindErrorPermissionDenied:
+		return "permission denied"
+	case BindErrorInvalidAddress:
+		return "invalid address"
+	default:
+		return "other"
+	}
+}
+
+// A BindError is returned when the server fails to listen on an address
+// The underlying error of the net package is available via errors.Unwrap.
+type BindError struct {
+	Address string
+	Kind    BindErrorKind
+	Err     error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("listening on %s failed (%s): %s", e.Address, e.Kind, e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+func newBindError(address string, err error) *BindError {
+	kind := BindErrorOther
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		kind = BindErrorAddressInUse
+	case errors.Is(err, os.ErrPermission):
+		kind = BindErrorPermissionDenied
+	case errors.Is(err, syscall.EADDRNOTAVAIL), errors.As(err, &addrErr), errors.As(err, &dnsErr):
+		kind = BindErrorInvalidAddress
+	}
+	return &BindError{Address: address, Kind: kind, Err: err}
+}
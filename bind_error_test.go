@@ -0,0 +1,65 @@
+package quic
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/lucas-clemente/quic-go/testdata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bind errors", func() {
+	var server *Server
+
+	BeforeEach(func() {
+		var err error
+		server, err = NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("returns a typed error if the address is already in use", func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		address := conn.LocalAddr().String()
+		err = server.ListenAndServe(address)
+		var bindErr *BindError
+		Expect(errors.As(err, &bindErr)).To(BeTrue())
+		Expect(bindErr.Kind).To(Equal(BindErrorAddressInUse))
+		Expect(bindErr.Address).To(Equal(address))
+		Expect(errors.Unwrap(err)).To(BeAssignableToTypeOf(&net.OpError{}))
+		Expect(errors.Is(err, syscall.EADDRINUSE)).To(BeTrue())
+	})
+
+	It("returns a typed error for invalid addresses", func() {
+		err := server.ListenAndServe("127.0.0.1:foobar")
+		var bindErr *BindError
+		Expect(errors.As(err, &bindErr)).To(BeTrue())
+		Expect(bindErr.Kind).To(Equal(BindErrorInvalidAddress))
+	})
+
+	It("returns a typed error when setting the preferred address fails", func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		err = server.SetPreferredAddress(conn.LocalAddr().String())
+		var bindErr *BindError
+		Expect(errors.As(err, &bindErr)).To(BeTrue())
+		Expect(bindErr.Kind).To(Equal(BindErrorAddressInUse))
+	})
+
+	It("classifies errors", func() {
+		err := newBindError("127.0.0.1:443", &net.OpError{Op: "listen", Net: "udp", Err: &net.AddrError{}})
+		Expect(err.Kind).To(Equal(BindErrorInvalidAddress))
+		err = newBindError("127.0.0.1:443", &net.OpError{Op: "listen", Net: "udp", Err: syscall.EACCES})
+		Expect(err.Kind).To(Equal(BindErrorPermissionDenied))
+		Expect(err.Error()).To(ContainSubstring("listening on 127.0.0.1:443 failed (permission denied)"))
+	})
+})
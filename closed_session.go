@@ -0,0 +1,54 @@
+package quic
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// A closedSession takes the place of a session after it was closed, until the draining period is over.
+// It answers packets of the peer with the packet the session closed the connection with,
+// so that the peer learns about the close even if that packet was lost.
+type closedSession struct {
+	conn connection
+	// the CONNECTION_CLOSE or public reset packet that was sent, nil if the peer closed the connection
+	closePacket []byte
+
+	packetCount uint64
+	mutex       sync.Mutex
+}
+
+var _ packetHandler = &closedSession{}
+
+func newClosedSession(conn connection, closePacket []byte) *closedSession {
+	return &closedSession{
+		conn:        conn,
+		closePacket: closePacket,
+	}
+}
+
+func (s *closedSession) handlePacket(addr interface{}, hdr *publicHeader, data []byte) {
+	if s.closePacket == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.packetCount++
+	// rate-limit our answers: only answer to the 1st, 2nd, 4th, 8th, ... packet
+	respond := s.packetCount&(s.packetCount-1) == 0
+	s.mutex.Unlock()
+
+	if !respond {
+		return
+	}
+	// The packet is sent to the current address of the session, not to the address this packet was received from,
+	// otherwise spoofed packets could make us send packets anywhere.
+	if err := s.conn.write(s.closePacket); err != nil {
+		utils.Errorf("error resending close packet for connection %x: %s", hdr.ConnectionID, err.Error())
+	}
+}
+
+func (s *closedSession) run() {}
+
+// Close does nothing, the session was already closed
+func (s *closedSession) Close(error) error { return nil }
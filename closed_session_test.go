@@ -0,0 +1,39 @@
+package quic
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Closed session", func() {
+	var (
+		conn *mockConnection
+		hdr  *publicHeader
+	)
+
+	BeforeEach(func() {
+		conn = &mockConnection{}
+		hdr = &publicHeader{ConnectionID: 0x1337}
+	})
+
+	It("resends the close packet", func() {
+		s := newClosedSession(conn, []byte("close"))
+		s.handlePacket(nil, hdr, nil)
+		Expect(conn.written).To(Equal([][]byte{[]byte("close")}))
+	})
+
+	It("rate-limits the resent close packets", func() {
+		s := newClosedSession(conn, []byte("close"))
+		for i := 0; i < 100; i++ {
+			s.handlePacket(nil, hdr, nil)
+		}
+		// answers to the 1st, 2nd, 4th, 8th, 16th, 32nd and 64th packet
+		Expect(conn.written).To(HaveLen(7))
+	})
+
+	It("doesn't answer if the peer closed the connection", func() {
+		s := newClosedSession(conn, nil)
+		s.handlePacket(nil, hdr, nil)
+		Expect(conn.written).To(BeEmpty())
+	})
+})
@@ -39,6 +39,23 @@ var _ = Describe("RTT stats", func() {
 		Expect(rttStats.SmoothedRTT()).To(Equal((200 * time.Millisecond)))
 	})
 
+	It("MeanDeviation", func() {
+		// The first sample initializes the estimates as in RFC 6298: SRTT = R, RTTVAR = R/2
+		rttStats.UpdateRTT((100 * time.Millisecond), 0, time.Time{})
+		Expect(rttStats.SmoothedRTT()).To(Equal((100 * time.Millisecond)))
+		Expect(rttStats.MeanDeviation()).To(Equal((50 * time.Millisecond)))
+		// RTTVAR = 3/4 * 50ms + 1/4 * |100ms - 200ms|, SRTT = 7/8 * 100ms + 1/8 * 200ms
+		rttStats.UpdateRTT((200 * time.Millisecond), 0, time.Time{})
+		Expect(rttStats.MeanDeviation()).To(Equal((62500 * time.Microsecond)))
+		Expect(rttStats.SmoothedRTT()).To(Equal((112500 * time.Microsecond)))
+		// RTTVAR = 3/4 * 62.5ms + 1/4 * |112.5ms - 50ms|, SRTT = 7/8 * 112.5ms + 1/8 * 50ms
+		rttStats.UpdateRTT((50 * time.Millisecond), 0, time.Time{})
+		Expect(rttStats.MeanDeviation()).To(Equal((62500 * time.Microsecond)))
+		Expect(rttStats.SmoothedRTT()).To(Equal((104687 * time.Microsecond)))
+		Expect(rttStats.LatestRTT()).To(Equal((50 * time.Millisecond)))
+		Expect(rttStats.MinRTT()).To(Equal((50 * time.Millisecond)))
+	})
+
 	It("MinRTT", func() {
 		rttStats.UpdateRTT((200 * time.Millisecond), 0, time.Time{})
 		Expect(rttStats.MinRTT()).To(Equal((200 * time.Millisecond)))
@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+type aeadAESGCM struct {
+	otherIV     []byte
+	myIV        []byte
+	nonceScheme NonceScheme
+	encrypter   cipher.AEAD
+	decrypter   cipher.AEAD
+}
+
+// NewAEADAESGCM creates a AEAD using AES-GCM with 128 bit keys, with concatenated nonces
+func NewAEADAESGCM(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte) (AEAD, error) {
+	return NewAEADAESGCMWithNonceScheme(otherKey, myKey, otherIV, myIV, NonceSchemeConcatenate)
+}
+
+// NewAEADAESGCMWithNonceScheme creates a AEAD using AES-GCM with 128 bit keys, constructing the nonces according to the nonce scheme
+func NewAEADAESGCMWithNonceScheme(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte, nonceScheme NonceScheme) (AEAD, error) {
+	if len(myKey) != 16 || len(otherKey) != 16 {
+		return nil, errors.New("AES-GCM: expected 16-byte keys")
+	}
+	if len(myIV) != nonceScheme.IVLen() || len(otherIV) != nonceScheme.IVLen() {
+		return nil, fmt.Errorf("AES-GCM: expected %d-byte IVs", nonceScheme.IVLen())
+	}
+	encrypter, err := newGCM(myKey)
+	if err != nil {
+		return nil, err
+	}
+	decrypter, err := newGCM(otherKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadAESGCM{
+		otherIV:     otherIV,
+		myIV:        myIV,
+		nonceScheme: nonceScheme,
+		encrypter:   encrypter,
+		decrypter:   decrypter,
+	}, nil
+}
+
+// newGCM creates an AES-GCM instance with the 12 byte tags used by QUIC
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithTagSize(block, 12)
+}
+
+func (aead *aeadAESGCM) Open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
+	plaintext, err := aead.decrypter.Open(nil, aead.nonceScheme.makeNonce(aead.otherIV, packetNumber), ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+func (aead *aeadAESGCM) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
+	return aead.encrypter.Seal(nil, aead.nonceScheme.makeNonce(aead.myIV, packetNumber), plaintext, associatedData)
+}
+
+func (aeadAESGCM) DiversificationNonce() []byte { return nil }
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AES-GCM", func() {
+	var (
+		alice, bob AEAD
+	)
+
+	BeforeEach(func() {
+		keyAlice := make([]byte, 16)
+		keyBob := make([]byte, 16)
+		ivAlice := make([]byte, 4)
+		ivBob := make([]byte, 4)
+		rand.Reader.Read(keyAlice)
+		rand.Reader.Read(keyBob)
+		rand.Reader.Read(ivAlice)
+		rand.Reader.Read(ivBob)
+		var err error
+		alice, err = NewAEADAESGCM(keyBob, keyAlice, ivBob, ivAlice)
+		Expect(err).ToNot(HaveOccurred())
+		bob, err = NewAEADAESGCM(keyAlice, keyBob, ivAlice, ivBob)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("seals and opens", func() {
+		b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+		text, err := bob.Open(42, []byte("aad"), b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(text).To(Equal([]byte("foobar")))
+	})
+
+	It("seals and opens reverse", func() {
+		b := bob.Seal(42, []byte("aad"), []byte("foobar"))
+		text, err := alice.Open(42, []byte("aad"), b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(text).To(Equal([]byte("foobar")))
+	})
+
+	It("uses 12 byte tags", func() {
+		b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+		Expect(b).To(HaveLen(6 + 12))
+	})
+
+	It("fails with wrong aad", func() {
+		b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+		_, err := bob.Open(42, []byte("aad2"), b)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails with the wrong packet number", func() {
+		b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+		_, err := bob.Open(43, []byte("aad"), b)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("doesn't open packets sealed with chacha20poly1305", func() {
+		key := make([]byte, 32)
+		iv := make([]byte, 4)
+		chacha, err := NewAEADChacha20Poly1305(key, key, iv, iv)
+		Expect(err).ToNot(HaveOccurred())
+		aesgcm, err := NewAEADAESGCM(key[:16], key[:16], iv, iv)
+		Expect(err).ToNot(HaveOccurred())
+		b := chacha.Seal(42, []byte("aad"), []byte("foobar"))
+		_, err = aesgcm.Open(42, []byte("aad"), b)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("errors with invalid key or IV lengths", func() {
+		_, err := NewAEADAESGCM(make([]byte, 32), make([]byte, 32), make([]byte, 4), make([]byte, 4))
+		Expect(err).To(MatchError("AES-GCM: expected 16-byte keys"))
+		_, err = NewAEADAESGCM(make([]byte, 16), make([]byte, 16), make([]byte, 12), make([]byte, 12))
+		Expect(err).To(MatchError("AES-GCM: expected 4-byte IVs"))
+	})
+})
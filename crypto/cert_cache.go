@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+)
+
+type certCacheEntry struct {
+	key   string
+	value []byte
+}
+
+// A certCache caches compressed certificate chains
+// It is keyed by the chain and the hashes sent by the client, not by the SNI, so that clients sending many
+// distinct SNIs for the same certificate don't create new entries. Since clients control the hashes,
+// the number of entries is bounded, evicting the least recently used entry.
+type certCache struct {
+	maxEntries int
+
+	entries map[string]*list.Element
+	lru     *list.List // the most recently used entry is at the front
+	mutex   sync.Mutex
+}
+
+func newCertCache(maxEntries int) *certCache {
+	return &certCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func certCacheKey(chain [][]byte, pCommonSetHashes, pCachedHashes []byte) string {
+	key := make([]byte, 0, 8*len(chain)+len(pCommonSetHashes)+len(pCachedHashes)+8)
+	for _, cert := range chain {
+		key = appendUint64(key, hashCert(cert))
+	}
+	// separate the hash lists by their lengths
+	key = appendUint64(key, uint64(len(pCommonSetHashes)))
+	key = append(key, pCommonSetHashes...)
+	return string(append(key, pCachedHashes...))
+}
+
+func appendUint64(b []byte, i uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], i)
+	return append(b, buf[:]...)
+}
+
+func (c *certCache) get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*certCacheEntry).value, true
+}
+
+func (c *certCache) add(key string, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*certCacheEntry).value = value
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&certCacheEntry{key: key, value: value})
+	if c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certCacheEntry).key)
+	}
+}
+
+func (c *certCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
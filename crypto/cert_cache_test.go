@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cert cache", func() {
+	var cache *certCache
+
+	BeforeEach(func() {
+		cache = newCertCache(2)
+	})
+
+	It("returns cached values", func() {
+		cache.add("foo", []byte("bar"))
+		val, ok := cache.get("foo")
+		Expect(ok).To(BeTrue())
+		Expect(val).To(Equal([]byte("bar")))
+		_, ok = cache.get("bar")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("evicts the least recently used entry", func() {
+		cache.add("1", []byte("1"))
+		cache.add("2", []byte("2"))
+		_, ok := cache.get("1")
+		Expect(ok).To(BeTrue())
+		cache.add("3", []byte("3"))
+		Expect(cache.len()).To(Equal(2))
+		_, ok = cache.get("2")
+		Expect(ok).To(BeFalse())
+		_, ok = cache.get("1")
+		Expect(ok).To(BeTrue())
+		_, ok = cache.get("3")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("updates existing entries", func() {
+		cache.add("foo", []byte("bar"))
+		cache.add("foo", []byte("baz"))
+		Expect(cache.len()).To(Equal(1))
+		val, _ := cache.get("foo")
+		Expect(val).To(Equal([]byte("baz")))
+	})
+
+	It("uses different keys for different hashes", func() {
+		chain := [][]byte{[]byte("cert")}
+		Expect(certCacheKey(chain, nil, nil)).ToNot(Equal(certCacheKey([][]byte{[]byte("cert2")}, nil, nil)))
+		// moving a hash from the common set hashes to the cached hashes changes the key
+		Expect(certCacheKey(chain, []byte("12345678"), nil)).ToNot(Equal(certCacheKey(chain, nil, []byte("12345678"))))
+	})
+
+	It("stays bounded", func() {
+		for i := 0; i < 100; i++ {
+			cache.add(strconv.Itoa(i), nil)
+		}
+		Expect(cache.len()).To(Equal(2))
+		Expect(cache.entries).To(HaveLen(2))
+	})
+})
@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 
+	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
@@ -27,6 +29,11 @@ type entry struct {
 }
 
 func compressChain(chain [][]byte, pCommonSetHashes, pCachedHashes []byte) ([]byte, error) {
+	return compressChainWithSets(chain, pCommonSetHashes, pCachedHashes, nil)
+}
+
+// compressChainWithSets compresses the chain, using the additional common certificate sets besides the built-in ones
+func compressChainWithSets(chain [][]byte, pCommonSetHashes, pCachedHashes []byte, additionalSets map[uint64]certSet) ([]byte, error) {
 	res := &bytes.Buffer{}
 
 	cachedHashes, err := splitHashes(pCachedHashes)
@@ -44,7 +51,7 @@ func compressChain(chain [][]byte, pCommonSetHashes, pCachedHashes []byte) ([]by
 		chainHashes[i] = hashCert(chain[i])
 	}
 
-	entries := buildEntries(chain, chainHashes, cachedHashes, setHashes)
+	entries := buildEntries(chain, chainHashes, cachedHashes, setHashes, additionalSets)
 
 	totalUncompressedLen := 0
 	for i, e := range entries {
@@ -89,7 +96,92 @@ func compressChain(chain [][]byte, pCommonSetHashes, pCachedHashes []byte) ([]by
 	return res.Bytes(), nil
 }
 
-func buildEntries(chain [][]byte, chainHashes, cachedHashes, setHashes []uint64) []entry {
+// DecompressChain decompresses a certificate chain sent by a server in the CERT tag
+// Certificates from common certificate sets are supported, cached certificates are not, since we never announce any.
+func DecompressChain(data []byte) ([][]byte, error) {
+	r := bytes.NewReader(data)
+	var entries []entry
+	var chain [][]byte
+	for {
+		t, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("cert decompression: unexpected end of entry list")
+		}
+		if t == 0 {
+			break
+		}
+		e := entry{t: entryType(t)}
+		var cert []byte
+		switch e.t {
+		case entryCompressed:
+		case entryCommon:
+			if e.h, err = utils.ReadUint64(r); err != nil {
+				return nil, errors.New("cert decompression: unexpected end of entry list")
+			}
+			if e.i, err = utils.ReadUint32(r); err != nil {
+				return nil, errors.New("cert decompression: unexpected end of entry list")
+			}
+			set, ok := lookupCertSet(nil, e.h)
+			if !ok {
+				return nil, fmt.Errorf("cert decompression: unknown common certificate set %x", e.h)
+			}
+			if int(e.i) >= len(set) {
+				return nil, errors.New("cert decompression: invalid index in common certificate set")
+			}
+			cert = set[e.i]
+		case entryCached:
+			return nil, errors.New("cert decompression: cached certificates are not supported")
+		default:
+			return nil, fmt.Errorf("cert decompression: invalid entry type %d", t)
+		}
+		entries = append(entries, e)
+		chain = append(chain, cert)
+	}
+
+	var numCompressed int
+	for _, e := range entries {
+		if e.t == entryCompressed {
+			numCompressed++
+		}
+	}
+	if numCompressed == 0 {
+		return chain, nil
+	}
+
+	uncompressedLen, err := utils.ReadUint32(r)
+	if err != nil {
+		return nil, errors.New("cert decompression: missing uncompressed length")
+	}
+	if uncompressedLen > protocol.MaxCertChainSize {
+		return nil, errors.New("cert decompression: certificate chain too large")
+	}
+	gz, err := zlib.NewReaderDict(r, buildZlibDictForEntries(entries, chain))
+	if err != nil {
+		return nil, fmt.Errorf("cert decompression failed: %s", err.Error())
+	}
+	defer gz.Close()
+	// limit the amount of data we decompress to the length the server announced
+	uncompressed := bytes.NewBuffer(make([]byte, 0, uncompressedLen))
+	if _, err := io.Copy(uncompressed, io.LimitReader(gz, int64(uncompressedLen)+1)); err != nil {
+		return nil, fmt.Errorf("cert decompression failed: %s", err.Error())
+	}
+	if uncompressed.Len() != int(uncompressedLen) {
+		return nil, errors.New("cert decompression: length mismatch")
+	}
+	for i, e := range entries {
+		if e.t != entryCompressed {
+			continue
+		}
+		certLen, err := utils.ReadUint32(uncompressed)
+		if err != nil || int(certLen) > uncompressed.Len() {
+			return nil, errors.New("cert decompression: certificate too short")
+		}
+		chain[i] = uncompressed.Next(int(certLen))
+	}
+	return chain, nil
+}
+
+func buildEntries(chain [][]byte, chainHashes, cachedHashes, setHashes []uint64, additionalSets map[uint64]certSet) []entry {
 	res := make([]entry, len(chain))
 chainLoop:
 	for i := range chain {
@@ -103,7 +195,7 @@ chainLoop:
 
 		// Go through common sets and check if it's in there
 		for _, setHash := range setHashes {
-			set, ok := certSets[setHash]
+			set, ok := lookupCertSet(additionalSets, setHash)
 			if !ok {
 				// We don't have this set
 				continue
@@ -133,4 +133,63 @@ var _ = Describe("Cert compression", func() {
 		expected = append(expected, certZlib.Bytes()...)
 		Expect(compressed).To(Equal(expected))
 	})
+
+	Context("decompression", func() {
+		It("decompresses compressed chains", func() {
+			chain := [][]byte{[]byte("leaf certificate"), []byte("intermediate certificate")}
+			compressed, err := compressChain(chain, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			decompressed, err := DecompressChain(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decompressed).To(Equal(chain))
+		})
+
+		It("decompresses chains using common certificates", func() {
+			setHash := make([]byte, 8)
+			binary.LittleEndian.PutUint64(setHash, certsets.CertSet1Hash)
+			chain := [][]byte{[]byte("leaf certificate"), certsets.CertSet1[42]}
+			compressed, err := compressChain(chain, setHash, nil)
+			Expect(err).ToNot(HaveOccurred())
+			decompressed, err := DecompressChain(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decompressed).To(Equal(chain))
+		})
+
+		It("decompresses empty chains", func() {
+			decompressed, err := DecompressChain([]byte{0})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decompressed).To(BeEmpty())
+		})
+
+		It("errors on cached certificates", func() {
+			cert := []byte("leaf certificate")
+			compressed, err := compressChain([][]byte{cert}, nil, byteHash(cert))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = DecompressChain(compressed)
+			Expect(err).To(MatchError("cert decompression: cached certificates are not supported"))
+		})
+
+		It("errors on truncated data", func() {
+			compressed, err := compressChain([][]byte{[]byte("leaf certificate")}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = DecompressChain(compressed[:len(compressed)-4])
+			Expect(err).To(HaveOccurred())
+			_, err = DecompressChain([]byte{0x01})
+			Expect(err).To(MatchError("cert decompression: unexpected end of entry list"))
+		})
+
+		It("errors if the uncompressed length doesn't match", func() {
+			compressed, err := compressChain([][]byte{[]byte("leaf certificate")}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			// the length is the 4 bytes after the entry list
+			compressed[2]++
+			_, err = DecompressChain(compressed)
+			Expect(err).To(MatchError("cert decompression: length mismatch"))
+		})
+
+		It("refuses too large chains", func() {
+			_, err := DecompressChain([]byte{0x01, 0x00, 0xff, 0xff, 0xff, 0xff})
+			Expect(err).To(MatchError("cert decompression: certificate chain too large"))
+		})
+	})
 })
@@ -2,6 +2,10 @@ package crypto
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
 
 	"github.com/lucas-clemente/quic-go-certificates"
 )
@@ -22,3 +26,60 @@ func (s *certSet) findCertInSet(cert []byte) int {
 	}
 	return -1
 }
+
+// A CommonCertSet is a set of certificates that clients may already know, identified by its hash
+// Certificates of the chain that are contained in a set the client announced in the CCS tag are not sent, but referenced by their index.
+type CommonCertSet struct {
+	Hash  uint64
+	Certs [][]byte
+}
+
+// LoadCommonCertSet reads a common certificate set.
+// It consists of the hash of the set as a 8 byte little endian integer, followed by the certificates,
+// each prefixed with its length as a 4 byte little endian integer.
+func LoadCommonCertSet(r io.Reader) (*CommonCertSet, error) {
+	set := &CommonCertSet{}
+	if err := binary.Read(r, binary.LittleEndian, &set.Hash); err != nil {
+		return nil, errors.New("common certificate set: missing hash")
+	}
+	for {
+		var certLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &certLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if certLen == 0 {
+			return nil, errors.New("common certificate set: empty certificate")
+		}
+		cert := make([]byte, certLen)
+		if _, err := io.ReadFull(r, cert); err != nil {
+			return nil, errors.New("common certificate set: certificate too short")
+		}
+		set.Certs = append(set.Certs, cert)
+	}
+	if len(set.Certs) == 0 {
+		return nil, errors.New("common certificate set: no certificates")
+	}
+	return set, nil
+}
+
+// LoadCommonCertSetFile reads a common certificate set from a file, see LoadCommonCertSet for the format
+func LoadCommonCertSetFile(filename string) (*CommonCertSet, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadCommonCertSet(f)
+}
+
+// lookupCertSet gets a common certificate set, preferring the sets in additionalSets over the built-in ones
+func lookupCertSet(additionalSets map[uint64]certSet, hash uint64) (certSet, bool) {
+	if set, ok := additionalSets[hash]; ok {
+		return set, true
+	}
+	set, ok := certSets[hash]
+	return set, ok
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Common certificate sets", func() {
+	// a set with the hash 0x1337 containing the certificates "foo" and "foobar"
+	setData := []byte{
+		0x37, 0x13, 0, 0, 0, 0, 0, 0,
+		3, 0, 0, 0, 'f', 'o', 'o',
+		6, 0, 0, 0, 'f', 'o', 'o', 'b', 'a', 'r',
+	}
+
+	It("loads a set", func() {
+		set, err := LoadCommonCertSet(bytes.NewReader(setData))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(set.Hash).To(Equal(uint64(0x1337)))
+		Expect(set.Certs).To(Equal([][]byte{[]byte("foo"), []byte("foobar")}))
+	})
+
+	It("loads a set from a file", func() {
+		f, err := ioutil.TempFile("", "certset")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		_, err = f.Write(setData)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		set, err := LoadCommonCertSetFile(f.Name())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(set.Hash).To(Equal(uint64(0x1337)))
+		Expect(set.Certs).To(HaveLen(2))
+	})
+
+	It("errors on truncated certificates", func() {
+		_, err := LoadCommonCertSet(bytes.NewReader(setData[:len(setData)-1]))
+		Expect(err).To(MatchError("common certificate set: certificate too short"))
+	})
+
+	It("errors on empty sets", func() {
+		_, err := LoadCommonCertSet(bytes.NewReader(setData[:8]))
+		Expect(err).To(MatchError("common certificate set: no certificates"))
+		_, err = LoadCommonCertSet(bytes.NewReader(nil))
+		Expect(err).To(MatchError("common certificate set: missing hash"))
+	})
+
+	It("uses a loaded set to compress a matching certificate", func() {
+		set, err := LoadCommonCertSet(bytes.NewReader(setData))
+		Expect(err).ToNot(HaveOccurred())
+		signer := NewProofSourceSigner(&mockProofSource{chain: [][]byte{[]byte("foobar")}})
+		signer.(CommonCertSetUser).SetCommonCertSets([]*CommonCertSet{set})
+		compressed, err := signer.GetCertsCompressed("", setData[:8], nil)
+		Expect(err).ToNot(HaveOccurred())
+		expected := []byte{0x03}
+		expected = append(expected, setData[:8]...)
+		expected = append(expected, []byte{1, 0, 0, 0}...)
+		expected = append(expected, 0x00)
+		Expect(compressed).To(Equal(expected))
+	})
+
+	It("doesn't use a set the client didn't announce", func() {
+		set, err := LoadCommonCertSet(bytes.NewReader(setData))
+		Expect(err).ToNot(HaveOccurred())
+		signer := NewProofSourceSigner(&mockProofSource{chain: [][]byte{[]byte("foobar")}})
+		signer.(CommonCertSetUser).SetCommonCertSets([]*CommonCertSet{set})
+		compressed, err := signer.GetCertsCompressed("", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(compressed[0]).To(Equal(byte(entryCompressed)))
+	})
+})
@@ -4,23 +4,71 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	"github.com/lucas-clemente/chacha20poly1305"
 
 	"github.com/lucas-clemente/quic-go/protocol"
 )
 
+// A NonceScheme is the way the nonce of a packet is constructed from the IV and the packet number
+type NonceScheme int
+
+const (
+	// NonceSchemeConcatenate appends the 8 byte packet number (little endian) to a 4 byte IV
+	NonceSchemeConcatenate NonceScheme = iota
+	// NonceSchemeXOR XORs the 8 byte packet number (big endian) into the last bytes of a 12 byte IV
+	NonceSchemeXOR
+)
+
+// NonceSchemeForVersion returns the nonce scheme used by a QUIC version
+func NonceSchemeForVersion(version protocol.VersionNumber) NonceScheme {
+	// all versions we support use the concatenated nonces
+	return NonceSchemeConcatenate
+}
+
+// IVLen returns the length of the IVs used with this scheme
+func (s NonceScheme) IVLen() int {
+	if s == NonceSchemeXOR {
+		return 12
+	}
+	return 4
+}
+
+func (s NonceScheme) makeNonce(iv []byte, packetNumber protocol.PacketNumber) []byte {
+	res := make([]byte, 12)
+	if s == NonceSchemeXOR {
+		binary.BigEndian.PutUint64(res[4:12], uint64(packetNumber))
+		for i := range res {
+			res[i] ^= iv[i]
+		}
+		return res
+	}
+	copy(res[0:4], iv)
+	binary.LittleEndian.PutUint64(res[4:12], uint64(packetNumber))
+	return res
+}
+
 type aeadChacha20Poly1305 struct {
-	otherIV   []byte
-	myIV      []byte
-	encrypter cipher.AEAD
-	decrypter cipher.AEAD
+	otherIV     []byte
+	myIV        []byte
+	nonceScheme NonceScheme
+	encrypter   cipher.AEAD
+	decrypter   cipher.AEAD
 }
 
-// NewAEADChacha20Poly1305 creates a AEAD using chacha20poly1305
+// NewAEADChacha20Poly1305 creates a AEAD using chacha20poly1305, with concatenated nonces
 func NewAEADChacha20Poly1305(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte) (AEAD, error) {
-	if len(myKey) != 32 || len(otherKey) != 32 || len(myIV) != 4 || len(otherIV) != 4 {
-		return nil, errors.New("chacha20poly1305: expected 32-byte keys and 4-byte IVs")
+	return NewAEADChacha20Poly1305WithNonceScheme(otherKey, myKey, otherIV, myIV, NonceSchemeConcatenate)
+}
+
+// NewAEADChacha20Poly1305WithNonceScheme creates a AEAD using chacha20poly1305, constructing the nonces according to the nonce scheme
+func NewAEADChacha20Poly1305WithNonceScheme(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte, nonceScheme NonceScheme) (AEAD, error) {
+	if len(myKey) != 32 || len(otherKey) != 32 {
+		return nil, errors.New("chacha20poly1305: expected 32-byte keys")
+	}
+	if len(myIV) != nonceScheme.IVLen() || len(otherIV) != nonceScheme.IVLen() {
+		return nil, fmt.Errorf("chacha20poly1305: expected %d-byte IVs", nonceScheme.IVLen())
 	}
 	encrypter, err := chacha20poly1305.New(myKey, 12)
 	if err != nil {
@@ -31,15 +79,16 @@ func NewAEADChacha20Poly1305(otherKey []byte, myKey []byte, otherIV []byte, myIV
 		return nil, err
 	}
 	return &aeadChacha20Poly1305{
-		otherIV:   otherIV,
-		myIV:      myIV,
-		encrypter: encrypter,
-		decrypter: decrypter,
+		otherIV:     otherIV,
+		myIV:        myIV,
+		nonceScheme: nonceScheme,
+		encrypter:   encrypter,
+		decrypter:   decrypter,
 	}, nil
 }
 
 func (aead *aeadChacha20Poly1305) Open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
-	plaintext, err := aead.decrypter.Open(nil, makeNonce(aead.otherIV, packetNumber), ciphertext, associatedData)
+	plaintext, err := aead.decrypter.Open(nil, aead.nonceScheme.makeNonce(aead.otherIV, packetNumber), ciphertext, associatedData)
 	if err != nil {
 		return nil, err
 	}
@@ -47,14 +96,7 @@ func (aead *aeadChacha20Poly1305) Open(packetNumber protocol.PacketNumber, assoc
 }
 
 func (aead *aeadChacha20Poly1305) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
-	return aead.encrypter.Seal(nil, makeNonce(aead.myIV, packetNumber), plaintext, associatedData)
-}
-
-func makeNonce(iv []byte, packetNumber protocol.PacketNumber) []byte {
-	res := make([]byte, 12)
-	copy(res[0:4], iv)
-	binary.LittleEndian.PutUint64(res[4:12], uint64(packetNumber))
-	return res
+	return aead.encrypter.Seal(nil, aead.nonceScheme.makeNonce(aead.myIV, packetNumber), plaintext, associatedData)
 }
 
 func (aeadChacha20Poly1305) DiversificationNonce() []byte { return nil }
@@ -3,6 +3,8 @@ package crypto
 import (
 	"crypto/rand"
 
+	"github.com/lucas-clemente/quic-go/protocol"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -47,4 +49,56 @@ var _ = Describe("Chacha20poly1305", func() {
 		_, err := bob.Open(42, []byte("aad2"), b)
 		Expect(err).To(HaveOccurred())
 	})
+
+	Context("nonce schemes", func() {
+		It("concatenates the IV and the packet number", func() {
+			nonce := NonceSchemeConcatenate.makeNonce([]byte{0xa, 0xb, 0xc, 0xd}, 0x0102030405060708)
+			Expect(nonce).To(Equal([]byte{0xa, 0xb, 0xc, 0xd, 0x8, 0x7, 0x6, 0x5, 0x4, 0x3, 0x2, 0x1}))
+		})
+
+		It("XORs the packet number into the IV", func() {
+			iv := []byte{0xa, 0xb, 0xc, 0xd, 0xf0, 0xf0, 0xf0, 0xf0, 0xf0, 0xf0, 0xf0, 0xf0}
+			nonce := NonceSchemeXOR.makeNonce(iv, 0x0102030405060708)
+			Expect(nonce).To(Equal([]byte{0xa, 0xb, 0xc, 0xd, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8}))
+		})
+
+		It("uses concatenated nonces for all supported versions", func() {
+			for _, v := range protocol.SupportedVersions {
+				Expect(NonceSchemeForVersion(v)).To(Equal(NonceSchemeConcatenate))
+			}
+		})
+
+		It("seals and opens with XORed nonces", func() {
+			key := make([]byte, 32)
+			iv := make([]byte, 12)
+			rand.Reader.Read(key)
+			rand.Reader.Read(iv)
+			alice, err := NewAEADChacha20Poly1305WithNonceScheme(key, key, iv, iv, NonceSchemeXOR)
+			Expect(err).ToNot(HaveOccurred())
+			b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+			text, err := alice.Open(42, []byte("aad"), b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).To(Equal([]byte("foobar")))
+		})
+
+		It("doesn't open packets sealed with a different nonce scheme", func() {
+			key := make([]byte, 32)
+			iv := make([]byte, 12)
+			concatenated, err := NewAEADChacha20Poly1305(key, key, iv[:4], iv[:4])
+			Expect(err).ToNot(HaveOccurred())
+			xored, err := NewAEADChacha20Poly1305WithNonceScheme(key, key, iv, iv, NonceSchemeXOR)
+			Expect(err).ToNot(HaveOccurred())
+			b := concatenated.Seal(42, []byte("aad"), []byte("foobar"))
+			_, err = xored.Open(42, []byte("aad"), b)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("errors if the IVs don't match the nonce scheme", func() {
+			key := make([]byte, 32)
+			_, err := NewAEADChacha20Poly1305WithNonceScheme(key, key, make([]byte, 4), make([]byte, 4), NonceSchemeXOR)
+			Expect(err).To(MatchError("chacha20poly1305: expected 12-byte IVs"))
+			_, err = NewAEADChacha20Poly1305(key, key, make([]byte, 12), make([]byte, 12))
+			Expect(err).To(MatchError("chacha20poly1305: expected 4-byte IVs"))
+		})
+	})
 })
@@ -13,6 +13,47 @@ import (
 
 // DeriveKeysChacha20 derives the client and server keys and creates a matching chacha20poly1305 instance
 func DeriveKeysChacha20(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	nonceScheme := NonceSchemeForVersion(version)
+	otherKey, myKey, otherIV, myIV, err := deriveKeys(version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce, 32, nonceScheme.IVLen())
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADChacha20Poly1305WithNonceScheme(otherKey, myKey, otherIV, myIV, nonceScheme)
+}
+
+// DeriveKeysAESGCM derives the client and server keys and creates a matching AES-GCM instance
+func DeriveKeysAESGCM(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	nonceScheme := NonceSchemeForVersion(version)
+	otherKey, myKey, otherIV, myIV, err := deriveKeys(version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce, 16, nonceScheme.IVLen())
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADAESGCMWithNonceScheme(otherKey, myKey, otherIV, myIV, nonceScheme)
+}
+
+// DeriveClientKeysChacha20 derives the same keys as DeriveKeysChacha20, but creates the chacha20poly1305 instance for the client
+func DeriveClientKeysChacha20(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	nonceScheme := NonceSchemeForVersion(version)
+	clientKey, serverKey, clientIV, serverIV, err := deriveKeys(version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce, 32, nonceScheme.IVLen())
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADChacha20Poly1305WithNonceScheme(serverKey, clientKey, serverIV, clientIV, nonceScheme)
+}
+
+// DeriveClientKeysAESGCM derives the same keys as DeriveKeysAESGCM, but creates the AES-GCM instance for the client
+func DeriveClientKeysAESGCM(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	nonceScheme := NonceSchemeForVersion(version)
+	clientKey, serverKey, clientIV, serverIV, err := deriveKeys(version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce, 16, nonceScheme.IVLen())
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADAESGCMWithNonceScheme(serverKey, clientKey, serverIV, clientIV, nonceScheme)
+}
+
+// deriveKeys derives the client's and the server's key and IV, in this order
+// For version 33 and later, the server's initial key and IV are diversified with the diversification nonce.
+func deriveKeys(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte, keyLen int, ivLen int) ([]byte, []byte, []byte, []byte, error) {
 	var info bytes.Buffer
 	if forwardSecure {
 		info.Write([]byte("QUIC forward secure key expansion\x00"))
@@ -26,31 +67,30 @@ func DeriveKeysChacha20(version protocol.VersionNumber, forwardSecure bool, shar
 
 	r := hkdf.New(sha256.New, sharedSecret, nonces, info.Bytes())
 
-	otherKey := make([]byte, 32)
-	myKey := make([]byte, 32)
-	otherIV := make([]byte, 4)
-	myIV := make([]byte, 4)
+	otherKey := make([]byte, keyLen)
+	myKey := make([]byte, keyLen)
+	otherIV := make([]byte, ivLen)
+	myIV := make([]byte, ivLen)
 
 	if _, err := io.ReadFull(r, otherKey); err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
 	if _, err := io.ReadFull(r, myKey); err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
 	if _, err := io.ReadFull(r, otherIV); err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
 	if _, err := io.ReadFull(r, myIV); err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
 
-	if !forwardSecure && version >= protocol.VersionNumber(33) {
+	if !forwardSecure && protocol.VersionUsesDiversificationNonce(version) {
 		if err := diversify(myKey, myIV, divNonce); err != nil {
-			return nil, err
+			return nil, nil, nil, nil, err
 		}
 	}
-
-	return NewAEADChacha20Poly1305(otherKey, myKey, otherIV, myIV)
+	return otherKey, myKey, otherIV, myIV, nil
 }
 
 func diversify(key, iv, divNonce []byte) error {
@@ -83,4 +83,44 @@ var _ = Describe("KeyDerivation", func() {
 		Expect(chacha.myIV).To(Equal([]byte{0xc4, 0x12, 0x25, 0x64}))
 		Expect(chacha.otherIV).To(Equal([]byte{0x75, 0xd8, 0xa2, 0x8d}))
 	})
+
+	It("derives AES-GCM keys", func() {
+		aead, err := DeriveKeysAESGCM(
+			32,
+			false,
+			[]byte("0123456789012345678901"),
+			[]byte("nonce"),
+			protocol.ConnectionID(42),
+			[]byte("chlo"),
+			[]byte("scfg"),
+			[]byte("cert"),
+			nil,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		aesgcm := aead.(*aeadAESGCM)
+		// the keys are shorter than for chacha20poly1305, so the IVs are read from a different offset
+		Expect(aesgcm.myIV).To(HaveLen(4))
+		Expect(aesgcm.otherIV).To(HaveLen(4))
+		Expect(aesgcm.myIV).ToNot(Equal([]byte{0xf0, 0xf5, 0x4c, 0xa8}))
+	})
+
+	It("derives client keys matching the server keys", func() {
+		for _, derivations := range [][2]func(protocol.VersionNumber, bool, []byte, []byte, protocol.ConnectionID, []byte, []byte, []byte, []byte) (AEAD, error){
+			{DeriveKeysChacha20, DeriveClientKeysChacha20},
+			{DeriveKeysAESGCM, DeriveClientKeysAESGCM},
+		} {
+			for _, forwardSecure := range []bool{false, true} {
+				server, err := derivations[0](33, forwardSecure, []byte("0123456789012345678901"), []byte("nonce"), 42, []byte("chlo"), []byte("scfg"), []byte("cert"), []byte("divnonce"))
+				Expect(err).ToNot(HaveOccurred())
+				client, err := derivations[1](33, forwardSecure, []byte("0123456789012345678901"), []byte("nonce"), 42, []byte("chlo"), []byte("scfg"), []byte("cert"), []byte("divnonce"))
+				Expect(err).ToNot(HaveOccurred())
+				text, err := client.Open(1, []byte("aad"), server.Seal(1, []byte("aad"), []byte("foobar")))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(text).To(Equal([]byte("foobar")))
+				text, err = server.Open(2, []byte("aad"), client.Seal(2, []byte("aad"), []byte("foobar")))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(text).To(Equal([]byte("foobar")))
+			}
+		}
+	})
 })
@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// A KeyExchangePool hands out pre-generated ephemeral key exchanges, so that they don't have to be generated during the handshake
+// Every key exchange is handed out only once. The pool is refilled in the background.
+type KeyExchangePool struct {
+	kexs   chan KeyExchange
+	newKEX func() (KeyExchange, error)
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKeyExchangePool creates a new pool holding up to size key exchanges created by newKEX
+func NewKeyExchangePool(size int, newKEX func() (KeyExchange, error)) *KeyExchangePool {
+	p := &KeyExchangePool{
+		kexs:      make(chan KeyExchange, size),
+		newKEX:    newKEX,
+		closeChan: make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+func (p *KeyExchangePool) fill() {
+	for {
+		kex, err := p.newKEX()
+		if err != nil {
+			utils.Errorf("Stopped filling the key exchange pool: %s", err.Error())
+			return
+		}
+		select {
+		case p.kexs <- kex:
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// Get takes a key exchange out of the pool
+// If the pool is empty, a new key exchange is generated.
+func (p *KeyExchangePool) Get() (KeyExchange, error) {
+	select {
+	case kex := <-p.kexs:
+		return kex, nil
+	default:
+		return p.newKEX()
+	}
+}
+
+// Close stops refilling the pool
+func (p *KeyExchangePool) Close() {
+	p.closeOnce.Do(func() { close(p.closeChan) })
+}
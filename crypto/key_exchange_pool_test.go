@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Key exchange pool", func() {
+	var pool *KeyExchangePool
+
+	BeforeEach(func() {
+		pool = NewKeyExchangePool(10, NewCurve25519KEX)
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	It("fills the pool in the background", func() {
+		Eventually(func() int { return len(pool.kexs) }).Should(Equal(10))
+	})
+
+	It("never hands out the same key exchange twice", func() {
+		publicKeys := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			kex, err := pool.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(publicKeys).ToNot(HaveKey(string(kex.PublicKey())))
+			publicKeys[string(kex.PublicKey())] = true
+		}
+	})
+
+	It("can be closed multiple times", func() {
+		pool.Close()
+		pool.Close()
+	})
+
+	It("generates a key exchange if the pool is empty", func() {
+		pool.Close()
+		pool = &KeyExchangePool{
+			kexs:      make(chan KeyExchange),
+			newKEX:    NewCurve25519KEX,
+			closeChan: make(chan struct{}),
+		}
+		kex, err := pool.Get()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kex.PublicKey()).To(HaveLen(32))
+	})
+})
+
+func BenchmarkNewCurve25519KEX(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := NewCurve25519KEX(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkKeyExchangePoolGet measures getting a key exchange from a filled pool, as during a burst of handshakes
+func BenchmarkKeyExchangePoolGet(b *testing.B) {
+	const size = 100
+	pool := NewKeyExchangePool(size, NewCurve25519KEX)
+	defer pool.Close()
+	for i := 0; i < b.N; i++ {
+		if i%size == 0 {
+			b.StopTimer()
+			for len(pool.kexs) < size {
+				time.Sleep(time.Millisecond)
+			}
+			b.StartTimer()
+		}
+		if _, err := pool.Get(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+)
+
+// p256KEX is a key exchange using ECDH on the NIST P-256 curve
+type p256KEX struct {
+	secret *ecdh.PrivateKey
+}
+
+var _ KeyExchange = &p256KEX{}
+
+// NewP256KEX creates a new KeyExchange using ECDH on P-256
+// The public key is an uncompressed point, the shared key is the x-coordinate of the resulting point.
+func NewP256KEX() (KeyExchange, error) {
+	secret, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("P256: could not create private key")
+	}
+	return &p256KEX{secret: secret}, nil
+}
+
+func (c *p256KEX) PublicKey() []byte {
+	return c.secret.PublicKey().Bytes()
+}
+
+func (c *p256KEX) CalculateSharedKey(otherPublic []byte) ([]byte, error) {
+	pub, err := ecdh.P256().NewPublicKey(otherPublic)
+	if err != nil {
+		return nil, errors.New("P256: invalid public key")
+	}
+	return c.secret.ECDH(pub)
+}
@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("P256", func() {
+	It("works", func() {
+		a, err := NewP256KEX()
+		Expect(err).ToNot(HaveOccurred())
+		b, err := NewP256KEX()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.PublicKey()).To(HaveLen(65))
+		sA, err := a.CalculateSharedKey(b.PublicKey())
+		Expect(err).ToNot(HaveOccurred())
+		sB, err := b.CalculateSharedKey(a.PublicKey())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sA).To(Equal(sB))
+		Expect(sA).To(HaveLen(32))
+	})
+
+	It("rejects invalid public keys", func() {
+		a, err := NewP256KEX()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = a.CalculateSharedKey(make([]byte, 65))
+		Expect(err).To(MatchError("P256: invalid public key"))
+	})
+})
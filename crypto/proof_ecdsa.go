@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+)
+
+// ecdsaSigner stores an ECDSA key and a certificate for the server proof
+// Only P-256 keys are supported, since this is the only curve every client supports.
+type ecdsaSigner struct {
+	rsaSigner
+}
+
+var _ ProofSource = &ecdsaSigner{}
+var _ SCTSource = &ecdsaSigner{}
+
+var errNotP256Key = errors.New("ECDSA signer: expected an ECDSA P-256 key")
+
+// NewECDSASigner creates a signer for the ECDSA certificates of the tls.Config
+func NewECDSASigner(tlsConfig *tls.Config) (Signer, error) {
+	for _, cert := range tlsConfig.Certificates {
+		if _, err := p256Key(cert.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	return NewProofSourceSigner(&ecdsaSigner{rsaSigner{config: tlsConfig}}), nil
+}
+
+// SignProof signs the data of a server proof
+func (kd *ecdsaSigner) SignProof(sni string, data []byte) ([]byte, error) {
+	cert, err := kd.getCertForSNI(sni)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p256Key(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, key, hash[:])
+}
+
+func p256Key(privateKey interface{}) (*ecdsa.PrivateKey, error) {
+	key, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errNotP256Key
+	}
+	return key, nil
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+
+	"github.com/lucas-clemente/quic-go/testdata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProofECDSA", func() {
+	It("gives signatures that the proof verifier accepts", func() {
+		config := testdata.GetECDSATLSConfig()
+		kd, err := NewECDSASigner(config)
+		Expect(err).ToNot(HaveOccurred())
+		proof, err := kd.SignServerProof("quic.clemente.io", []byte("CHLO"), []byte("SCFG"))
+		Expect(err).ToNot(HaveOccurred())
+		leaf, err := kd.GetLeafCert("quic.clemente.io")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leaf).To(Equal(config.Certificates[0].Certificate[0]))
+		Expect(VerifyServerProof(leaf, []byte("CHLO"), []byte("SCFG"), proof)).To(Succeed())
+		Expect(VerifyServerProof(leaf, []byte("other CHLO"), []byte("SCFG"), proof)).ToNot(Succeed())
+	})
+
+	It("gives signatures that the proof verifier accepts, for RSA certificates", func() {
+		kd, err := NewRSASigner(testdata.GetTLSConfig())
+		Expect(err).ToNot(HaveOccurred())
+		proof, err := kd.SignServerProof("quic.clemente.io", []byte("CHLO"), []byte("SCFG"))
+		Expect(err).ToNot(HaveOccurred())
+		leaf, err := kd.GetLeafCert("quic.clemente.io")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyServerProof(leaf, []byte("CHLO"), []byte("SCFG"), proof)).To(Succeed())
+	})
+
+	It("rejects RSA keys", func() {
+		_, err := NewECDSASigner(testdata.GetTLSConfig())
+		Expect(err).To(MatchError(errNotP256Key))
+	})
+
+	It("rejects keys on other curves", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewECDSASigner(&tls.Config{
+			Certificates: []tls.Certificate{{PrivateKey: key}},
+		})
+		Expect(err).To(MatchError(errNotP256Key))
+	})
+
+	It("rejects RSA keys returned by GetCertificate", func() {
+		cert := testdata.GetCertificate()
+		kd := &ecdsaSigner{rsaSigner{config: &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil },
+		}}}
+		_, err := kd.SignProof("quic.clemente.io", []byte("proof data"))
+		Expect(err).To(MatchError(errNotP256Key))
+	})
+})
@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -11,62 +12,54 @@ import (
 )
 
 // rsaSigner stores a key and a certificate for the server proof
+// It is the default ProofSource, holding the private key in-process. Despite its name, it also supports ECDSA keys,
+// which is needed if certificates with different key types are returned by the tls.Config's GetCertificate.
 type rsaSigner struct {
 	config *tls.Config
 }
 
+var _ ProofSource = &rsaSigner{}
+var _ SCTSource = &rsaSigner{}
+
 // NewRSASigner loads the key and cert from files
 func NewRSASigner(tlsConfig *tls.Config) (Signer, error) {
-	return &rsaSigner{config: tlsConfig}, nil
+	return NewProofSourceSigner(&rsaSigner{config: tlsConfig}), nil
 }
 
-// SignServerProof signs CHLO and server config for use in the server proof
-func (kd *rsaSigner) SignServerProof(sni string, chlo []byte, serverConfigData []byte) ([]byte, error) {
+// SignProof signs the data of a server proof
+func (kd *rsaSigner) SignProof(sni string, data []byte) ([]byte, error) {
 	cert, err := kd.getCertForSNI(sni)
 	if err != nil {
 		return nil, err
 	}
-	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("only RSA keys are supported for now")
-	}
 
-	hash := sha256.New()
-	if len(chlo) > 0 {
-		hash.Write([]byte("QUIC CHLO and server config signature\x00"))
-		chloHash := sha256.Sum256(chlo)
-		hash.Write([]byte{32, 0, 0, 0})
-		hash.Write(chloHash[:])
-	} else {
-		// TODO: Remove when we drop support for version 30
-		hash.Write([]byte("QUIC server config signature\x00"))
+	hash := sha256.Sum256(data)
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA256, hash[:], &rsa.PSSOptions{SaltLength: 32})
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, key, hash[:])
+	default:
+		return nil, errors.New("only RSA and ECDSA keys are supported")
 	}
-	hash.Write(serverConfigData)
-	return rsa.SignPSS(
-		rand.Reader,
-		key,
-		crypto.SHA256,
-		hash.Sum(nil),
-		&rsa.PSSOptions{SaltLength: 32},
-	)
 }
 
-// GetCertsCompressed gets the certificate in the format described by the QUIC crypto doc
-func (kd *rsaSigner) GetCertsCompressed(sni string, pCommonSetHashes, pCachedHashes []byte) ([]byte, error) {
+// GetCertChain gets the certificate chain of the tls.Certificate
+func (kd *rsaSigner) GetCertChain(sni string) ([][]byte, error) {
 	cert, err := kd.getCertForSNI(sni)
 	if err != nil {
 		return nil, err
 	}
-	return compressChain(cert.Certificate, pCommonSetHashes, pCachedHashes)
+	return cert.Certificate, nil
 }
 
-// GetLeafCert gets the leaf certificate
-func (kd *rsaSigner) GetLeafCert(sni string) ([]byte, error) {
+// GetSCTs gets the signed certificate timestamps of the tls.Certificate
+func (kd *rsaSigner) GetSCTs(sni string) ([][]byte, error) {
 	cert, err := kd.getCertForSNI(sni)
 	if err != nil {
 		return nil, err
 	}
-	return cert.Certificate[0], nil
+	return cert.SignedCertificateTimestamps, nil
 }
 
 func (kd *rsaSigner) getCertForSNI(sni string) (*tls.Certificate, error) {
@@ -5,7 +5,11 @@ import (
 	"compress/flate"
 	"compress/zlib"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 
 	"github.com/lucas-clemente/quic-go/testdata"
@@ -23,13 +27,13 @@ var _ = Describe("ProofRsa", func() {
 		z.Write([]byte{0x04, 0x00, 0x00, 0x00})
 		z.Write(cert)
 		z.Close()
-		kd := &rsaSigner{
+		kd := NewProofSourceSigner(&rsaSigner{
 			config: &tls.Config{
 				Certificates: []tls.Certificate{
 					{Certificate: [][]byte{cert}},
 				},
 			},
-		}
+		})
 		certCompressed, err := kd.GetCertsCompressed("", nil, nil)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(certCompressed).To(Equal(append([]byte{
@@ -38,6 +42,45 @@ var _ = Describe("ProofRsa", func() {
 		}, certZlib.Bytes()...)))
 	})
 
+	It("compresses the leaf certificate together with the intermediates", func() {
+		leaf := []byte{0xde, 0xca, 0xfb, 0xad}
+		intermediate := []byte{0xde, 0xad, 0xbe, 0xef}
+		certZlib := &bytes.Buffer{}
+		z, err := zlib.NewWriterLevelDict(certZlib, flate.BestCompression, certDictZlib)
+		Expect(err).ToNot(HaveOccurred())
+		z.Write([]byte{0x04, 0x00, 0x00, 0x00})
+		z.Write(leaf)
+		z.Write([]byte{0x04, 0x00, 0x00, 0x00})
+		z.Write(intermediate)
+		z.Close()
+		kd := NewProofSourceSigner(&rsaSigner{
+			config: &tls.Config{
+				Certificates: []tls.Certificate{
+					{Certificate: [][]byte{leaf, intermediate}},
+				},
+			},
+		})
+		certCompressed, err := kd.GetCertsCompressed("", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(certCompressed).To(Equal(append([]byte{
+			0x01, 0x01, 0x00,
+			0x10, 0x00, 0x00, 0x00,
+		}, certZlib.Bytes()...)))
+		leafCert, err := kd.GetLeafCert("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leafCert).To(Equal(leaf))
+	})
+
+	It("errors when getting the leaf certificate of an empty chain", func() {
+		kd := NewProofSourceSigner(&rsaSigner{
+			config: &tls.Config{
+				Certificates: []tls.Certificate{{}},
+			},
+		})
+		_, err := kd.GetLeafCert("")
+		Expect(err).To(MatchError("certificate chain is empty"))
+	})
+
 	It("gives valid signatures", func() {
 		key := testdata.GetTLSConfig().Certificates[0].PrivateKey.(*rsa.PrivateKey).Public().(*rsa.PublicKey)
 		kd, err := NewRSASigner(testdata.GetTLSConfig())
@@ -64,6 +107,30 @@ var _ = Describe("ProofRsa", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	It("gives valid signatures with ECDSA keys", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		kd := &rsaSigner{
+			config: &tls.Config{
+				Certificates: []tls.Certificate{{PrivateKey: key}},
+			},
+		}
+		signature, err := kd.SignProof("", []byte("proof data"))
+		Expect(err).ToNot(HaveOccurred())
+		hash := sha256.Sum256([]byte("proof data"))
+		Expect(ecdsa.VerifyASN1(&key.PublicKey, hash[:], signature)).To(BeTrue())
+	})
+
+	It("errors for unsupported keys", func() {
+		kd := &rsaSigner{
+			config: &tls.Config{
+				Certificates: []tls.Certificate{{PrivateKey: "foobar"}},
+			},
+		}
+		_, err := kd.SignProof("", []byte("proof data"))
+		Expect(err).To(MatchError("only RSA and ECDSA keys are supported"))
+	})
+
 	Context("retrieving certificate", func() {
 		var (
 			signer *rsaSigner
@@ -123,7 +190,7 @@ var _ = Describe("ProofRsa", func() {
 
 		It("gets leaf certificates", func() {
 			config.Certificates = []tls.Certificate{cert}
-			cert2, err := signer.GetLeafCert("")
+			cert2, err := NewProofSourceSigner(signer).GetLeafCert("")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(cert2).To(Equal(cert.Certificate[0]))
 		})
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// A ProofSource signs the server proof and provides the certificate chain.
+// It doesn't need access to the private key itself, so the key can be kept in an HSM or a KMS.
+type ProofSource interface {
+	// SignProof signs the data of a server proof, which covers the CHLO and the server config
+	SignProof(sni string, data []byte) ([]byte, error)
+	// GetCertChain gets the certificate chain, starting with the leaf certificate
+	GetCertChain(sni string) ([][]byte, error)
+}
+
+// An SCTSource provides the signed certificate timestamps (RFC 6962) of the leaf certificate
+// A ProofSource can implement it to have the SCTs sent to clients that request them.
+type SCTSource interface {
+	GetSCTs(sni string) ([][]byte, error)
+}
+
+// A CommonCertSetUser is a Signer that can use additional common certificate sets when compressing the certificate chain
+type CommonCertSetUser interface {
+	// SetCommonCertSets sets the common certificate sets used in addition to the built-in ones
+	// It must be called before the Signer is used.
+	SetCommonCertSets(sets []*CommonCertSet)
+}
+
+// proofSourceSigner is a Signer that delegates signing to a ProofSource
+type proofSourceSigner struct {
+	source     ProofSource
+	certCache  *certCache
+	commonSets map[uint64]certSet
+}
+
+var _ CommonCertSetUser = &proofSourceSigner{}
+
+// NewProofSourceSigner creates a Signer using a ProofSource
+func NewProofSourceSigner(source ProofSource) Signer {
+	return &proofSourceSigner{
+		source:    source,
+		certCache: newCertCache(protocol.MaxCertCacheEntries),
+	}
+}
+
+// SignServerProof signs CHLO and server config for use in the server proof
+func (s *proofSourceSigner) SignServerProof(sni string, chlo []byte, serverConfigData []byte) ([]byte, error) {
+	return s.source.SignProof(sni, serverProofData(chlo, serverConfigData))
+}
+
+// GetCertsCompressed gets the certificate chain in the format described by the QUIC crypto doc
+// The chain contains the leaf certificate as well as all intermediates, so that clients can verify it.
+func (s *proofSourceSigner) GetCertsCompressed(sni string, pCommonSetHashes, pCachedHashes []byte) ([]byte, error) {
+	chain, err := s.source.GetCertChain(sni)
+	if err != nil {
+		return nil, err
+	}
+	key := certCacheKey(chain, pCommonSetHashes, pCachedHashes)
+	if certs, ok := s.certCache.get(key); ok {
+		return certs, nil
+	}
+	certs, err := compressChainWithSets(chain, pCommonSetHashes, pCachedHashes, s.commonSets)
+	if err != nil {
+		return nil, err
+	}
+	s.certCache.add(key, certs)
+	return certs, nil
+}
+
+// SetCommonCertSets sets the common certificate sets used in addition to the built-in ones
+func (s *proofSourceSigner) SetCommonCertSets(sets []*CommonCertSet) {
+	s.commonSets = make(map[uint64]certSet, len(sets))
+	for _, set := range sets {
+		s.commonSets[set.Hash] = set.Certs
+	}
+}
+
+// GetLeafCert gets the leaf certificate
+func (s *proofSourceSigner) GetLeafCert(sni string) ([]byte, error) {
+	chain, err := s.source.GetCertChain(sni)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("certificate chain is empty")
+	}
+	return chain[0], nil
+}
+
+// GetSCTList gets the SCTs, if the ProofSource is an SCTSource
+func (s *proofSourceSigner) GetSCTList(sni string) ([]byte, error) {
+	sctSource, ok := s.source.(SCTSource)
+	if !ok {
+		return nil, nil
+	}
+	scts, err := sctSource.GetSCTs(sni)
+	if err != nil {
+		return nil, err
+	}
+	return serializeSCTList(scts)
+}
+
+// serializeSCTList serializes SCTs as a SignedCertificateTimestampList, see RFC 6962, section 3.3
+func serializeSCTList(scts [][]byte) ([]byte, error) {
+	if len(scts) == 0 {
+		return nil, nil
+	}
+	// the lengths are encoded as big endian uint16s
+	list := []byte{0, 0}
+	for _, sct := range scts {
+		if len(sct) == 0 || len(sct) > 0xffff {
+			return nil, errors.New("invalid SCT length")
+		}
+		list = append(list, byte(len(sct)>>8), byte(len(sct)))
+		list = append(list, sct...)
+	}
+	listLen := len(list) - 2
+	if listLen > 0xffff {
+		return nil, errors.New("SCT list too long")
+	}
+	list[0], list[1] = byte(listLen>>8), byte(listLen)
+	return list, nil
+}
+
+// serverProofData is the data signed in the server proof
+func serverProofData(chlo []byte, serverConfigData []byte) []byte {
+	var data []byte
+	if len(chlo) > 0 {
+		data = append(data, []byte("QUIC CHLO and server config signature\x00")...)
+		chloHash := sha256.Sum256(chlo)
+		data = append(data, 32, 0, 0, 0)
+		data = append(data, chloHash[:]...)
+	} else {
+		// TODO: Remove when we drop support for version 30
+		data = append(data, []byte("QUIC server config signature\x00")...)
+	}
+	return append(data, serverConfigData...)
+}
@@ -0,0 +1,155 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"strconv"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/testdata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// remoteSigner simulates a KMS: it only ever receives digests, the key never leaves it
+type remoteSigner struct {
+	key     *rsa.PrivateKey
+	digests [][]byte
+}
+
+func (r *remoteSigner) sign(digest []byte) ([]byte, error) {
+	r.digests = append(r.digests, digest)
+	return rsa.SignPSS(rand.Reader, r.key, crypto.SHA256, digest, &rsa.PSSOptions{SaltLength: 32})
+}
+
+// mockProofSource holds the certificates, and delegates signing to the remote signer
+type mockProofSource struct {
+	remote *remoteSigner
+	chain  [][]byte
+	sni    string
+}
+
+func (s *mockProofSource) SignProof(sni string, data []byte) ([]byte, error) {
+	s.sni = sni
+	hash := sha256.Sum256(data)
+	return s.remote.sign(hash[:])
+}
+
+func (s *mockProofSource) GetCertChain(sni string) ([][]byte, error) {
+	if s.chain == nil {
+		return nil, errors.New("no chain")
+	}
+	return s.chain, nil
+}
+
+// sniProofSource returns a different certificate for every SNI
+type sniProofSource struct{}
+
+func (sniProofSource) SignProof(sni string, data []byte) ([]byte, error) { return nil, nil }
+func (sniProofSource) GetCertChain(sni string) ([][]byte, error) {
+	return [][]byte{[]byte("cert for " + sni)}, nil
+}
+
+var _ = Describe("Proof source", func() {
+	var (
+		remote *remoteSigner
+		source *mockProofSource
+		signer Signer
+	)
+
+	BeforeEach(func() {
+		tlsCert := testdata.GetCertificate()
+		remote = &remoteSigner{key: tlsCert.PrivateKey.(*rsa.PrivateKey)}
+		source = &mockProofSource{remote: remote, chain: tlsCert.Certificate}
+		signer = NewProofSourceSigner(source)
+	})
+
+	It("delegates signing the server proof", func() {
+		signature, err := signer.SignServerProof("quic.clemente.io", []byte{'C', 'H', 'L', 'O'}, []byte{'S', 'C', 'F', 'G'})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(source.sni).To(Equal("quic.clemente.io"))
+		Expect(remote.digests).To(HaveLen(1))
+		// Generated with:
+		// ruby -e 'require "digest"; p Digest::SHA256.digest("QUIC CHLO and server config signature\x00" + "\x20\x00\x00\x00" + Digest::SHA256.digest("CHLO") + "SCFG")'
+		data := []byte("W\xA6\xFC\xDE\xC7\xD2>c\xE6\xB5\xF6\tq\x9E|<~1\xA33\x01\xCA=\x19\xBD\xC1\xE4\xB0\xBA\x9B\x16%")
+		Expect(remote.digests[0]).To(Equal(data))
+		err = rsa.VerifyPSS(&remote.key.PublicKey, crypto.SHA256, data, signature, &rsa.PSSOptions{SaltLength: 32})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("gets the leaf certificate from the chain", func() {
+		leaf, err := signer.GetLeafCert("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leaf).To(Equal(source.chain[0]))
+	})
+
+	It("compresses the chain", func() {
+		certs, err := signer.GetCertsCompressed("", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		expected, err := compressChain(source.chain, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(certs).To(Equal(expected))
+	})
+
+	It("caches the compressed chain", func() {
+		certs, err := signer.GetCertsCompressed("", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.(*proofSourceSigner).certCache.len()).To(Equal(1))
+		certs2, err := signer.GetCertsCompressed("quic.clemente.io", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(certs2).To(Equal(certs))
+		Expect(signer.(*proofSourceSigner).certCache.len()).To(Equal(1))
+	})
+
+	It("bounds the cache when many distinct SNIs are used", func() {
+		signer = NewProofSourceSigner(&sniProofSource{})
+		for i := 0; i < protocol.MaxCertCacheEntries+100; i++ {
+			_, err := signer.GetCertsCompressed(strconv.Itoa(i)+".clemente.io", nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(signer.(*proofSourceSigner).certCache.len()).To(Equal(protocol.MaxCertCacheEntries))
+	})
+
+	It("returns errors of the proof source", func() {
+		source.chain = nil
+		_, err := signer.GetLeafCert("")
+		Expect(err).To(MatchError("no chain"))
+		_, err = signer.GetCertsCompressed("", nil, nil)
+		Expect(err).To(MatchError("no chain"))
+	})
+
+	It("errors if the chain is empty", func() {
+		source.chain = [][]byte{}
+		_, err := signer.GetLeafCert("")
+		Expect(err).To(MatchError("certificate chain is empty"))
+	})
+
+	It("doesn't return SCTs if the proof source doesn't provide them", func() {
+		scts, err := signer.GetSCTList("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(scts).To(BeNil())
+	})
+
+	It("gets the SCTs of the tls.Certificate", func() {
+		signer = NewProofSourceSigner(&rsaSigner{
+			config: &tls.Config{
+				Certificates: []tls.Certificate{
+					{SignedCertificateTimestamps: [][]byte{{0xde, 0xca, 0xfb, 0xad}, {0x13, 0x37}}},
+				},
+			},
+		})
+		scts, err := signer.GetSCTList("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(scts).To(Equal([]byte{0x0, 0xa, 0x0, 0x4, 0xde, 0xca, 0xfb, 0xad, 0x0, 0x2, 0x13, 0x37}))
+	})
+
+	It("errors on empty SCTs", func() {
+		_, err := serializeSCTList([][]byte{{}})
+		Expect(err).To(MatchError("invalid SCT length"))
+	})
+})
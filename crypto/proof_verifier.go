@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// A ProofVerifier verifies the certificate chain and the server proof (PROF) sent by a server
+// Implementations can add custom checks, e.g. certificate pinning or SCT verification.
+type ProofVerifier interface {
+	// VerifyProof verifies that the chain is valid for the hostname, and that the proof is a signature
+	// of the CHLO and the server config by the leaf certificate. The chain starts with the leaf certificate.
+	VerifyProof(hostname string, chlo []byte, serverConfigData []byte, chain [][]byte, proof []byte) error
+}
+
+// x509ProofVerifier verifies the certificate chain against a pool of root certificates
+type x509ProofVerifier struct {
+	roots *x509.CertPool
+	// the time the certificates have to be valid at, only replaced in tests
+	currentTime func() time.Time
+}
+
+var _ ProofVerifier = &x509ProofVerifier{}
+
+// NewProofVerifier creates a ProofVerifier that verifies RSA and ECDSA proofs
+// The certificate chain is verified against the roots, or against the system roots if roots is nil.
+func NewProofVerifier(roots *x509.CertPool) ProofVerifier {
+	return &x509ProofVerifier{
+		roots:       roots,
+		currentTime: time.Now,
+	}
+}
+
+// VerifyProof verifies the certificate chain and the server proof
+func (v *x509ProofVerifier) VerifyProof(hostname string, chlo []byte, serverConfigData []byte, chain [][]byte, proof []byte) error {
+	if len(chain) == 0 {
+		return errors.New("certificate chain is empty")
+	}
+	certs := make([]*x509.Certificate, len(chain))
+	for i, data := range chain {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   v.currentTime(),
+	}); err != nil {
+		return err
+	}
+
+	return verifyServerProof(leaf, chlo, serverConfigData, proof)
+}
+
+// VerifyServerProof verifies that the proof is a signature of the CHLO and the server config by the certificate
+// It doesn't verify the certificate itself, this is done by the ProofVerifier.
+func VerifyServerProof(cert, chlo, serverConfigData, proof []byte) error {
+	leaf, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return err
+	}
+	return verifyServerProof(leaf, chlo, serverConfigData, proof)
+}
+
+func verifyServerProof(leaf *x509.Certificate, chlo, serverConfigData, proof []byte) error {
+	hash := sha256.Sum256(serverProofData(chlo, serverConfigData))
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(key, crypto.SHA256, hash[:], proof, &rsa.PSSOptions{SaltLength: 32})
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], proof) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return errors.New("only RSA and ECDSA keys are supported")
+	}
+}
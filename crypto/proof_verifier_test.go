@@ -0,0 +1,135 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/testdata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// pinningVerifier only accepts a pinned leaf certificate, in addition to the checks of the default verifier
+type pinningVerifier struct {
+	ProofVerifier
+	pinnedLeaf []byte
+}
+
+func (v *pinningVerifier) VerifyProof(hostname string, chlo []byte, serverConfigData []byte, chain [][]byte, proof []byte) error {
+	if len(chain) == 0 || !bytes.Equal(chain[0], v.pinnedLeaf) {
+		return errors.New("leaf certificate not pinned")
+	}
+	return v.ProofVerifier.VerifyProof(hostname, chlo, serverConfigData, chain, proof)
+}
+
+var _ = Describe("Proof verifier", func() {
+	var (
+		verifier ProofVerifier
+		chain    [][]byte
+		proof    []byte
+	)
+
+	chlo := []byte("CHLO")
+	serverConfigData := []byte("SCFG")
+
+	BeforeEach(func() {
+		tlsConfig := testdata.GetTLSConfig()
+		chain = tlsConfig.Certificates[0].Certificate
+		// the test certificate was issued by the Let's Encrypt intermediate, which we use as the root here
+		intermediate, err := x509.ParseCertificate(chain[1])
+		Expect(err).ToNot(HaveOccurred())
+		roots := x509.NewCertPool()
+		roots.AddCert(intermediate)
+		verifier = NewProofVerifier(roots)
+		// the test certificate is valid from 2016-04-15 to 2016-07-14
+		verifier.(*x509ProofVerifier).currentTime = func() time.Time { return time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC) }
+		signer, err := NewRSASigner(tlsConfig)
+		Expect(err).ToNot(HaveOccurred())
+		proof, err = signer.SignServerProof("quic.clemente.io", chlo, serverConfigData)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("accepts valid proofs", func() {
+		err := verifier.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("rejects proofs for a different CHLO", func() {
+		err := verifier.VerifyProof("quic.clemente.io", []byte("other CHLO"), serverConfigData, chain, proof)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects tampered proofs", func() {
+		proof[len(proof)-1] ^= 0xff
+		err := verifier.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+		Expect(err).To(MatchError(rsa.ErrVerification))
+	})
+
+	It("rejects certificates for a different hostname", func() {
+		err := verifier.VerifyProof("example.com", chlo, serverConfigData, chain, proof)
+		Expect(err).To(BeAssignableToTypeOf(x509.HostnameError{}))
+	})
+
+	It("rejects certificates not issued by one of the roots", func() {
+		verifier.(*x509ProofVerifier).roots = x509.NewCertPool()
+		err := verifier.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+		Expect(err).To(BeAssignableToTypeOf(x509.UnknownAuthorityError{}))
+	})
+
+	It("rejects expired certificates", func() {
+		verifier.(*x509ProofVerifier).currentTime = time.Now
+		err := verifier.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+		Expect(err).To(BeAssignableToTypeOf(x509.CertificateInvalidError{}))
+	})
+
+	It("errors on empty chains", func() {
+		err := verifier.VerifyProof("quic.clemente.io", chlo, serverConfigData, nil, proof)
+		Expect(err).To(MatchError("certificate chain is empty"))
+	})
+
+	Context("verifying the signature", func() {
+		It("accepts valid proofs", func() {
+			err := VerifyServerProof(chain[0], chlo, serverConfigData, proof)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects tampered proofs", func() {
+			proof[0] ^= 0xff
+			err := VerifyServerProof(chain[0], chlo, serverConfigData, proof)
+			Expect(err).To(MatchError(rsa.ErrVerification))
+		})
+
+		It("rejects proofs for a different server config", func() {
+			err := VerifyServerProof(chain[0], chlo, []byte("other SCFG"), proof)
+			Expect(err).To(MatchError(rsa.ErrVerification))
+		})
+
+		It("rejects proofs signed by a different certificate", func() {
+			err := VerifyServerProof(chain[1], chlo, serverConfigData, proof)
+			Expect(err).To(MatchError(rsa.ErrVerification))
+		})
+
+		It("errors on invalid certificates", func() {
+			err := VerifyServerProof([]byte("foobar"), chlo, serverConfigData, proof)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("custom verifiers", func() {
+		It("accepts the pinned certificate", func() {
+			pinning := &pinningVerifier{ProofVerifier: verifier, pinnedLeaf: chain[0]}
+			err := pinning.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects other certificates, even if they are valid", func() {
+			pinning := &pinningVerifier{ProofVerifier: verifier, pinnedLeaf: []byte("other cert")}
+			err := pinning.VerifyProof("quic.clemente.io", chlo, serverConfigData, chain, proof)
+			Expect(err).To(MatchError("leaf certificate not pinned"))
+		})
+	})
+})
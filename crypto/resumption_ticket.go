@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// TicketSource is used to create and open resumption tickets
+// The time is passed in by the caller, so that tickets follow the clock of the handshake.
+type TicketSource interface {
+	// NewTicket encrypts some state into a new ticket, issued at time now
+	NewTicket(state []byte, now time.Time) ([]byte, error)
+	// OpenTicket decrypts a ticket and returns the state, if the ticket is not outdated at time now
+	OpenTicket(data []byte, now time.Time) ([]byte, error)
+}
+
+type ticketSource struct {
+	aead cipher.AEAD
+}
+
+// NewTicketSource creates a source for resumption tickets
+// Tickets are encrypted the same way as source address tokens, with a key derived for tickets.
+func NewTicketSource(secret []byte) (TicketSource, error) {
+	aead, err := newTokenAEAD(secret, ticketKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &ticketSource{aead: aead}, nil
+}
+
+func (s *ticketSource) NewTicket(state []byte, now time.Time) ([]byte, error) {
+	plaintext := make([]byte, 8+len(state))
+	binary.LittleEndian.PutUint64(plaintext, uint64(now.Unix()))
+	copy(plaintext[8:], state)
+	return sealWithRandomNonce(s.aead, plaintext)
+}
+
+func (s *ticketSource) OpenTicket(data []byte, now time.Time) ([]byte, error) {
+	if len(data) < stkNonceSize {
+		return nil, errors.New("resumption ticket too short")
+	}
+	nonce := data[:stkNonceSize]
+
+	res, err := s.aead.Open(nil, nonce, data[stkNonceSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 8 {
+		return nil, errors.New("invalid resumption ticket")
+	}
+
+	timestamp := binary.LittleEndian.Uint64(res)
+	if now.Unix() > int64(timestamp)+protocol.ResumptionTicketExpiryTimeSec {
+		return nil, errors.New("resumption ticket expired")
+	}
+	return res[8:], nil
+}
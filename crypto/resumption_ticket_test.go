@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resumption tickets", func() {
+	var source *ticketSource
+
+	BeforeEach(func() {
+		sourceI, err := NewTicketSource([]byte("TESTING"))
+		Expect(err).NotTo(HaveOccurred())
+		source = sourceI.(*ticketSource)
+	})
+
+	It("issues and opens tickets", func() {
+		ticket, err := source.NewTicket([]byte("foobar"), time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ticket).ToNot(ContainSubstring("foobar"))
+		state, err := source.OpenTicket(ticket, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(Equal([]byte("foobar")))
+	})
+
+	It("uses a different key than the STK source", func() {
+		stkSource, err := NewStkSource([]byte("TESTING"))
+		Expect(err).NotTo(HaveOccurred())
+		stk, err := stkSource.NewToken([]byte{127, 0, 0, 1})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = source.OpenTicket(stk, time.Now())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects tampered tickets", func() {
+		ticket, err := source.NewTicket([]byte("foobar"), time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		ticket[len(ticket)-1] ^= 0xff
+		_, err = source.OpenTicket(ticket, time.Now())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects short tickets", func() {
+		_, err := source.OpenTicket([]byte("foobar"), time.Now())
+		Expect(err).To(MatchError("resumption ticket too short"))
+	})
+
+	It("rejects outdated tickets", func() {
+		issued := time.Unix(1000000, 0)
+		ticket, err := source.NewTicket([]byte("foobar"), issued)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = source.OpenTicket(ticket, issued.Add(protocol.ResumptionTicketExpiryTimeSec*time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = source.OpenTicket(ticket, issued.Add((protocol.ResumptionTicketExpiryTimeSec+1)*time.Second))
+		Expect(err).To(MatchError("resumption ticket expired"))
+	})
+})
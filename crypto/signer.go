@@ -5,4 +5,7 @@ type Signer interface {
 	SignServerProof(sni string, chlo []byte, serverConfigData []byte) ([]byte, error)
 	GetCertsCompressed(sni string, commonSetHashes, cachedHashes []byte) ([]byte, error)
 	GetLeafCert(sni string) ([]byte, error)
+	// GetSCTList gets the signed certificate timestamps of the leaf certificate, serialized as a SignedCertificateTimestampList (RFC 6962)
+	// It returns nil if there are no SCTs.
+	GetSCTList(sni string) ([]byte, error)
 }
@@ -51,29 +51,59 @@ func parseToken(data []byte) (*sourceAddressToken, error) {
 
 type stkSource struct {
 	aead cipher.AEAD
+	// the AEADs for previous secrets, only used for verifying tokens
+	previousAEADs []cipher.AEAD
+	// tokens older than this are rejected
+	expiry time.Duration
 }
 
 const stkKeySize = 16
 
+// the HKDF info strings used for deriving the keys from the secrets
+const (
+	stkKeyInfo    = "QUIC source address token key"
+	ticketKeyInfo = "QUIC resumption ticket key"
+)
+
 // Chrome currently sets this to 12, but discusses changing it to 16. We start
 // at 16 :)
 const stkNonceSize = 16
 
 // NewStkSource creates a source for source address tokens
-func NewStkSource(secret []byte) (StkSource, error) {
-	key, err := deriveKey(secret)
+// Tokens are valid for protocol.STKExpiryTimeSec.
+// New tokens are created with the secret. Tokens created with one of the previous secrets are still accepted,
+// so that the secret can be rotated without rejecting all outstanding tokens.
+func NewStkSource(secret []byte, previousSecrets ...[]byte) (StkSource, error) {
+	return NewStkSourceWithExpiry(secret, protocol.STKExpiryTimeSec*time.Second, previousSecrets...)
+}
+
+// NewStkSourceWithExpiry creates a source for source address tokens that are valid for the given duration
+func NewStkSourceWithExpiry(secret []byte, expiry time.Duration, previousSecrets ...[]byte) (StkSource, error) {
+	aead, err := newTokenAEAD(secret, stkKeyInfo)
 	if err != nil {
 		return nil, err
 	}
-	c, err := aes.NewCipher(key)
+	previousAEADs := make([]cipher.AEAD, len(previousSecrets))
+	for i, previousSecret := range previousSecrets {
+		if previousAEADs[i], err = newTokenAEAD(previousSecret, stkKeyInfo); err != nil {
+			return nil, err
+		}
+	}
+	return &stkSource{aead: aead, previousAEADs: previousAEADs, expiry: expiry}, nil
+}
+
+// newTokenAEAD creates the AEAD for encrypting tokens with a key derived from the secret
+// It is used for both source address tokens and resumption tickets, with different HKDF info strings.
+func newTokenAEAD(secret []byte, info string) (cipher.AEAD, error) {
+	key, err := deriveKey(secret, info)
 	if err != nil {
 		return nil, err
 	}
-	aead, err := cipher.NewGCMWithNonceSize(c, stkNonceSize)
+	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	return &stkSource{aead: aead}, nil
+	return cipher.NewGCMWithNonceSize(c, stkNonceSize)
 }
 
 func (s *stkSource) NewToken(ip net.IP) ([]byte, error) {
@@ -89,7 +119,15 @@ func (s *stkSource) VerifyToken(ip net.IP, data []byte) error {
 	}
 	nonce := data[:stkNonceSize]
 
+	// The GCM tag is checked in constant time by the AEAD
+	// The current secret is tried first, since most tokens were created with it.
 	res, err := s.aead.Open(nil, nonce, data[stkNonceSize:], nil)
+	for _, aead := range s.previousAEADs {
+		if err == nil {
+			break
+		}
+		res, err = aead.Open(nil, nonce, data[stkNonceSize:], nil)
+	}
 	if err != nil {
 		return err
 	}
@@ -99,19 +137,31 @@ func (s *stkSource) VerifyToken(ip net.IP, data []byte) error {
 		return err
 	}
 
-	if subtle.ConstantTimeCompare(token.ip, ip) != 1 {
+	if !ipsEqual(token.ip, ip) {
 		return errors.New("invalid ip in STK")
 	}
 
-	if time.Now().Unix() > int64(token.timestamp)+protocol.STKExpiryTimeSec {
+	if time.Now().After(time.Unix(int64(token.timestamp), 0).Add(s.expiry)) {
 		return errors.New("STK expired")
 	}
 
 	return nil
 }
 
-func deriveKey(secret []byte) ([]byte, error) {
-	r := hkdf.New(sha256.New, secret, nil, []byte("QUIC source address token key"))
+// ipsEqual compares two IPs in constant time.
+// Both IPs are converted to their 16 byte representation first, such that the
+// comparison always runs over the full length, no matter how the IPs were encoded.
+func ipsEqual(a, b net.IP) bool {
+	a16 := a.To16()
+	b16 := b.To16()
+	if a16 == nil || b16 == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a16, b16) == 1
+}
+
+func deriveKey(secret []byte, info string) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, nil, []byte(info))
 	key := make([]byte, stkKeySize)
 	if _, err := io.ReadFull(r, key); err != nil {
 		return nil, err
@@ -120,9 +170,14 @@ func deriveKey(secret []byte) ([]byte, error) {
 }
 
 func encryptToken(aead cipher.AEAD, token *sourceAddressToken) ([]byte, error) {
+	return sealWithRandomNonce(aead, token.serialize())
+}
+
+// sealWithRandomNonce encrypts the plaintext with a random nonce, which is prepended to the ciphertext
+func sealWithRandomNonce(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
 	nonce := make([]byte, stkNonceSize)
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	return aead.Seal(nonce, nonce, token.serialize(), nil), nil
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
 }
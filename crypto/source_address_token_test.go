@@ -11,7 +11,7 @@ import (
 
 var _ = Describe("Source Address Tokens", func() {
 	It("should generate the encryption key", func() {
-		Expect(deriveKey([]byte("TESTING"))).To(Equal([]byte{0xee, 0x71, 0x18, 0x9, 0xfd, 0xb8, 0x9a, 0x79, 0x19, 0xfc, 0x5e, 0x1a, 0x97, 0x20, 0xb2, 0x6}))
+		Expect(deriveKey([]byte("TESTING"), stkKeyInfo)).To(Equal([]byte{0xee, 0x71, 0x18, 0x9, 0xfd, 0xb8, 0x9a, 0x79, 0x19, 0xfc, 0x5e, 0x1a, 0x97, 0x20, 0xb2, 0x6}))
 	})
 
 	Context("tokens", func() {
@@ -99,6 +99,79 @@ var _ = Describe("Source Address Tokens", func() {
 			Expect(err).To(MatchError("STK expired"))
 		})
 
+		Context("with a custom expiry", func() {
+			BeforeEach(func() {
+				sourceI, err := NewStkSourceWithExpiry(secret, time.Hour)
+				Expect(err).NotTo(HaveOccurred())
+				source = sourceI.(*stkSource)
+			})
+
+			It("accepts tokens just inside the window", func() {
+				stk, err := encryptToken(source.aead, &sourceAddressToken{
+					ip:        ip4,
+					timestamp: uint64(time.Now().Add(-time.Hour + 10*time.Second).Unix()),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = source.VerifyToken(ip4, stk)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("rejects tokens just outside the window", func() {
+				stk, err := encryptToken(source.aead, &sourceAddressToken{
+					ip:        ip4,
+					timestamp: uint64(time.Now().Add(-time.Hour - time.Second).Unix()),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = source.VerifyToken(ip4, stk)
+				Expect(err).To(MatchError("STK expired"))
+			})
+		})
+
+		Context("rotating the secret", func() {
+			It("accepts tokens created with a previous secret", func() {
+				stk, err := source.NewToken(ip4)
+				Expect(err).NotTo(HaveOccurred())
+				rotated, err := NewStkSource([]byte("NEW SECRET"), secret)
+				Expect(err).NotTo(HaveOccurred())
+				err = rotated.VerifyToken(ip4, stk)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("creates new tokens with the current secret", func() {
+				rotated, err := NewStkSource([]byte("NEW SECRET"), secret)
+				Expect(err).NotTo(HaveOccurred())
+				stk, err := rotated.NewToken(ip4)
+				Expect(err).NotTo(HaveOccurred())
+				current, err := NewStkSource([]byte("NEW SECRET"))
+				Expect(err).NotTo(HaveOccurred())
+				err = current.VerifyToken(ip4, stk)
+				Expect(err).NotTo(HaveOccurred())
+				err = source.VerifyToken(ip4, stk)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("rejects tokens created with a secret that was dropped", func() {
+				stk, err := source.NewToken(ip4)
+				Expect(err).NotTo(HaveOccurred())
+				rotated, err := NewStkSource([]byte("NEWEST SECRET"), []byte("NEW SECRET"))
+				Expect(err).NotTo(HaveOccurred())
+				err = rotated.VerifyToken(ip4, stk)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("checks the expiry of tokens created with a previous secret", func() {
+				stk, err := encryptToken(source.aead, &sourceAddressToken{
+					ip:        ip4,
+					timestamp: uint64(time.Now().Unix() - protocol.STKExpiryTimeSec - 1),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				rotated, err := NewStkSource([]byte("NEW SECRET"), secret)
+				Expect(err).NotTo(HaveOccurred())
+				err = rotated.VerifyToken(ip4, stk)
+				Expect(err).To(MatchError("STK expired"))
+			})
+		})
+
 		It("should reject tokens with wrong IP addresses", func() {
 			otherIP := net.ParseIP("4.3.2.1")
 			stk, err := encryptToken(source.aead, &sourceAddressToken{
@@ -109,5 +182,41 @@ var _ = Describe("Source Address Tokens", func() {
 			err = source.VerifyToken(ip4, stk)
 			Expect(err).To(MatchError("invalid ip in STK"))
 		})
+
+		It("should verify tokens independent of the IPv4 encoding", func() {
+			stk, err := source.NewToken(ip4.To4())
+			Expect(err).NotTo(HaveOccurred())
+			err = source.VerifyToken(ip4.To16(), stk)
+			Expect(err).NotTo(HaveOccurred())
+			stk, err = source.NewToken(ip4.To16())
+			Expect(err).NotTo(HaveOccurred())
+			err = source.VerifyToken(ip4.To4(), stk)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reject tokens for an IP of a different address family", func() {
+			stk, err := source.NewToken(ip6)
+			Expect(err).NotTo(HaveOccurred())
+			err = source.VerifyToken(ip4.To4(), stk)
+			Expect(err).To(MatchError("invalid ip in STK"))
+		})
+	})
+
+	Context("comparing IPs", func() {
+		It("compares equal IPs", func() {
+			Expect(ipsEqual(net.IP{1, 2, 3, 4}, net.IP{1, 2, 3, 4})).To(BeTrue())
+			Expect(ipsEqual(net.IP{1, 2, 3, 4}, net.ParseIP("1.2.3.4"))).To(BeTrue())
+			Expect(ipsEqual(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1"))).To(BeTrue())
+		})
+
+		It("compares different IPs", func() {
+			Expect(ipsEqual(net.IP{1, 2, 3, 4}, net.IP{4, 3, 2, 1})).To(BeFalse())
+			Expect(ipsEqual(net.IP{1, 2, 3, 4}, net.ParseIP("2001:db8::1"))).To(BeFalse())
+		})
+
+		It("rejects invalid IPs", func() {
+			Expect(ipsEqual(nil, nil)).To(BeFalse())
+			Expect(ipsEqual(net.IP{1, 2, 3}, net.IP{1, 2, 3})).To(BeFalse())
+		})
 	})
 })
@@ -0,0 +1,75 @@
+package frames
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// A GoawayFrame in QUIC
+type GoawayFrame struct {
+	ErrorCode      qerr.ErrorCode
+	LastGoodStream protocol.StreamID
+	ReasonPhrase   string
+}
+
+// ParseGoawayFrame reads a GOAWAY frame
+func ParseGoawayFrame(r *bytes.Reader) (*GoawayFrame, error) {
+	frame := &GoawayFrame{}
+
+	// read the TypeByte
+	_, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	errorCode, err := utils.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	frame.ErrorCode = qerr.ErrorCode(errorCode)
+
+	lastGoodStream, err := utils.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	frame.LastGoodStream = protocol.StreamID(lastGoodStream)
+
+	reasonPhraseLen, err := utils.ReadUint16(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reasonPhrase := make([]byte, reasonPhraseLen)
+	if _, err := io.ReadFull(r, reasonPhrase); err != nil {
+		return nil, err
+	}
+	frame.ReasonPhrase = string(reasonPhrase)
+
+	return frame, nil
+}
+
+// MinLength of a written frame
+func (f *GoawayFrame) MinLength() (protocol.ByteCount, error) {
+	return 1 + 4 + 4 + 2 + protocol.ByteCount(len(f.ReasonPhrase)), nil
+}
+
+// Write writes a GOAWAY frame.
+func (f *GoawayFrame) Write(b *bytes.Buffer, version protocol.VersionNumber) error {
+	if len(f.ReasonPhrase) > math.MaxUint16 {
+		return errors.New("GoawayFrame: ReasonPhrase too long")
+	}
+
+	b.WriteByte(0x03)
+	utils.WriteUint32(b, uint32(f.ErrorCode))
+	utils.WriteUint32(b, uint32(f.LastGoodStream))
+	utils.WriteUint16(b, uint16(len(f.ReasonPhrase)))
+	b.WriteString(f.ReasonPhrase)
+
+	return nil
+}
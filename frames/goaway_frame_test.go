@@ -0,0 +1,66 @@
+package frames
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GoawayFrame", func() {
+	Context("when parsing", func() {
+		It("accepts sample frame", func() {
+			b := bytes.NewReader([]byte{0x03, 0xAD, 0xFB, 0xCA, 0xDE, 0x37, 0x13, 0x00, 0x00, 0x03, 0x00, 'f', 'o', 'o'})
+			frame, err := ParseGoawayFrame(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.ErrorCode).To(Equal(qerr.ErrorCode(0xDECAFBAD)))
+			Expect(frame.LastGoodStream).To(Equal(protocol.StreamID(0x1337)))
+			Expect(frame.ReasonPhrase).To(Equal("foo"))
+			Expect(b.Len()).To(Equal(0))
+		})
+
+		It("errors on EOFs", func() {
+			data := []byte{0x03, 0xAD, 0xFB, 0xCA, 0xDE, 0x37, 0x13, 0x00, 0x00, 0x03, 0x00, 'f', 'o', 'o'}
+			for i := range data {
+				_, err := ParseGoawayFrame(bytes.NewReader(data[:i]))
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Context("when writing", func() {
+		It("writes a sample frame", func() {
+			b := &bytes.Buffer{}
+			frame := &GoawayFrame{
+				ErrorCode:      0xDEADBEEF,
+				LastGoodStream: 0x1337,
+				ReasonPhrase:   "foo",
+			}
+			err := frame.Write(b, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b.Bytes()).To(Equal([]byte{0x03, 0xEF, 0xBE, 0xAD, 0xDE, 0x37, 0x13, 0x00, 0x00, 0x03, 0x00, 'f', 'o', 'o'}))
+		})
+
+		It("rejects ReasonPhrases that are too long", func() {
+			b := &bytes.Buffer{}
+			frame := &GoawayFrame{ReasonPhrase: strings.Repeat("a", 0xFFFF+1)}
+			err := frame.Write(b, 0)
+			Expect(err).To(HaveOccurred())
+			Expect(b.Len()).To(BeZero())
+		})
+
+		It("has proper min length", func() {
+			b := &bytes.Buffer{}
+			f := &GoawayFrame{
+				ErrorCode:      0xDEADBEEF,
+				LastGoodStream: 0x1337,
+				ReasonPhrase:   "foobar",
+			}
+			f.Write(b, 0)
+			Expect(f.MinLength()).To(Equal(protocol.ByteCount(b.Len())))
+		})
+	})
+})
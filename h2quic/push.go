@@ -0,0 +1,128 @@
+package h2quic
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	errPushMethod = errors.New("h2quic: only GET and HEAD requests can be pushed")
+	errPushTarget = errors.New("h2quic: push target must be an absolute path")
+)
+
+// A pusher sends the server pushes of a connection
+type pusher struct {
+	session      streamCreator
+	headerStream utils.Stream
+	handler      http.Handler
+
+	mutex sync.Mutex
+	// the client can disable server push by sending SETTINGS_ENABLE_PUSH = 0
+	enabled bool
+	// server initiated streams have even stream IDs
+	nextStreamID protocol.StreamID
+}
+
+func newPusher(session streamCreator, headerStream utils.Stream, handler http.Handler) *pusher {
+	return &pusher{
+		session:      session,
+		headerStream: headerStream,
+		handler:      handler,
+		enabled:      true,
+		nextStreamID: 2,
+	}
+}
+
+func (p *pusher) setEnabled(enabled bool) {
+	p.mutex.Lock()
+	p.enabled = enabled
+	p.mutex.Unlock()
+}
+
+// push sends a PUSH_PROMISE for the target on the header stream, and serves the promised request on a new stream
+func (p *pusher) push(associatedStreamID protocol.StreamID, authority, target string, opts *http.PushOptions) error {
+	method := "GET"
+	header := http.Header{}
+	if opts != nil {
+		if opts.Method != "" {
+			method = opts.Method
+		}
+		if opts.Header != nil {
+			header = opts.Header
+		}
+	}
+	if method != "GET" && method != "HEAD" {
+		return errPushMethod
+	}
+	if !strings.HasPrefix(target, "/") {
+		return errPushTarget
+	}
+
+	headers := []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: target},
+	}
+	for k, vv := range header {
+		for _, v := range vv {
+			headers = append(headers, hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	req, err := requestFromHeaders(headers)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	if !p.enabled {
+		p.mutex.Unlock()
+		return http.ErrNotSupported
+	}
+	streamID := p.nextStreamID
+	dataStream, err := p.session.GetOrOpenStream(streamID)
+	if err != nil {
+		p.mutex.Unlock()
+		return err
+	}
+	p.nextStreamID += 2
+	p.mutex.Unlock()
+
+	var headerBlock bytes.Buffer
+	enc := hpack.NewEncoder(&headerBlock)
+	for _, hf := range headers {
+		enc.WriteField(hf)
+	}
+	utils.Infof("Pushing %s %s%s on stream %d", req.Method, req.Host, req.RequestURI, streamID)
+	h2framer := http2.NewFramer(p.headerStream, nil)
+	err = h2framer.WritePushPromise(http2.PushPromiseParam{
+		StreamID:      uint32(associatedStreamID),
+		PromiseID:     uint32(streamID),
+		EndHeaders:    true,
+		BlockFragment: headerBlock.Bytes(),
+	})
+	if err != nil {
+		dataStream.Close()
+		return err
+	}
+	// there's no request body for pushed requests
+	dataStream.CloseRemote(0)
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	// pushed responses can't push themselves
+	responseWriter := newResponseWriter(p.headerStream, dataStream, streamID)
+	go func() {
+		p.handler.ServeHTTP(responseWriter, req)
+		dataStream.Close()
+	}()
+	return nil
+}
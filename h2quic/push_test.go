@@ -0,0 +1,138 @@
+package h2quic
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server push", func() {
+	var (
+		p            *pusher
+		session      *mockSession
+		headerStream *mockStream
+		h2framer     *http2.Framer
+
+		mutex      sync.Mutex
+		pushedReqs []*http.Request
+	)
+
+	BeforeEach(func() {
+		pushedReqs = nil
+		session = &mockSession{dataStream: &mockStream{}}
+		headerStream = &mockStream{id: 3}
+		h2framer = http2.NewFramer(nil, headerStream)
+		p = newPusher(session, headerStream, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("pushed"))
+			mutex.Lock()
+			pushedReqs = append(pushedReqs, r)
+			mutex.Unlock()
+		}))
+	})
+
+	getPushedReqs := func() []*http.Request {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return pushedReqs
+	}
+
+	readPushPromise := func() (*http2.PushPromiseFrame, []hpack.HeaderField) {
+		frame, err := h2framer.ReadFrame()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(frame).To(BeAssignableToTypeOf(&http2.PushPromiseFrame{}))
+		pushPromise := frame.(*http2.PushPromiseFrame)
+		headers, err := hpack.NewDecoder(4096, nil).DecodeFull(pushPromise.HeaderBlockFragment())
+		Expect(err).NotTo(HaveOccurred())
+		return pushPromise, headers
+	}
+
+	It("sends a PUSH_PROMISE whose headers round-trip through requestFromHeaders", func() {
+		err := p.push(5, "www.example.com", "/style.css", &http.PushOptions{
+			Header: http.Header{"Accept-Encoding": {"gzip"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(getPushedReqs).Should(HaveLen(1))
+		pushPromise, headers := readPushPromise()
+		Expect(pushPromise.StreamID).To(BeEquivalentTo(5))
+		Expect(pushPromise.PromiseID).To(BeEquivalentTo(2))
+		Expect(pushPromise.HeadersEnded()).To(BeTrue())
+		req, err := requestFromHeaders(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Method).To(Equal("GET"))
+		Expect(req.Host).To(Equal("www.example.com"))
+		Expect(req.RequestURI).To(Equal("/style.css"))
+		Expect(req.Header).To(Equal(http.Header{"Accept-Encoding": {"gzip"}}))
+	})
+
+	It("serves the promised request on a new stream", func() {
+		err := p.push(5, "www.example.com", "/style.css", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(getPushedReqs).Should(HaveLen(1))
+		req := getPushedReqs()[0]
+		Expect(req.Method).To(Equal("GET"))
+		Expect(req.Host).To(Equal("www.example.com"))
+		Expect(req.URL.Path).To(Equal("/style.css"))
+		Expect(session.pushedStreams).To(HaveKey(protocol.StreamID(2)))
+		Expect(session.pushedStreams[2].remoteClosed).To(BeTrue())
+		// the response headers are sent after the PUSH_PROMISE
+		readPushPromise()
+		frame, err := h2framer.ReadFrame()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(frame.Header().StreamID).To(BeEquivalentTo(2))
+		Expect(frame).To(BeAssignableToTypeOf(&http2.HeadersFrame{}))
+	})
+
+	It("uses a new even stream ID for every push", func() {
+		Expect(p.push(5, "www.example.com", "/a.css", nil)).To(Succeed())
+		Eventually(getPushedReqs).Should(HaveLen(1))
+		Expect(p.push(5, "www.example.com", "/b.css", nil)).To(Succeed())
+		Eventually(getPushedReqs).Should(HaveLen(2))
+		pushPromise, _ := readPushPromise()
+		Expect(pushPromise.PromiseID).To(BeEquivalentTo(2))
+		Expect(h2framer.ReadFrame()).To(BeAssignableToTypeOf(&http2.HeadersFrame{}))
+		pushPromise, _ = readPushPromise()
+		Expect(pushPromise.PromiseID).To(BeEquivalentTo(4))
+	})
+
+	It("pushes HEAD requests", func() {
+		err := p.push(5, "www.example.com", "/style.css", &http.PushOptions{Method: "HEAD"})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(getPushedReqs).Should(HaveLen(1))
+		_, headers := readPushPromise()
+		req, err := requestFromHeaders(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Method).To(Equal("HEAD"))
+	})
+
+	It("refuses to push requests with other methods", func() {
+		err := p.push(5, "www.example.com", "/form", &http.PushOptions{Method: "POST"})
+		Expect(err).To(MatchError(errPushMethod))
+		Expect(headerStream.Len()).To(BeZero())
+	})
+
+	It("refuses to push relative targets", func() {
+		err := p.push(5, "www.example.com", "style.css", nil)
+		Expect(err).To(MatchError(errPushTarget))
+		Expect(headerStream.Len()).To(BeZero())
+	})
+
+	It("doesn't push when the client disabled server push", func() {
+		p.setEnabled(false)
+		err := p.push(5, "www.example.com", "/style.css", nil)
+		Expect(err).To(MatchError(http.ErrNotSupported))
+		Expect(headerStream.Len()).To(BeZero())
+		Expect(session.pushedStreams).To(BeEmpty())
+	})
+
+	It("doesn't allow pushes from pushed responses", func() {
+		w := newResponseWriter(headerStream, &mockStream{}, 2)
+		Expect(w.Push("/style.css", nil)).To(MatchError(http.ErrNotSupported))
+	})
+})
@@ -2,17 +2,36 @@ package h2quic
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/http2/hpack"
 )
 
+// connectionSpecificHeaders are not allowed in HTTP/2, see RFC 7540 section 8.1.2.2
+var connectionSpecificHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
 func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
-	var path, authority, method string
+	var path, authority, method, scheme string
+	var cookies []string
+	contentLength := int64(-1)
 	httpHeaders := http.Header{}
 
 	for _, h := range headers {
+		if err := validateHeaderField(h); err != nil {
+			return nil, err
+		}
 		switch h.Name {
 		case ":path":
 			path = h.Value
@@ -20,6 +39,18 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 			method = h.Value
 		case ":authority":
 			authority = h.Value
+		case ":scheme":
+			scheme = h.Value
+		case "cookie":
+			// the cookie header may be split into multiple header fields, see RFC 7540 section 8.1.2.5
+			cookies = append(cookies, h.Value)
+		case "content-length":
+			var err error
+			contentLength, err = strconv.ParseInt(h.Value, 10, 64)
+			if err != nil || contentLength < 0 {
+				return nil, errors.New("invalid content-length")
+			}
+			httpHeaders.Add(h.Name, h.Value)
 		default:
 			if !h.IsPseudo() {
 				httpHeaders.Add(h.Name, h.Value)
@@ -27,25 +58,84 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 		}
 	}
 
+	if len(cookies) > 0 {
+		httpHeaders.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	// a CONNECT request only contains the :authority, see RFC 7540 section 8.3
+	if method == "CONNECT" {
+		if len(path) > 0 || len(scheme) > 0 {
+			return nil, errors.New(":path and :scheme must be empty for CONNECT requests")
+		}
+		if len(authority) == 0 {
+			return nil, errors.New(":authority must not be empty for CONNECT requests")
+		}
+		return &http.Request{
+			Method:        method,
+			URL:           &url.URL{Host: authority},
+			Proto:         "HTTP/2.0",
+			ProtoMajor:    2,
+			ProtoMinor:    0,
+			Header:        httpHeaders,
+			ContentLength: contentLength,
+			Host:          authority,
+			RequestURI:    authority,
+		}, nil
+	}
+
 	if len(path) == 0 || len(authority) == 0 || len(method) == 0 {
 		return nil, errors.New(":path, :authority and :method must not be empty")
 	}
 
+	switch scheme {
+	case "":
+		scheme = "https"
+	case "http", "https":
+	default:
+		return nil, errors.New("invalid :scheme: " + scheme)
+	}
+
 	u, err := url.Parse(path)
 	if err != nil {
 		return nil, err
 	}
+	u.Scheme = scheme
 
 	return &http.Request{
-		Method:     method,
-		URL:        u,
-		Proto:      "HTTP/2.0",
-		ProtoMajor: 2,
-		ProtoMinor: 0,
-		Header:     httpHeaders,
-		Body:       nil,
-		// ContentLength: -1,
-		Host:       authority,
-		RequestURI: path,
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        httpHeaders,
+		Body:          nil,
+		ContentLength: contentLength,
+		Host:          authority,
+		RequestURI:    path,
 	}, nil
 }
+
+// validateHeaderField checks that a header field is allowed in an HTTP/2 request
+func validateHeaderField(h hpack.HeaderField) error {
+	if strings.ToLower(h.Name) != h.Name {
+		return fmt.Errorf("uppercase header field name: %s", h.Name)
+	}
+	if connectionSpecificHeaders[h.Name] {
+		return fmt.Errorf("connection-specific header field: %s", h.Name)
+	}
+	// TE is the only exception, if it only indicates that trailers are accepted
+	if h.Name == "te" && h.Value != "trailers" {
+		return fmt.Errorf("invalid te header field: %s", h.Value)
+	}
+	return nil
+}
+
+// newRequestBody creates the body of a request, which is read from the data stream
+// If the content-length is known, reading stops after that many bytes.
+func newRequestBody(dataStream io.Reader, contentLength int64) io.ReadCloser {
+	if contentLength >= 0 {
+		dataStream = io.LimitReader(dataStream, contentLength)
+	}
+	// stream's Close() closes the write side, not the read side
+	return ioutil.NopCloser(dataStream)
+}
@@ -1,6 +1,8 @@
 package h2quic
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
 
 	"golang.org/x/net/http2/hpack"
@@ -20,11 +22,13 @@ var _ = Describe("Request", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(req.Method).To(Equal("GET"))
 		Expect(req.URL.Path).To(Equal("/foo"))
+		Expect(req.URL.Scheme).To(Equal("https"))
 		Expect(req.Proto).To(Equal("HTTP/2.0"))
 		Expect(req.ProtoMajor).To(Equal(2))
 		Expect(req.ProtoMinor).To(Equal(0))
 		Expect(req.Header).To(BeEmpty())
 		Expect(req.Body).To(BeNil())
+		Expect(req.ContentLength).To(BeEquivalentTo(-1))
 		Expect(req.Host).To(Equal("quic.clemente.io"))
 		Expect(req.RequestURI).To(Equal("/foo"))
 	})
@@ -46,6 +50,140 @@ var _ = Describe("Request", func() {
 		}))
 	})
 
+	It("reads the scheme", func() {
+		headers := []hpack.HeaderField{
+			{":path", "/foo", false},
+			{":authority", "quic.clemente.io", false},
+			{":method", "GET", false},
+			{":scheme", "http", false},
+		}
+		req, err := requestFromHeaders(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.URL.Scheme).To(Equal("http"))
+	})
+
+	It("errors with an invalid scheme", func() {
+		headers := []hpack.HeaderField{
+			{":path", "/foo", false},
+			{":authority", "quic.clemente.io", false},
+			{":method", "GET", false},
+			{":scheme", "ftp", false},
+		}
+		_, err := requestFromHeaders(headers)
+		Expect(err).To(MatchError("invalid :scheme: ftp"))
+	})
+
+	Context("CONNECT requests", func() {
+		It("populates a CONNECT request", func() {
+			headers := []hpack.HeaderField{
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "CONNECT", false},
+			}
+			req, err := requestFromHeaders(headers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Method).To(Equal("CONNECT"))
+			Expect(req.Host).To(Equal("quic.clemente.io:443"))
+			Expect(req.RequestURI).To(Equal("quic.clemente.io:443"))
+			Expect(req.URL.Host).To(Equal("quic.clemente.io:443"))
+		})
+
+		It("errors with a :path", func() {
+			headers := []hpack.HeaderField{
+				{":path", "/foo", false},
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "CONNECT", false},
+			}
+			_, err := requestFromHeaders(headers)
+			Expect(err).To(MatchError(":path and :scheme must be empty for CONNECT requests"))
+		})
+
+		It("errors with a :scheme", func() {
+			headers := []hpack.HeaderField{
+				{":scheme", "https", false},
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "CONNECT", false},
+			}
+			_, err := requestFromHeaders(headers)
+			Expect(err).To(MatchError(":path and :scheme must be empty for CONNECT requests"))
+		})
+
+		It("errors with missing authority", func() {
+			headers := []hpack.HeaderField{
+				{":method", "CONNECT", false},
+			}
+			_, err := requestFromHeaders(headers)
+			Expect(err).To(MatchError(":authority must not be empty for CONNECT requests"))
+		})
+	})
+
+	It("joins multiple cookie header fields", func() {
+		headers := []hpack.HeaderField{
+			{":path", "/foo", false},
+			{":authority", "quic.clemente.io", false},
+			{":method", "GET", false},
+			{"cookie", "a=b", false},
+			{"cookie", "c=d", false},
+		}
+		req, err := requestFromHeaders(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Header).To(Equal(http.Header{"Cookie": []string{"a=b; c=d"}}))
+		Expect(req.Cookies()).To(HaveLen(2))
+	})
+
+	Context("header field validation", func() {
+		requestWithHeader := func(name, value string) error {
+			headers := []hpack.HeaderField{
+				{":path", "/foo", false},
+				{":authority", "quic.clemente.io", false},
+				{":method", "GET", false},
+				{name, value, false},
+			}
+			_, err := requestFromHeaders(headers)
+			return err
+		}
+
+		It("rejects connection-specific header fields", func() {
+			for _, name := range []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"} {
+				Expect(requestWithHeader(name, "foo")).To(MatchError("connection-specific header field: " + name))
+			}
+		})
+
+		It("accepts te: trailers", func() {
+			Expect(requestWithHeader("te", "trailers")).To(Succeed())
+		})
+
+		It("rejects other te header fields", func() {
+			Expect(requestWithHeader("te", "gzip")).To(MatchError("invalid te header field: gzip"))
+		})
+
+		It("rejects uppercase header field names", func() {
+			Expect(requestWithHeader("User-Agent", "foo")).To(MatchError("uppercase header field name: User-Agent"))
+		})
+	})
+
+	It("parses the content-length", func() {
+		headers := []hpack.HeaderField{
+			{":path", "/foo", false},
+			{":authority", "quic.clemente.io", false},
+			{":method", "POST", false},
+			{"content-length", "42", false},
+		}
+		req, err := requestFromHeaders(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.ContentLength).To(BeEquivalentTo(42))
+	})
+
+	It("errors with an invalid content-length", func() {
+		headers := []hpack.HeaderField{
+			{":path", "/foo", false},
+			{":authority", "quic.clemente.io", false},
+			{":method", "POST", false},
+			{"content-length", "-1", false},
+		}
+		_, err := requestFromHeaders(headers)
+		Expect(err).To(MatchError("invalid content-length"))
+	})
+
 	It("errors with missing path", func() {
 		headers := []hpack.HeaderField{
 			{":authority", "quic.clemente.io", false},
@@ -72,4 +210,20 @@ var _ = Describe("Request", func() {
 		_, err := requestFromHeaders(headers)
 		Expect(err).To(MatchError(":path, :authority and :method must not be empty"))
 	})
+
+	Context("request body", func() {
+		It("reads the body from the data stream", func() {
+			body := newRequestBody(bytes.NewReader([]byte("foobar")), -1)
+			data, err := ioutil.ReadAll(body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(Equal([]byte("foobar")))
+		})
+
+		It("stops reading after content-length bytes", func() {
+			body := newRequestBody(bytes.NewReader([]byte("foobar")), 3)
+			data, err := ioutil.ReadAll(body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(Equal([]byte("foo")))
+		})
+	})
 })
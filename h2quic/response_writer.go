@@ -18,8 +18,14 @@ type responseWriter struct {
 
 	header        http.Header
 	headerWritten bool
+
+	// if set, the handler can push responses for the request with this authority
+	pusher    *pusher
+	authority string
 }
 
+var _ http.Pusher = &responseWriter{}
+
 func newResponseWriter(headerStream, dataStream utils.Stream, dataStreamID protocol.StreamID) *responseWriter {
 	return &responseWriter{
 		header:       http.Header{},
@@ -62,3 +68,11 @@ func (w *responseWriter) Write(p []byte) (int, error) {
 	}
 	return w.dataStream.Write(p)
 }
+
+// Push implements http.Pusher. The target must be an absolute path.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if w.pusher == nil {
+		return http.ErrNotSupported
+	}
+	return w.pusher.push(w.dataStreamID, w.authority, target, opts)
+}
@@ -3,12 +3,12 @@ package h2quic
 import (
 	"crypto/tls"
 	"errors"
-	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/utils"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
@@ -16,9 +16,13 @@ import (
 
 type streamCreator interface {
 	GetOrOpenStream(protocol.StreamID) (utils.Stream, error)
+	MaxHeaderListSize() uint32
+	SupportsMaxHeaderListSize() bool
 	Close(error) error
 }
 
+var errHeaderListTooLarge = errors.New("http2 header list too large")
+
 // Server is a HTTP2 server listening for QUIC connections
 type Server struct {
 	server  *quic.Server
@@ -61,28 +65,62 @@ func (s *Server) handleStream(session streamCreator, stream utils.Stream) {
 	}
 
 	hpackDecoder := hpack.NewDecoder(4096, nil)
+	hpackDecoder.SetMaxStringLength(int(session.MaxHeaderListSize()))
 	h2framer := http2.NewFramer(nil, stream)
 
+	if session.SupportsMaxHeaderListSize() {
+		if err := s.sendSettings(session, stream); err != nil {
+			utils.Errorf("error sending h2 settings: %s", err.Error())
+		}
+	}
+
+	pusher := newPusher(session, stream, s.handler)
+
 	go func() {
 		for {
-			if err := s.handleRequest(session, stream, hpackDecoder, h2framer); err != nil {
+			if err := s.handleRequest(session, stream, pusher, hpackDecoder, h2framer); err != nil {
 				utils.Errorf("error handling h2 request: %s", err.Error())
+				// the header compression state is lost, so we can't serve any more requests
+				session.Close(qerr.Error(qerr.InvalidHeadersStreamData, err.Error()))
 				return
 			}
 		}
 	}()
 }
 
-func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream, hpackDecoder *hpack.Decoder, h2framer *http2.Framer) error {
+// sendSettings tells the client the maximum size of a header list we accept
+func (s *Server) sendSettings(session streamCreator, headerStream utils.Stream) error {
+	h2framer := http2.NewFramer(headerStream, nil)
+	return h2framer.WriteSettings(http2.Setting{
+		ID:  http2.SettingMaxHeaderListSize,
+		Val: session.MaxHeaderListSize(),
+	})
+}
+
+func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream, pusher *pusher, hpackDecoder *hpack.Decoder, h2framer *http2.Framer) error {
 	h2frame, err := h2framer.ReadFrame()
 	if err != nil {
 		return err
 	}
-	h2headersFrame := h2frame.(*http2.HeadersFrame)
+	if settingsFrame, ok := h2frame.(*http2.SettingsFrame); ok {
+		// clients that support SETTINGS_MAX_HEADER_LIST_SIZE send their settings as well
+		if val, ok := settingsFrame.Value(http2.SettingEnablePush); ok {
+			pusher.setEnabled(val != 0)
+		}
+		return nil
+	}
+	h2headersFrame, ok := h2frame.(*http2.HeadersFrame)
+	if !ok {
+		return errors.New("unexpected http2 frame on the headers stream")
+	}
 	if !h2headersFrame.HeadersEnded() {
 		return errors.New("http2 header continuation not implemented")
 	}
-	headers, err := hpackDecoder.DecodeFull(h2headersFrame.HeaderBlockFragment())
+	headers, err := decodeHeaders(hpackDecoder, h2headersFrame.HeaderBlockFragment(), session.MaxHeaderListSize())
+	if err == errHeaderListTooLarge {
+		utils.Errorf("rejecting h2 request on stream %d: %s", h2headersFrame.StreamID, err.Error())
+		return s.rejectRequest(session, headerStream, protocol.StreamID(h2headersFrame.StreamID), http.StatusRequestHeaderFieldsTooLarge)
+	}
 	if err != nil {
 		utils.Errorf("invalid http2 headers encoding: %s", err.Error())
 		return err
@@ -90,7 +128,9 @@ func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream,
 
 	req, err := requestFromHeaders(headers)
 	if err != nil {
-		return err
+		// a malformed request is a stream error, the header compression state is still intact
+		utils.Errorf("rejecting malformed h2 request on stream %d: %s", h2headersFrame.StreamID, err.Error())
+		return s.rejectRequest(session, headerStream, protocol.StreamID(h2headersFrame.StreamID), http.StatusBadRequest)
 	}
 	utils.Infof("%s %s%s", req.Method, req.Host, req.RequestURI)
 
@@ -103,10 +143,11 @@ func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream,
 		dataStream.CloseRemote(0)
 	}
 
-	// stream's Close() closes the write side, not the read side
-	req.Body = ioutil.NopCloser(dataStream)
+	req.Body = newRequestBody(dataStream, req.ContentLength)
 
 	responseWriter := newResponseWriter(headerStream, dataStream, protocol.StreamID(h2headersFrame.StreamID))
+	responseWriter.pusher = pusher
+	responseWriter.authority = req.Host
 
 	go func() {
 		s.handler.ServeHTTP(responseWriter, req)
@@ -121,3 +162,40 @@ func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream,
 
 	return nil
 }
+
+// decodeHeaders decodes a header block, stopping to collect header fields once the header list gets too large
+func decodeHeaders(hpackDecoder *hpack.Decoder, headerBlock []byte, maxHeaderListSize uint32) ([]hpack.HeaderField, error) {
+	var headers []hpack.HeaderField
+	var headerListSize uint32
+	hpackDecoder.SetEmitEnabled(true)
+	hpackDecoder.SetEmitFunc(func(hf hpack.HeaderField) {
+		headerListSize += hf.Size()
+		if headerListSize > maxHeaderListSize {
+			// keep decoding, so that the dynamic table stays in sync with the client's
+			hpackDecoder.SetEmitEnabled(false)
+			return
+		}
+		headers = append(headers, hf)
+	})
+	if _, err := hpackDecoder.Write(headerBlock); err != nil {
+		return nil, err
+	}
+	if err := hpackDecoder.Close(); err != nil {
+		return nil, err
+	}
+	if headerListSize > maxHeaderListSize {
+		return nil, errHeaderListTooLarge
+	}
+	return headers, nil
+}
+
+// rejectRequest answers a request with the status code, without calling the handler
+func (s *Server) rejectRequest(session streamCreator, headerStream utils.Stream, streamID protocol.StreamID, status int) error {
+	dataStream, err := session.GetOrOpenStream(streamID)
+	if err != nil {
+		return err
+	}
+	responseWriter := newResponseWriter(headerStream, dataStream, streamID)
+	responseWriter.WriteHeader(status)
+	return dataStream.Close()
+}
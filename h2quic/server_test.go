@@ -1,7 +1,10 @@
 package h2quic
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
@@ -15,14 +18,31 @@ import (
 )
 
 type mockSession struct {
-	closed     bool
-	dataStream *mockStream
+	closed                    bool
+	dataStream                *mockStream
+	maxHeaderListSize         uint32
+	supportsMaxHeaderListSize bool
+	// the server initiated streams, i.e. the streams with even stream IDs
+	pushedStreams map[protocol.StreamID]*mockStream
 }
 
 func (s *mockSession) GetOrOpenStream(id protocol.StreamID) (utils.Stream, error) {
+	if id%2 == 0 {
+		if s.pushedStreams == nil {
+			s.pushedStreams = make(map[protocol.StreamID]*mockStream)
+		}
+		if _, ok := s.pushedStreams[id]; !ok {
+			s.pushedStreams[id] = &mockStream{id: id}
+		}
+		return s.pushedStreams[id], nil
+	}
 	return s.dataStream, nil
 }
 
+func (s *mockSession) MaxHeaderListSize() uint32 { return s.maxHeaderListSize }
+
+func (s *mockSession) SupportsMaxHeaderListSize() bool { return s.supportsMaxHeaderListSize }
+
 func (s *mockSession) Close(error) error { s.closed = true; return nil }
 
 var _ = Describe("H2 server", func() {
@@ -38,7 +58,7 @@ var _ = Describe("H2 server", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(s).NotTo(BeNil())
 		dataStream = &mockStream{}
-		session = &mockSession{dataStream: dataStream}
+		session = &mockSession{dataStream: dataStream, maxHeaderListSize: protocol.MaxHeaderListSize}
 	})
 
 	It("uses default handler", func() {
@@ -61,12 +81,14 @@ var _ = Describe("H2 server", func() {
 			h2framer     *http2.Framer
 			hpackDecoder *hpack.Decoder
 			headerStream *mockStream
+			pusher       *pusher
 		)
 
 		BeforeEach(func() {
 			headerStream = &mockStream{}
 			hpackDecoder = hpack.NewDecoder(4096, nil)
 			h2framer = http2.NewFramer(nil, headerStream)
+			pusher = newPusher(session, headerStream, nil)
 		})
 
 		It("handles a sample GET request", func() {
@@ -80,7 +102,7 @@ var _ = Describe("H2 server", func() {
 				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
 				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
 			})
-			err := s.handleRequest(session, headerStream, hpackDecoder, h2framer)
+			err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
 			Expect(err).NotTo(HaveOccurred())
 			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
 			Expect(dataStream.remoteClosed).To(BeTrue())
@@ -97,11 +119,180 @@ var _ = Describe("H2 server", func() {
 				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
 				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
 			})
-			err := s.handleRequest(session, headerStream, hpackDecoder, h2framer)
+			err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
 			Expect(err).NotTo(HaveOccurred())
 			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
 			Expect(dataStream.remoteClosed).To(BeFalse())
 		})
+
+		It("passes the request body to the handler", func() {
+			var body []byte
+			s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.Method).To(Equal("POST"))
+				Expect(r.ContentLength).To(BeEquivalentTo(6))
+				var err error
+				body, err = ioutil.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+			})
+			var headerBlock bytes.Buffer
+			enc := hpack.NewEncoder(&headerBlock)
+			enc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+			enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/upload"})
+			enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "www.example.com"})
+			enc.WriteField(hpack.HeaderField{Name: "content-length", Value: "6"})
+			err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      5,
+				EndHeaders:    true,
+				BlockFragment: headerBlock.Bytes(),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			dataStream.Write([]byte("foobar, and more"))
+			err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() []byte { return body }).Should(Equal([]byte("foobar")))
+		})
+
+		Context("rejecting requests", func() {
+			var (
+				handlerCalled bool
+				headerBlock   *bytes.Buffer
+				hpackEncoder  *hpack.Encoder
+			)
+
+			BeforeEach(func() {
+				handlerCalled = false
+				s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handlerCalled = true
+				})
+				headerBlock = &bytes.Buffer{}
+				hpackEncoder = hpack.NewEncoder(headerBlock)
+			})
+
+			// writeRequest writes a HEADERS frame and returns the size of the header block
+			writeRequest := func(streamID uint32, fields ...hpack.HeaderField) int {
+				headerBlock.Reset()
+				fields = append([]hpack.HeaderField{
+					{Name: ":method", Value: "GET"},
+					{Name: ":path", Value: "/"},
+					{Name: ":authority", Value: "www.example.com"},
+				}, fields...)
+				for _, f := range fields {
+					hpackEncoder.WriteField(f)
+				}
+				err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      streamID,
+					EndHeaders:    true,
+					BlockFragment: headerBlock.Bytes(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return headerBlock.Len()
+			}
+
+			readStatus := func() string {
+				frame, err := h2framer.ReadFrame()
+				Expect(err).NotTo(HaveOccurred())
+				headers, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(headers[0].Name).To(Equal(":status"))
+				return headers[0].Value
+			}
+
+			It("answers requests exceeding the max header list size with 431 and keeps serving", func() {
+				session.maxHeaderListSize = 200
+				writeRequest(5,
+					hpack.HeaderField{Name: "cookie", Value: strings.Repeat("a", 100)},
+					hpack.HeaderField{Name: "user-agent", Value: strings.Repeat("b", 100)},
+				)
+				err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readStatus()).To(Equal("431"))
+				Consistently(func() bool { return handlerCalled }).Should(BeFalse())
+				// the next request on the connection is handled
+				writeRequest(7)
+				err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			})
+
+			It("rejects small header blocks that expand to a large header list", func() {
+				session.maxHeaderListSize = 300
+				cookie := hpack.HeaderField{Name: "cookie", Value: strings.Repeat("a", 100)}
+				writeRequest(5, cookie)
+				err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+				handlerCalled = false
+				// all fields are in the dynamic table now, so every field is encoded in a single byte
+				Expect(writeRequest(7, cookie, cookie)).To(Equal(5))
+				err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readStatus()).To(Equal("431"))
+				Consistently(func() bool { return handlerCalled }).Should(BeFalse())
+			})
+
+			It("answers malformed requests with 400 and keeps serving", func() {
+				writeRequest(5, hpack.HeaderField{Name: "Foo", Value: "bar"})
+				err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readStatus()).To(Equal("400"))
+				writeRequest(7, hpack.HeaderField{Name: "connection", Value: "keep-alive"})
+				err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readStatus()).To(Equal("400"))
+				Consistently(func() bool { return handlerCalled }).Should(BeFalse())
+				Expect(session.closed).To(BeFalse())
+				// the next valid request on the connection is handled
+				writeRequest(9, hpack.HeaderField{Name: "foo", Value: "bar"})
+				err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			})
+		})
+
+		It("ignores SETTINGS frames", func() {
+			err := http2.NewFramer(headerStream, nil).WriteSettings(http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: 1337})
+			Expect(err).NotTo(HaveOccurred())
+			err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("disables server push when the client sends SETTINGS_ENABLE_PUSH = 0", func() {
+			err := http2.NewFramer(headerStream, nil).WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0})
+			Expect(err).NotTo(HaveOccurred())
+			err = s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pusher.enabled).To(BeFalse())
+		})
+
+		It("passes the pusher to the handler", func() {
+			var pushErr error
+			var handlerCalled bool
+			s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pushErr = w.(http.Pusher).Push("/style.css", nil)
+				handlerCalled = true
+			})
+			pusher.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(session, headerStream, pusher, hpackDecoder, h2framer)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(pushErr).NotTo(HaveOccurred())
+			Expect(session.pushedStreams).To(HaveKey(protocol.StreamID(2)))
+		})
+
+		It("sends the max header list size in a SETTINGS frame", func() {
+			err := s.sendSettings(session, headerStream)
+			Expect(err).NotTo(HaveOccurred())
+			frame, err := h2framer.ReadFrame()
+			Expect(err).NotTo(HaveOccurred())
+			val, ok := frame.(*http2.SettingsFrame).Value(http2.SettingMaxHeaderListSize)
+			Expect(ok).To(BeTrue())
+			Expect(val).To(Equal(protocol.MaxHeaderListSize))
+		})
 	})
 
 	It("handles the header stream", func() {
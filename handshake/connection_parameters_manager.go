@@ -19,9 +19,11 @@ type ConnectionParametersManager struct {
 	params map[Tag][]byte
 	mutex  sync.RWMutex
 
-	flowControlNegotiated bool // have the flow control parameters for sending already been negotiated
+	flowControlNegotiated     bool // have the flow control parameters for sending already been negotiated
+	supportsMaxHeaderListSize bool // does the client support SETTINGS_MAX_HEADER_LIST_SIZE
 
-	maxStreamsPerConnection            uint32
+	maxStreamsPerConnection            uint32 // the number of streams the client may open
+	maxOutgoingStreams                 uint32 // the number of streams we may open
 	idleConnectionStateLifetime        time.Duration
 	sendStreamFlowControlWindow        protocol.ByteCount
 	sendConnectionFlowControlWindow    protocol.ByteCount
@@ -29,6 +31,12 @@ type ConnectionParametersManager struct {
 	receiveConnectionFlowControlWindow protocol.ByteCount
 }
 
+// requiredParameters are the connection parameters a client has to send in a full CHLO, unless it resumes them from a ticket
+var requiredParameters = []Tag{TagICSL, TagMSPC}
+
+// resumableParameters are the connection parameters that are stored in resumption tickets
+var resumableParameters = []Tag{TagICSL, TagMSPC, TagMIDS, TagSMHL, TagSFCW, TagCFCW}
+
 var errTagNotInConnectionParameterMap = errors.New("ConnectionParametersManager: Tag not found in ConnectionsParameter map")
 
 // ErrMalformedTag is returned when the tag value cannot be read
@@ -40,7 +48,9 @@ var (
 // NewConnectionParamatersManager creates a new connection parameters manager
 func NewConnectionParamatersManager() *ConnectionParametersManager {
 	return &ConnectionParametersManager{
-		params: make(map[Tag][]byte),
+		params:                             make(map[Tag][]byte),
+		maxStreamsPerConnection:            protocol.MaxStreamsPerConnection,
+		maxOutgoingStreams:                 protocol.MaxStreamsPerConnection,
 		idleConnectionStateLifetime:        protocol.InitialIdleConnectionStateLifetime,
 		sendStreamFlowControlWindow:        protocol.InitialStreamFlowControlWindow,     // can only be changed by the client
 		sendConnectionFlowControlWindow:    protocol.InitialConnectionFlowControlWindow, // can only be changed by the client
@@ -54,6 +64,21 @@ func (h *ConnectionParametersManager) SetFromMap(params map[Tag][]byte) error {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	// validate all values before applying any of them, so that a malformed CHLO doesn't leave the parameters half-set
+	for key, value := range params {
+		switch key {
+		case TagMSPC, TagMIDS, TagSMHL, TagICSL, TagSFCW, TagCFCW:
+			if len(value) < 4 {
+				return ErrMalformedTag
+			}
+		}
+	}
+	_, containsSFCW := params[TagSFCW]
+	_, containsCFCW := params[TagCFCW]
+	if h.flowControlNegotiated && (containsCFCW || containsSFCW) {
+		return ErrFlowControlRenegotiationNotSupported
+	}
+
 	for key, value := range params {
 		switch key {
 		case TagTCID:
@@ -64,6 +89,22 @@ func (h *ConnectionParametersManager) SetFromMap(params map[Tag][]byte) error {
 				return ErrMalformedTag
 			}
 			h.maxStreamsPerConnection = h.negotiateMaxStreamsPerConnection(clientValue)
+			// Clients that don't send MIDS use the same limit in both directions
+			if _, ok := params[TagMIDS]; !ok {
+				h.maxOutgoingStreams = clientValue
+			}
+		case TagMIDS:
+			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
+			if err != nil {
+				return ErrMalformedTag
+			}
+			h.maxOutgoingStreams = clientValue
+		case TagSMHL:
+			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
+			if err != nil {
+				return ErrMalformedTag
+			}
+			h.supportsMaxHeaderListSize = clientValue == 1
 		case TagICSL:
 			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
 			if err != nil {
@@ -71,28 +112,22 @@ func (h *ConnectionParametersManager) SetFromMap(params map[Tag][]byte) error {
 			}
 			h.idleConnectionStateLifetime = h.negotiateIdleConnectionStateLifetime(time.Duration(clientValue) * time.Second)
 		case TagSFCW:
-			if h.flowControlNegotiated {
-				return ErrFlowControlRenegotiationNotSupported
-			}
 			sendStreamFlowControlWindow, err := utils.ReadUint32(bytes.NewBuffer(value))
 			if err != nil {
 				return ErrMalformedTag
 			}
 			h.sendStreamFlowControlWindow = protocol.ByteCount(sendStreamFlowControlWindow)
+			h.receiveStreamFlowControlWindow = h.negotiateReceiveStreamFlowControlWindow(protocol.ByteCount(sendStreamFlowControlWindow))
 		case TagCFCW:
-			if h.flowControlNegotiated {
-				return ErrFlowControlRenegotiationNotSupported
-			}
 			sendConnectionFlowControlWindow, err := utils.ReadUint32(bytes.NewBuffer(value))
 			if err != nil {
 				return ErrMalformedTag
 			}
 			h.sendConnectionFlowControlWindow = protocol.ByteCount(sendConnectionFlowControlWindow)
+			h.receiveConnectionFlowControlWindow = h.negotiateReceiveConnectionFlowControlWindow(protocol.ByteCount(sendConnectionFlowControlWindow))
 		}
 	}
 
-	_, containsSFCW := params[TagSFCW]
-	_, containsCFCW := params[TagCFCW]
 	if containsCFCW || containsSFCW {
 		h.flowControlNegotiated = true
 	}
@@ -100,6 +135,16 @@ func (h *ConnectionParametersManager) SetFromMap(params map[Tag][]byte) error {
 	return nil
 }
 
+// checkRequiredParameters checks that a CHLO contains all connection parameters needed for the SHLO
+func checkRequiredParameters(params map[Tag][]byte) error {
+	for _, tag := range requiredParameters {
+		if _, ok := params[tag]; !ok {
+			return qerr.Error(qerr.CryptoMessageParameterNotFound, tagToString(tag)+" missing")
+		}
+	}
+	return nil
+}
+
 func (h *ConnectionParametersManager) negotiateMaxStreamsPerConnection(clientValue uint32) uint32 {
 	return utils.MinUint32(clientValue, protocol.MaxStreamsPerConnection)
 }
@@ -109,6 +154,15 @@ func (h *ConnectionParametersManager) negotiateIdleConnectionStateLifetime(clien
 	return utils.MinDuration(clientValue, protocol.MaxIdleConnectionStateLifetime)
 }
 
+// The flow control windows we announce in the SHLO are the ones the client requested, unless they exceed our maximum
+func (h *ConnectionParametersManager) negotiateReceiveStreamFlowControlWindow(clientValue protocol.ByteCount) protocol.ByteCount {
+	return utils.MinByteCount(clientValue, protocol.ReceiveStreamFlowControlWindow)
+}
+
+func (h *ConnectionParametersManager) negotiateReceiveConnectionFlowControlWindow(clientValue protocol.ByteCount) protocol.ByteCount {
+	return utils.MinByteCount(clientValue, protocol.ReceiveConnectionFlowControlWindow)
+}
+
 // getRawValue gets the byte-slice for a tag
 func (h *ConnectionParametersManager) getRawValue(tag Tag) ([]byte, error) {
 	h.mutex.RLock()
@@ -130,14 +184,18 @@ func (h *ConnectionParametersManager) GetSHLOMap() map[Tag][]byte {
 	mspc := bytes.NewBuffer([]byte{})
 	utils.WriteUint32(mspc, uint32(h.GetMaxStreamsPerConnection()))
 	icsl := bytes.NewBuffer([]byte{})
-	utils.WriteUint32(icsl, uint32(h.GetIdleConnectionStateLifetime()/time.Second))
+	utils.WriteUint32(icsl, uint32(h.GetIdleTimeout()/time.Second))
 
-	return map[Tag][]byte{
+	params := map[Tag][]byte{
 		TagICSL: icsl.Bytes(),
 		TagMSPC: mspc.Bytes(),
 		TagCFCW: cfcw.Bytes(),
 		TagSFCW: sfcw.Bytes(),
 	}
+	if h.SupportsMaxHeaderListSize() {
+		params[TagSMHL] = []byte{1, 0, 0, 0}
+	}
+	return params
 }
 
 // GetSendStreamFlowControlWindow gets the size of the stream-level flow control window for sending data
@@ -180,8 +238,36 @@ func (h *ConnectionParametersManager) GetMaxStreamsPerConnection() uint32 {
 	return h.maxStreamsPerConnection
 }
 
-// GetIdleConnectionStateLifetime gets the idle timeout
-func (h *ConnectionParametersManager) GetIdleConnectionStateLifetime() time.Duration {
+// GetMaxIncomingStreams gets the maximum number of streams the client may open
+func (h *ConnectionParametersManager) GetMaxIncomingStreams() uint32 {
+	return h.GetMaxStreamsPerConnection()
+}
+
+// GetMaxOutgoingStreams gets the maximum number of streams we may open
+func (h *ConnectionParametersManager) GetMaxOutgoingStreams() uint32 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.maxOutgoingStreams
+}
+
+// SupportsMaxHeaderListSize determines if the client supports SETTINGS_MAX_HEADER_LIST_SIZE
+func (h *ConnectionParametersManager) SupportsMaxHeaderListSize() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.supportsMaxHeaderListSize
+}
+
+// GetMaxHeaderListSize gets the maximum size of an uncompressed header list the client may send
+// We enforce it in any case, but only clients that support SETTINGS_MAX_HEADER_LIST_SIZE are told about it
+func (h *ConnectionParametersManager) GetMaxHeaderListSize() uint32 {
+	return protocol.MaxHeaderListSize
+}
+
+// GetIdleTimeout gets the negotiated idle timeout
+// This is the idle connection state lifetime sent in the SHLO, and the one the session enforces.
+func (h *ConnectionParametersManager) GetIdleTimeout() time.Duration {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
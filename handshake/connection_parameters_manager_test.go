@@ -32,6 +32,37 @@ var _ = Describe("ConnectionsParameterManager", func() {
 		Expect(err).To(MatchError(errTagNotInConnectionParameterMap))
 	})
 
+	It("does not apply any value if one of them is malformed", func() {
+		values := map[Tag][]byte{
+			TagMSPC: {2, 0, 0, 0},
+			TagICSL: {10, 0, 0}, // 1 byte too short
+		}
+		err := cpm.SetFromMap(values)
+		Expect(err).To(MatchError(ErrMalformedTag))
+		Expect(cpm.GetMaxStreamsPerConnection()).To(Equal(protocol.MaxStreamsPerConnection))
+		Expect(cpm.GetIdleTimeout()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
+	})
+
+	Context("required parameters", func() {
+		It("accepts a CHLO with all required parameters", func() {
+			err := checkRequiredParameters(map[Tag][]byte{
+				TagICSL: {10, 0, 0, 0},
+				TagMSPC: {2, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("errors if the ICSL is missing", func() {
+			err := checkRequiredParameters(map[Tag][]byte{TagMSPC: {2, 0, 0, 0}})
+			Expect(err).To(MatchError("CryptoMessageParameterNotFound: ICSL missing"))
+		})
+
+		It("errors if the MSPC is missing", func() {
+			err := checkRequiredParameters(map[Tag][]byte{TagICSL: {10, 0, 0, 0}})
+			Expect(err).To(MatchError("CryptoMessageParameterNotFound: MSPC missing"))
+		})
+	})
+
 	Context("SHLO", func() {
 		It("returns all parameters necessary for the SHLO", func() {
 			entryMap := cpm.GetSHLOMap()
@@ -68,6 +99,29 @@ var _ = Describe("ConnectionsParameterManager", func() {
 		})
 	})
 
+	Context("max header list size", func() {
+		It("does not support the max header list size by default", func() {
+			Expect(cpm.SupportsMaxHeaderListSize()).To(BeFalse())
+			Expect(cpm.GetSHLOMap()).ToNot(HaveKey(TagSMHL))
+		})
+
+		It("reads the SMHL tag and echoes it in the SHLO", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{TagSMHL: {1, 0, 0, 0}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.SupportsMaxHeaderListSize()).To(BeTrue())
+			Expect(cpm.GetSHLOMap()).To(HaveKeyWithValue(TagSMHL, []byte{1, 0, 0, 0}))
+		})
+
+		It("errors when given an invalid SMHL value", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{TagSMHL: {1, 0, 0}})
+			Expect(err).To(MatchError(ErrMalformedTag))
+		})
+
+		It("gets the max header list size", func() {
+			Expect(cpm.GetMaxHeaderListSize()).To(Equal(protocol.MaxHeaderListSize))
+		})
+	})
+
 	Context("Truncated connection IDs", func() {
 		It("does not send truncated connection IDs if the TCID tag is missing", func() {
 			Expect(cpm.TruncateConnectionID()).To(BeFalse())
@@ -135,6 +189,33 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			Expect(cpm.GetSendStreamFlowControlWindow()).To(Equal(protocol.InitialConnectionFlowControlWindow))
 		})
 
+		It("echoes the flow control windows requested by the client in the SHLO", func() {
+			values := map[Tag][]byte{
+				TagSFCW: {0x00, 0x40, 0x00, 0x00}, // 16 kB
+				TagCFCW: {0x00, 0x80, 0x00, 0x00}, // 32 kB
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetReceiveStreamFlowControlWindow()).To(Equal(protocol.ByteCount(0x4000)))
+			Expect(cpm.GetReceiveConnectionFlowControlWindow()).To(Equal(protocol.ByteCount(0x8000)))
+			entryMap := cpm.GetSHLOMap()
+			Expect(entryMap[TagSFCW]).To(Equal(values[TagSFCW]))
+			Expect(entryMap[TagCFCW]).To(Equal(values[TagCFCW]))
+		})
+
+		It("doesn't announce flow control windows larger than the maximum in the SHLO", func() {
+			values := map[Tag][]byte{
+				TagSFCW: {0xDE, 0xAD, 0xBE, 0xEF},
+				TagCFCW: {0xDE, 0xAD, 0xBE, 0xEF},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetSendStreamFlowControlWindow()).To(Equal(protocol.ByteCount(0xEFBEADDE)))
+			Expect(cpm.GetSendConnectionFlowControlWindow()).To(Equal(protocol.ByteCount(0xEFBEADDE)))
+			Expect(cpm.GetReceiveStreamFlowControlWindow()).To(Equal(protocol.ReceiveStreamFlowControlWindow))
+			Expect(cpm.GetReceiveConnectionFlowControlWindow()).To(Equal(protocol.ReceiveConnectionFlowControlWindow))
+		})
+
 		It("does not allow renegotiation of flow control parameters", func() {
 			values := map[Tag][]byte{
 				TagCFCW: {0xDE, 0xAD, 0xBE, 0xEF},
@@ -155,7 +236,7 @@ var _ = Describe("ConnectionsParameterManager", func() {
 
 	Context("idle connection state lifetime", func() {
 		It("has initial idle conneciton state lifetime", func() {
-			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
+			Expect(cpm.GetIdleTimeout()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
 		})
 
 		It("negotiates correctly when the client wants a longer lifetime", func() {
@@ -173,7 +254,17 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			}
 			err := cpm.SetFromMap(values)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(10 * time.Second))
+			Expect(cpm.GetIdleTimeout()).To(Equal(10 * time.Second))
+		})
+
+		It("caps a huge idle timeout requested by the client, and announces it in the SHLO", func() {
+			values := map[Tag][]byte{
+				TagICSL: {0xff, 0xff, 0xff, 0xff},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetIdleTimeout()).To(Equal(protocol.MaxIdleConnectionStateLifetime))
+			Expect(cpm.GetSHLOMap()[TagICSL]).To(Equal([]byte{byte(protocol.MaxIdleConnectionStateLifetime / time.Second), 0, 0, 0}))
 		})
 
 		It("does not change the idle connection state lifetime when given an invalid value", func() {
@@ -182,13 +273,13 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			}
 			err := cpm.SetFromMap(values)
 			Expect(err).To(MatchError(ErrMalformedTag))
-			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
+			Expect(cpm.GetIdleTimeout()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
 		})
 
 		It("gets idle connection state lifetime", func() {
 			value := 0xDECAFBAD * time.Second
 			cpm.idleConnectionStateLifetime = value
-			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(value))
+			Expect(cpm.GetIdleTimeout()).To(Equal(value))
 		})
 	})
 
@@ -224,5 +315,39 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			cpm.maxStreamsPerConnection = value
 			Expect(cpm.GetMaxStreamsPerConnection()).To(Equal(value))
 		})
+
+		It("has default limits for incoming and outgoing streams", func() {
+			Expect(cpm.GetMaxIncomingStreams()).To(Equal(protocol.MaxStreamsPerConnection))
+			Expect(cpm.GetMaxOutgoingStreams()).To(Equal(protocol.MaxStreamsPerConnection))
+		})
+
+		It("uses the client's MSPC for both directions if MIDS is missing", func() {
+			values := map[Tag][]byte{
+				TagMSPC: {2, 0, 0, 0},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetMaxIncomingStreams()).To(Equal(uint32(2)))
+			Expect(cpm.GetMaxOutgoingStreams()).To(Equal(uint32(2)))
+		})
+
+		It("negotiates incoming and outgoing streams separately", func() {
+			values := map[Tag][]byte{
+				TagMSPC: {2, 0, 0, 0},
+				TagMIDS: {3, 0, 0, 0},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetMaxIncomingStreams()).To(Equal(uint32(2)))
+			Expect(cpm.GetMaxOutgoingStreams()).To(Equal(uint32(3)))
+		})
+
+		It("errors when given an invalid max incoming dynamic streams value", func() {
+			values := map[Tag][]byte{
+				TagMIDS: {3, 0, 0}, // 1 byte too short
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).To(MatchError(ErrMalformedTag))
+		})
 	})
 })
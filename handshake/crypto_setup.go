@@ -2,10 +2,13 @@ package handshake
 
 import (
 	"bytes"
-	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/protocol"
@@ -19,9 +22,38 @@ type KeyDerivationFunction func(version protocol.VersionNumber, forwardSecure bo
 // KeyExchangeFunction is used to make a new KEX
 type KeyExchangeFunction func() (crypto.KeyExchange, error)
 
+// A Tracer is notified about events of the crypto handshake
+type Tracer interface {
+	// ReceivedCHLO is called for every CHLO received, with its tags. The tags must not be modified.
+	ReceivedCHLO(connID protocol.ConnectionID, tags map[Tag][]byte)
+	// SentREJ is called when a REJ was sent in response to a CHLO
+	SentREJ(connID protocol.ConnectionID)
+	// SentSHLO is called when the SHLO was sent
+	SentSHLO(connID protocol.ConnectionID)
+	// KeysInstalled is called when the initial or the forward secure keys are derived
+	KeysInstalled(connID protocol.ConnectionID, forwardSecure bool)
+	// HandshakeComplete is called when the first forward secure packet was received
+	HandshakeComplete(connID protocol.ConnectionID)
+}
+
+// HandshakeState is the state of the crypto handshake, as seen by the packets we seal
+type HandshakeState int
+
+const (
+	// HandshakeStateUnencrypted means that no keys have been derived yet, packets are only authenticated with the null AEAD
+	HandshakeStateUnencrypted HandshakeState = iota
+	// HandshakeStateSecure means that packets are encrypted with the initial keys
+	HandshakeStateSecure
+	// HandshakeStateForwardSecure means that the client used the forward secure keys, and we use them as well
+	HandshakeStateForwardSecure
+)
+
 // The CryptoSetup handles all things crypto for the Session
 type CryptoSetup struct {
-	connID               protocol.ConnectionID
+	connID protocol.ConnectionID
+	// the IP the client started the handshake from
+	// STKs are issued for and validated against this IP. It is not updated when the client migrates,
+	// so that a migration during the handshake doesn't invalidate the STK the client already received.
 	ip                   net.IP
 	version              protocol.VersionNumber
 	scfg                 *ServerConfig
@@ -34,6 +66,16 @@ type CryptoSetup struct {
 	receivedSecurePacket        bool
 	aeadChanged                 chan struct{}
 
+	// after the first forward secure packet, the secure AEAD is kept for a grace period to open reordered packets
+	retiredSecureAEAD              crypto.AEAD
+	retiredSecureAEADDeadline      time.Time
+	firstForwardSecurePacketNumber protocol.PacketNumber
+	clock                          utils.Clock
+
+	forwardSecureAEADInstalled  chan struct{} // closed when the forward secure AEAD is derived
+	forwardSecurePacketReceived chan struct{} // closed when the first forward secure packet is decrypted
+
+	// if set, it is used instead of the key derivation of the negotiated AEAD
 	keyDerivation KeyDerivationFunction
 	keyExchange   KeyExchangeFunction
 
@@ -41,11 +83,49 @@ type CryptoSetup struct {
 
 	connectionParametersManager *ConnectionParametersManager
 
+	// the tags of the key exchange and AEAD algorithms used for the keys
+	keyExchangeTag []byte
+	aeadTag        []byte
+
+	// the time reported by the client in the last CHLO, only used for diagnostics
+	clientTime time.Time
+
+	// the bytes of CHLOs received and REJs sent before the client's address was validated by an STK
+	unvalidatedBytesReceived int
+	unvalidatedBytesSent     int
+
 	mutex sync.RWMutex
 }
 
 var _ crypto.AEAD = &CryptoSetup{}
 
+// A CryptoSetupOption changes the behavior of a CryptoSetup
+type CryptoSetupOption func(*CryptoSetup)
+
+// WithKeyDerivation sets the key derivation used for both the initial and the forward secure keys
+// By default, the key derivation of the AEAD negotiated with the client is used.
+func WithKeyDerivation(keyDerivation KeyDerivationFunction) CryptoSetupOption {
+	return func(h *CryptoSetup) {
+		h.keyDerivation = keyDerivation
+	}
+}
+
+// WithKeyExchange sets the function creating the ephemeral curve25519 key exchanges for the forward secure keys
+// By default, new keys are generated, or taken from the server config's key exchange pool.
+func WithKeyExchange(keyExchange KeyExchangeFunction) CryptoSetupOption {
+	return func(h *CryptoSetup) {
+		h.keyExchange = keyExchange
+	}
+}
+
+// WithClock sets the clock used for the grace period of the initial encryption
+// By default, the system clock is used.
+func WithClock(clock utils.Clock) CryptoSetupOption {
+	return func(h *CryptoSetup) {
+		h.clock = clock
+	}
+}
+
 // NewCryptoSetup creates a new CryptoSetup instance
 func NewCryptoSetup(
 	connID protocol.ConnectionID,
@@ -55,118 +135,295 @@ func NewCryptoSetup(
 	cryptoStream utils.Stream,
 	connectionParametersManager *ConnectionParametersManager,
 	aeadChanged chan struct{},
+	opts ...CryptoSetupOption,
 ) (*CryptoSetup, error) {
-	nonce := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
-	diversificationNonce := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, diversificationNonce); err != nil {
-		return nil, err
+	keyExchange := crypto.NewCurve25519KEX
+	if scfg.kexPool != nil {
+		keyExchange = scfg.kexPool.Get
 	}
-	return &CryptoSetup{
+	h := &CryptoSetup{
 		connID:                      connID,
 		ip:                          ip,
 		version:                     version,
 		scfg:                        scfg,
-		nonce:                       nonce,
-		diversificationNonce:        diversificationNonce,
-		keyDerivation:               crypto.DeriveKeysChacha20,
-		keyExchange:                 crypto.NewCurve25519KEX,
+		keyExchange:                 keyExchange,
 		cryptoStream:                cryptoStream,
 		connectionParametersManager: connectionParametersManager,
 		aeadChanged:                 aeadChanged,
-	}, nil
+		forwardSecureAEADInstalled:  make(chan struct{}),
+		forwardSecurePacketReceived: make(chan struct{}),
+		clock:                       utils.DefaultClock{},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if err := h.regenerateNonces(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// regenerateNonces generates a new server nonce and diversification nonce
+// The nonces must never be used for more than one handshake, so a CryptoSetup that is reused for a new handshake must call this first.
+func (h *CryptoSetup) regenerateNonces() error {
+	nonce := make([]byte, 32)
+	if _, err := io.ReadFull(h.scfg.rand, nonce); err != nil {
+		return err
+	}
+	divNonceSource := h.scfg.rand
+	if h.scfg.divNonceSource != nil {
+		divNonceSource = h.scfg.divNonceSource
+	}
+	diversificationNonce := make([]byte, 32)
+	if _, err := io.ReadFull(divNonceSource, diversificationNonce); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.nonce = nonce
+	h.diversificationNonce = diversificationNonce
+	h.mutex.Unlock()
+	return nil
 }
 
 // HandleCryptoStream reads and writes messages on the crypto stream
 func (h *CryptoSetup) HandleCryptoStream() error {
-	for {
-		cachingReader := utils.NewCachingReader(h.cryptoStream)
-		messageTag, cryptoData, err := ParseHandshakeMessage(cachingReader)
+	cachingReader := utils.NewLimitedCachingReader(h.cryptoStream, h.scfg.cryptoStreamBufferLimiter)
+	for numCHLOs := 1; ; numCHLOs++ {
+		messageTag, cryptoData, err := parseCHLOMessage(cachingReader)
+		// the budget only limits the data buffered while waiting for the complete message
+		cachingReader.Release()
+		if err == utils.ErrBufferLimitExceeded {
+			return qerr.Error(qerr.HandshakeFailed, "crypto stream buffer limit exceeded")
+		}
 		if err != nil {
 			return err
 		}
 		if messageTag != TagCHLO {
 			return qerr.InvalidCryptoMessageType
 		}
+		if numCHLOs > protocol.MaxClientHellos {
+			return qerr.Error(qerr.CryptoTooManyRejects, fmt.Sprintf("more than %d CHLOs", protocol.MaxClientHellos))
+		}
 		chloData := cachingReader.Get()
 
-		utils.Infof("Got CHLO:\n%s", printHandshakeMessage(cryptoData))
+		utils.Infof("Got CHLO for connection %x from %s:\n%s", h.connID, h.ip, printHandshakeMessage(cryptoData))
+		if h.scfg.tracer != nil {
+			h.scfg.tracer.ReceivedCHLO(h.connID, cryptoData)
+		}
 
 		done, err := h.handleMessage(chloData, cryptoData)
+		// the CHLO is not needed any more once it has been handled
+		cachingReader.Reset(h.cryptoStream)
 		if err != nil {
 			return err
 		}
 		if done {
+			// The handshake is complete, we won't read from the crypto stream any more.
+			// The keys are kept in the AEADs, so we don't need to retain anything else.
+			h.cryptoStream = nil
 			return nil
 		}
 	}
 }
 
 func (h *CryptoSetup) handleMessage(chloData []byte, cryptoData map[Tag][]byte) (bool, error) {
+	if err := h.checkUnknownTags(cryptoData); err != nil {
+		return false, err
+	}
+	h.readClientTime(cryptoData)
+
 	sniSlice, ok := cryptoData[TagSNI]
 	if !ok {
 		return false, qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")
 	}
 	sni := string(sniSlice)
 	if sni == "" {
-		return false, qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")
+		return false, qerr.Error(qerr.InvalidCryptoMessageParameter, "empty SNI")
+	}
+	if !h.scfg.acceptsHostname(sni) {
+		return false, qerr.Error(qerr.CryptoMessageParameterNotFound, "unknown SNI: "+sni)
 	}
 
 	var reply []byte
 	var err error
-	if !h.isInchoateCHLO(cryptoData) {
+	// the STK is only verified once, it decides both if the CHLO is inchoate and how large the REJ may be
+	addressValidated := h.validatesSourceAddress(cryptoData)
+	reason := h.inchoateCHLOReason(cryptoData, addressValidated)
+	if reason == inchoateReasonNone && h.acceptsCHLONonce(cryptoData) {
 		// We have a CHLO with a proper server config ID, do a 0-RTT handshake
 		reply, err = h.handleCHLO(sni, chloData, cryptoData)
 		if err != nil {
 			return false, err
 		}
+		// The nonce is only remembered once the CHLO was accepted, so that an invalid CHLO can't use up the nonce of a valid one
+		if err = h.rememberCHLONonce(cryptoData); err != nil {
+			return false, err
+		}
+		utils.Infof("Sending SHLO for connection %x to %s", h.connID, h.ip)
 		_, err = h.cryptoStream.Write(reply)
 		if err != nil {
 			return false, err
 		}
+		if h.scfg.tracer != nil {
+			h.scfg.tracer.SentSHLO(h.connID)
+		}
 		return true, nil
 	}
 
 	// We have an inchoate or non-matching CHLO, we now send a rejection
-	reply, err = h.handleInchoateCHLO(sni, chloData, cryptoData)
+	if reason != inchoateReasonNone {
+		utils.Infof("Inchoate CHLO for connection %x from %s: %s", h.connID, h.ip, reason)
+	}
+	reply, err = h.handleInchoateCHLO(sni, chloData, cryptoData, addressValidated)
 	if err != nil {
 		return false, err
 	}
+	utils.Infof("Sending REJ for connection %x to %s", h.connID, h.ip)
 	_, err = h.cryptoStream.Write(reply)
 	if err != nil {
 		return false, err
 	}
+	if h.scfg.tracer != nil {
+		h.scfg.tracer.SentREJ(h.connID)
+	}
 	return false, nil
 }
 
+// checkUnknownTags rejects CHLOs with unknown tags when strict tag parsing is enabled, and ignores these tags otherwise
+func (h *CryptoSetup) checkUnknownTags(cryptoData map[Tag][]byte) error {
+	for tag := range cryptoData {
+		if chloTags[tag] {
+			continue
+		}
+		if h.scfg.strictTagParsing {
+			return qerr.Error(qerr.InvalidCryptoMessageParameter, "unknown tag "+tagToString(tag))
+		}
+		utils.Debugf("Ignoring unknown tag %s in CHLO for connection %x", tagToString(tag), h.connID)
+	}
+	return nil
+}
+
+// readClientTime reads the time reported by the client, for debugging e.g. clock skew
+// It is never enforced, so invalid values are ignored.
+func (h *CryptoSetup) readClientTime(cryptoData map[Tag][]byte) {
+	ctim, ok := cryptoData[TagCTIM]
+	if !ok {
+		return
+	}
+	if len(ctim) != 8 {
+		utils.Debugf("Ignoring invalid CTIM in CHLO for connection %x", h.connID)
+		return
+	}
+	clientTime := time.Unix(int64(binary.LittleEndian.Uint64(ctim)), 0)
+	utils.Infof("Client time for connection %x: %s (skew %s)", h.connID, clientTime, clientTime.Sub(h.clock.Now()))
+	h.mutex.Lock()
+	h.clientTime = clientTime
+	h.mutex.Unlock()
+}
+
+// ClientTime returns the time the client reported in the last CHLO, and false if it didn't report one
+func (h *CryptoSetup) ClientTime() (time.Time, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.clientTime, !h.clientTime.IsZero()
+}
+
 // Open a message
 func (h *CryptoSetup) Open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
+	res, firstForwardSecurePacket, err := h.open(packetNumber, associatedData, ciphertext, true)
+	if firstForwardSecurePacket {
+		h.dropInitialEncryption(packetNumber)
+	}
+	h.maybeDropRetiredSecureAEAD()
+	return res, err
+}
+
+// TryOpen opens a message like Open, but doesn't change the state of the handshake
+// It can be used to check if a packet can be decrypted with the current keys, e.g. before buffering it.
+func (h *CryptoSetup) TryOpen(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
+	res, _, err := h.open(packetNumber, associatedData, ciphertext, false)
+	return res, err
+}
+
+// open opens a message. If updateState is set, it records that a secure packet was received.
+// It returns if this is the first forward secure packet, which the caller then has to handle.
+func (h *CryptoSetup) open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte, updateState bool) ([]byte, bool, error) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	if h.forwardSecureAEAD != nil {
 		res, err := h.forwardSecureAEAD.Open(packetNumber, associatedData, ciphertext)
 		if err == nil {
-			h.receivedForwardSecurePacket = true
-			return res, nil
+			return res, !h.receivedForwardSecurePacket, nil
 		}
 		if h.receivedForwardSecurePacket {
-			return nil, err
+			if h.acceptsRetiredSecureAEAD(packetNumber) {
+				if res, err := h.retiredSecureAEAD.Open(packetNumber, associatedData, ciphertext); err == nil {
+					return res, false, nil
+				}
+			}
+			return nil, false, err
 		}
 	}
 	if h.secureAEAD != nil {
 		res, err := h.secureAEAD.Open(packetNumber, associatedData, ciphertext)
 		if err == nil {
-			h.receivedSecurePacket = true
-			return res, nil
+			if updateState {
+				h.receivedSecurePacket = true
+			}
+			return res, false, nil
 		}
 		if h.receivedSecurePacket {
-			return nil, err
+			return nil, false, err
 		}
 	}
-	return (&crypto.NullAEAD{}).Open(packetNumber, associatedData, ciphertext)
+	res, err := (&crypto.NullAEAD{}).Open(packetNumber, associatedData, ciphertext)
+	return res, false, err
+}
+
+// acceptsRetiredSecureAEAD checks if a packet that can't be opened with the forward secure AEAD may still be opened with the secure AEAD.
+// This is only the case during the grace period, and for packets that were sent before the first forward secure packet.
+func (h *CryptoSetup) acceptsRetiredSecureAEAD(packetNumber protocol.PacketNumber) bool {
+	return h.retiredSecureAEAD != nil &&
+		packetNumber < h.firstForwardSecurePacketNumber &&
+		h.clock.Now().Before(h.retiredSecureAEADDeadline)
+}
+
+// maybeDropRetiredSecureAEAD releases the secure AEAD once the grace period is over
+func (h *CryptoSetup) maybeDropRetiredSecureAEAD() {
+	h.mutex.RLock()
+	expired := h.retiredSecureAEAD != nil && !h.clock.Now().Before(h.retiredSecureAEADDeadline)
+	h.mutex.RUnlock()
+	if !expired {
+		return
+	}
+	h.mutex.Lock()
+	h.retiredSecureAEAD = nil
+	h.mutex.Unlock()
+}
+
+// dropInitialEncryption is called when the first forward secure packet was received.
+// After that, the peer must not send packets with the initial encryption anymore. Only reordered packets
+// are still accepted for a short grace period, after which we don't need to keep the secure AEAD around.
+func (h *CryptoSetup) dropInitialEncryption(packetNumber protocol.PacketNumber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// another forward secure packet might have been opened concurrently
+	if h.receivedForwardSecurePacket {
+		return
+	}
+	h.receivedForwardSecurePacket = true
+	if h.scfg.initialEncryptionGracePeriod > 0 {
+		h.retiredSecureAEAD = h.secureAEAD
+		h.retiredSecureAEADDeadline = h.clock.Now().Add(h.scfg.initialEncryptionGracePeriod)
+		h.firstForwardSecurePacketNumber = packetNumber
+	}
+	h.secureAEAD = nil
+	close(h.forwardSecurePacketReceived)
+	if h.scfg.tracer != nil {
+		h.scfg.tracer.HandshakeComplete(h.connID)
+	}
 }
 
 // Seal a message
@@ -183,19 +440,106 @@ func (h *CryptoSetup) Seal(packetNumber protocol.PacketNumber, associatedData []
 	}
 }
 
-func (h *CryptoSetup) isInchoateCHLO(cryptoData map[Tag][]byte) bool {
+// ErrUnencryptedApplicationData is returned when sealing application data before a secure AEAD is available
+var ErrUnencryptedApplicationData = errors.New("CryptoSetup BUG: tried to seal application data without encryption")
+
+// SealApplicationData seals a packet containing application data.
+// Unlike Seal, it never falls back to the null encryption, which may only be used for handshake data.
+func (h *CryptoSetup) SealApplicationData(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) ([]byte, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if h.receivedForwardSecurePacket {
+		return h.forwardSecureAEAD.Seal(packetNumber, associatedData, plaintext), nil
+	} else if h.secureAEAD != nil {
+		return h.secureAEAD.Seal(packetNumber, associatedData, plaintext), nil
+	}
+	utils.Errorf("Refusing to seal application data without encryption for connection %x", h.connID)
+	return nil, ErrUnencryptedApplicationData
+}
+
+// An inchoateReason is the reason a CHLO is treated as inchoate, and answered with a REJ
+type inchoateReason int
+
+const (
+	// inchoateReasonNone means that the CHLO can be used for a 0-RTT handshake
+	inchoateReasonNone inchoateReason = iota
+	inchoateReasonNoSCID
+	inchoateReasonSCIDMismatch
+	inchoateReasonBadSTK
+)
+
+func (r inchoateReason) String() string {
+	switch r {
+	case inchoateReasonNone:
+		return "none"
+	case inchoateReasonNoSCID:
+		return "no SCID"
+	case inchoateReasonSCIDMismatch:
+		return "SCID mismatch"
+	case inchoateReasonBadSTK:
+		return "bad STK"
+	default:
+		return fmt.Sprintf("unknown inchoate reason %d", int(r))
+	}
+}
+
+// validatesSourceAddress checks if the CHLO contains a valid STK for the client's address
+func (h *CryptoSetup) validatesSourceAddress(cryptoData map[Tag][]byte) bool {
+	if err := h.scfg.stkSource.VerifyToken(h.ip, cryptoData[TagSTK]); err != nil {
+		utils.Infof("STK invalid for connection %x from %s: %s", h.connID, h.ip, err.Error())
+		return false
+	}
+	return true
+}
+
+// inchoateCHLOReason returns why a CHLO is inchoate, or inchoateReasonNone if it isn't
+// addressValidated is the result of validatesSourceAddress for the CHLO.
+func (h *CryptoSetup) inchoateCHLOReason(cryptoData map[Tag][]byte, addressValidated bool) inchoateReason {
 	scid, ok := cryptoData[TagSCID]
-	if !ok || !bytes.Equal(h.scfg.ID, scid) {
+	if !ok {
+		return inchoateReasonNoSCID
+	}
+	if !bytes.Equal(h.scfg.ID, scid) {
+		return inchoateReasonSCIDMismatch
+	}
+	// A client without a valid STK gets a REJ containing a new one
+	if !addressValidated {
+		return inchoateReasonBadSTK
+	}
+	return inchoateReasonNone
+}
+
+// acceptsCHLONonce checks if the client nonce of a 0-RTT CHLO can be accepted
+// A replayed CHLO is answered with a REJ, so a captured CHLO can't be used to replay the request sent with it.
+// The same applies if the nonce is too old to be in the replay cache, or if the replay cache is full.
+func (h *CryptoSetup) acceptsCHLONonce(cryptoData map[Tag][]byte) bool {
+	nonce, ok := cryptoData[TagNONC]
+	if !ok {
 		return true
 	}
-	if err := h.scfg.stkSource.VerifyToken(h.ip, cryptoData[TagSTK]); err != nil {
-		utils.Infof("STK invalid: %s", err.Error())
+	if err := h.scfg.replayCache.Check(nonce, h.clock.Now()); err != nil {
+		utils.Infof("Rejecting CHLO for connection %x from %s: %s", h.connID, h.ip, err.Error())
 		return false
 	}
-	return false
+	return true
 }
 
-func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map[Tag][]byte) ([]byte, error) {
+// rememberCHLONonce adds the client nonce of an accepted CHLO to the replay cache
+// It fails if the same nonce was accepted concurrently on a different connection, or if the replay cache filled up in the meantime.
+func (h *CryptoSetup) rememberCHLONonce(cryptoData map[Tag][]byte) error {
+	nonce, ok := cryptoData[TagNONC]
+	if !ok {
+		return nil
+	}
+	if err := h.scfg.replayCache.Add(nonce, h.clock.Now()); err != nil {
+		utils.Infof("Not accepting CHLO for connection %x from %s: %s", h.connID, h.ip, err.Error())
+		return qerr.Error(qerr.HandshakeFailed, err.Error())
+	}
+	return nil
+}
+
+func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map[Tag][]byte, addressValidated bool) ([]byte, error) {
 	if len(data) < protocol.ClientHelloMinimumSize {
 		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "CHLO too small")
 	}
@@ -223,19 +567,72 @@ func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map
 		return nil, err
 	}
 
-	var serverReply bytes.Buffer
-	WriteHandshakeMessage(&serverReply, TagREJ, map[Tag][]byte{
+	replyMap := map[Tag][]byte{
 		TagSCFG: h.scfg.Get(),
 		TagCERT: certCompressed,
 		TagPROF: proof,
 		TagSTK:  token,
-	})
+	}
+	// only send the SCTs if the client requested them, they can be quite large
+	if _, ok := cryptoData[TagCSCT]; ok {
+		sctList, err := h.scfg.GetSCTList(sni)
+		if err != nil {
+			return nil, err
+		}
+		if sctList != nil {
+			replyMap[TagCSCT] = sctList
+		}
+	}
+
+	if addressValidated {
+		var serverReply bytes.Buffer
+		WriteHandshakeMessage(&serverReply, TagREJ, replyMap)
+		return serverReply.Bytes(), nil
+	}
+
+	// The client's address is not validated yet, so the REJ must not exceed the anti-amplification limit.
+	// If it would, the certificate chain and the proof are omitted. The client then retries with the STK, and gets them in the next REJ.
+	h.unvalidatedBytesReceived += len(data)
+	var serverReply bytes.Buffer
+	WriteHandshakeMessage(&serverReply, TagREJ, replyMap)
+	if h.unvalidatedBytesSent+serverReply.Len() > protocol.MaxAmplificationFactor*h.unvalidatedBytesReceived {
+		utils.Infof("Omitting the certificate chain from the REJ for connection %x to %s, the address is not validated yet", h.connID, h.ip)
+		delete(replyMap, TagCERT)
+		delete(replyMap, TagPROF)
+		delete(replyMap, TagCSCT)
+		serverReply.Reset()
+		WriteHandshakeMessage(&serverReply, TagREJ, replyMap)
+	}
+	h.unvalidatedBytesSent += serverReply.Len()
 	return serverReply.Bytes(), nil
 }
 
 func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]byte) ([]byte, error) {
+	// Full CHLOs have to be padded as well, otherwise a client could skip the padding by never sending an inchoate CHLO
+	if len(data) < protocol.ClientHelloMinimumSize {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "CHLO too small")
+	}
+	cryptoData = h.resumeParameters(cryptoData)
+
+	// Check the connection parameters before doing any key exchange
+	if err := checkRequiredParameters(cryptoData); err != nil {
+		return nil, err
+	}
+	if err := checkAlgorithmLists(cryptoData); err != nil {
+		return nil, err
+	}
+
+	aead, err := selectAEAD(cryptoData[TagAEAD])
+	if err != nil {
+		return nil, err
+	}
+	kexAlg, err := h.scfg.selectKeyExchange(cryptoData[TagKEXS])
+	if err != nil {
+		return nil, err
+	}
+
 	// We have a CHLO matching our server config, we can continue with the 0-RTT handshake
-	sharedSecret, err := h.scfg.kex.CalculateSharedKey(cryptoData[TagPUBS])
+	sharedSecret, err := kexAlg.kex.CalculateSharedKey(cryptoData[TagPUBS])
 	if err != nil {
 		return nil, err
 	}
@@ -248,7 +645,11 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 		return nil, err
 	}
 
-	h.secureAEAD, err = h.keyDerivation(
+	keyDerivation := aead.keyDerivation
+	if h.keyDerivation != nil {
+		keyDerivation = h.keyDerivation
+	}
+	h.secureAEAD, err = keyDerivation(
 		h.version,
 		false,
 		sharedSecret,
@@ -267,15 +668,24 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 	var fsNonce bytes.Buffer
 	fsNonce.Write(cryptoData[TagNONC])
 	fsNonce.Write(h.nonce)
-	ephermalKex, err := h.keyExchange()
+	// the ephemeral curve25519 key exchanges may be taken from a pool
+	newEphemeralKex := kexAlg.newEphemeral
+	if bytes.Equal(kexAlg.tag, kexCurve25519) {
+		newEphemeralKex = h.keyExchange
+	}
+	ephermalKex, err := newEphemeralKex()
 	if err != nil {
 		return nil, err
 	}
+	// The ephemeral public key is sent in the SHLO. It must have the same length as the public key of the same algorithm in the server config.
+	if len(ephermalKex.PublicKey()) != len(kexAlg.kex.PublicKey()) {
+		return nil, qerr.Error(qerr.CryptoInternalError, fmt.Sprintf("ephemeral %s public key has length %d, expected %d", kexAlg.tag, len(ephermalKex.PublicKey()), len(kexAlg.kex.PublicKey())))
+	}
 	ephermalSharedSecret, err := ephermalKex.CalculateSharedKey(cryptoData[TagPUBS])
 	if err != nil {
 		return nil, err
 	}
-	h.forwardSecureAEAD, err = h.keyDerivation(h.version,
+	h.forwardSecureAEAD, err = keyDerivation(h.version,
 		true,
 		ephermalSharedSecret,
 		fsNonce.Bytes(),
@@ -293,24 +703,156 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 	if err != nil {
 		return nil, err
 	}
+	h.keyExchangeTag = kexAlg.tag
+	h.aeadTag = aead.tag
 
 	replyMap := h.connectionParametersManager.GetSHLOMap()
 	// add crypto parameters
+	replyMap[TagKEXS] = kexAlg.tag
 	replyMap[TagPUBS] = ephermalKex.PublicKey()
 	replyMap[TagSNO] = h.nonce
-	replyMap[TagVER] = protocol.SupportedVersionsAsTags
+	replyMap[TagVER] = h.scfg.supportedVersionsAsTags
+	if preferredAddress := h.scfg.PreferredAddress(); preferredAddress != nil {
+		replyMap[TagSPAD] = encodeSocketAddress(preferredAddress)
+	}
+	ticket, err := h.newResumptionTicket(cryptoData)
+	if err != nil {
+		return nil, err
+	}
+	if ticket != nil {
+		replyMap[TagRTKT] = ticket
+	}
 
 	var reply bytes.Buffer
 	WriteHandshakeMessage(&reply, TagSHLO, replyMap)
 
 	h.aeadChanged <- struct{}{}
+	close(h.forwardSecureAEADInstalled)
+	if h.scfg.tracer != nil {
+		h.scfg.tracer.KeysInstalled(h.connID, false)
+		h.scfg.tracer.KeysInstalled(h.connID, true)
+	}
 
 	return reply.Bytes(), nil
 }
 
+// checkAlgorithmLists checks that the client advertised at least one AEAD and one key exchange algorithm, if it sent these lists
+func checkAlgorithmLists(cryptoData map[Tag][]byte) error {
+	for _, tag := range []Tag{TagAEAD, TagKEXS} {
+		if list, ok := cryptoData[tag]; ok && len(list) == 0 {
+			return qerr.Error(qerr.CryptoMessageParameterNoOverlap, "empty "+tagToString(tag)+" list")
+		}
+	}
+	return nil
+}
+
+// resumeParameters adds the connection parameters stored in a resumption ticket, unless the client sent them again
+// Resumption only saves the client from repeating its connection parameters, it doesn't skip any part of the handshake:
+// the client still needs a valid STK, and does a full key exchange.
+// Invalid tickets are ignored, the client then has to send all parameters.
+func (h *CryptoSetup) resumeParameters(cryptoData map[Tag][]byte) map[Tag][]byte {
+	ticket, ok := cryptoData[TagRTKT]
+	if !ok || len(ticket) == 0 {
+		return cryptoData
+	}
+	state, err := h.scfg.ticketSource.OpenTicket(ticket, h.clock.Now())
+	if err != nil {
+		utils.Infof("Resumption ticket invalid for connection %x from %s: %s", h.connID, h.ip, err.Error())
+		return cryptoData
+	}
+	_, params, err := ParseHandshakeMessage(bytes.NewReader(state))
+	if err != nil {
+		return cryptoData
+	}
+
+	res := make(map[Tag][]byte, len(cryptoData)+len(params))
+	for _, tag := range resumableParameters {
+		if value, ok := params[tag]; ok {
+			res[tag] = value
+		}
+	}
+	for tag, value := range cryptoData {
+		res[tag] = value
+	}
+	return res
+}
+
+// newResumptionTicket stores the connection parameters sent by the client in a ticket
+// Tickets are only issued to clients that sent an RTKT, either an empty one to ask for a ticket, or the ticket they resumed from.
+// It returns nil if the client didn't ask for a ticket.
+func (h *CryptoSetup) newResumptionTicket(cryptoData map[Tag][]byte) ([]byte, error) {
+	if _, ok := cryptoData[TagRTKT]; !ok {
+		return nil, nil
+	}
+	params := make(map[Tag][]byte)
+	for _, tag := range resumableParameters {
+		if value, ok := cryptoData[tag]; ok {
+			params[tag] = value
+		}
+	}
+	var state bytes.Buffer
+	WriteHandshakeMessage(&state, TagRTKT, params)
+	return h.scfg.ticketSource.NewTicket(state.Bytes(), h.clock.Now())
+}
+
+// ForwardSecureAEADInstalled returns a channel that is closed once the forward secure AEAD is installed.
+// It is not used for sealing packets until the first forward secure packet was received.
+func (h *CryptoSetup) ForwardSecureAEADInstalled() <-chan struct{} {
+	return h.forwardSecureAEADInstalled
+}
+
+// ForwardSecurePacketReceived returns a channel that is closed once the first forward secure packet was decrypted.
+// From then on, all packets are sealed with the forward secure AEAD.
+func (h *CryptoSetup) ForwardSecurePacketReceived() <-chan struct{} {
+	return h.forwardSecurePacketReceived
+}
+
+// HandshakeState returns the current state of the handshake
+func (h *CryptoSetup) HandshakeState() HandshakeState {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.handshakeState()
+}
+
+// handshakeState returns the current state of the handshake. The caller must hold the mutex.
+func (h *CryptoSetup) handshakeState() HandshakeState {
+	if h.receivedForwardSecurePacket {
+		return HandshakeStateForwardSecure
+	}
+	if h.secureAEAD != nil {
+		return HandshakeStateSecure
+	}
+	return HandshakeStateUnencrypted
+}
+
+// NegotiatedParameters returns a snapshot of the parameters negotiated for the connection
+func (h *CryptoSetup) NegotiatedParameters() NegotiatedParameters {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	params := NegotiatedParameters{
+		ConnectionID:         h.connID,
+		Version:              h.version,
+		HandshakeState:       h.handshakeState(),
+		ServerNonce:          h.nonce,
+		IdleTimeout:          h.connectionParametersManager.GetIdleTimeout(),
+		MaxIncomingStreams:   h.connectionParametersManager.GetMaxIncomingStreams(),
+		MaxOutgoingStreams:   h.connectionParametersManager.GetMaxOutgoingStreams(),
+		TruncateConnectionID: h.connectionParametersManager.TruncateConnectionID(),
+	}
+	if h.forwardSecureAEAD != nil {
+		params.KeyExchange = string(h.keyExchangeTag)
+		params.AEAD = string(h.aeadTag)
+	}
+	if protocol.VersionUsesDiversificationNonce(h.version) {
+		params.DiversificationNonce = h.diversificationNonce
+	}
+	return params
+}
+
 // DiversificationNonce returns a diversification nonce if required in the next packet to be Seal'ed
 func (h *CryptoSetup) DiversificationNonce() []byte {
-	if h.version < protocol.VersionNumber(33) {
+	if !protocol.VersionUsesDiversificationNonce(h.version) {
 		return nil
 	}
 	if h.receivedForwardSecurePacket || h.secureAEAD == nil {
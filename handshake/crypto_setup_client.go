@@ -0,0 +1,420 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// CryptoSetupClient performs the client side of the crypto handshake
+// It sends an inchoate CHLO, verifies the server's proof in the REJ, and then sends a full CHLO.
+// Like the server's CryptoSetup, it is used as the AEAD for all packets of the connection.
+type CryptoSetupClient struct {
+	mutex sync.RWMutex
+
+	hostname     string
+	connID       protocol.ConnectionID
+	version      protocol.VersionNumber
+	cryptoStream utils.Stream
+	// the versions listed in the version negotiation packet we received, nil if there was no version negotiation
+	negotiatedVersions []protocol.VersionNumber
+
+	proofVerifier               crypto.ProofVerifier
+	connectionParametersManager *ConnectionParametersManager
+
+	// the values received in the last REJ
+	stk          []byte
+	sno          []byte
+	serverConfig *serverConfigClient
+	certChain    [][]byte
+	aead         *aeadAlgorithm
+
+	lastSentCHLO []byte
+	nonc         []byte
+	// the full CHLO the keys are derived from
+	fullCHLO             []byte
+	diversificationNonce []byte
+
+	secureAEAD                  crypto.AEAD
+	forwardSecureAEAD           crypto.AEAD
+	receivedSecurePacket        bool
+	receivedForwardSecurePacket bool
+	aeadChanged                 chan struct{}
+
+	// if set, it is used instead of the key derivation of the selected AEAD
+	keyDerivation KeyDerivationFunction
+	keyExchange   KeyExchangeFunction
+	rand          io.Reader
+}
+
+var _ crypto.AEAD = &CryptoSetupClient{}
+
+// NewCryptoSetupClient creates a new CryptoSetupClient
+// The certificate chain sent by the server is verified for the hostname by the proofVerifier.
+// If the version was chosen from a version negotiation packet, negotiatedVersions are the versions it listed.
+func NewCryptoSetupClient(
+	hostname string,
+	connID protocol.ConnectionID,
+	version protocol.VersionNumber,
+	negotiatedVersions []protocol.VersionNumber,
+	cryptoStream utils.Stream,
+	proofVerifier crypto.ProofVerifier,
+	connectionParametersManager *ConnectionParametersManager,
+	aeadChanged chan struct{},
+) *CryptoSetupClient {
+	return &CryptoSetupClient{
+		hostname:                    hostname,
+		connID:                      connID,
+		version:                     version,
+		negotiatedVersions:          negotiatedVersions,
+		cryptoStream:                cryptoStream,
+		proofVerifier:               proofVerifier,
+		connectionParametersManager: connectionParametersManager,
+		aeadChanged:                 aeadChanged,
+		keyExchange:                 crypto.NewCurve25519KEX,
+		rand:                        rand.Reader,
+	}
+}
+
+// HandleCryptoStream sends CHLOs and handles the server's REJs, until the handshake is completed by the SHLO
+func (h *CryptoSetupClient) HandleCryptoStream() error {
+	for numCHLOs := 1; ; numCHLOs++ {
+		if numCHLOs > protocol.MaxClientHellos {
+			return qerr.Error(qerr.CryptoTooManyRejects, fmt.Sprintf("more than %d REJs", protocol.MaxClientHellos))
+		}
+		if err := h.sendCHLO(); err != nil {
+			return err
+		}
+
+		messageTag, cryptoData, err := ParseHandshakeMessage(h.cryptoStream)
+		if err != nil {
+			return err
+		}
+		switch messageTag {
+		case TagREJ:
+			utils.Infof("Got REJ for connection %x:\n%s", h.connID, printHandshakeMessage(cryptoData))
+			if err := h.handleREJMessage(cryptoData); err != nil {
+				return err
+			}
+		case TagSHLO:
+			utils.Infof("Got SHLO for connection %x:\n%s", h.connID, printHandshakeMessage(cryptoData))
+			return h.handleSHLOMessage(cryptoData)
+		default:
+			return qerr.InvalidCryptoMessageType
+		}
+	}
+}
+
+func (h *CryptoSetupClient) handleREJMessage(cryptoData map[Tag][]byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if stk, ok := cryptoData[TagSTK]; ok {
+		h.stk = stk
+	}
+	if sno, ok := cryptoData[TagSNO]; ok {
+		h.sno = sno
+	}
+
+	scfg := h.serverConfig
+	aead := h.aead
+	if scfgData, ok := cryptoData[TagSCFG]; ok {
+		var err error
+		scfg, err = parseServerConfig(scfgData, h.keyExchange)
+		if err != nil {
+			return err
+		}
+		if scfg.isExpired() {
+			return qerr.CryptoServerConfigExpired
+		}
+		aead, err = scfg.selectAEAD()
+		if err != nil {
+			return err
+		}
+	}
+	if scfg == nil {
+		return qerr.Error(qerr.CryptoMessageParameterNotFound, "SCFG missing")
+	}
+
+	if certData, ok := cryptoData[TagCERT]; ok {
+		chain, err := crypto.DecompressChain(certData)
+		if err != nil {
+			return qerr.Error(qerr.InvalidCryptoMessageParameter, err.Error())
+		}
+		h.certChain = chain
+	}
+	proof, ok := cryptoData[TagPROF]
+	if !ok {
+		// Before our address is validated, the server omits the certificate chain and the proof if they exceed the anti-amplification limit.
+		// We retry with the STK, and only use the server config once its proof was verified.
+		if _, hasSTK := cryptoData[TagSTK]; hasSTK && cryptoData[TagCERT] == nil {
+			utils.Infof("REJ for connection %x without a proof, retrying with the STK", h.connID)
+			return nil
+		}
+		return qerr.Error(qerr.CryptoMessageParameterNotFound, "PROF missing")
+	}
+	// the proof signs the CHLO that caused the REJ
+	var chloOrNil []byte
+	if h.version > protocol.VersionNumber(30) {
+		chloOrNil = h.lastSentCHLO
+	}
+	if err := h.proofVerifier.VerifyProof(h.hostname, chloOrNil, scfg.raw, h.certChain, proof); err != nil {
+		utils.Infof("Invalid server proof for connection %x: %s", h.connID, err.Error())
+		return qerr.ProofInvalid
+	}
+	h.serverConfig = scfg
+	h.aead = aead
+	return nil
+}
+
+func (h *CryptoSetupClient) handleSHLOMessage(cryptoData map[Tag][]byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.receivedSecurePacket {
+		return qerr.Error(qerr.CryptoEncryptionLevelIncorrect, "unencrypted SHLO message")
+	}
+	serverPubs, ok := cryptoData[TagPUBS]
+	if !ok {
+		return qerr.Error(qerr.CryptoMessageParameterNotFound, "PUBS missing")
+	}
+	sno, ok := cryptoData[TagSNO]
+	if !ok {
+		return qerr.Error(qerr.CryptoMessageParameterNotFound, "SNO missing")
+	}
+
+	if err := h.validateVersionList(cryptoData[TagVER]); err != nil {
+		return err
+	}
+
+	ephermalSharedSecret, err := h.serverConfig.kex.CalculateSharedKey(serverPubs)
+	if err != nil {
+		return err
+	}
+	var fsNonce bytes.Buffer
+	fsNonce.Write(h.nonc)
+	fsNonce.Write(sno)
+	h.forwardSecureAEAD, err = h.getKeyDerivation()(
+		h.version,
+		true,
+		ephermalSharedSecret,
+		fsNonce.Bytes(),
+		h.connID,
+		h.fullCHLO,
+		h.serverConfig.raw,
+		h.certChain[0],
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := h.connectionParametersManager.SetFromMap(cryptoData); err != nil {
+		return qerr.InvalidCryptoMessageParameter
+	}
+	h.notifyAEADChanged()
+	return nil
+}
+
+// validateVersionList detects version downgrade attacks
+// A man-in-the-middle could remove versions from the version negotiation packet. The server lists its versions in the SHLO
+// as well, where they are protected by the encryption, so they must lead to the same version.
+func (h *CryptoSetupClient) validateVersionList(verTags []byte) error {
+	if len(h.negotiatedVersions) == 0 {
+		return nil
+	}
+	if len(verTags) == 0 || len(verTags)%4 != 0 {
+		return qerr.Error(qerr.InvalidCryptoMessageParameter, "invalid VER")
+	}
+	serverVersions := make([]protocol.VersionNumber, 0, len(verTags)/4)
+	for i := 0; i < len(verTags); i += 4 {
+		serverVersions = append(serverVersions, protocol.VersionTagToNumber(binary.LittleEndian.Uint32(verTags[i:i+4])))
+	}
+	if v, ok := protocol.ChooseSupportedVersion(protocol.SupportedVersions, serverVersions); !ok || v != h.version {
+		return qerr.Error(qerr.VersionNegotiationMismatch, "downgrade attack detected")
+	}
+	return nil
+}
+
+func (h *CryptoSetupClient) sendCHLO() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	tags, err := h.getTags()
+	if err != nil {
+		return err
+	}
+	var chlo bytes.Buffer
+	WriteHandshakeMessage(&chlo, TagCHLO, tags)
+	// pad the CHLO to the minimum size the server expects
+	// Every tag adds 8 bytes to the index, so the PAD tag itself has to be taken into account.
+	if padding := protocol.ClientHelloMinimumSize - chlo.Len() - 8; padding > 0 {
+		tags[TagPAD] = bytes.Repeat([]byte{'-'}, padding)
+		chlo.Reset()
+		WriteHandshakeMessage(&chlo, TagCHLO, tags)
+	}
+	h.lastSentCHLO = chlo.Bytes()
+
+	if h.serverConfig != nil {
+		// this is a full CHLO, the keys are derived from it
+		h.fullCHLO = h.lastSentCHLO
+		if err := h.maybeDeriveSecureAEAD(); err != nil {
+			return err
+		}
+	}
+	utils.Infof("Sending CHLO for connection %x:\n%s", h.connID, printHandshakeMessage(tags))
+	_, err = h.cryptoStream.Write(h.lastSentCHLO)
+	return err
+}
+
+func (h *CryptoSetupClient) getTags() (map[Tag][]byte, error) {
+	tags := h.connectionParametersManager.GetSHLOMap()
+	tags[TagSNI] = []byte(h.hostname)
+	versionTag := make([]byte, 4)
+	binary.LittleEndian.PutUint32(versionTag, protocol.VersionNumberToTag(h.version))
+	tags[TagVER] = versionTag
+	if h.stk != nil {
+		tags[TagSTK] = h.stk
+	}
+	if h.serverConfig == nil {
+		return tags, nil
+	}
+
+	// a full CHLO
+	nonc, err := h.generateClientNonce()
+	if err != nil {
+		return nil, err
+	}
+	h.nonc = nonc
+	tags[TagSCID] = h.serverConfig.ID
+	tags[TagNONC] = h.nonc
+	tags[TagKEXS] = kexCurve25519
+	tags[TagAEAD] = h.aead.tag
+	tags[TagPUBS] = h.serverConfig.kex.PublicKey()
+	if h.sno != nil {
+		tags[TagSNO] = h.sno
+	}
+	return tags, nil
+}
+
+// generateClientNonce generates the NONC sent in the full CHLO
+// It consists of the current time (4 bytes), the server's orbit (8 bytes) and 20 random bytes.
+func (h *CryptoSetupClient) generateClientNonce() ([]byte, error) {
+	nonc := make([]byte, 32)
+	binary.BigEndian.PutUint32(nonc, uint32(time.Now().Unix()))
+	copy(nonc[4:12], h.serverConfig.obit)
+	if _, err := io.ReadFull(h.rand, nonc[12:]); err != nil {
+		return nil, err
+	}
+	return nonc, nil
+}
+
+// maybeDeriveSecureAEAD derives the initial keys after the full CHLO was sent
+// For version 33 and later, the server's keys are diversified, so we have to wait for the diversification nonce.
+func (h *CryptoSetupClient) maybeDeriveSecureAEAD() error {
+	if h.secureAEAD != nil || h.fullCHLO == nil {
+		return nil
+	}
+	if protocol.VersionUsesDiversificationNonce(h.version) && h.diversificationNonce == nil {
+		return nil
+	}
+	var err error
+	h.secureAEAD, err = h.getKeyDerivation()(
+		h.version,
+		false,
+		h.serverConfig.sharedSecret,
+		h.nonc,
+		h.connID,
+		h.fullCHLO,
+		h.serverConfig.raw,
+		h.certChain[0],
+		h.diversificationNonce,
+	)
+	if err != nil {
+		return err
+	}
+	h.notifyAEADChanged()
+	return nil
+}
+
+func (h *CryptoSetupClient) getKeyDerivation() KeyDerivationFunction {
+	if h.keyDerivation != nil {
+		return h.keyDerivation
+	}
+	return h.aead.clientKeyDerivation
+}
+
+// notifyAEADChanged notifies the session that new keys are available, without blocking if a notification is still pending
+func (h *CryptoSetupClient) notifyAEADChanged() {
+	select {
+	case h.aeadChanged <- struct{}{}:
+	default:
+	}
+}
+
+// SetDiversificationNonce sets the diversification nonce the server sent in the public header
+// Starting with version 33, it is needed to derive the server's initial keys.
+func (h *CryptoSetupClient) SetDiversificationNonce(divNonce []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.diversificationNonce != nil {
+		if !bytes.Equal(h.diversificationNonce, divNonce) {
+			return qerr.Error(qerr.InvalidCryptoMessageParameter, "received two different diversification nonces")
+		}
+		return nil
+	}
+	h.diversificationNonce = divNonce
+	return h.maybeDeriveSecureAEAD()
+}
+
+// Open a message
+func (h *CryptoSetupClient) Open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.forwardSecureAEAD != nil {
+		if res, err := h.forwardSecureAEAD.Open(packetNumber, associatedData, ciphertext); err == nil {
+			h.receivedForwardSecurePacket = true
+			return res, nil
+		}
+	}
+	if h.secureAEAD != nil {
+		if res, err := h.secureAEAD.Open(packetNumber, associatedData, ciphertext); err == nil {
+			h.receivedSecurePacket = true
+			return res, nil
+		}
+	}
+	res, err := (&crypto.NullAEAD{}).Open(packetNumber, associatedData, ciphertext)
+	if err != nil {
+		return nil, qerr.DecryptionFailure
+	}
+	return res, nil
+}
+
+// Seal a message, with the best keys available
+func (h *CryptoSetupClient) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if h.forwardSecureAEAD != nil {
+		return h.forwardSecureAEAD.Seal(packetNumber, associatedData, plaintext)
+	} else if h.secureAEAD != nil {
+		return h.secureAEAD.Seal(packetNumber, associatedData, plaintext)
+	}
+	return (&crypto.NullAEAD{}).Seal(packetNumber, associatedData, plaintext)
+}
+
+// DiversificationNonce is only sent by servers, so it always returns nil
+func (h *CryptoSetupClient) DiversificationNonce() []byte {
+	return nil
+}
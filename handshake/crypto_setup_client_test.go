@@ -0,0 +1,533 @@
+package handshake
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type mockProofVerifier struct {
+	err error
+
+	hostname string
+	chlo     []byte
+	scfg     []byte
+	chain    [][]byte
+	proof    []byte
+}
+
+func (v *mockProofVerifier) VerifyProof(hostname string, chlo []byte, serverConfigData []byte, chain [][]byte, proof []byte) error {
+	v.hostname = hostname
+	v.chlo = chlo
+	v.scfg = serverConfigData
+	v.chain = chain
+	v.proof = proof
+	return v.err
+}
+
+// compressCert compresses a single certificate, the way a server does if the client doesn't have any common or cached certificates
+func compressCert(cert []byte) []byte {
+	var uncompressed bytes.Buffer
+	binary.Write(&uncompressed, binary.LittleEndian, uint32(len(cert)))
+	uncompressed.Write(cert)
+	res := bytes.NewBuffer([]byte{1, 0})
+	binary.Write(res, binary.LittleEndian, uint32(uncompressed.Len()))
+	gz := zlib.NewWriter(res)
+	gz.Write(uncompressed.Bytes())
+	gz.Close()
+	return res.Bytes()
+}
+
+func getServerConfigData(tags map[Tag][]byte) []byte {
+	var b bytes.Buffer
+	WriteHandshakeMessage(&b, TagSCFG, tags)
+	return b.Bytes()
+}
+
+func getValidServerConfigTags() map[Tag][]byte {
+	return map[Tag][]byte{
+		TagSCID: bytes.Repeat([]byte{0x13}, 16),
+		TagKEXS: []byte("C255"),
+		TagAEAD: []byte("AESGCC20"),
+		TagPUBS: append([]byte{0x20, 0, 0}, bytes.Repeat([]byte{0x42}, 32)...),
+		TagOBIT: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+		TagEXPY: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	}
+}
+
+var _ = Describe("Client Crypto Setup", func() {
+	var (
+		cs            *CryptoSetupClient
+		stream        *mockStream
+		verifier      *mockProofVerifier
+		aeadChanged   chan struct{}
+		scfgTags      map[Tag][]byte
+		rej           map[Tag][]byte
+		derivedKeys   []bool
+		derivedChlo   [][]byte
+		derivedNonces [][]byte
+		derivedDiv    [][]byte
+	)
+
+	recordingKeyDerivation := func(v protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (crypto.AEAD, error) {
+		derivedKeys = append(derivedKeys, forwardSecure)
+		derivedChlo = append(derivedChlo, chlo)
+		derivedNonces = append(derivedNonces, nonces)
+		derivedDiv = append(derivedDiv, divNonce)
+		Expect(cert).To(Equal([]byte("leaf cert")))
+		return &mockAEAD{forwardSecure: forwardSecure, sharedSecret: sharedSecret}, nil
+	}
+
+	writeMessage := func(tag Tag, data map[Tag][]byte) {
+		WriteHandshakeMessage(&stream.dataToRead, tag, data)
+	}
+
+	readCHLOs := func() []map[Tag][]byte {
+		var chlos []map[Tag][]byte
+		r := bytes.NewReader(stream.dataWritten.Bytes())
+		for r.Len() > 0 {
+			tag, msg, err := ParseHandshakeMessage(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag).To(Equal(TagCHLO))
+			chlos = append(chlos, msg)
+		}
+		return chlos
+	}
+
+	BeforeEach(func() {
+		derivedKeys = nil
+		derivedChlo = nil
+		derivedNonces = nil
+		derivedDiv = nil
+		stream = &mockStream{}
+		verifier = &mockProofVerifier{}
+		aeadChanged = make(chan struct{}, 1)
+		scfgTags = getValidServerConfigTags()
+		rej = map[Tag][]byte{
+			TagSCFG: getServerConfigData(scfgTags),
+			TagCERT: compressCert([]byte("leaf cert")),
+			TagPROF: []byte("proof"),
+			TagSTK:  []byte("stk"),
+			TagSNO:  []byte("server nonce"),
+		}
+		cs = NewCryptoSetupClient("quic.clemente.io", 42, protocol.VersionNumber(32), nil, stream, verifier, NewConnectionParamatersManager(), aeadChanged)
+		cs.keyDerivation = recordingKeyDerivation
+		cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{}, nil }
+	})
+
+	Context("sending CHLOs", func() {
+		It("sends an inchoate CHLO padded to the minimum size", func() {
+			err := cs.HandleCryptoStream()
+			Expect(err).To(HaveOccurred()) // there's nothing to read
+			Expect(stream.dataWritten.Len()).To(Equal(protocol.ClientHelloMinimumSize))
+			chlos := readCHLOs()
+			Expect(chlos).To(HaveLen(1))
+			Expect(chlos[0]).To(HaveKeyWithValue(TagSNI, []byte("quic.clemente.io")))
+			Expect(chlos[0]).To(HaveKeyWithValue(TagVER, []byte("Q032")))
+			Expect(chlos[0]).To(HaveKey(TagICSL))
+			Expect(chlos[0]).ToNot(HaveKey(TagSCID))
+			Expect(chlos[0]).ToNot(HaveKey(TagNONC))
+		})
+
+		It("sends a full CHLO after receiving a REJ", func() {
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			chlos := readCHLOs()
+			Expect(chlos).To(HaveLen(2))
+			full := chlos[1]
+			Expect(full).To(HaveKeyWithValue(TagSCID, scfgTags[TagSCID]))
+			Expect(full).To(HaveKeyWithValue(TagSTK, []byte("stk")))
+			Expect(full).To(HaveKeyWithValue(TagSNO, []byte("server nonce")))
+			Expect(full).To(HaveKeyWithValue(TagKEXS, []byte("C255")))
+			Expect(full).To(HaveKeyWithValue(TagPUBS, []byte("initial pubs")))
+			// we prefer ChaCha20-Poly1305
+			Expect(full).To(HaveKeyWithValue(TagAEAD, []byte("CC20")))
+			Expect(full[TagNONC]).To(HaveLen(32))
+			Expect(full[TagNONC][4:12]).To(Equal(scfgTags[TagOBIT]))
+			timestamp := time.Unix(int64(binary.BigEndian.Uint32(full[TagNONC][:4])), 0)
+			Expect(timestamp).To(BeTemporally("~", time.Now(), 2*time.Second))
+		})
+
+		It("errors after too many REJs", func() {
+			for i := 0; i < protocol.MaxClientHellos; i++ {
+				writeMessage(TagREJ, rej)
+			}
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoTooManyRejects, "more than 4 REJs")))
+			Expect(readCHLOs()).To(HaveLen(protocol.MaxClientHellos))
+		})
+
+		It("errors on unexpected messages", func() {
+			writeMessage(TagCHLO, map[Tag][]byte{})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.InvalidCryptoMessageType))
+		})
+	})
+
+	Context("handling REJs", func() {
+		It("verifies the proof", func() {
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			Expect(verifier.hostname).To(Equal("quic.clemente.io"))
+			Expect(verifier.scfg).To(Equal(rej[TagSCFG]))
+			Expect(verifier.chain).To(Equal([][]byte{[]byte("leaf cert")}))
+			Expect(verifier.proof).To(Equal([]byte("proof")))
+			// the proof signs the inchoate CHLO
+			Expect(verifier.chlo).To(HaveLen(protocol.ClientHelloMinimumSize))
+		})
+
+		It("doesn't pass the CHLO to the verifier for version 30", func() {
+			cs.version = protocol.VersionNumber(30)
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			Expect(verifier.proof).To(Equal([]byte("proof")))
+			Expect(verifier.chlo).To(BeNil())
+		})
+
+		It("errors if the proof is invalid", func() {
+			verifier.err = errors.New("invalid signature")
+			writeMessage(TagREJ, rej)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.ProofInvalid))
+		})
+
+		It("errors if the PROF is missing", func() {
+			delete(rej, TagPROF)
+			writeMessage(TagREJ, rej)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoMessageParameterNotFound, "PROF missing")))
+		})
+
+		It("retries with the STK if the REJ omits the certificate chain and the proof", func() {
+			writeMessage(TagREJ, map[Tag][]byte{TagSCFG: rej[TagSCFG], TagSTK: []byte("stk")})
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			chlos := readCHLOs()
+			Expect(chlos).To(HaveLen(3))
+			// the server config is only used after its proof was verified
+			Expect(chlos[1]).To(HaveKeyWithValue(TagSTK, []byte("stk")))
+			Expect(chlos[1]).ToNot(HaveKey(TagSCID))
+			Expect(chlos[2]).To(HaveKeyWithValue(TagSCID, scfgTags[TagSCID]))
+			// the proof signs the CHLO sent with the STK
+			_, verifiedCHLO, err := ParseHandshakeMessage(bytes.NewReader(verifier.chlo))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(verifiedCHLO).To(HaveKeyWithValue(TagSTK, []byte("stk")))
+		})
+
+		It("errors if the PROF is missing from a REJ without an STK", func() {
+			writeMessage(TagREJ, map[Tag][]byte{TagSCFG: rej[TagSCFG]})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoMessageParameterNotFound, "PROF missing")))
+		})
+
+		It("errors if the SCFG is missing", func() {
+			delete(rej, TagSCFG)
+			writeMessage(TagREJ, rej)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoMessageParameterNotFound, "SCFG missing")))
+		})
+
+		It("rejects expired server configs", func() {
+			scfgTags[TagEXPY] = []byte{0x1, 0, 0, 0, 0, 0, 0, 0}
+			rej[TagSCFG] = getServerConfigData(scfgTags)
+			writeMessage(TagREJ, rej)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.CryptoServerConfigExpired))
+		})
+
+		It("errors on invalid CERTs", func() {
+			rej[TagCERT] = []byte{2, 0}
+			writeMessage(TagREJ, rej)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.Error(qerr.InvalidCryptoMessageParameter, "cert decompression: cached certificates are not supported")))
+		})
+	})
+
+	Context("deriving keys", func() {
+		It("derives the initial keys when sending the full CHLO, for versions before 33", func() {
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			Expect(derivedKeys).To(Equal([]bool{false}))
+			chlos := readCHLOs()
+			Expect(derivedNonces[0]).To(Equal(chlos[1][TagNONC]))
+			var fullCHLO bytes.Buffer
+			WriteHandshakeMessage(&fullCHLO, TagCHLO, chlos[1])
+			Expect(derivedChlo[0]).To(Equal(fullCHLO.Bytes()))
+			Expect(cs.secureAEAD).ToNot(BeNil())
+			Expect(aeadChanged).To(Receive())
+			Expect(cs.Seal(0, []byte{}, []byte{})).To(Equal([]byte("encrypted")))
+		})
+
+		It("waits for the diversification nonce, for version 33", func() {
+			cs.version = protocol.VersionNumber(33)
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			Expect(derivedKeys).To(BeEmpty())
+			Expect(cs.secureAEAD).To(BeNil())
+			divNonce := bytes.Repeat([]byte{'d'}, 32)
+			err := cs.SetDiversificationNonce(divNonce)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivedKeys).To(Equal([]bool{false}))
+			Expect(derivedDiv[0]).To(Equal(divNonce))
+			Expect(aeadChanged).To(Receive())
+		})
+
+		It("doesn't derive keys when receiving a diversification nonce before the full CHLO", func() {
+			err := cs.SetDiversificationNonce(bytes.Repeat([]byte{'d'}, 32))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivedKeys).To(BeEmpty())
+		})
+
+		It("errors if the diversification nonce changes", func() {
+			err := cs.SetDiversificationNonce(bytes.Repeat([]byte{'d'}, 32))
+			Expect(err).ToNot(HaveOccurred())
+			err = cs.SetDiversificationNonce(bytes.Repeat([]byte{'d'}, 32))
+			Expect(err).ToNot(HaveOccurred())
+			err = cs.SetDiversificationNonce(bytes.Repeat([]byte{'e'}, 32))
+			Expect(err).To(MatchError(qerr.Error(qerr.InvalidCryptoMessageParameter, "received two different diversification nonces")))
+		})
+	})
+
+	Context("handling SHLOs", func() {
+		var shlo map[Tag][]byte
+
+		BeforeEach(func() {
+			shlo = map[Tag][]byte{
+				TagPUBS: []byte("server ephermal pubs"),
+				TagSNO:  []byte("fs server nonce"),
+				TagICSL: []byte{13, 0, 0, 0},
+			}
+			writeMessage(TagREJ, rej)
+			cs.HandleCryptoStream()
+			Expect(aeadChanged).To(Receive())
+		})
+
+		It("rejects unencrypted SHLOs", func() {
+			err := cs.handleSHLOMessage(shlo)
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoEncryptionLevelIncorrect, "unencrypted SHLO message")))
+			Expect(cs.forwardSecureAEAD).To(BeNil())
+		})
+
+		It("derives the forward secure keys", func() {
+			_, err := cs.Open(0, []byte{}, []byte("encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			err = cs.handleSHLOMessage(shlo)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivedKeys).To(Equal([]bool{false, true}))
+			Expect(derivedNonces[1]).To(Equal(append(append([]byte{}, cs.nonc...), []byte("fs server nonce")...)))
+			Expect(derivedDiv[1]).To(BeNil())
+			Expect(aeadChanged).To(Receive())
+			Expect(cs.Seal(0, []byte{}, []byte{})).To(Equal([]byte("forward secure encrypted")))
+		})
+
+		It("applies the connection parameters", func() {
+			cs.Open(0, []byte{}, []byte("encrypted"))
+			err := cs.handleSHLOMessage(shlo)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.connectionParametersManager.GetIdleTimeout()).To(Equal(13 * time.Second))
+		})
+
+		Context("version downgrade detection", func() {
+			BeforeEach(func() {
+				cs.Open(0, []byte{}, []byte("encrypted"))
+				// the client chose version 32 from a version negotiation packet
+				cs.negotiatedVersions = []protocol.VersionNumber{30, 31, 32}
+			})
+
+			It("accepts a VER list leading to the same version", func() {
+				shlo[TagVER] = protocol.VersionsAsTags([]protocol.VersionNumber{30, 31, 32})
+				Expect(cs.handleSHLOMessage(shlo)).To(Succeed())
+			})
+
+			It("detects a downgrade if the VER list leads to a different version", func() {
+				shlo[TagVER] = protocol.VersionsAsTags([]protocol.VersionNumber{30, 31, 32, 33})
+				err := cs.handleSHLOMessage(shlo)
+				Expect(err).To(MatchError(qerr.Error(qerr.VersionNegotiationMismatch, "downgrade attack detected")))
+				Expect(cs.forwardSecureAEAD).To(BeNil())
+			})
+
+			It("errors if the VER list is missing", func() {
+				delete(shlo, TagVER)
+				err := cs.handleSHLOMessage(shlo)
+				Expect(err).To(MatchError(qerr.Error(qerr.InvalidCryptoMessageParameter, "invalid VER")))
+			})
+
+			It("doesn't check the VER list if there was no version negotiation", func() {
+				cs.negotiatedVersions = nil
+				shlo[TagVER] = protocol.VersionsAsTags([]protocol.VersionNumber{30, 31, 32, 33})
+				Expect(cs.handleSHLOMessage(shlo)).To(Succeed())
+			})
+		})
+
+		It("errors if the PUBS is missing", func() {
+			cs.Open(0, []byte{}, []byte("encrypted"))
+			delete(shlo, TagPUBS)
+			err := cs.handleSHLOMessage(shlo)
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoMessageParameterNotFound, "PUBS missing")))
+		})
+	})
+
+	Context("handshake with the server", func() {
+		// runHandshake runs the handshake between a client and a server crypto setup, and returns the server's SHLO
+		runHandshake := func(client *CryptoSetupClient, clientStream *mockStream, server *CryptoSetup, serverStream *mockStream) map[Tag][]byte {
+			for {
+				Expect(client.sendCHLO()).To(Succeed())
+				chloData := append([]byte{}, clientStream.dataWritten.Bytes()...)
+				clientStream.dataWritten.Reset()
+				_, chlo, err := ParseHandshakeMessage(bytes.NewReader(chloData))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = server.handleMessage(chloData, chlo)
+				Expect(err).ToNot(HaveOccurred())
+				tag, reply, err := ParseHandshakeMessage(&serverStream.dataWritten)
+				Expect(err).ToNot(HaveOccurred())
+				if tag == TagSHLO {
+					return reply
+				}
+				Expect(tag).To(Equal(TagREJ))
+				Expect(client.handleREJMessage(reply)).To(Succeed())
+			}
+		}
+
+		for _, v := range []protocol.VersionNumber{32, 33} {
+			version := v
+
+			It(fmt.Sprintf("derives the same keys as the server, for version %d", version), func() {
+				kex, err := crypto.NewCurve25519KEX()
+				Expect(err).ToNot(HaveOccurred())
+				signer := &mockSigner{certsCompressed: compressCert([]byte("certuncompressed"))}
+				scfg, err := NewServerConfig(kex, signer)
+				Expect(err).ToNot(HaveOccurred())
+				scfg.stkSource = &mockStkSource{}
+				serverStream := &mockStream{}
+				server, err := NewCryptoSetup(42, net.ParseIP("1.2.3.4"), version, scfg, serverStream, NewConnectionParamatersManager(), make(chan struct{}, 2))
+				Expect(err).ToNot(HaveOccurred())
+				clientStream := &mockStream{}
+				client := NewCryptoSetupClient("quic.clemente.io", 42, version, nil, clientStream, &mockProofVerifier{}, NewConnectionParamatersManager(), make(chan struct{}, 2))
+
+				shlo := runHandshake(client, clientStream, server, serverStream)
+
+				// the initial keys
+				if version >= protocol.VersionNumber(33) {
+					Expect(client.SetDiversificationNonce(server.DiversificationNonce())).To(Succeed())
+				}
+				sealed := server.Seal(1, []byte("header"), []byte("initial"))
+				opened, err := client.Open(1, []byte("header"), sealed)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(opened).To(Equal([]byte("initial")))
+				// the forward secure keys
+				Expect(client.handleSHLOMessage(shlo)).To(Succeed())
+				sealed = client.Seal(2, []byte("header"), []byte("forward secure"))
+				opened, err = server.Open(2, []byte("header"), sealed)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(opened).To(Equal([]byte("forward secure")))
+				Expect(server.HandshakeState()).To(Equal(HandshakeStateForwardSecure))
+			})
+		}
+	})
+
+	Context("encryption", func() {
+		It("is initially unencrypted", func() {
+			enc := cs.Seal(0, []byte{}, []byte("foobar"))
+			Expect(enc).To(Equal((&crypto.NullAEAD{}).Seal(0, []byte{}, []byte("foobar"))))
+			d, err := cs.Open(0, []byte{}, enc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d).To(Equal([]byte("foobar")))
+		})
+
+		It("errors if a packet can't be decrypted", func() {
+			_, err := cs.Open(0, []byte{}, []byte("not a valid packet"))
+			Expect(err).To(MatchError(qerr.DecryptionFailure))
+		})
+
+		It("notes which keys were used for received packets", func() {
+			cs.secureAEAD = &mockAEAD{}
+			cs.forwardSecureAEAD = &mockAEAD{forwardSecure: true}
+			_, err := cs.Open(0, []byte{}, []byte("encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.receivedSecurePacket).To(BeTrue())
+			Expect(cs.receivedForwardSecurePacket).To(BeFalse())
+			_, err = cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.receivedForwardSecurePacket).To(BeTrue())
+		})
+
+		It("never sends a diversification nonce", func() {
+			Expect(cs.DiversificationNonce()).To(BeNil())
+		})
+	})
+
+	Context("parsing server configs", func() {
+		It("parses a server config", func() {
+			scfg, err := parseServerConfig(rej[TagSCFG], cs.keyExchange)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scfg.raw).To(Equal(rej[TagSCFG]))
+			Expect(scfg.ID).To(Equal(scfgTags[TagSCID]))
+			Expect(scfg.obit).To(Equal(scfgTags[TagOBIT]))
+			Expect(scfg.sharedSecret).To(Equal([]byte("shared key")))
+			Expect(scfg.isExpired()).To(BeFalse())
+		})
+
+		It("rejects messages that are not a server config", func() {
+			var b bytes.Buffer
+			WriteHandshakeMessage(&b, TagCHLO, scfgTags)
+			_, err := parseServerConfig(b.Bytes(), cs.keyExchange)
+			Expect(err).To(MatchError(errMessageNotServerConfig))
+		})
+
+		It("rejects server configs with an invalid SCID", func() {
+			scfgTags[TagSCID] = []byte("short")
+			_, err := parseServerConfig(getServerConfigData(scfgTags), cs.keyExchange)
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoInvalidValueLength, "SCID")))
+		})
+
+		It("rejects server configs without an OBIT", func() {
+			delete(scfgTags, TagOBIT)
+			_, err := parseServerConfig(getServerConfigData(scfgTags), cs.keyExchange)
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoInvalidValueLength, "OBIT")))
+		})
+
+		It("finds the curve25519 public value among multiple ones", func() {
+			pub := bytes.Repeat([]byte{0x42}, 32)
+			pubs := append([]byte{0x3, 0, 0}, []byte("foo")...)
+			pubs = append(pubs, 0x20, 0, 0)
+			pubs = append(pubs, pub...)
+			res, err := curve25519PublicValue([]byte("P256C255"), pubs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal(pub))
+		})
+
+		It("errors if the server doesn't support curve25519", func() {
+			_, err := curve25519PublicValue([]byte("P256"), []byte{0x3, 0, 0, 'f', 'o', 'o'})
+			Expect(err).To(MatchError(errNoCurve25519))
+		})
+
+		It("errors if the PUBS are too short", func() {
+			_, err := curve25519PublicValue([]byte("C255"), []byte{0x20, 0, 0, 'f', 'o', 'o'})
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoInvalidValueLength, "PUBS")))
+		})
+
+		It("selects the AEAD by our order of preference", func() {
+			scfg := &serverConfigClient{aeads: []byte("AESGCC20")}
+			aead, err := scfg.selectAEAD()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aead.tag).To(Equal([]byte("CC20")))
+		})
+
+		It("errors if there's no common AEAD", func() {
+			scfg := &serverConfigClient{aeads: []byte("S20P")}
+			_, err := scfg.selectAEAD()
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoNoSupport, "server config doesn't support any of our AEADs")))
+		})
+	})
+})
@@ -2,11 +2,20 @@ package handshake
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -14,13 +23,18 @@ import (
 
 type mockKEX struct {
 	ephermal bool
+	// if set, PublicKey returns this value
+	publicKey []byte
 }
 
 func (m *mockKEX) PublicKey() []byte {
+	if m.publicKey != nil {
+		return m.publicKey
+	}
 	if m.ephermal {
 		return []byte("ephermal pub")
 	}
-	return []byte("initial public")
+	return []byte("initial pubs")
 }
 
 func (m *mockKEX) CalculateSharedKey(otherPublic []byte) ([]byte, error) {
@@ -31,7 +45,9 @@ func (m *mockKEX) CalculateSharedKey(otherPublic []byte) ([]byte, error) {
 }
 
 type mockSigner struct {
-	gotCHLO bool
+	gotCHLO         bool
+	sctList         []byte
+	certsCompressed []byte
 }
 
 func (s *mockSigner) SignServerProof(sni string, chlo []byte, serverConfigData []byte) ([]byte, error) {
@@ -40,12 +56,18 @@ func (s *mockSigner) SignServerProof(sni string, chlo []byte, serverConfigData [
 	}
 	return []byte("proof"), nil
 }
-func (*mockSigner) GetCertsCompressed(sni string, common, cached []byte) ([]byte, error) {
+func (s *mockSigner) GetCertsCompressed(sni string, common, cached []byte) ([]byte, error) {
+	if s.certsCompressed != nil {
+		return s.certsCompressed, nil
+	}
 	return []byte("certcompressed"), nil
 }
 func (*mockSigner) GetLeafCert(sni string) ([]byte, error) {
 	return []byte("certuncompressed"), nil
 }
+func (s *mockSigner) GetSCTList(sni string) ([]byte, error) {
+	return s.sctList, nil
+}
 
 type mockAEAD struct {
 	forwardSecure bool
@@ -70,6 +92,9 @@ func (m *mockAEAD) Open(packetNumber protocol.PacketNumber, associatedData []byt
 
 func (mockAEAD) DiversificationNonce() []byte { return nil }
 
+// fullCHLOData is the raw data of a full CHLO, padded to the minimum size
+var fullCHLOData = bytes.Repeat([]byte{'c'}, protocol.ClientHelloMinimumSize)
+
 var expectedInitialNonceLen int
 var expectedFSNonceLen int
 
@@ -123,6 +148,79 @@ func (mockStkSource) VerifyToken(ip net.IP, token []byte) error {
 	return nil
 }
 
+// countingStkSource counts how often tokens are verified
+type countingStkSource struct {
+	mockStkSource
+	verifications int
+}
+
+func (s *countingStkSource) VerifyToken(ip net.IP, token []byte) error {
+	s.verifications++
+	return s.mockStkSource.VerifyToken(ip, token)
+}
+
+type mockTracer struct {
+	keysInstalled     []bool
+	handshakeComplete bool
+	// the names of all events, in the order they were reported
+	events []string
+}
+
+func (t *mockTracer) ReceivedCHLO(connID protocol.ConnectionID, tags map[Tag][]byte) {
+	Expect(connID).To(Equal(protocol.ConnectionID(42)))
+	Expect(tags).To(HaveKey(TagSNI))
+	t.events = append(t.events, "CHLO")
+}
+
+func (t *mockTracer) SentREJ(connID protocol.ConnectionID) {
+	Expect(connID).To(Equal(protocol.ConnectionID(42)))
+	t.events = append(t.events, "REJ")
+}
+
+func (t *mockTracer) SentSHLO(connID protocol.ConnectionID) {
+	Expect(connID).To(Equal(protocol.ConnectionID(42)))
+	t.events = append(t.events, "SHLO")
+}
+
+func (t *mockTracer) KeysInstalled(connID protocol.ConnectionID, forwardSecure bool) {
+	Expect(connID).To(Equal(protocol.ConnectionID(42)))
+	t.keysInstalled = append(t.keysInstalled, forwardSecure)
+	if forwardSecure {
+		t.events = append(t.events, "forward secure keys")
+	} else {
+		t.events = append(t.events, "initial keys")
+	}
+}
+
+func (t *mockTracer) HandshakeComplete(connID protocol.ConnectionID) {
+	Expect(connID).To(Equal(protocol.ConnectionID(42)))
+	t.handshakeComplete = true
+	t.events = append(t.events, "complete")
+}
+
+type mockTicketSource struct{}
+
+func (mockTicketSource) NewTicket(state []byte, _ time.Time) ([]byte, error) {
+	return append([]byte("ticket "), state...), nil
+}
+
+func (mockTicketSource) OpenTicket(data []byte, _ time.Time) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("ticket ")) {
+		return nil, errors.New("invalid ticket")
+	}
+	return data[len("ticket "):], nil
+}
+
+// mockClock is a clock that only moves when advanced
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time                              { return c.now }
+func (c *mockClock) NewTimer(time.Duration) utils.Timer          { panic("not implemented") }
+func (c *mockClock) AfterFunc(time.Duration, func()) utils.Timer { panic("not implemented") }
+func (c *mockClock) advance(d time.Duration)                     { c.now = c.now.Add(d) }
+
 var _ = Describe("Crypto setup", func() {
 	var (
 		kex         *mockKEX
@@ -133,6 +231,8 @@ var _ = Describe("Crypto setup", func() {
 		cpm         *ConnectionParametersManager
 		aeadChanged chan struct{}
 		nonce32     []byte
+		icsl        []byte
+		mspc        []byte
 		ip          net.IP
 		validSTK    []byte
 	)
@@ -143,6 +243,9 @@ var _ = Describe("Crypto setup", func() {
 		validSTK, err = mockStkSource{}.NewToken(ip)
 		Expect(err).NotTo(HaveOccurred())
 		nonce32 = make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce32, uint32(time.Now().Unix()))
+		icsl = []byte{10, 0, 0, 0}
+		mspc = []byte{2, 0, 0, 0}
 		expectedInitialNonceLen = 32
 		expectedFSNonceLen = 64
 		aeadChanged = make(chan struct{}, 1)
@@ -154,10 +257,55 @@ var _ = Describe("Crypto setup", func() {
 		scfg.stkSource = &mockStkSource{}
 		v := protocol.SupportedVersions[len(protocol.SupportedVersions)-1]
 		cpm = NewConnectionParamatersManager()
-		cs, err = NewCryptoSetup(protocol.ConnectionID(42), ip, v, scfg, stream, cpm, aeadChanged)
+		cs, err = NewCryptoSetup(
+			protocol.ConnectionID(42), ip, v, scfg, stream, cpm, aeadChanged,
+			WithKeyDerivation(mockKeyDerivation),
+			WithKeyExchange(func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }),
+		)
 		Expect(err).NotTo(HaveOccurred())
-		cs.keyDerivation = mockKeyDerivation
-		cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+	})
+
+	It("takes the ephemeral key exchanges from the pool, if there is one", func() {
+		pool := crypto.NewKeyExchangePool(1, func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil })
+		defer pool.Close()
+		scfg.SetKeyExchangePool(pool)
+		cs2, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, stream, cpm, aeadChanged)
+		Expect(err).ToNot(HaveOccurred())
+		kex, err := cs2.keyExchange()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kex).To(BeAssignableToTypeOf(&mockKEX{}))
+	})
+
+	It("uses the key derivation and key exchange passed as options", func() {
+		type derivation struct {
+			forwardSecure bool
+			sharedSecret  []byte
+			connID        protocol.ConnectionID
+			divNonce      []byte
+		}
+		var derivations []derivation
+		keyDerivation := func(v protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (crypto.AEAD, error) {
+			derivations = append(derivations, derivation{forwardSecure: forwardSecure, sharedSecret: sharedSecret, connID: connID, divNonce: divNonce})
+			return &mockAEAD{forwardSecure: forwardSecure, sharedSecret: sharedSecret}, nil
+		}
+		var err error
+		cs, err = NewCryptoSetup(
+			protocol.ConnectionID(1337), ip, 33, scfg, stream, cpm, aeadChanged,
+			WithKeyDerivation(keyDerivation),
+			WithKeyExchange(func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+			TagPUBS: []byte("pubs-c"),
+			TagNONC: nonce32,
+			TagICSL: icsl,
+			TagMSPC: mspc,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(derivations).To(Equal([]derivation{
+			{forwardSecure: false, sharedSecret: []byte("shared key"), connID: 1337, divNonce: cs.diversificationNonce},
+			{forwardSecure: true, sharedSecret: []byte("shared ephermal"), connID: 1337, divNonce: nil},
+		}))
 	})
 
 	It("has a nonce", func() {
@@ -180,14 +328,66 @@ var _ = Describe("Crypto setup", func() {
 			Expect(cs.DiversificationNonce()).To(HaveLen(32))
 		})
 
-		It("does not return nonce for version < 33", func() {
-			cs.version = 32
-			Expect(cs.DiversificationNonce()).To(BeEmpty())
+		It("uses the diversification nonce source", func() {
+			divNonce := bytes.Repeat([]byte{0xd1}, 32)
+			scfg.SetDiversificationNonceSource(bytes.NewReader(divNonce))
+			var err error
+			cs, err = NewCryptoSetup(protocol.ConnectionID(42), ip, 33, scfg, stream, cpm, aeadChanged)
+			Expect(err).ToNot(HaveOccurred())
+			var derivedDivNonce []byte
+			cs.keyDerivation = func(v protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (crypto.AEAD, error) {
+				if !forwardSecure {
+					derivedDivNonce = divNonce
+				}
+				return &mockAEAD{forwardSecure: forwardSecure, sharedSecret: sharedSecret}, nil
+			}
+			cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+			_, err = cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(derivedDivNonce).To(Equal(divNonce))
+			Expect(cs.DiversificationNonce()).To(Equal(divNonce))
 		})
 
-		It("does not return nonce for FS packets", func() {
-			cs.receivedForwardSecurePacket = true
-			Expect(cs.DiversificationNonce()).To(BeEmpty())
+		It("generates fresh nonces when regenerating the nonces for a new handshake", func() {
+			nonce := cs.nonce
+			divNonce := cs.DiversificationNonce()
+			Expect(cs.regenerateNonces()).To(Succeed())
+			Expect(cs.nonce).To(HaveLen(32))
+			Expect(cs.nonce).ToNot(Equal(nonce))
+			Expect(cs.DiversificationNonce()).To(HaveLen(32))
+			Expect(cs.DiversificationNonce()).ToNot(Equal(divNonce))
+		})
+
+		It("errors when the nonces can't be regenerated", func() {
+			scfg.rand = bytes.NewReader(nil)
+			Expect(cs.regenerateNonces()).To(MatchError(io.EOF))
+		})
+
+		It("only returns the nonce for versions using it, until a forward secure packet was received", func() {
+			for _, t := range []struct {
+				version                     protocol.VersionNumber
+				receivedForwardSecurePacket bool
+				sendsNonce                  bool
+			}{
+				{32, false, false},
+				{33, false, true},
+				{34, false, true},
+				{33, true, false},
+				{34, true, false},
+			} {
+				cs.version = t.version
+				cs.receivedForwardSecurePacket = t.receivedForwardSecurePacket
+				if t.sendsNonce {
+					Expect(cs.DiversificationNonce()).To(HaveLen(32), fmt.Sprintf("%+v", t))
+				} else {
+					Expect(cs.DiversificationNonce()).To(BeEmpty(), fmt.Sprintf("%+v", t))
+				}
+			}
 		})
 
 		It("does not return nonce for unencrypted packets", func() {
@@ -198,31 +398,107 @@ var _ = Describe("Crypto setup", func() {
 
 	Context("when responding to client messages", func() {
 		It("generates REJ messages", func() {
-			response, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), nil)
+			response, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), nil, false)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(response).To(HavePrefix("REJ"))
 			Expect(response).To(ContainSubstring("certcompressed"))
-			Expect(response).To(ContainSubstring("initial public"))
+			Expect(response).To(ContainSubstring("initial pubs"))
 			Expect(signer.gotCHLO).To(BeTrue())
 		})
 
+		It("sends the SCTs in the REJ if the client requested them", func() {
+			signer.sctList = []byte("sct list")
+			response, err := cs.handleInchoateCHLO("", sampleCHLO, map[Tag][]byte{TagCSCT: {}}, false)
+			Expect(err).ToNot(HaveOccurred())
+			_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rej).To(HaveKeyWithValue(TagCSCT, []byte("sct list")))
+		})
+
+		It("doesn't send SCTs in the REJ if the client didn't request them", func() {
+			signer.sctList = []byte("sct list")
+			response, err := cs.handleInchoateCHLO("", sampleCHLO, map[Tag][]byte{}, false)
+			Expect(err).ToNot(HaveOccurred())
+			_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rej).ToNot(HaveKey(TagCSCT))
+		})
+
+		It("doesn't send SCTs in the REJ if there are none", func() {
+			response, err := cs.handleInchoateCHLO("", sampleCHLO, map[Tag][]byte{TagCSCT: {}}, false)
+			Expect(err).ToNot(HaveOccurred())
+			_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rej).ToNot(HaveKey(TagCSCT))
+		})
+
+		Context("amplification limit", func() {
+			BeforeEach(func() {
+				signer.certsCompressed = bytes.Repeat([]byte{'c'}, protocol.MaxAmplificationFactor*protocol.ClientHelloMinimumSize)
+			})
+
+			It("omits the certificate chain and the proof if the REJ would exceed the limit", func() {
+				chlo := bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize)
+				response, err := cs.handleInchoateCHLO("", chlo, map[Tag][]byte{TagCSCT: {}}, false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(response)).To(BeNumerically("<=", protocol.MaxAmplificationFactor*len(chlo)))
+				_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rej).ToNot(HaveKey(TagCERT))
+				Expect(rej).ToNot(HaveKey(TagPROF))
+				Expect(rej).ToNot(HaveKey(TagCSCT))
+				Expect(rej).To(HaveKey(TagSCFG))
+				Expect(rej).To(HaveKeyWithValue(TagSTK, validSTK))
+			})
+
+			It("counts the bytes of all CHLOs received and REJs sent", func() {
+				signer.certsCompressed = bytes.Repeat([]byte{'c'}, 2*protocol.ClientHelloMinimumSize)
+				chlo := bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize)
+				// the first REJ is below the limit
+				response, err := cs.handleInchoateCHLO("", chlo, nil, false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(response).To(ContainSubstring(string(signer.certsCompressed)))
+				// the second one only fits because of the bytes of the first CHLO that were not used up by the first REJ
+				signer.certsCompressed = bytes.Repeat([]byte{'c'}, 3*protocol.ClientHelloMinimumSize)
+				response, err = cs.handleInchoateCHLO("", chlo, nil, false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(response).To(ContainSubstring(string(signer.certsCompressed)))
+				Expect(cs.unvalidatedBytesSent).To(BeNumerically("<=", protocol.MaxAmplificationFactor*cs.unvalidatedBytesReceived))
+			})
+
+			It("sends the full REJ once the address is validated by the STK", func() {
+				chlo := bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize)
+				response, err := cs.handleInchoateCHLO("", chlo, map[Tag][]byte{TagSTK: validSTK}, true)
+				Expect(err).ToNot(HaveOccurred())
+				_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rej).To(HaveKeyWithValue(TagCERT, signer.certsCompressed))
+				Expect(rej).To(HaveKey(TagPROF))
+			})
+		})
+
 		It("generates REJ messages for version 30", func() {
 			cs.version = protocol.VersionNumber(30)
-			_, err := cs.handleInchoateCHLO("", sampleCHLO, nil)
+			_, err := cs.handleInchoateCHLO("", sampleCHLO, nil, false)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(signer.gotCHLO).To(BeFalse())
 		})
 
 		It("generates SHLO messages", func() {
-			response, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
 				TagPUBS: []byte("pubs-c"),
 				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
 			})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(response).To(HavePrefix("SHLO"))
 			Expect(response).To(ContainSubstring("ephermal pub"))
 			Expect(response).To(ContainSubstring(string(cs.nonce)))
 			Expect(response).To(ContainSubstring(string(protocol.SupportedVersionsAsTags)))
+			_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(shlo).To(HaveKeyWithValue(TagKEXS, []byte("C255")))
 			Expect(cs.secureAEAD).ToNot(BeNil())
 			Expect(cs.secureAEAD.(*mockAEAD).forwardSecure).To(BeFalse())
 			Expect(cs.secureAEAD.(*mockAEAD).sharedSecret).To(Equal([]byte("shared key")))
@@ -231,6 +507,231 @@ var _ = Describe("Crypto setup", func() {
 			Expect(cs.forwardSecureAEAD.(*mockAEAD).forwardSecure).To(BeTrue())
 		})
 
+		It("announces the versions of the server config in the SHLO", func() {
+			scfg.SetSupportedVersions([]protocol.VersionNumber{31, 32})
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(shlo).To(HaveKeyWithValue(TagVER, []byte("Q031Q032")))
+		})
+
+		It("generates the exact SHLO bytes", func() {
+			scfg.rand = bytes.NewReader(bytes.Repeat([]byte{0x42}, 64))
+			scfg.ticketSource = &mockTicketSource{}
+			cs, err := NewCryptoSetup(protocol.ConnectionID(42), ip, cs.version, scfg, stream, cpm, aeadChanged)
+			Expect(err).NotTo(HaveOccurred())
+			cs.keyDerivation = mockKeyDerivation
+			cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagRTKT: {},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			expected := []byte{
+				// message tag and number of entries
+				0x53, 0x48, 0x4c, 0x4f, 0x9, 0x0, 0x0, 0x0,
+				// index: SNO, VER, MSPC, ICSL, PUBS, KEXS, RTKT, CFCW, SFCW
+				0x53, 0x4e, 0x4f, 0x0, 0x20, 0x0, 0x0, 0x0, 0x56, 0x45, 0x52, 0x0, 0x30, 0x0, 0x0, 0x0,
+				0x4d, 0x53, 0x50, 0x43, 0x34, 0x0, 0x0, 0x0, 0x49, 0x43, 0x53, 0x4c, 0x38, 0x0, 0x0, 0x0,
+				0x50, 0x55, 0x42, 0x53, 0x44, 0x0, 0x0, 0x0, 0x4b, 0x45, 0x58, 0x53, 0x48, 0x0, 0x0, 0x0,
+				0x52, 0x54, 0x4b, 0x54, 0x6f, 0x0, 0x0, 0x0, 0x43, 0x46, 0x43, 0x57, 0x73, 0x0, 0x0, 0x0,
+				0x53, 0x46, 0x43, 0x57, 0x77, 0x0, 0x0, 0x0,
+				// SNO
+				0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42,
+				0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42, 0x42,
+				// VER
+				0x51, 0x30, 0x33, 0x30, 0x51, 0x30, 0x33, 0x31, 0x51, 0x30, 0x33, 0x32, 0x51, 0x30, 0x33, 0x33,
+				// MSPC, ICSL
+				0x2, 0x0, 0x0, 0x0, 0xa, 0x0, 0x0, 0x0,
+				// PUBS
+				0x65, 0x70, 0x68, 0x65, 0x72, 0x6d, 0x61, 0x6c, 0x20, 0x70, 0x75, 0x62,
+				// KEXS
+				0x43, 0x32, 0x35, 0x35,
+				// RTKT
+				0x74, 0x69, 0x63, 0x6b, 0x65, 0x74, 0x20, 0x52, 0x54, 0x4b, 0x54, 0x2, 0x0, 0x0, 0x0,
+				0x4d, 0x53, 0x50, 0x43, 0x4, 0x0, 0x0, 0x0, 0x49, 0x43, 0x53, 0x4c, 0x8, 0x0, 0x0, 0x0,
+				0x2, 0x0, 0x0, 0x0, 0xa, 0x0, 0x0, 0x0,
+				// CFCW, SFCW
+				0x0, 0x0, 0x18, 0x0, 0x0, 0x0, 0x10, 0x0,
+			}
+			Expect(response).To(Equal(expected))
+		})
+
+		It("advertises the preferred address in the SHLO", func() {
+			scfg.SetPreferredAddress(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 0x1337})
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(shlo).To(HaveKeyWithValue(TagSPAD, []byte{2, 0, 1, 2, 3, 4, 0x37, 0x13}))
+		})
+
+		It("does not advertise a preferred address if none is set", func() {
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(shlo).ToNot(HaveKey(TagSPAD))
+		})
+
+		It("errors if the CHLO is missing required connection parameters", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagMSPC: mspc,
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNotFound: ICSL missing"))
+			Expect(cs.secureAEAD).To(BeNil())
+			Expect(cs.forwardSecureAEAD).To(BeNil())
+		})
+
+		It("errors if the CHLO has an empty AEAD list", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: {},
+				TagKEXS: []byte("C255"),
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNoOverlap: empty AEAD list"))
+			Expect(cs.secureAEAD).To(BeNil())
+		})
+
+		It("errors if the CHLO has an empty KEXS list", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("CC20"),
+				TagKEXS: {},
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNoOverlap: empty KEXS list"))
+			Expect(cs.secureAEAD).To(BeNil())
+		})
+
+		It("accepts non-empty AEAD and KEXS lists", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("CC20"),
+				TagKEXS: []byte("C255"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("errors if the CHLO only offers AEADs the server doesn't support", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("S20P"),
+				TagKEXS: []byte("C255"),
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNoOverlap: no mutually supported AEAD"))
+			Expect(cs.secureAEAD).To(BeNil())
+		})
+
+		It("accepts a CHLO offering a supported AEAD among unsupported ones", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("S20PCC20"),
+				TagKEXS: []byte("C255"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("derives the keys for the AEAD the client chose", func() {
+			cs.keyDerivation = nil
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("AESG"),
+				TagKEXS: []byte("C255"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			cert, err := scfg.signer.GetLeafCert("")
+			Expect(err).ToNot(HaveOccurred())
+			expected, err := crypto.DeriveKeysAESGCM(cs.version, false, []byte("shared key"), nonce32, cs.connID, fullCHLOData, scfg.Get(), cert, cs.diversificationNonce)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.secureAEAD.Seal(1, []byte("aad"), []byte("foobar"))).To(Equal(expected.Seal(1, []byte("aad"), []byte("foobar"))))
+			Expect(cs.NegotiatedParameters().AEAD).To(Equal("AESG"))
+		})
+
+		It("errors if the ephemeral public key has the wrong length", func() {
+			cs.keyExchange = func() (crypto.KeyExchange, error) {
+				return &mockKEX{ephermal: true, publicKey: []byte("too short")}, nil
+			}
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+			})
+			Expect(err).To(MatchError("CryptoInternalError: ephemeral C255 public key has length 9, expected 12"))
+			Expect(cs.forwardSecureAEAD).To(BeNil())
+		})
+
+		It("uses the key exchange algorithm selected from the KEXS list", func() {
+			p256 := &mockKEX{}
+			err := scfg.AddKeyExchange([]byte("P256"), p256, func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil })
+			Expect(err).ToNot(HaveOccurred())
+			response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("CC20"),
+				TagKEXS: []byte("P256"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(shlo).To(HaveKeyWithValue(TagKEXS, []byte("P256")))
+			Expect(cs.NegotiatedParameters().KeyExchange).To(Equal("P256"))
+		})
+
+		It("errors if the CHLO's KEXS list has no overlap with the server config", func() {
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagAEAD: []byte("CC20"),
+				TagKEXS: []byte("P256"),
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNoOverlap: no mutually supported KEXS"))
+			Expect(cs.secureAEAD).To(BeNil())
+		})
+
 		It("handles long handshake", func() {
 			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
 				TagSNI: []byte("quic.clemente.io"),
@@ -241,7 +742,10 @@ var _ = Describe("Crypto setup", func() {
 				TagSCID: scfg.ID,
 				TagSNI:  []byte("quic.clemente.io"),
 				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
 				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
 			})
 			err := cs.HandleCryptoStream()
 			Expect(err).NotTo(HaveOccurred())
@@ -250,12 +754,244 @@ var _ = Describe("Crypto setup", func() {
 			Expect(aeadChanged).To(Receive())
 		})
 
+		It("errors after too many CHLOs", func() {
+			for i := 0; i < protocol.MaxClientHellos+1; i++ {
+				WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+					TagSNI: []byte("quic.clemente.io"),
+					TagSTK: validSTK,
+					TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+				})
+			}
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("CryptoTooManyRejects: more than 4 CHLOs"))
+			Expect(bytes.Count(stream.dataWritten.Bytes(), []byte("REJ"))).To(Equal(protocol.MaxClientHellos))
+		})
+
+		It("completes a handshake with amplification-limited REJs within the CHLO limit", func() {
+			signer.certsCompressed = bytes.Repeat([]byte{'c'}, 10*protocol.ClientHelloMinimumSize)
+			inchoateCHLO := map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			}
+			// the inchoate CHLO is sent twice, e.g. because the client resends it after version negotiation
+			// the REJs don't contain a proof, since the address is not validated yet
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, inchoateCHLO)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, inchoateCHLO)
+			// the client retries with the STK, and gets the proof
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagSTK: validSTK,
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(aeadChanged).To(Receive())
+			rejs := bytes.Split(stream.dataWritten.Bytes(), []byte("REJ"))[1:]
+			Expect(rejs).To(HaveLen(3))
+			Expect(rejs[0]).ToNot(ContainSubstring(string(signer.certsCompressed)))
+			Expect(rejs[1]).ToNot(ContainSubstring(string(signer.certsCompressed)))
+			Expect(rejs[2]).To(ContainSubstring(string(signer.certsCompressed)))
+			Expect(rejs[2]).To(ContainSubstring("SHLO"))
+		})
+
+		Context("crypto stream buffer limit", func() {
+			var limiter *utils.BufferLimiter
+
+			BeforeEach(func() {
+				limiter = utils.NewBufferLimiter(10 * protocol.ClientHelloMinimumSize)
+				scfg.cryptoStreamBufferLimiter = limiter
+			})
+
+			It("releases the buffer after reading a CHLO", func() {
+				WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+					TagSNI: []byte("quic.clemente.io"),
+					TagSTK: validSTK,
+					TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+				})
+				err := cs.HandleCryptoStream()
+				Expect(err).To(MatchError("EOF"))
+				Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+				Expect(limiter.Used()).To(BeZero())
+			})
+
+			It("refuses to buffer CHLOs when the buffers of other handshakes exhaust the limit", func() {
+				// simulate many handshakes that are still waiting for the rest of their CHLO
+				for i := 0; i < 10; i++ {
+					cr := utils.NewLimitedCachingReader(bytes.NewReader(make([]byte, protocol.ClientHelloMinimumSize)), limiter)
+					_, err := io.ReadFull(cr, make([]byte, protocol.ClientHelloMinimumSize))
+					Expect(err).ToNot(HaveOccurred())
+				}
+				WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+					TagSNI: []byte("quic.clemente.io"),
+					TagSTK: validSTK,
+					TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+				})
+				err := cs.HandleCryptoStream()
+				Expect(err).To(MatchError("HandshakeFailed: crypto stream buffer limit exceeded"))
+				Expect(stream.dataWritten.Len()).To(BeZero())
+				Expect(limiter.Used()).To(Equal(10 * protocol.ClientHelloMinimumSize))
+			})
+		})
+
+		It("errors after too many non-matching full CHLOs", func() {
+			for i := 0; i < protocol.MaxClientHellos+1; i++ {
+				WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+					TagSCID: []byte("wrong server config ID"),
+					TagSNI:  []byte("quic.clemente.io"),
+					TagNONC: nonce32,
+					TagICSL: icsl,
+					TagMSPC: mspc,
+					TagSTK:  validSTK,
+					TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+				})
+			}
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("CryptoTooManyRejects: more than 4 CHLOs"))
+		})
+
+		Context("resumption tickets", func() {
+			getTicket := func() []byte {
+				response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagICSL: icsl,
+					TagMSPC: mspc,
+					TagRTKT: {},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shlo).To(HaveKey(TagRTKT))
+				return shlo[TagRTKT]
+			}
+
+			newCryptoSetup := func() (*CryptoSetup, *ConnectionParametersManager) {
+				cpm := NewConnectionParamatersManager()
+				cs, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, &mockStream{}, cpm, make(chan struct{}, 1))
+				Expect(err).NotTo(HaveOccurred())
+				cs.keyDerivation = mockKeyDerivation
+				cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+				return cs, cpm
+			}
+
+			It("only issues a ticket if the client asks for one", func() {
+				response, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagICSL: icsl,
+					TagMSPC: mspc,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				_, shlo, err := ParseHandshakeMessage(bytes.NewReader(response))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(shlo).ToNot(HaveKey(TagRTKT))
+			})
+
+			It("issues a ticket containing the negotiated parameters", func() {
+				state, err := scfg.ticketSource.OpenTicket(getTicket(), time.Now())
+				Expect(err).ToNot(HaveOccurred())
+				_, params, err := ParseHandshakeMessage(bytes.NewReader(state))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(params).To(Equal(map[Tag][]byte{TagICSL: icsl, TagMSPC: mspc}))
+			})
+
+			It("resumes the parameters from a ticket", func() {
+				ticket := getTicket()
+				cs2, cpm2 := newCryptoSetup()
+				_, err := cs2.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagRTKT: ticket,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cpm2.GetMaxStreamsPerConnection()).To(Equal(uint32(2)))
+				Expect(cpm2.GetIdleTimeout()).To(Equal(10 * time.Second))
+			})
+
+			It("uses the clock of the handshake for tickets", func() {
+				scfg.ticketSource, _ = crypto.NewTicketSource([]byte("TESTING"))
+				ticket := getTicket()
+				cs2, _ := newCryptoSetup()
+				cs2.clock = &mockClock{now: time.Now().Add((protocol.ResumptionTicketExpiryTimeSec + 1) * time.Second)}
+				_, err := cs2.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagRTKT: ticket,
+				})
+				Expect(err).To(MatchError("CryptoMessageParameterNotFound: ICSL missing"))
+			})
+
+			It("prefers the parameters sent in the CHLO", func() {
+				ticket := getTicket()
+				cs2, cpm2 := newCryptoSetup()
+				_, err := cs2.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagMSPC: {3, 0, 0, 0},
+					TagRTKT: ticket,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cpm2.GetMaxStreamsPerConnection()).To(Equal(uint32(3)))
+			})
+
+			It("rejects a tampered ticket", func() {
+				ticket := getTicket()
+				ticket[len(ticket)-1] ^= 0xff
+				cs2, _ := newCryptoSetup()
+				_, err := cs2.handleCHLO("", fullCHLOData, map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagRTKT: ticket,
+				})
+				Expect(err).To(MatchError("CryptoMessageParameterNotFound: ICSL missing"))
+			})
+		})
+
+		It("logs the connection ID and the remote address", func() {
+			logOutput := &bytes.Buffer{}
+			utils.SetLogWriter(logOutput)
+			utils.SetLogLevel(utils.LogLevelInfo)
+			defer utils.SetLogWriter(os.Stdout)
+			defer utils.SetLogLevel(utils.LogLevelNothing)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagSTK: validSTK,
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logOutput.String()).To(ContainSubstring("Got CHLO for connection 2a from 1.2.3.4"))
+			Expect(logOutput.String()).To(ContainSubstring("Sending REJ for connection 2a to 1.2.3.4"))
+			Expect(logOutput.String()).To(ContainSubstring("Sending SHLO for connection 2a to 1.2.3.4"))
+		})
+
 		It("handles 0-RTT handshake", func() {
 			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
 				TagSCID: scfg.ID,
 				TagSNI:  []byte("quic.clemente.io"),
 				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
 				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
 			})
 			err := cs.HandleCryptoStream()
 			Expect(err).NotTo(HaveOccurred())
@@ -264,17 +1000,244 @@ var _ = Describe("Crypto setup", func() {
 			Expect(aeadChanged).To(Receive())
 		})
 
+		It("releases the crypto stream buffers after the handshake is complete", func() {
+			limiter := utils.NewBufferLimiter(10 * protocol.ClientHelloMinimumSize)
+			scfg.cryptoStreamBufferLimiter = limiter
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("SHLO"))
+			Expect(limiter.Used()).To(BeZero())
+			Expect(cs.cryptoStream).To(BeNil())
+			// the keys are still available
+			Expect(cs.forwardSecureAEAD).ToNot(BeNil())
+		})
+
+		It("rejects a replayed 0-RTT CHLO", func() {
+			chlo := map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			}
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, chlo)
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("SHLO"))
+			Expect(aeadChanged).To(Receive())
+			// replay the same CHLO on a new connection
+			stream2 := &mockStream{}
+			cs2, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, stream2, NewConnectionParamatersManager(), aeadChanged)
+			Expect(err).NotTo(HaveOccurred())
+			cs2.keyDerivation = mockKeyDerivation
+			cs2.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+			WriteHandshakeMessage(&stream2.dataToRead, TagCHLO, chlo)
+			err = cs2.HandleCryptoStream()
+			Expect(err).To(MatchError("EOF"))
+			Expect(stream2.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream2.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(aeadChanged).ToNot(Receive())
+			Expect(cs2.secureAEAD).To(BeNil())
+		})
+
+		It("rejects a 0-RTT CHLO with a nonce outside of the replay cache window", func() {
+			clock := &mockClock{now: time.Now().Add(protocol.ReplayCacheWindow + time.Second)}
+			cs.clock = clock
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("EOF"))
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(cs.secureAEAD).To(BeNil())
+		})
+
+		It("rejects 0-RTT CHLOs when the replay cache is full", func() {
+			scfg.replayCache.maxEntries = 1
+			other := make([]byte, 32)
+			copy(other, nonce32)
+			other[31] = 1
+			Expect(scfg.replayCache.Add(other, time.Now())).To(Succeed())
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("EOF"))
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			// the nonce that was already in the cache is still remembered
+			Expect(scfg.replayCache.Contains(other, time.Now())).To(BeTrue())
+		})
+
+		It("doesn't remember the nonce of a CHLO that fails validation", func() {
+			invalidCHLO := map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			}
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, invalidCHLO)
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("CryptoMessageParameterNotFound: ICSL missing"))
+			Expect(scfg.replayCache.Contains(nonce32, time.Now())).To(BeFalse())
+			// a valid CHLO with the same nonce is still accepted on a new connection
+			stream2 := &mockStream{}
+			cs2, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, stream2, NewConnectionParamatersManager(), aeadChanged)
+			Expect(err).NotTo(HaveOccurred())
+			cs2.keyDerivation = mockKeyDerivation
+			cs2.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+			validCHLO := map[Tag][]byte{TagICSL: icsl}
+			for tag, value := range invalidCHLO {
+				validCHLO[tag] = value
+			}
+			WriteHandshakeMessage(&stream2.dataToRead, TagCHLO, validCHLO)
+			err = cs2.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream2.dataWritten.Bytes()).To(HavePrefix("SHLO"))
+			Expect(scfg.replayCache.Contains(nonce32, time.Now())).To(BeTrue())
+		})
+
+		It("notifies the tracer about the installed keys and the completed handshake", func() {
+			tracer := &mockTracer{}
+			scfg.SetTracer(tracer)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tracer.keysInstalled).To(Equal([]bool{false, true}))
+			Expect(tracer.handshakeComplete).To(BeFalse())
+			_, err = cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tracer.handshakeComplete).To(BeTrue())
+		})
+
+		It("reports the events of a 0-RTT handshake to the tracer", func() {
+			tracer := &mockTracer{}
+			scfg.SetTracer(tracer)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagICSL: icsl,
+				TagMSPC: mspc,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tracer.events).To(Equal([]string{"CHLO", "initial keys", "forward secure keys", "SHLO", "complete"}))
+		})
+
+		It("reports REJs to the tracer", func() {
+			tracer := &mockTracer{}
+			scfg.SetTracer(tracer)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("EOF"))
+			Expect(tracer.events).To(Equal([]string{"CHLO", "REJ"}))
+		})
+
 		It("recognizes inchoate CHLOs missing SCID", func() {
-			Expect(cs.isInchoateCHLO(map[Tag][]byte{})).To(BeTrue())
+			Expect(cs.inchoateCHLOReason(map[Tag][]byte{}, false)).To(Equal(inchoateReasonNoSCID))
+		})
+
+		It("recognizes inchoate CHLOs with a different SCID", func() {
+			Expect(cs.inchoateCHLOReason(map[Tag][]byte{TagSCID: []byte("foobar"), TagSTK: validSTK}, true)).To(Equal(inchoateReasonSCIDMismatch))
+		})
+
+		It("recognizes inchoate CHLOs with an invalid STK", func() {
+			cryptoData := map[Tag][]byte{TagSCID: scfg.ID, TagSTK: []byte("foobar")}
+			Expect(cs.validatesSourceAddress(cryptoData)).To(BeFalse())
+			Expect(cs.inchoateCHLOReason(cryptoData, false)).To(Equal(inchoateReasonBadSTK))
+		})
+
+		It("recognizes inchoate CHLOs without an STK", func() {
+			cryptoData := map[Tag][]byte{TagSCID: scfg.ID}
+			Expect(cs.validatesSourceAddress(cryptoData)).To(BeFalse())
+			Expect(cs.inchoateCHLOReason(cryptoData, false)).To(Equal(inchoateReasonBadSTK))
 		})
 
 		It("recognizes proper CHLOs", func() {
-			Expect(cs.isInchoateCHLO(map[Tag][]byte{TagSCID: scfg.ID})).To(BeFalse())
+			cryptoData := map[Tag][]byte{TagSCID: scfg.ID, TagSTK: validSTK}
+			Expect(cs.validatesSourceAddress(cryptoData)).To(BeTrue())
+			Expect(cs.inchoateCHLOReason(cryptoData, true)).To(Equal(inchoateReasonNone))
+		})
+
+		It("verifies the STK only once per CHLO", func() {
+			stkSource := &countingStkSource{}
+			scfg.stkSource = stkSource
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagSTK:  []byte("foobar"),
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError("EOF"))
+			Expect(stkSource.verifications).To(Equal(1))
+		})
+
+		It("has string representations of the reasons", func() {
+			Expect(inchoateReasonNone.String()).To(Equal("none"))
+			Expect(inchoateReasonNoSCID.String()).To(Equal("no SCID"))
+			Expect(inchoateReasonSCIDMismatch.String()).To(Equal("SCID mismatch"))
+			Expect(inchoateReasonBadSTK.String()).To(Equal("bad STK"))
+			Expect(inchoateReason(42).String()).To(Equal("unknown inchoate reason 42"))
 		})
 
 		It("errors on too short inchoate CHLOs", func() {
-			_, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize-1), nil)
+			_, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize-1), nil, false)
+			Expect(err).To(MatchError("CryptoInvalidValueLength: CHLO too small"))
+		})
+
+		It("errors on too short full CHLOs, before deriving any keys", func() {
+			var derivedKeys bool
+			cs.keyDerivation = func(protocol.VersionNumber, bool, []byte, []byte, protocol.ConnectionID, []byte, []byte, []byte, []byte) (crypto.AEAD, error) {
+				derivedKeys = true
+				return &mockAEAD{}, nil
+			}
+			_, err := cs.handleCHLO("", fullCHLOData[:protocol.ClientHelloMinimumSize-1], map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagICSL: icsl, TagMSPC: mspc})
 			Expect(err).To(MatchError("CryptoInvalidValueLength: CHLO too small"))
+			Expect(derivedKeys).To(BeFalse())
+			Expect(cs.secureAEAD).To(BeNil())
 		})
 	})
 
@@ -286,11 +1249,162 @@ var _ = Describe("Crypto setup", func() {
 		Expect(err).To(MatchError("CryptoMessageParameterNotFound: SNI required"))
 	})
 
+	It("errors with an empty SNI", func() {
+		WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+			TagSNI: {},
+			TagSTK: validSTK,
+		})
+		err := cs.HandleCryptoStream()
+		Expect(err).To(MatchError("InvalidCryptoMessageParameter: empty SNI"))
+	})
+
+	Context("accepted hostnames", func() {
+		BeforeEach(func() {
+			scfg.SetAcceptedHostnames([]string{"quic.clemente.io", "www.example.org"})
+		})
+
+		It("accepts a hostname from the list", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI: []byte("www.example.org"),
+				TagSTK: validSTK,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+		})
+
+		It("compares hostnames case-insensitively", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI: []byte("QUIC.clemente.IO"),
+				TagSTK: validSTK,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a hostname not on the list, without sending a REJ", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI: []byte("evil.example.org"),
+				TagSTK: validSTK,
+			})
+			Expect(err).To(MatchError("CryptoMessageParameterNotFound: unknown SNI: evil.example.org"))
+			Expect(stream.dataWritten.Len()).To(BeZero())
+			Expect(signer.gotCHLO).To(BeFalse())
+		})
+
+		It("accepts all hostnames when the list is reset", func() {
+			scfg.SetAcceptedHostnames(nil)
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI: []byte("evil.example.org"),
+				TagSTK: validSTK,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("client time", func() {
+		It("exposes the time reported by the client", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI:  []byte("quic.clemente.io"),
+				TagCTIM: {0x0, 0xe1, 0xf5, 0x5, 0x0, 0x0, 0x0, 0x0}, // 100000000
+			})
+			Expect(err).ToNot(HaveOccurred())
+			t, ok := cs.ClientTime()
+			Expect(ok).To(BeTrue())
+			Expect(t).To(Equal(time.Unix(100000000, 0)))
+		})
+
+		It("doesn't report a time if the client didn't send one", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, ok := cs.ClientTime()
+			Expect(ok).To(BeFalse())
+		})
+
+		It("ignores invalid times", func() {
+			_, err := cs.handleMessage(sampleCHLO, map[Tag][]byte{
+				TagSNI:  []byte("quic.clemente.io"),
+				TagCTIM: {0x13, 0x37},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, ok := cs.ClientTime()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("unknown tags", func() {
+		unknownTag := Tag('F' + 'O'<<8 + 'O'<<16 + 'O'<<24)
+
+		It("ignores unknown tags by default", func() {
+			done, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), map[Tag][]byte{
+				TagSNI:     []byte("foo"),
+				unknownTag: []byte("bar"),
+			})
+			Expect(done).To(BeFalse())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stream.dataWritten.Bytes()).ToNot(BeEmpty())
+		})
+
+		It("rejects unknown tags with strict tag parsing", func() {
+			scfg.SetStrictTagParsing(true)
+			done, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), map[Tag][]byte{
+				TagSNI:     []byte("foo"),
+				unknownTag: []byte("bar"),
+			})
+			Expect(done).To(BeFalse())
+			Expect(err).To(MatchError("InvalidCryptoMessageParameter: unknown tag FOOO"))
+			Expect(stream.dataWritten.Bytes()).To(BeEmpty())
+		})
+
+		It("accepts known tags with strict tag parsing", func() {
+			scfg.SetStrictTagParsing(true)
+			_, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), map[Tag][]byte{
+				TagSNI: []byte("foo"),
+				TagPAD: []byte("pad"),
+				TagVER: []byte("Q032"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("negotiated parameters", func() {
+		It("has no algorithms before the handshake", func() {
+			params := cs.NegotiatedParameters()
+			Expect(params.ConnectionID).To(Equal(protocol.ConnectionID(42)))
+			Expect(params.HandshakeState).To(Equal(HandshakeStateUnencrypted))
+			Expect(params.KeyExchange).To(BeEmpty())
+			Expect(params.AEAD).To(BeEmpty())
+		})
+
+		It("dumps the parameters of a completed handshake as JSON", func() {
+			cs.nonce = bytes.Repeat([]byte{0xab}, 32)
+			cs.diversificationNonce = bytes.Repeat([]byte{0xcd}, 32)
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagICSL: icsl, TagMSPC: mspc})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			data, err := json.Marshal(cs.NegotiatedParameters())
+			Expect(err).ToNot(HaveOccurred())
+			var dump map[string]interface{}
+			Expect(json.Unmarshal(data, &dump)).To(Succeed())
+			Expect(dump).To(HaveKeyWithValue("connection_id", "000000000000002a"))
+			Expect(dump).To(HaveKeyWithValue("version", float64(33)))
+			Expect(dump).To(HaveKeyWithValue("handshake_state", "forward-secure"))
+			Expect(dump).To(HaveKeyWithValue("key_exchange", "C255"))
+			Expect(dump).To(HaveKeyWithValue("aead", "CC20"))
+			Expect(dump).To(HaveKeyWithValue("server_nonce", strings.Repeat("ab", 32)))
+			Expect(dump).To(HaveKeyWithValue("diversification_nonce", strings.Repeat("cd", 32)))
+			Expect(dump).To(HaveKeyWithValue("idle_timeout_ms", float64(10000)))
+			Expect(dump).To(HaveKeyWithValue("max_incoming_streams", BeNumerically(">", 0)))
+			Expect(dump).To(HaveKeyWithValue("truncate_connection_id", false))
+		})
+	})
+
 	Context("escalating crypto", func() {
 		foobarFNVSigned := []byte{0x18, 0x6f, 0x44, 0xba, 0x97, 0x35, 0xd, 0x6f, 0xbf, 0x64, 0x3c, 0x79, 0x66, 0x6f, 0x6f, 0x62, 0x61, 0x72}
 
 		doCHLO := func() {
-			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			_, err := cs.handleCHLO("", fullCHLOData, map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagICSL: icsl, TagMSPC: mspc})
 			Expect(err).ToNot(HaveOccurred())
 		}
 
@@ -327,6 +1441,18 @@ var _ = Describe("Crypto setup", func() {
 				d := cs.Seal(0, []byte{}, []byte("foobar"))
 				Expect(d).ToNot(Equal(foobarFNVSigned))
 			})
+
+			It("is not used for application data", func() {
+				_, err := cs.SealApplicationData(0, []byte{}, []byte("foobar"))
+				Expect(err).To(MatchError(ErrUnencryptedApplicationData))
+			})
+
+			It("seals application data after CHLO", func() {
+				doCHLO()
+				d, err := cs.SealApplicationData(0, []byte{}, []byte("foobar"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(d).To(Equal([]byte("encrypted")))
+			})
 		})
 
 		Context("initial encryption", func() {
@@ -358,6 +1484,88 @@ var _ = Describe("Crypto setup", func() {
 				_, err = cs.Open(0, []byte{}, []byte("encrypted"))
 				Expect(err).To(MatchError("authentication failed"))
 			})
+
+			Context("reordered packets", func() {
+				BeforeEach(func() {
+					scfg.SetInitialEncryptionGracePeriod(time.Second)
+				})
+
+				It("is accepted for packets sent before the first forward secure packet", func() {
+					doCHLO()
+					_, err := cs.Open(10, []byte{}, []byte("forward secure encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					d, err := cs.Open(9, []byte{}, []byte("encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(d).To(Equal([]byte("decrypted")))
+					Expect(cs.HandshakeState()).To(Equal(HandshakeStateForwardSecure))
+				})
+
+				It("is not accepted for packets sent after the first forward secure packet", func() {
+					doCHLO()
+					_, err := cs.Open(10, []byte{}, []byte("forward secure encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					_, err = cs.Open(11, []byte{}, []byte("encrypted"))
+					Expect(err).To(MatchError("authentication failed"))
+				})
+
+				It("is not accepted after the grace period, and dropped", func() {
+					clock := &mockClock{now: time.Unix(1000000, 0)}
+					cs.clock = clock
+					doCHLO()
+					_, err := cs.Open(10, []byte{}, []byte("forward secure encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					clock.advance(time.Second - time.Nanosecond)
+					_, err = cs.Open(8, []byte{}, []byte("encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(cs.retiredSecureAEAD).ToNot(BeNil())
+					clock.advance(time.Nanosecond)
+					_, err = cs.Open(9, []byte{}, []byte("encrypted"))
+					Expect(err).To(MatchError("authentication failed"))
+					Expect(cs.retiredSecureAEAD).To(BeNil())
+				})
+
+				It("is disabled by default", func() {
+					scfg, err := NewServerConfig(kex, signer)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(scfg.initialEncryptionGracePeriod).To(BeZero())
+				})
+
+				It("is not accepted if the grace period is disabled", func() {
+					scfg.SetInitialEncryptionGracePeriod(0)
+					doCHLO()
+					_, err := cs.Open(10, []byte{}, []byte("forward secure encrypted"))
+					Expect(err).ToNot(HaveOccurred())
+					_, err = cs.Open(9, []byte{}, []byte("encrypted"))
+					Expect(err).To(MatchError("authentication failed"))
+					Expect(cs.retiredSecureAEAD).To(BeNil())
+				})
+			})
+
+			It("is dropped after receiving forward secure packet", func() {
+				doCHLO()
+				_, err := cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.secureAEAD).To(BeNil())
+				_, err = cs.Open(1, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("is dropped only once when forward secure packets are opened concurrently", func() {
+				doCHLO()
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(pn protocol.PacketNumber) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						_, err := cs.Open(pn, []byte{}, []byte("forward secure encrypted"))
+						Expect(err).ToNot(HaveOccurred())
+					}(protocol.PacketNumber(i))
+				}
+				wg.Wait()
+				Expect(cs.secureAEAD).To(BeNil())
+				Expect(cs.ForwardSecurePacketReceived()).To(BeClosed())
+			})
 		})
 
 		Context("forward secure encryption", func() {
@@ -368,6 +1576,72 @@ var _ = Describe("Crypto setup", func() {
 				d := cs.Seal(0, []byte{}, []byte("foobar"))
 				Expect(d).To(Equal([]byte("forward secure encrypted")))
 			})
+
+			It("signals when the forward secure AEAD is installed and when it is first used", func() {
+				Expect(cs.ForwardSecureAEADInstalled()).ToNot(BeClosed())
+				Expect(cs.ForwardSecurePacketReceived()).ToNot(BeClosed())
+				doCHLO()
+				Expect(cs.ForwardSecureAEADInstalled()).To(BeClosed())
+				Expect(cs.ForwardSecurePacketReceived()).ToNot(BeClosed())
+				_, err := cs.Open(0, []byte{}, []byte("encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.ForwardSecurePacketReceived()).ToNot(BeClosed())
+				_, err = cs.Open(1, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.ForwardSecurePacketReceived()).To(BeClosed())
+				// subsequent packets don't close the channel again
+				_, err = cs.Open(2, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("trying to open packets", func() {
+			It("doesn't record secure packets", func() {
+				doCHLO()
+				d, err := cs.TryOpen(0, []byte{}, []byte("encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(d).To(Equal([]byte("decrypted")))
+				Expect(cs.receivedSecurePacket).To(BeFalse())
+				// null encrypted packets are still accepted
+				_, err = cs.Open(0, []byte{}, foobarFNVSigned)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = cs.Open(0, []byte{}, []byte("encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.receivedSecurePacket).To(BeTrue())
+			})
+
+			It("doesn't record forward secure packets", func() {
+				doCHLO()
+				d, err := cs.TryOpen(0, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(d).To(Equal([]byte("decrypted")))
+				Expect(cs.receivedForwardSecurePacket).To(BeFalse())
+				Expect(cs.secureAEAD).ToNot(BeNil())
+				Expect(cs.HandshakeState()).To(Equal(HandshakeStateSecure))
+				_, err = cs.Open(0, []byte{}, []byte("forward secure encrypted"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.receivedForwardSecurePacket).To(BeTrue())
+				Expect(cs.HandshakeState()).To(Equal(HandshakeStateForwardSecure))
+			})
+
+			It("fails for packets that can't be decrypted", func() {
+				doCHLO()
+				_, err := cs.TryOpen(0, []byte{}, []byte("foobar"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		It("reports the handshake state", func() {
+			Expect(cs.HandshakeState()).To(Equal(HandshakeStateUnencrypted))
+			doCHLO()
+			Expect(cs.HandshakeState()).To(Equal(HandshakeStateSecure))
+			// the forward secure AEAD is only used once the client used it
+			_, err := cs.Open(0, []byte{}, []byte("encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.HandshakeState()).To(Equal(HandshakeStateSecure))
+			_, err = cs.Open(1, []byte{}, []byte("forward secure encrypted"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.HandshakeState()).To(Equal(HandshakeStateForwardSecure))
 		})
 	})
 
@@ -399,5 +1673,53 @@ var _ = Describe("Crypto setup", func() {
 			Expect(err).To(BeNil())
 			Expect(stream.dataWritten.Bytes()).To(ContainSubstring(string(validSTK)))
 		})
+
+		Context("full CHLOs", func() {
+			fullCHLO := func(stk []byte) map[Tag][]byte {
+				return map[Tag][]byte{
+					TagSCID: scfg.ID,
+					TagSNI:  []byte("quic.clemente.io"),
+					TagNONC: nonce32,
+					TagICSL: icsl,
+					TagMSPC: mspc,
+					TagSTK:  stk,
+				}
+			}
+
+			It("answers with a REJ if the STK was issued for a different IP", func() {
+				stk, err := mockStkSource{}.NewToken(net.ParseIP("4.3.2.1"))
+				Expect(err).ToNot(HaveOccurred())
+				done, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), fullCHLO(stk))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(done).To(BeFalse())
+				Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+				Expect(stream.dataWritten.Bytes()).To(ContainSubstring(string(validSTK)))
+				Expect(cs.secureAEAD).To(BeNil())
+			})
+
+			It("answers with a REJ if the STK is missing", func() {
+				done, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), fullCHLO(nil))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(done).To(BeFalse())
+				Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			})
+
+			It("validates the STK against the IP the handshake was started from", func() {
+				// the STK was issued for the IP the connection was created with, and stays valid if the client migrates
+				done, err := cs.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), fullCHLO(validSTK))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(done).To(BeTrue())
+				Expect(stream.dataWritten.Bytes()).To(HavePrefix("SHLO"))
+			})
+
+			It("doesn't accept an STK issued for the IP of another connection", func() {
+				cs2, err := NewCryptoSetup(protocol.ConnectionID(43), net.ParseIP("4.3.2.1"), cs.version, scfg, stream, cpm, aeadChanged)
+				Expect(err).ToNot(HaveOccurred())
+				done, err := cs2.handleMessage(bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), fullCHLO(validSTK))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(done).To(BeFalse())
+				Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			})
+		})
 	})
 })
@@ -7,11 +7,37 @@ import (
 	"io"
 	"sort"
 
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
+// maxTagValueLength is the maximum length of a tag value in a CHLO, for tags not listed in chloTagValueMaxLengths
+const maxTagValueLength = 1024
+
+// chloTagValueMaxLengths are the maximum lengths of the values of tags in a CHLO that may be longer or have to be shorter
+// They only apply to messages received from clients, messages from the server (e.g. the SCFG or the certificate chain) may be larger.
+var chloTagValueMaxLengths = map[Tag]int{
+	TagPAD:  int(protocol.MaxPacketSize),
+	TagSNI:  255,
+	TagPUBS: 128,
+	TagNONC: 64,
+	TagSTK:  256,
+	TagCERT: 16 * 1024,
+}
+
 // ParseHandshakeMessage reads a crypto message
 func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
+	return parseHandshakeMessage(r, false)
+}
+
+// parseCHLOMessage reads a crypto message sent by a client
+// The lengths of the tag values are limited, so that a client can't make us allocate large amounts of memory.
+func parseCHLOMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
+	return parseHandshakeMessage(r, true)
+}
+
+func parseHandshakeMessage(r utils.ReadStream, limitValueLengths bool) (Tag, map[Tag][]byte, error) {
 	messageTag, err := utils.ReadUint32(r)
 	if err != nil {
 		return 0, nil, err
@@ -21,6 +47,9 @@ func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
 	if err != nil {
 		return 0, nil, err
 	}
+	if nPairs > protocol.CryptoMaxParams {
+		return 0, nil, qerr.CryptoTooManyEntries
+	}
 
 	index := make([]byte, nPairs*8)
 	_, err = io.ReadFull(r, index)
@@ -36,6 +65,19 @@ func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
 		tag := Tag(binary.LittleEndian.Uint32(index[indexPos : indexPos+4]))
 		dataEnd := int(binary.LittleEndian.Uint32(index[indexPos+4 : indexPos+8]))
 
+		if dataEnd < dataStart {
+			return 0, nil, qerr.Error(qerr.CryptoInvalidValueLength, fmt.Sprintf("value of tag %s has a negative length", tagToString(tag)))
+		}
+		if limitValueLengths {
+			maxLength, ok := chloTagValueMaxLengths[tag]
+			if !ok {
+				maxLength = maxTagValueLength
+			}
+			if dataEnd-dataStart > maxLength {
+				return 0, nil, qerr.Error(qerr.CryptoInvalidValueLength, fmt.Sprintf("value of tag %s too long", tagToString(tag)))
+			}
+		}
+
 		data := make([]byte, dataEnd-dataStart)
 		_, err = io.ReadFull(r, data)
 		if err != nil {
@@ -49,6 +91,23 @@ func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
 	return Tag(messageTag), resultMap, nil
 }
 
+// ParseCHLO parses a complete CHLO message, e.g. one captured from the wire
+// data must contain exactly one message, trailing bytes are an error
+func ParseCHLO(data []byte) (map[Tag][]byte, error) {
+	r := bytes.NewReader(data)
+	messageTag, cryptoData, err := parseCHLOMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if messageTag != TagCHLO {
+		return nil, qerr.InvalidCryptoMessageType
+	}
+	if r.Len() != 0 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "trailing data after CHLO")
+	}
+	return cryptoData, nil
+}
+
 // WriteHandshakeMessage writes a crypto message
 func WriteHandshakeMessage(b *bytes.Buffer, messageTag Tag, data map[Tag][]byte) {
 	utils.WriteUint32(b, uint32(messageTag))
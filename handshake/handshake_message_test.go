@@ -2,6 +2,11 @@ package handshake
 
 import (
 	"bytes"
+	"io"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,6 +20,131 @@ var _ = Describe("Handshake Message", func() {
 			Expect(tag).To(Equal(TagCHLO))
 			Expect(msg).To(Equal(sampleCHLOMap))
 		})
+
+		Context("tag value lengths", func() {
+			It("errors on an oversized PUBS in a CHLO", func() {
+				b := &bytes.Buffer{}
+				WriteHandshakeMessage(b, TagCHLO, map[Tag][]byte{
+					TagSNI:  []byte("quic.clemente.io"),
+					TagPUBS: bytes.Repeat([]byte{'a'}, 129),
+				})
+				_, _, err := parseCHLOMessage(b)
+				Expect(err).To(MatchError("CryptoInvalidValueLength: value of tag PUBS too long"))
+			})
+
+			It("errors on an oversized unknown tag", func() {
+				b := &bytes.Buffer{}
+				WriteHandshakeMessage(b, TagCHLO, map[Tag][]byte{
+					Tag('F' + 'O'<<8 + 'O'<<16 + 'O'<<24): bytes.Repeat([]byte{'a'}, maxTagValueLength+1),
+				})
+				_, _, err := parseCHLOMessage(b)
+				Expect(err).To(MatchError("CryptoInvalidValueLength: value of tag FOOO too long"))
+			})
+
+			It("accepts tag values up to the maximum length", func() {
+				b := &bytes.Buffer{}
+				WriteHandshakeMessage(b, TagCHLO, map[Tag][]byte{
+					TagPUBS: bytes.Repeat([]byte{'a'}, 128),
+					TagPAD:  bytes.Repeat([]byte{'-'}, int(protocol.MaxPacketSize)),
+				})
+				_, msg, err := parseCHLOMessage(b)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg[TagPUBS]).To(HaveLen(128))
+			})
+
+			It("doesn't limit the tag value lengths of messages sent by the server", func() {
+				scfg := &bytes.Buffer{}
+				WriteHandshakeMessage(scfg, TagSCFG, map[Tag][]byte{
+					TagKEXS: []byte("C255P256"),
+					TagPUBS: bytes.Repeat([]byte{'a'}, 200),
+				})
+				b := &bytes.Buffer{}
+				WriteHandshakeMessage(b, TagREJ, map[Tag][]byte{
+					TagSCFG: scfg.Bytes(),
+					TagCERT: bytes.Repeat([]byte{'c'}, 32*1024),
+				})
+				tag, msg, err := ParseHandshakeMessage(b)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tag).To(Equal(TagREJ))
+				Expect(msg[TagCERT]).To(HaveLen(32 * 1024))
+				tag, msg, err = ParseHandshakeMessage(bytes.NewReader(msg[TagSCFG]))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tag).To(Equal(TagSCFG))
+				Expect(msg[TagPUBS]).To(HaveLen(200))
+			})
+
+			It("errors on decreasing offsets", func() {
+				b := &bytes.Buffer{}
+				utils.WriteUint32(b, uint32(TagCHLO))
+				utils.WriteUint32(b, 2)
+				utils.WriteUint32(b, uint32(TagSNI))
+				utils.WriteUint32(b, 10)
+				utils.WriteUint32(b, uint32(TagPUBS))
+				utils.WriteUint32(b, 5)
+				b.Write(bytes.Repeat([]byte{'a'}, 10))
+				_, _, err := ParseHandshakeMessage(b)
+				Expect(err).To(MatchError("CryptoInvalidValueLength: value of tag PUBS has a negative length"))
+			})
+		})
+
+		It("errors on too many tag-value pairs", func() {
+			b := &bytes.Buffer{}
+			utils.WriteUint32(b, uint32(TagCHLO))
+			utils.WriteUint32(b, 0xffffffff)
+			_, _, err := ParseHandshakeMessage(b)
+			Expect(err).To(MatchError(qerr.CryptoTooManyEntries))
+		})
+
+		It("accepts the maximum number of tag-value pairs", func() {
+			data := map[Tag][]byte{}
+			for i := 0; i < protocol.CryptoMaxParams; i++ {
+				data[Tag(i)] = []byte{byte(i)}
+			}
+			b := &bytes.Buffer{}
+			WriteHandshakeMessage(b, TagCHLO, data)
+			_, msg, err := ParseHandshakeMessage(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg).To(HaveLen(protocol.CryptoMaxParams))
+		})
+
+		Context("CHLOs", func() {
+			It("parses a sample CHLO", func() {
+				msg, err := ParseCHLO(sampleCHLO)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg).To(Equal(sampleCHLOMap))
+			})
+
+			It("errors on other message types", func() {
+				b := &bytes.Buffer{}
+				WriteHandshakeMessage(b, TagSHLO, sampleCHLOMap)
+				_, err := ParseCHLO(b.Bytes())
+				Expect(err).To(MatchError(qerr.InvalidCryptoMessageType))
+			})
+
+			It("errors on truncated messages", func() {
+				_, err := ParseCHLO(sampleCHLO[:len(sampleCHLO)-1])
+				Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+			})
+
+			It("errors on trailing data", func() {
+				data := append(append([]byte{}, sampleCHLO...), 0)
+				_, err := ParseCHLO(data)
+				Expect(err).To(MatchError("CryptoInvalidValueLength: trailing data after CHLO"))
+			})
+
+			It("errors on decreasing offsets", func() {
+				b := &bytes.Buffer{}
+				utils.WriteUint32(b, uint32(TagCHLO))
+				utils.WriteUint32(b, 2)
+				utils.WriteUint32(b, uint32(TagSNI))
+				utils.WriteUint32(b, 4)
+				utils.WriteUint32(b, uint32(TagKEXS))
+				utils.WriteUint32(b, 0)
+				b.WriteString("quic")
+				_, err := ParseCHLO(b.Bytes())
+				Expect(err).To(MatchError("CryptoInvalidValueLength: value of tag KEXS has a negative length"))
+			})
+		})
 	})
 
 	Context("when writing", func() {
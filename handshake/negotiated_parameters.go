@@ -0,0 +1,68 @@
+package handshake
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// NegotiatedParameters is a snapshot of the parameters negotiated for a connection
+type NegotiatedParameters struct {
+	ConnectionID   protocol.ConnectionID
+	Version        protocol.VersionNumber
+	HandshakeState HandshakeState
+
+	// the key exchange and AEAD algorithms, empty until keys were derived from a full CHLO
+	KeyExchange string
+	AEAD        string
+
+	ServerNonce          []byte
+	DiversificationNonce []byte
+
+	IdleTimeout          time.Duration
+	MaxIncomingStreams   uint32
+	MaxOutgoingStreams   uint32
+	TruncateConnectionID bool
+}
+
+// negotiatedParametersJSON is the JSON representation of the NegotiatedParameters
+// Binary values are hex encoded, so that the format is stable and readable.
+type negotiatedParametersJSON struct {
+	ConnectionID         string `json:"connection_id"`
+	Version              int    `json:"version"`
+	HandshakeState       string `json:"handshake_state"`
+	KeyExchange          string `json:"key_exchange"`
+	AEAD                 string `json:"aead"`
+	ServerNonce          string `json:"server_nonce"`
+	DiversificationNonce string `json:"diversification_nonce"`
+	IdleTimeoutMs        int64  `json:"idle_timeout_ms"`
+	MaxIncomingStreams   uint32 `json:"max_incoming_streams"`
+	MaxOutgoingStreams   uint32 `json:"max_outgoing_streams"`
+	TruncateConnectionID bool   `json:"truncate_connection_id"`
+}
+
+var handshakeStateNames = map[HandshakeState]string{
+	HandshakeStateUnencrypted:   "unencrypted",
+	HandshakeStateSecure:        "secure",
+	HandshakeStateForwardSecure: "forward-secure",
+}
+
+// MarshalJSON encodes the parameters as JSON, e.g. for debugging tools
+func (p NegotiatedParameters) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&negotiatedParametersJSON{
+		ConnectionID:         fmt.Sprintf("%016x", uint64(p.ConnectionID)),
+		Version:              int(p.Version),
+		HandshakeState:       handshakeStateNames[p.HandshakeState],
+		KeyExchange:          p.KeyExchange,
+		AEAD:                 p.AEAD,
+		ServerNonce:          hex.EncodeToString(p.ServerNonce),
+		DiversificationNonce: hex.EncodeToString(p.DiversificationNonce),
+		IdleTimeoutMs:        int64(p.IdleTimeout / time.Millisecond),
+		MaxIncomingStreams:   p.MaxIncomingStreams,
+		MaxOutgoingStreams:   p.MaxOutgoingStreams,
+		TruncateConnectionID: p.TruncateConnectionID,
+	})
+}
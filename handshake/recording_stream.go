@@ -0,0 +1,73 @@
+package handshake
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// A RecordedMessage is data that was read from or written to the crypto stream
+type RecordedMessage struct {
+	// Sent is true for data written by the server, and false for data read from the client
+	Sent bool
+	Data []byte
+}
+
+// A RecordingStream wraps the crypto stream and records all data read and written
+// It can be used to capture the byte exchange of a handshake, e.g. to replay it in regression tests.
+// Consecutive reads (or writes) are recorded as a single message.
+type RecordingStream struct {
+	utils.Stream
+
+	records []RecordedMessage
+	mutex   sync.Mutex
+}
+
+// NewRecordingStream creates a new RecordingStream
+func NewRecordingStream(stream utils.Stream) *RecordingStream {
+	return &RecordingStream{Stream: stream}
+}
+
+func (s *RecordingStream) record(sent bool, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if n := len(s.records); n > 0 && s.records[n-1].Sent == sent {
+		s.records[n-1].Data = append(s.records[n-1].Data, data...)
+		return
+	}
+	s.records = append(s.records, RecordedMessage{Sent: sent, Data: append([]byte{}, data...)})
+}
+
+// Read implements io.Reader
+func (s *RecordingStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	s.record(false, p[:n])
+	return n, err
+}
+
+// ReadByte implements io.ByteReader
+func (s *RecordingStream) ReadByte() (byte, error) {
+	b, err := s.Stream.ReadByte()
+	if err == nil {
+		s.record(false, []byte{b})
+	}
+	return b, err
+}
+
+// Write implements io.Writer
+func (s *RecordingStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	s.record(true, p[:n])
+	return n, err
+}
+
+// Records returns the data recorded so far
+func (s *RecordingStream) Records() []RecordedMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]RecordedMessage{}, s.records...)
+}
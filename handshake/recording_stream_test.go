@@ -0,0 +1,96 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recording stream", func() {
+	ip := net.ParseIP("1.2.3.4")
+	now := time.Unix(1000000, 0)
+
+	// newPinnedCryptoSetup creates a CryptoSetup that doesn't use any randomness
+	newPinnedCryptoSetup := func(stream *RecordingStream) *CryptoSetup {
+		scfg, err := NewServerConfig(&mockKEX{}, &mockSigner{})
+		Expect(err).ToNot(HaveOccurred())
+		scfg.ID = bytes.Repeat([]byte{0x13}, 16)
+		scfg.stkSource = &mockStkSource{}
+		scfg.ticketSource = &mockTicketSource{}
+		scfg.rand = bytes.NewReader(bytes.Repeat([]byte{0x42}, 64))
+		cs, err := NewCryptoSetup(protocol.ConnectionID(42), ip, protocol.VersionNumber(33), scfg, stream, NewConnectionParamatersManager(), make(chan struct{}, 1))
+		Expect(err).ToNot(HaveOccurred())
+		cs.keyDerivation = mockKeyDerivation
+		cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+		cs.clock = &mockClock{now: now}
+		return cs
+	}
+
+	BeforeEach(func() {
+		expectedInitialNonceLen = 32
+		expectedFSNonceLen = 64
+	})
+
+	It("records consecutive reads and writes as one message", func() {
+		s := &mockStream{}
+		s.dataToRead.Write([]byte("foobar"))
+		stream := NewRecordingStream(s)
+		_, err := stream.ReadByte()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = stream.Read(make([]byte, 5))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = stream.Write([]byte("foo"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = stream.Write([]byte("bar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stream.Records()).To(Equal([]RecordedMessage{
+			{Sent: false, Data: []byte("foobar")},
+			{Sent: true, Data: []byte("foobar")},
+		}))
+	})
+
+	It("replays a recorded handshake", func() {
+		stk, err := mockStkSource{}.NewToken(ip)
+		Expect(err).ToNot(HaveOccurred())
+		nonce := make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce, uint32(now.Unix()))
+		s := &mockStream{}
+		WriteHandshakeMessage(&s.dataToRead, TagCHLO, map[Tag][]byte{
+			TagSNI: []byte("quic.clemente.io"),
+			TagSTK: stk,
+			TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+		})
+		WriteHandshakeMessage(&s.dataToRead, TagCHLO, map[Tag][]byte{
+			TagSCID: bytes.Repeat([]byte{0x13}, 16),
+			TagSNI:  []byte("quic.clemente.io"),
+			TagNONC: nonce,
+			TagPUBS: []byte("pubs-c"),
+			TagICSL: []byte{10, 0, 0, 0},
+			TagMSPC: []byte{2, 0, 0, 0},
+			TagSTK:  stk,
+			TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+		})
+		recording := NewRecordingStream(s)
+		Expect(newPinnedCryptoSetup(recording).HandleCryptoStream()).To(Succeed())
+		records := recording.Records()
+		// CHLO, REJ, CHLO, SHLO
+		Expect(records).To(HaveLen(4))
+		Expect(records[1].Data).To(HavePrefix("REJ"))
+		Expect(records[3].Data).To(HavePrefix("SHLO"))
+
+		// feed the recorded CHLOs to a new CryptoSetup
+		replayStream := &mockStream{}
+		replayStream.dataToRead.Write(records[0].Data)
+		replayStream.dataToRead.Write(records[2].Data)
+		replay := NewRecordingStream(replayStream)
+		Expect(newPinnedCryptoSetup(replay).HandleCryptoStream()).To(Succeed())
+		Expect(replay.Records()).To(Equal(records))
+	})
+})
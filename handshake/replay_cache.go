@@ -0,0 +1,106 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+var (
+	errNonceReplayed      = errors.New("client nonce was already used")
+	errNonceOutsideWindow = errors.New("client nonce timestamp is outside of the replay cache window")
+	errReplayCacheFull    = errors.New("replay cache is full")
+)
+
+type replayCacheEntry struct {
+	nonce string
+	added time.Time
+}
+
+// A replayCache remembers the client nonces of 0-RTT CHLOs, to detect replayed CHLOs
+// Nonces are remembered for protocol.ReplayCacheWindow, but at most protocol.MaxReplayCacheEntries nonces are kept.
+// Nonces are never evicted before the window has passed, so that a captured CHLO can't be replayed after flooding the cache.
+// For the same reason, nonces with a timestamp outside of the window are not accepted at all.
+type replayCache struct {
+	window     time.Duration
+	maxEntries int
+
+	nonces map[string]bool
+	// the entries, in the order they were added
+	queue []replayCacheEntry
+	mutex sync.Mutex
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		window:     protocol.ReplayCacheWindow,
+		maxEntries: protocol.MaxReplayCacheEntries,
+		nonces:     make(map[string]bool),
+	}
+}
+
+// Check returns an error if a 0-RTT CHLO with this nonce must not be accepted at time now
+func (c *replayCache) Check(nonce []byte, now time.Time) error {
+	if !c.isInWindow(nonce, now) {
+		return errNonceOutsideWindow
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeExpired(now)
+	return c.check(nonce)
+}
+
+// Contains returns if the nonce was already seen
+func (c *replayCache) Contains(nonce []byte, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeExpired(now)
+	return c.nonces[string(nonce)]
+}
+
+// Add remembers a nonce. It returns an error if the nonce was already seen, or if the cache is full.
+func (c *replayCache) Add(nonce []byte, now time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeExpired(now)
+	if err := c.check(nonce); err != nil {
+		return err
+	}
+	key := string(nonce)
+	c.nonces[key] = true
+	c.queue = append(c.queue, replayCacheEntry{nonce: key, added: now})
+	return nil
+}
+
+func (c *replayCache) check(nonce []byte) error {
+	if c.nonces[string(nonce)] {
+		return errNonceReplayed
+	}
+	if len(c.queue) >= c.maxEntries {
+		return errReplayCacheFull
+	}
+	return nil
+}
+
+// isInWindow checks the timestamp in the first 4 bytes of the client nonce
+func (c *replayCache) isInWindow(nonce []byte, now time.Time) bool {
+	if len(nonce) < 4 {
+		return false
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(nonce)), 0)
+	return now.Sub(timestamp) <= c.window && timestamp.Sub(now) <= c.window
+}
+
+func (c *replayCache) removeExpired(now time.Time) {
+	for len(c.queue) > 0 && now.Sub(c.queue[0].added) > c.window {
+		delete(c.nonces, c.queue[0].nonce)
+		c.queue = c.queue[1:]
+	}
+}
@@ -0,0 +1,96 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Replay cache", func() {
+	var (
+		cache *replayCache
+		now   time.Time
+	)
+
+	// newNonce creates a client nonce with the timestamp at time t
+	newNonce := func(t time.Time, id byte) []byte {
+		nonce := make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce, uint32(t.Unix()))
+		nonce[31] = id
+		return nonce
+	}
+
+	BeforeEach(func() {
+		cache = newReplayCache()
+		now = time.Unix(1000000, 0)
+	})
+
+	It("uses the default values", func() {
+		Expect(cache.window).To(Equal(protocol.ReplayCacheWindow))
+		Expect(cache.maxEntries).To(Equal(protocol.MaxReplayCacheEntries))
+	})
+
+	It("detects a reused nonce", func() {
+		nonce1 := newNonce(now, 1)
+		nonce2 := newNonce(now, 2)
+		Expect(cache.Add(nonce1, now)).To(Succeed())
+		Expect(cache.Add(nonce2, now)).To(Succeed())
+		Expect(cache.Add(nonce1, now)).To(MatchError(errNonceReplayed))
+		Expect(cache.Check(nonce1, now)).To(MatchError(errNonceReplayed))
+		Expect(cache.Contains(nonce1, now)).To(BeTrue())
+		Expect(cache.Contains(nonce2, now)).To(BeTrue())
+	})
+
+	It("doesn't remember nonces when checking them", func() {
+		nonce := newNonce(now, 1)
+		Expect(cache.Check(nonce, now)).To(Succeed())
+		Expect(cache.Check(nonce, now)).To(Succeed())
+		Expect(cache.Contains(nonce, now)).To(BeFalse())
+		Expect(cache.queue).To(BeEmpty())
+	})
+
+	It("forgets nonces after the window", func() {
+		nonce := newNonce(now, 1)
+		Expect(cache.Add(nonce, now)).To(Succeed())
+		later := now.Add(protocol.ReplayCacheWindow + time.Second)
+		Expect(cache.Contains(nonce, later)).To(BeFalse())
+		Expect(cache.queue).To(BeEmpty())
+	})
+
+	It("rejects nonces with a timestamp outside of the window", func() {
+		Expect(cache.Check(newNonce(now.Add(-protocol.ReplayCacheWindow), 1), now)).To(Succeed())
+		Expect(cache.Check(newNonce(now.Add(protocol.ReplayCacheWindow), 1), now)).To(Succeed())
+		Expect(cache.Check(newNonce(now.Add(-protocol.ReplayCacheWindow-time.Second), 1), now)).To(MatchError(errNonceOutsideWindow))
+		Expect(cache.Check(newNonce(now.Add(protocol.ReplayCacheWindow+time.Second), 1), now)).To(MatchError(errNonceOutsideWindow))
+		Expect(cache.Check([]byte{1, 2, 3}, now)).To(MatchError(errNonceOutsideWindow))
+	})
+
+	It("doesn't accept a nonce again once it was forgotten", func() {
+		nonce := newNonce(now, 1)
+		Expect(cache.Add(nonce, now)).To(Succeed())
+		later := now.Add(protocol.ReplayCacheWindow + time.Second)
+		Expect(cache.Check(nonce, later)).To(MatchError(errNonceOutsideWindow))
+	})
+
+	It("doesn't evict nonces when it is full", func() {
+		cache.maxEntries = 2
+		Expect(cache.Add(newNonce(now, 1), now)).To(Succeed())
+		Expect(cache.Add(newNonce(now, 2), now)).To(Succeed())
+		Expect(cache.Check(newNonce(now, 3), now)).To(MatchError(errReplayCacheFull))
+		Expect(cache.Add(newNonce(now, 3), now)).To(MatchError(errReplayCacheFull))
+		Expect(cache.nonces).To(HaveLen(2))
+		Expect(cache.Contains(newNonce(now, 1), now)).To(BeTrue())
+		Expect(cache.Contains(newNonce(now, 3), now)).To(BeFalse())
+	})
+
+	It("accepts new nonces once old ones expired", func() {
+		cache.maxEntries = 1
+		Expect(cache.Add(newNonce(now, 1), now)).To(Succeed())
+		later := now.Add(protocol.ReplayCacheWindow + time.Second)
+		Expect(cache.Add(newNonce(later, 2), later)).To(Succeed())
+	})
+})
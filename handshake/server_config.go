@@ -3,17 +3,96 @@ package handshake
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
 )
 
+// The key exchange and AEAD algorithms we support, as encoded in the KEXS and AEAD tags
+var (
+	kexCurve25519        = []byte("C255")
+	aeadChacha20Poly1305 = []byte("CC20")
+	aeadAESGCM           = []byte("AESG")
+)
+
+// An aeadAlgorithm is an AEAD algorithm advertised in the server config
+type aeadAlgorithm struct {
+	tag                 []byte
+	keyDerivation       KeyDerivationFunction
+	clientKeyDerivation KeyDerivationFunction
+}
+
+// supportedAEADs are the AEAD algorithms we support, in the order they are advertised in the server config
+var supportedAEADs = []aeadAlgorithm{
+	{tag: aeadChacha20Poly1305, keyDerivation: crypto.DeriveKeysChacha20, clientKeyDerivation: crypto.DeriveClientKeysChacha20},
+	{tag: aeadAESGCM, keyDerivation: crypto.DeriveKeysAESGCM, clientKeyDerivation: crypto.DeriveClientKeysAESGCM},
+}
+
+func supportedAEADTags() []byte {
+	var tags []byte
+	for _, aead := range supportedAEADs {
+		tags = append(tags, aead.tag...)
+	}
+	return tags
+}
+
+// A keyExchangeAlgorithm is a key exchange algorithm advertised in the server config
+type keyExchangeAlgorithm struct {
+	tag []byte
+	// the key exchange of the server config, used for the initial keys
+	kex crypto.KeyExchange
+	// creates the ephemeral key exchanges used for the forward secure keys
+	newEphemeral KeyExchangeFunction
+}
+
 // ServerConfig is a server config
 type ServerConfig struct {
-	kex       crypto.KeyExchange
+	// the key exchange algorithms, in the order of our preference
+	kexs      []keyExchangeAlgorithm
 	signer    crypto.Signer
 	ID        []byte
 	stkSource crypto.StkSource
+
+	ticketSource crypto.TicketSource
+	replayCache  *replayCache
+
+	preferredAddress      *net.UDPAddr
+	preferredAddressMutex sync.RWMutex
+
+	// reject CHLOs containing tags we don't know, instead of ignoring these tags
+	strictTagParsing bool
+
+	// if set, the ephemeral key exchanges are taken from this pool
+	kexPool *crypto.KeyExchangePool
+
+	// if set, it is notified about handshake events
+	tracer Tracer
+
+	// the time reordered packets with the initial encryption are accepted after the first forward secure packet
+	initialEncryptionGracePeriod time.Duration
+
+	// limits the data buffered while reading handshake messages, for all connections using this server config
+	cryptoStreamBufferLimiter *utils.BufferLimiter
+
+	// the source of randomness for the server nonces, only replaced in tests
+	rand io.Reader
+	// if set, the diversification nonces are read from this source instead of rand
+	divNonceSource io.Reader
+
+	// the versions announced in the SHLO, which allows clients to detect version downgrades
+	supportedVersionsAsTags []byte
+
+	// if set, CHLOs with an SNI not contained in this set are rejected. The hostnames are lower case.
+	acceptedHostnames map[string]struct{}
 }
 
 // NewServerConfig creates a new server config
@@ -33,22 +112,45 @@ func NewServerConfig(kex crypto.KeyExchange, signer crypto.Signer) (*ServerConfi
 		return nil, err
 	}
 
+	ticketSecret := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, ticketSecret); err != nil {
+		return nil, err
+	}
+	ticketSource, err := crypto.NewTicketSource(ticketSecret)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ServerConfig{
-		kex:       kex,
-		signer:    signer,
-		ID:        id,
-		stkSource: stkSource,
+		kexs:         []keyExchangeAlgorithm{{tag: kexCurve25519, kex: kex, newEphemeral: crypto.NewCurve25519KEX}},
+		signer:       signer,
+		ID:           id,
+		stkSource:    stkSource,
+		ticketSource: ticketSource,
+		replayCache:  newReplayCache(),
+		rand:         rand.Reader,
+
+		supportedVersionsAsTags:   protocol.SupportedVersionsAsTags,
+		cryptoStreamBufferLimiter: utils.NewBufferLimiter(protocol.MaxCryptoStreamBufferSize),
 	}, nil
 }
 
 // Get the server config binary representation
 func (s *ServerConfig) Get() []byte {
 	var serverConfig bytes.Buffer
+	var kexs, pubs []byte
+	for _, alg := range s.kexs {
+		kexs = append(kexs, alg.tag...)
+		// each public value is prefixed with its length, as a 24 bit little endian integer
+		pub := alg.kex.PublicKey()
+		pubs = append(pubs, byte(len(pub)), byte(len(pub)>>8), byte(len(pub)>>16))
+		pubs = append(pubs, pub...)
+	}
 	WriteHandshakeMessage(&serverConfig, TagSCFG, map[Tag][]byte{
 		TagSCID: s.ID,
-		TagKEXS: []byte("C255"),
-		TagAEAD: []byte("CC20"),
-		TagPUBS: append([]byte{0x20, 0x00, 0x00}, s.kex.PublicKey()...),
+		TagKEXS: kexs,
+		TagAEAD: supportedAEADTags(),
+		TagPUBS: pubs,
 		TagOBIT: {0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7},
 		TagEXPY: {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 		TagVER:  []byte("Q032"),
@@ -56,6 +158,56 @@ func (s *ServerConfig) Get() []byte {
 	return serverConfig.Bytes()
 }
 
+// AddKeyExchange adds a key exchange algorithm, which is advertised after the algorithms added before.
+// The tag is the algorithm's 4 byte tag in the KEXS list, e.g. "P256". newEphemeral creates the key exchanges for the forward secure keys.
+// It must be called before the server config is used.
+func (s *ServerConfig) AddKeyExchange(tag []byte, kex crypto.KeyExchange, newEphemeral KeyExchangeFunction) error {
+	if len(tag) != 4 {
+		return errors.New("key exchange tags must be 4 bytes long")
+	}
+	for _, alg := range s.kexs {
+		if bytes.Equal(alg.tag, tag) {
+			return fmt.Errorf("key exchange %s already added", tag)
+		}
+	}
+	s.kexs = append(s.kexs, keyExchangeAlgorithm{tag: tag, kex: kex, newEphemeral: newEphemeral})
+	return nil
+}
+
+// selectKeyExchange selects the key exchange algorithm for a CHLO
+// If the client sent a KEXS list, the first of our algorithms, in the order advertised in the server config, that the client supports is used.
+func (s *ServerConfig) selectKeyExchange(clientKEXS []byte) (*keyExchangeAlgorithm, error) {
+	if clientKEXS == nil {
+		return &s.kexs[0], nil
+	}
+	for i := range s.kexs {
+		for j := 0; j+4 <= len(clientKEXS); j += 4 {
+			if bytes.Equal(s.kexs[i].tag, clientKEXS[j:j+4]) {
+				return &s.kexs[i], nil
+			}
+		}
+	}
+	return nil, qerr.Error(qerr.CryptoMessageParameterNoOverlap, "no mutually supported KEXS")
+}
+
+// selectAEAD selects the AEAD algorithm for a CHLO
+// Unlike for the key exchange, the client's order of preference is used, since clients know best which AEAD is fast on their hardware.
+// If the client didn't send an AEAD tag, chacha20poly1305 is used.
+func selectAEAD(clientAEADs []byte) (*aeadAlgorithm, error) {
+	if clientAEADs == nil {
+		return &supportedAEADs[0], nil
+	}
+	for j := 0; j+4 <= len(clientAEADs); j += 4 {
+		for i := range supportedAEADs {
+			if bytes.Equal(supportedAEADs[i].tag, clientAEADs[j:j+4]) {
+				return &supportedAEADs[i], nil
+			}
+		}
+	}
+	utils.Infof("Client offered AEADs %q, but we only support %q", clientAEADs, supportedAEADTags())
+	return nil, qerr.Error(qerr.CryptoMessageParameterNoOverlap, "no mutually supported AEAD")
+}
+
 // Sign the server config and CHLO with the server's keyData
 func (s *ServerConfig) Sign(sni string, chlo []byte) ([]byte, error) {
 	return s.signer.SignServerProof(sni, chlo, s.Get())
@@ -65,3 +217,119 @@ func (s *ServerConfig) Sign(sni string, chlo []byte) ([]byte, error) {
 func (s *ServerConfig) GetCertsCompressed(sni string, commonSetHashes, compressedHashes []byte) ([]byte, error) {
 	return s.signer.GetCertsCompressed(sni, commonSetHashes, compressedHashes)
 }
+
+// SetCommonCertSets sets common certificate sets that are used for compressing the certificate chain, in addition to the built-in ones.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetCommonCertSets(sets []*crypto.CommonCertSet) error {
+	signer, ok := s.signer.(crypto.CommonCertSetUser)
+	if !ok {
+		return errors.New("the signer doesn't support common certificate sets")
+	}
+	signer.SetCommonCertSets(sets)
+	return nil
+}
+
+// GetSCTList returns the signed certificate timestamps of the certificate, or nil if there are none
+func (s *ServerConfig) GetSCTList(sni string) ([]byte, error) {
+	return s.signer.GetSCTList(sni)
+}
+
+// SetPreferredAddress sets the address that is advertised to clients in the SHLO.
+// Clients may migrate to this address after the handshake.
+func (s *ServerConfig) SetPreferredAddress(addr *net.UDPAddr) {
+	s.preferredAddressMutex.Lock()
+	s.preferredAddress = addr
+	s.preferredAddressMutex.Unlock()
+}
+
+// PreferredAddress gets the address that is advertised to clients in the SHLO, or nil if none is set
+func (s *ServerConfig) PreferredAddress() *net.UDPAddr {
+	s.preferredAddressMutex.RLock()
+	defer s.preferredAddressMutex.RUnlock()
+	return s.preferredAddress
+}
+
+// encodeSocketAddress encodes an address for the SPAD tag: the address family, the IP and the port
+func encodeSocketAddress(addr *net.UDPAddr) []byte {
+	var b bytes.Buffer
+	if ip := addr.IP.To4(); ip != nil {
+		utils.WriteUint16(&b, 2) // AF_INET
+		b.Write(ip)
+	} else {
+		utils.WriteUint16(&b, 10) // AF_INET6
+		b.Write(addr.IP.To16())
+	}
+	utils.WriteUint16(&b, uint16(addr.Port))
+	return b.Bytes()
+}
+
+// SetStrictTagParsing sets if CHLOs containing unknown tags are rejected
+// By default, unknown tags are ignored. Rejecting them helps debugging interop with experimental clients.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetStrictTagParsing(strict bool) {
+	s.strictTagParsing = strict
+}
+
+// SetStkSource sets the source for the source address tokens, e.g. to use a different validity period
+// Servers behind a load balancer must use the same secret on all servers.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetStkSource(source crypto.StkSource) {
+	s.stkSource = source
+}
+
+// SetKeyExchangePool sets a pool of pre-generated ephemeral key exchanges used for the handshakes
+// It must be called before the server config is used.
+func (s *ServerConfig) SetKeyExchangePool(pool *crypto.KeyExchangePool) {
+	s.kexPool = pool
+}
+
+// SetInitialEncryptionGracePeriod sets the time packets with the initial encryption are still accepted after the first forward secure packet was received.
+// This allows reordered packets sent before the first forward secure packet to be processed.
+// Only packets with a lower packet number than the first forward secure packet are accepted. The grace period is disabled by default.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetInitialEncryptionGracePeriod(d time.Duration) {
+	s.initialEncryptionGracePeriod = d
+}
+
+// SetDiversificationNonceSource sets the source the diversification nonces are read from.
+// This allows fixing the diversification nonce, e.g. for interop testing. It must never be used in production.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetDiversificationNonceSource(source io.Reader) {
+	s.divNonceSource = source
+}
+
+// SetSupportedVersions sets the versions announced in the SHLO
+// They must match the versions listed in the version negotiation packets, otherwise clients detect a version downgrade.
+// It must be called before the server config is used.
+func (s *ServerConfig) SetSupportedVersions(versions []protocol.VersionNumber) {
+	s.supportedVersionsAsTags = protocol.VersionsAsTags(versions)
+}
+
+// SetAcceptedHostnames sets the hostnames clients may request in the SNI
+// CHLOs for any other hostname are rejected before any certificate is looked up. Hostnames are compared case-insensitively.
+// A nil or empty list accepts all hostnames. It must be called before the server config is used.
+func (s *ServerConfig) SetAcceptedHostnames(hostnames []string) {
+	if len(hostnames) == 0 {
+		s.acceptedHostnames = nil
+		return
+	}
+	s.acceptedHostnames = make(map[string]struct{}, len(hostnames))
+	for _, h := range hostnames {
+		s.acceptedHostnames[strings.ToLower(h)] = struct{}{}
+	}
+}
+
+// acceptsHostname checks if a client may request this hostname in the SNI
+func (s *ServerConfig) acceptsHostname(sni string) bool {
+	if s.acceptedHostnames == nil {
+		return true
+	}
+	_, ok := s.acceptedHostnames[strings.ToLower(sni)]
+	return ok
+}
+
+// SetTracer sets a tracer that is notified about events of the handshakes
+// It must be called before the server config is used.
+func (s *ServerConfig) SetTracer(tracer Tracer) {
+	s.tracer = tracer
+}
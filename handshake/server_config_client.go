@@ -0,0 +1,122 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/qerr"
+)
+
+// A serverConfigClient is a server config received by a client in a REJ
+type serverConfigClient struct {
+	raw    []byte
+	ID     []byte
+	obit   []byte
+	expiry time.Time
+	aeads  []byte
+
+	// the client's key exchange, and the shared key calculated with the server's curve25519 public value
+	kex          crypto.KeyExchange
+	sharedSecret []byte
+}
+
+var (
+	errMessageNotServerConfig = errors.New("ServerConfig must have TagSCFG")
+	errNoCurve25519           = qerr.Error(qerr.CryptoNoSupport, "server config doesn't support C255")
+)
+
+// parseServerConfig parses a server config and calculates the shared key for the initial keys
+func parseServerConfig(data []byte, newKEX KeyExchangeFunction) (*serverConfigClient, error) {
+	tag, tagMap, err := ParseHandshakeMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if tag != TagSCFG {
+		return nil, errMessageNotServerConfig
+	}
+
+	scfg := &serverConfigClient{raw: data}
+	var ok bool
+	scfg.ID, ok = tagMap[TagSCID]
+	if !ok || len(scfg.ID) != 16 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "SCID")
+	}
+	scfg.obit, ok = tagMap[TagOBIT]
+	if !ok || len(scfg.obit) != 8 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "OBIT")
+	}
+	expy, ok := tagMap[TagEXPY]
+	if !ok || len(expy) != 8 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "EXPY")
+	}
+	// EXPY is a Unix timestamp. Values too large for a time.Time mean that the server config never expires.
+	expiry := binary.LittleEndian.Uint64(expy)
+	if expiry > math.MaxInt64/2 {
+		expiry = math.MaxInt64 / 2
+	}
+	scfg.expiry = time.Unix(int64(expiry), 0)
+	scfg.aeads, ok = tagMap[TagAEAD]
+	if !ok || len(scfg.aeads) == 0 || len(scfg.aeads)%4 != 0 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "AEAD")
+	}
+
+	pub, err := curve25519PublicValue(tagMap[TagKEXS], tagMap[TagPUBS])
+	if err != nil {
+		return nil, err
+	}
+	scfg.kex, err = newKEX()
+	if err != nil {
+		return nil, err
+	}
+	scfg.sharedSecret, err = scfg.kex.CalculateSharedKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return scfg, nil
+}
+
+// curve25519PublicValue finds the curve25519 public value in the PUBS of a server config
+// The public values are listed in the same order as the algorithms in KEXS, each prefixed with its 24 bit little endian length.
+func curve25519PublicValue(kexs, pubs []byte) ([]byte, error) {
+	if len(kexs) == 0 || len(kexs)%4 != 0 {
+		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "KEXS")
+	}
+	for i := 0; i < len(kexs); i += 4 {
+		if len(pubs) < 3 {
+			return nil, qerr.Error(qerr.CryptoInvalidValueLength, "PUBS")
+		}
+		l := int(pubs[0]) | int(pubs[1])<<8 | int(pubs[2])<<16
+		if len(pubs) < 3+l {
+			return nil, qerr.Error(qerr.CryptoInvalidValueLength, "PUBS")
+		}
+		pub := pubs[3 : 3+l]
+		pubs = pubs[3+l:]
+		if bytes.Equal(kexs[i:i+4], kexCurve25519) {
+			if len(pub) != 32 {
+				return nil, qerr.Error(qerr.CryptoInvalidValueLength, "PUBS")
+			}
+			return pub, nil
+		}
+	}
+	return nil, errNoCurve25519
+}
+
+// selectAEAD selects the AEAD algorithm, in our order of preference, among the ones the server supports
+func (s *serverConfigClient) selectAEAD() (*aeadAlgorithm, error) {
+	for i := range supportedAEADs {
+		for j := 0; j+4 <= len(s.aeads); j += 4 {
+			if bytes.Equal(supportedAEADs[i].tag, s.aeads[j:j+4]) {
+				return &supportedAEADs[i], nil
+			}
+		}
+	}
+	return nil, qerr.Error(qerr.CryptoNoSupport, "server config doesn't support any of our AEADs")
+}
+
+func (s *serverConfigClient) isExpired() bool {
+	return time.Now().After(s.expiry)
+}
@@ -2,6 +2,9 @@ package handshake
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 
@@ -24,11 +27,130 @@ var _ = Describe("ServerConfig", func() {
 	})
 
 	It("gets the proper binary representation", func() {
-		expected := bytes.NewBuffer([]byte{0x53, 0x43, 0x46, 0x47, 0x7, 0x0, 0x0, 0x0, 0x56, 0x45, 0x52, 0x0, 0x4, 0x0, 0x0, 0x0, 0x41, 0x45, 0x41, 0x44, 0x8, 0x0, 0x0, 0x0, 0x53, 0x43, 0x49, 0x44, 0x18, 0x0, 0x0, 0x0, 0x50, 0x55, 0x42, 0x53, 0x3b, 0x0, 0x0, 0x0, 0x4b, 0x45, 0x58, 0x53, 0x3f, 0x0, 0x0, 0x0, 0x4f, 0x42, 0x49, 0x54, 0x47, 0x0, 0x0, 0x0, 0x45, 0x58, 0x50, 0x59, 0x4f, 0x0, 0x0, 0x0, 0x51, 0x30, 0x33, 0x32, 0x43, 0x43, 0x32, 0x30})
-		expected.Write(scfg.ID)
-		expected.Write([]byte{0x20, 0x0, 0x0})
-		expected.Write(kex.PublicKey())
-		expected.Write([]byte{0x43, 0x32, 0x35, 0x35, 0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		var expected bytes.Buffer
+		WriteHandshakeMessage(&expected, TagSCFG, map[Tag][]byte{
+			TagSCID: scfg.ID,
+			TagKEXS: []byte("C255"),
+			TagAEAD: []byte("CC20AESG"),
+			TagPUBS: append([]byte{0x20, 0x0, 0x0}, kex.PublicKey()...),
+			TagOBIT: {0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7},
+			TagEXPY: {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			TagVER:  []byte("Q032"),
+		})
 		Expect(scfg.Get()).To(Equal(expected.Bytes()))
 	})
+
+	Context("selecting the AEAD", func() {
+		It("uses the client's order of preference", func() {
+			aead, err := selectAEAD([]byte("AESGCC20"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aead.tag).To(Equal([]byte("AESG")))
+			aead, err = selectAEAD([]byte("S20PCC20AESG"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aead.tag).To(Equal([]byte("CC20")))
+		})
+
+		It("uses chacha20poly1305 if the client didn't send an AEAD tag", func() {
+			aead, err := selectAEAD(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aead.tag).To(Equal([]byte("CC20")))
+		})
+	})
+
+	Context("multiple key exchange algorithms", func() {
+		var p256 *mockKEX
+
+		BeforeEach(func() {
+			p256 = &mockKEX{}
+			err := scfg.AddKeyExchange([]byte("P256"), p256, func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil })
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("advertises all algorithms in the order of preference", func() {
+			_, msg, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg[TagKEXS]).To(Equal([]byte("C255P256")))
+			pubs := append([]byte{0x20, 0x0, 0x0}, kex.PublicKey()...)
+			pubs = append(pubs, byte(len(p256.PublicKey())), 0x0, 0x0)
+			pubs = append(pubs, p256.PublicKey()...)
+			Expect(msg[TagPUBS]).To(Equal(pubs))
+		})
+
+		It("refuses to add an algorithm twice", func() {
+			err := scfg.AddKeyExchange([]byte("P256"), p256, nil)
+			Expect(err).To(MatchError("key exchange P256 already added"))
+		})
+
+		It("refuses invalid tags", func() {
+			err := scfg.AddKeyExchange([]byte("P25"), p256, nil)
+			Expect(err).To(MatchError("key exchange tags must be 4 bytes long"))
+		})
+
+		It("selects the most preferred algorithm supported by the client", func() {
+			alg, err := scfg.selectKeyExchange([]byte("P256C255"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alg.tag).To(Equal([]byte("C255")))
+			alg, err = scfg.selectKeyExchange([]byte("P256"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alg.tag).To(Equal([]byte("P256")))
+		})
+
+		It("selects the most preferred algorithm if the client didn't send a KEXS", func() {
+			alg, err := scfg.selectKeyExchange(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(alg.tag).To(Equal([]byte("C255")))
+		})
+
+		It("errors if there's no mutually supported algorithm", func() {
+			_, err := scfg.selectKeyExchange([]byte("QBIC"))
+			Expect(err).To(MatchError("CryptoMessageParameterNoOverlap: no mutually supported KEXS"))
+		})
+	})
+
+	It("sets the STK source", func() {
+		source := mockStkSource{}
+		scfg.SetStkSource(source)
+		Expect(scfg.stkSource).To(Equal(source))
+	})
+
+	It("reads the nonces from crypto/rand by default", func() {
+		Expect(scfg.rand).To(Equal(rand.Reader))
+		Expect(scfg.divNonceSource).To(BeNil())
+	})
+
+	It("sets the diversification nonce source", func() {
+		source := bytes.NewReader([]byte("foobar"))
+		scfg.SetDiversificationNonceSource(source)
+		Expect(scfg.divNonceSource).To(Equal(source))
+	})
+
+	Context("common certificate sets", func() {
+		It("sets common certificate sets on the signer", func() {
+			signer, err := crypto.NewRSASigner(&tls.Config{})
+			Expect(err).ToNot(HaveOccurred())
+			scfg.signer = signer
+			err = scfg.SetCommonCertSets([]*crypto.CommonCertSet{{Hash: 0x1337, Certs: [][]byte{[]byte("foobar")}}})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("errors if the signer doesn't support common certificate sets", func() {
+			scfg.signer = &mockSigner{}
+			err := scfg.SetCommonCertSets(nil)
+			Expect(err).To(MatchError("the signer doesn't support common certificate sets"))
+		})
+	})
+
+	Context("encoding the preferred address", func() {
+		It("encodes IPv4 addresses", func() {
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 0x1337}
+			Expect(encodeSocketAddress(addr)).To(Equal([]byte{2, 0, 1, 2, 3, 4, 0x37, 0x13}))
+		})
+
+		It("encodes IPv6 addresses", func() {
+			addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0x1337}
+			expected := append([]byte{10, 0}, net.ParseIP("2001:db8::1")...)
+			expected = append(expected, 0x37, 0x13)
+			Expect(encodeSocketAddress(addr)).To(Equal(expected))
+		})
+	})
 })
@@ -23,6 +23,8 @@ const (
 	TagCCRT Tag = 'C' + 'C'<<8 + 'R'<<16 + 'T'<<24
 	// TagMSPC is max streams per connection
 	TagMSPC Tag = 'M' + 'S'<<8 + 'P'<<16 + 'C'<<24
+	// TagMIDS is max incoming dynamic streams
+	TagMIDS Tag = 'M' + 'I'<<8 + 'D'<<16 + 'S'<<24
 	// TagUAID is the user agent ID
 	TagUAID Tag = 'U' + 'A'<<8 + 'I'<<16 + 'D'<<24
 	// TagTCID is truncation of the connection ID
@@ -41,13 +43,23 @@ const (
 	TagCSCT Tag = 'C' + 'S'<<8 + 'C'<<16 + 'T'<<24
 	// TagCOPT are the connection options
 	TagCOPT Tag = 'C' + 'O'<<8 + 'P'<<16 + 'T'<<24
+	// TagSMHL is support max header list (size)
+	TagSMHL Tag = 'S' + 'M'<<8 + 'H'<<16 + 'L'<<24
 	// TagCFCW is the initial session/connection flow control receive window
 	TagCFCW Tag = 'C' + 'F'<<8 + 'C'<<16 + 'W'<<24
 	// TagSFCW is the initial stream flow control receive window.
 	TagSFCW Tag = 'S' + 'F'<<8 + 'C'<<16 + 'W'<<24
 
+	// TagCTIM is the client's timestamp, in seconds since the UNIX epoch
+	TagCTIM Tag = 'C' + 'T'<<8 + 'I'<<16 + 'M'<<24
+
 	// TagSTK is the source-address token
 	TagSTK Tag = 'S' + 'T'<<8 + 'K'<<16
+	// TagRTKT is the resumption ticket
+	// A client sends an empty RTKT to ask for a ticket. The ticket only stores the connection parameters, so that the client doesn't have to send them again.
+	TagRTKT Tag = 'R' + 'T'<<8 + 'K'<<16 + 'T'<<24
+	// TagSPAD is the server's preferred address
+	TagSPAD Tag = 'S' + 'P'<<8 + 'A'<<16 + 'D'<<24
 	// TagSNO is the server nonce
 	TagSNO Tag = 'S' + 'N'<<8 + 'O'<<16
 	// TagPROF is the server proof
@@ -81,3 +93,34 @@ const (
 	// TagRNON is the public reset nonce
 	TagRNON Tag = 'R' + 'N'<<8 + 'O'<<16 + 'N'<<24
 )
+
+// chloTags are the tags we know of in a CHLO
+var chloTags = map[Tag]bool{
+	TagPAD:  true,
+	TagSNI:  true,
+	TagVER:  true,
+	TagCCS:  true,
+	TagCCRT: true,
+	TagMSPC: true,
+	TagMIDS: true,
+	TagUAID: true,
+	TagTCID: true,
+	TagPDMD: true,
+	TagSRBF: true,
+	TagICSL: true,
+	TagNONP: true,
+	TagSCLS: true,
+	TagCSCT: true,
+	TagCOPT: true,
+	TagSMHL: true,
+	TagCFCW: true,
+	TagSFCW: true,
+	TagCTIM: true,
+	TagSTK:  true,
+	TagRTKT: true,
+	TagNONC: true,
+	TagSCID: true,
+	TagKEXS: true,
+	TagAEAD: true,
+	TagPUBS: true,
+}
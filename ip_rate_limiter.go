@@ -0,0 +1,72 @@
+package quic
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// An ipRateLimiter limits the number of events, e.g. new sessions, per IP address within a time window
+type ipRateLimiter struct {
+	mutex sync.Mutex
+
+	limit  int
+	window time.Duration
+	clock  utils.Clock
+
+	windows map[string]*rateLimitWindow
+	// the last time windows that are over were removed
+	lastCleanup time.Time
+}
+
+type rateLimitWindow struct {
+	start  time.Time
+	events int
+}
+
+func newIPRateLimiter(limit int, window time.Duration, clock utils.Clock) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:       limit,
+		window:      window,
+		clock:       clock,
+		windows:     make(map[string]*rateLimitWindow),
+		lastCleanup: clock.Now(),
+	}
+}
+
+// allow returns if the IP address is within the limit, and counts the event if so
+func (l *ipRateLimiter) allow(ip net.IP) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.clock.Now()
+	l.maybeCleanup(now)
+
+	key := string(ip.To16())
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateLimitWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.events >= l.limit {
+		return false
+	}
+	w.events++
+	return true
+}
+
+// maybeCleanup removes the windows that are over, at most once per window
+// Otherwise, an attacker using many different IP addresses could make the map grow without bounds.
+func (l *ipRateLimiter) maybeCleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < l.window {
+		return
+	}
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+	l.lastCleanup = now
+}
@@ -0,0 +1,59 @@
+package quic
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP rate limiter", func() {
+	var (
+		limiter *ipRateLimiter
+		clock   *mockClock
+		ip      net.IP
+	)
+
+	BeforeEach(func() {
+		clock = newMockClock()
+		limiter = newIPRateLimiter(2, time.Second, clock)
+		ip = net.IPv4(1, 2, 3, 4)
+	})
+
+	It("allows events up to the limit", func() {
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.allow(ip)).To(BeFalse())
+	})
+
+	It("limits every IP address separately", func() {
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.allow(net.IPv4(1, 2, 3, 5))).To(BeTrue())
+	})
+
+	It("treats IPv4 and IPv4-mapped IPv6 addresses as the same address", func() {
+		Expect(limiter.allow(ip.To4())).To(BeTrue())
+		Expect(limiter.allow(ip.To16())).To(BeTrue())
+		Expect(limiter.allow(ip.To4())).To(BeFalse())
+	})
+
+	It("allows new events once the window is over", func() {
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.allow(ip)).To(BeTrue())
+		clock.Advance(time.Second - time.Nanosecond)
+		Expect(limiter.allow(ip)).To(BeFalse())
+		clock.Advance(time.Nanosecond)
+		Expect(limiter.allow(ip)).To(BeTrue())
+	})
+
+	It("removes windows that are over", func() {
+		Expect(limiter.allow(ip)).To(BeTrue())
+		Expect(limiter.windows).To(HaveLen(1))
+		clock.Advance(time.Second)
+		Expect(limiter.allow(net.IPv4(1, 2, 3, 5))).To(BeTrue())
+		Expect(limiter.windows).To(HaveLen(1))
+		Expect(limiter.windows).To(HaveKey(string(net.IPv4(1, 2, 3, 5).To16())))
+	})
+})
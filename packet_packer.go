@@ -20,6 +20,11 @@ type packedPacket struct {
 	frames     []frames.Frame
 }
 
+// An applicationDataSealer refuses to seal application data with the null encryption
+type applicationDataSealer interface {
+	SealApplicationData(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) ([]byte, error)
+}
+
 type packetPacker struct {
 	connectionID protocol.ConnectionID
 	version      protocol.VersionNumber
@@ -65,6 +70,11 @@ func (p *packetPacker) AddBlocked(streamID protocol.StreamID, byteOffset protoco
 	p.blockedManager.AddBlockedStream(streamID, byteOffset)
 }
 
+// AddPing queues a PING frame, e.g. to keep the connection alive
+func (p *packetPacker) AddPing() {
+	p.controlFrames = append(p.controlFrames, &frames.PingFrame{})
+}
+
 func (p *packetPacker) PackConnectionClose(frame *frames.ConnectionCloseFrame) (*packedPacket, error) {
 	return p.packPacket(nil, []frames.Frame{frame}, true)
 }
@@ -135,7 +145,15 @@ func (p *packetPacker) packPacket(stopWaitingFrame *frames.StopWaitingFrame, con
 		return nil, err
 	}
 
-	ciphertext := p.aead.Seal(currentPacketNumber, raw.Bytes(), payload)
+	var ciphertext []byte
+	if sealer, ok := p.aead.(applicationDataSealer); ok && containsApplicationData(payloadFrames) {
+		ciphertext, err = sealer.SealApplicationData(currentPacketNumber, raw.Bytes(), payload)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ciphertext = p.aead.Seal(currentPacketNumber, raw.Bytes(), payload)
+	}
 	raw.Write(ciphertext)
 
 	if protocol.ByteCount(raw.Len()) > protocol.MaxPacketSize {
@@ -258,3 +276,13 @@ func (p *packetPacker) Empty() bool {
 func (p *packetPacker) StreamFrameQueueByteLen() protocol.ByteCount {
 	return p.streamFrameQueue.ByteLen()
 }
+
+// containsApplicationData checks if any of the frames carries data of a stream other than the crypto stream
+func containsApplicationData(fs []frames.Frame) bool {
+	for _, f := range fs {
+		if sf, ok := f.(*frames.StreamFrame); ok && sf.StreamID != 1 {
+			return true
+		}
+	}
+	return false
+}
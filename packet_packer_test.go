@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/handshake"
@@ -22,6 +23,8 @@ func (h *mockSentPacketHandler) HasPacketForRetransmission() bool
 func (h *mockSentPacketHandler) BytesInFlight() protocol.ByteCount                  { return 0 }
 func (h *mockSentPacketHandler) GetLargestObserved() protocol.PacketNumber          { return 1 }
 func (h *mockSentPacketHandler) CongestionAllowsSending() bool                      { panic("not implemented") }
+func (h *mockSentPacketHandler) GetCongestionWindow() protocol.ByteCount            { panic("not implemented") }
+func (h *mockSentPacketHandler) GetRTTStats() *congestion.RTTStats                  { panic("not implemented") }
 func (h *mockSentPacketHandler) CheckForError() error                               { panic("not implemented") }
 func (h *mockSentPacketHandler) TimeToFirstRTO() time.Duration                      { panic("not implemented") }
 
@@ -29,6 +32,15 @@ func newMockSentPacketHandler() ackhandler.SentPacketHandler {
 	return &mockSentPacketHandler{}
 }
 
+// handshakeOnlyAEAD only has the null encryption available, like the CryptoSetup before receiving a CHLO
+type handshakeOnlyAEAD struct {
+	crypto.NullAEAD
+}
+
+func (*handshakeOnlyAEAD) SealApplicationData(protocol.PacketNumber, []byte, []byte) ([]byte, error) {
+	return nil, handshake.ErrUnencryptedApplicationData
+}
+
 var _ = Describe("Packet packer", func() {
 	var (
 		packer          *packetPacker
@@ -38,7 +50,7 @@ var _ = Describe("Packet packer", func() {
 	BeforeEach(func() {
 		aead := &crypto.NullAEAD{}
 		packer = &packetPacker{
-			aead: aead,
+			aead:                        aead,
 			connectionParametersManager: handshake.NewConnectionParamatersManager(),
 			sentPacketHandler:           newMockSentPacketHandler(),
 			blockedManager:              newBlockedManager(),
@@ -71,6 +83,21 @@ var _ = Describe("Packet packer", func() {
 		Expect(p.raw).To(ContainSubstring(string(b.Bytes())))
 	})
 
+	It("refuses to pack application data without encryption", func() {
+		packer.aead = &handshakeOnlyAEAD{}
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		_, err := packer.PackPacket(nil, []frames.Frame{})
+		Expect(err).To(MatchError(handshake.ErrUnencryptedApplicationData))
+	})
+
+	It("packs crypto stream data without encryption", func() {
+		packer.aead = &handshakeOnlyAEAD{}
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 1, Data: []byte("foobar")})
+		p, err := packer.PackPacket(nil, []frames.Frame{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p).ToNot(BeNil())
+	})
+
 	It("packs a ConnectionCloseFrame", func() {
 		ccf := frames.ConnectionCloseFrame{
 			ErrorCode:    0x1337,
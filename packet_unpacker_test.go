@@ -110,10 +110,24 @@ var _ = Describe("Packet unpacker", func() {
 		Expect(packet.frames).To(Equal([]frames.Frame{f}))
 	})
 
-	It("errors on GOAWAY frames", func() {
-		setReader([]byte{0x03})
+	It("unpacks GOAWAY frames", func() {
+		f := &frames.GoawayFrame{
+			ErrorCode:      1,
+			LastGoodStream: 5,
+			ReasonPhrase:   "foo",
+		}
+		err := f.Write(buf, 0)
+		Expect(err).ToNot(HaveOccurred())
+		setReader(buf.Bytes())
+		packet, err := unpacker.Unpack(hdrBin, hdr, r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet.frames).To(Equal([]frames.Frame{f}))
+	})
+
+	It("errors on invalid GOAWAY frames", func() {
+		setReader([]byte{0x03, 0x01})
 		_, err := unpacker.Unpack(hdrBin, hdr, r)
-		Expect(err).To(MatchError("unimplemented: GOAWAY"))
+		Expect(err).To(MatchError("InvalidGoawayData: EOF"))
 	})
 
 	It("accepts WINDOW_UPDATE frames", func() {
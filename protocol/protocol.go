@@ -1,6 +1,9 @@
 package protocol
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 // A PacketNumber in QUIC
 type PacketNumber uint64
@@ -31,8 +34,30 @@ type StreamID uint32
 type ByteCount uint64
 
 // MaxPacketSize is the maximum packet size, including the public header
+// We send packets of at most this size, for all versions and address families.
 const MaxPacketSize ByteCount = 1452
 
+// MaxReceivePacketSizeIPv4 is the maximum size of packets we accept on IPv4 paths: the Ethernet MTU of 1500 bytes minus the IPv4 and UDP headers
+const MaxReceivePacketSizeIPv4 ByteCount = 1500 - 20 - 8
+
+// MaxReceivePacketSizeIPv6 is the maximum size of packets we accept on IPv6 paths: the Ethernet MTU of 1500 bytes minus the IPv6 and UDP headers
+const MaxReceivePacketSizeIPv6 ByteCount = 1500 - 40 - 8
+
+// MaxReceivePacketSize is the maximum size of packets we accept, for any address family
+const MaxReceivePacketSize = MaxReceivePacketSizeIPv4
+
+// MaxReceivePacketSizeForIP returns the maximum size of packets we accept from a peer
+// If the IP is unknown, MaxPacketSize is returned.
+func MaxReceivePacketSizeForIP(ip net.IP) ByteCount {
+	if ip == nil {
+		return MaxPacketSize
+	}
+	if ip.To4() != nil {
+		return MaxReceivePacketSizeIPv4
+	}
+	return MaxReceivePacketSizeIPv6
+}
+
 // MaxFrameAndPublicHeaderSize is the maximum size of a QUIC frame plus PublicHeader
 const MaxFrameAndPublicHeaderSize = MaxPacketSize - 1 /*private header*/ - 12 /*crypto signature*/
 
@@ -57,3 +82,13 @@ const MinRetransmissionTime = 200 * time.Millisecond
 
 // ClientHelloMinimumSize is the minimum size the server expectes an inchoate CHLO to have.
 const ClientHelloMinimumSize = 1024
+
+// MaxAmplificationFactor is the max factor by which the REJs sent may be larger than the CHLOs received, before the client's address is validated by an STK
+const MaxAmplificationFactor = 3
+
+// MaxCertChainSize is the maximum size of an uncompressed certificate chain accepted from a server
+const MaxCertChainSize = 1 << 20
+
+// MinInitialPacketSize is the minimum size of the first packet of a connection.
+// Clients pad the packet carrying the CHLO, so that the server's response can't be used for amplification attacks.
+const MinInitialPacketSize = ClientHelloMinimumSize
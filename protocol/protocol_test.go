@@ -0,0 +1,37 @@
+package protocol_test
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Max packet size", func() {
+	It("accepts larger packets on IPv4 than on IPv6 paths", func() {
+		ipv4 := protocol.MaxReceivePacketSizeForIP(net.IPv4(1, 2, 3, 4))
+		ipv6 := protocol.MaxReceivePacketSizeForIP(net.ParseIP("2001:db8::1"))
+		Expect(ipv4).To(Equal(protocol.ByteCount(1472)))
+		Expect(ipv6).To(Equal(protocol.ByteCount(1452)))
+		Expect(ipv4 - ipv6).To(Equal(protocol.ByteCount(20))) // the IPv6 header is 20 bytes longer
+	})
+
+	It("treats IPv4-mapped IPv6 addresses as IPv4", func() {
+		Expect(protocol.MaxReceivePacketSizeForIP(net.ParseIP("::ffff:1.2.3.4"))).To(Equal(protocol.MaxReceivePacketSizeIPv4))
+	})
+
+	It("uses the default if the IP is unknown", func() {
+		Expect(protocol.MaxReceivePacketSizeForIP(nil)).To(Equal(protocol.MaxPacketSize))
+	})
+
+	It("never sends packets that are too large for IPv6 paths", func() {
+		Expect(protocol.MaxPacketSize).To(BeNumerically("<=", protocol.MaxReceivePacketSizeIPv6))
+	})
+
+	It("receives packets of all sizes", func() {
+		Expect(protocol.MaxReceivePacketSize).To(BeNumerically(">=", protocol.MaxReceivePacketSizeIPv4))
+		Expect(protocol.MaxReceivePacketSize).To(BeNumerically(">=", protocol.MaxReceivePacketSizeIPv6))
+	})
+})
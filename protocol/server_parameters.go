@@ -40,9 +40,31 @@ const MaxStreamsPerConnection uint32 = 100
 // TODO: set a reasonable value here
 const MaxIdleConnectionStateLifetime = 60 * time.Second
 
+// MaxHeaderListSize is the maximum size of an uncompressed HTTP/2 header list we accept, as defined for SETTINGS_MAX_HEADER_LIST_SIZE
+const MaxHeaderListSize uint32 = 16 * (1 << 10) // 16 kB
+
 // WindowUpdateNumRepitions is the number of times the same WindowUpdate frame will be sent to the client
 const WindowUpdateNumRepitions uint8 = 2
 
+// MaxUnreadStreamData is the max number of bytes buffered for a stream that the application hasn't read yet.
+// It is only enforced for sessions using the ReceivePolicyDrop.
+const MaxUnreadStreamData ByteCount = 64 * (1 << 10) // 64 kB
+
+// MaxSessionDrainPackets is the max number of packets sent when draining a session on a graceful close
+const MaxSessionDrainPackets = 32
+
+// SessionDrainTimeout is the max time we wait for the session's run loop to stop before draining it
+const SessionDrainTimeout = 100 * time.Millisecond
+
+// ServerCloseTimeout is the max time Server.Close waits for the sessions to send their CONNECTION_CLOSE
+const ServerCloseTimeout = time.Second
+
+// ClosedSessionDrainingPeriod is the time we keep answering packets for a closed session with the close packet
+const ClosedSessionDrainingPeriod = 5 * time.Second
+
+// MaxPublicResetsPerSecond is the max number of public resets sent per second to an IP address for packets of unknown connections
+const MaxPublicResetsPerSecond = 10
+
 // MaxSessionUnprocessedPackets is the max number of packets stored in each session that are not yet processed.
 const MaxSessionUnprocessedPackets = 128
 
@@ -52,6 +74,28 @@ const RetransmissionThreshold uint8 = 3
 // STKExpiryTimeSec is the valid time of a source address token in seconds
 const STKExpiryTimeSec = 24 * 60 * 60
 
+// ResumptionTicketExpiryTimeSec is the valid time of a resumption ticket in seconds
+const ResumptionTicketExpiryTimeSec = 24 * 60 * 60
+
+// ReplayCacheWindow is the time the client nonces of 0-RTT CHLOs are remembered to detect replays
+const ReplayCacheWindow = 5 * time.Minute
+
+// MaxReplayCacheEntries is the max number of client nonces remembered to detect replayed 0-RTT CHLOs
+const MaxReplayCacheEntries = 1 << 16
+
+// MaxCertCacheEntries is the max number of compressed certificate chains cached
+const MaxCertCacheEntries = 1024
+
+// MaxCryptoStreamBufferSize is the max number of bytes buffered for reading handshake messages, summed over all connections of a server
+const MaxCryptoStreamBufferSize = 32 * 1 << 20 // 32 MB
+
+// CryptoMaxParams is the max number of tag-value pairs accepted in a handshake message
+const CryptoMaxParams = 128
+
+// MaxClientHellos is the max number of CHLOs we process for a connection before the handshake has to complete
+// This is the same allowance as in Chromium's QUIC client. A client whose address is not validated yet needs 3 CHLOs if the REJ is limited by the anti-amplification limit, leaving room for one CHLO resent after version negotiation.
+const MaxClientHellos = 4
+
 // MaxTrackedSentPackets is maximum number of sent packets saved for either later retransmission or entropy calculation
 // TODO: find a reasonable value here
 // TODO: decrease this value after dropping support for QUIC 33 and earlier
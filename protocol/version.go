@@ -37,12 +37,43 @@ func IsSupportedVersion(v VersionNumber) bool {
 	return false
 }
 
-func init() {
+// VersionUsesDiversificationNonce says if the server sends a diversification nonce with the initial encryption
+// Starting with version 33, the initial keys are diversified with a nonce sent in the public header of server packets.
+func VersionUsesDiversificationNonce(v VersionNumber) bool {
+	return v >= 33
+}
+
+// ChooseSupportedVersion chooses the highest version of ours that they also support
+// It returns false if there's no version in common.
+func ChooseSupportedVersion(ours, theirs []VersionNumber) (VersionNumber, bool) {
+	var chosen VersionNumber
+	var found bool
+	for _, v := range ours {
+		if found && v <= chosen {
+			continue
+		}
+		for _, t := range theirs {
+			if v == t {
+				chosen = v
+				found = true
+				break
+			}
+		}
+	}
+	return chosen, found
+}
+
+// VersionsAsTags concatenates the tags of a list of versions, as sent in the SHLO and in version negotiation packets
+func VersionsAsTags(versions []VersionNumber) []byte {
 	var b bytes.Buffer
-	for _, v := range SupportedVersions {
+	for _, v := range versions {
 		s := make([]byte, 4)
 		binary.LittleEndian.PutUint32(s, VersionNumberToTag(v))
 		b.Write(s)
 	}
-	SupportedVersionsAsTags = b.Bytes()
+	return b.Bytes()
+}
+
+func init() {
+	SupportedVersionsAsTags = VersionsAsTags(SupportedVersions)
 }
@@ -1,6 +1,8 @@
 package protocol_test
 
 import (
+	"fmt"
+
 	"github.com/lucas-clemente/quic-go/protocol"
 
 	. "github.com/onsi/ginkgo"
@@ -22,6 +24,35 @@ var _ = Describe("Version", func() {
 		Expect(protocol.SupportedVersionsAsTags).To(Equal([]byte("Q030Q031Q032Q033")))
 	})
 
+	It("converts a list of versions to tags", func() {
+		Expect(protocol.VersionsAsTags([]protocol.VersionNumber{31, 33})).To(Equal([]byte("Q031Q033")))
+	})
+
+	It("says which versions use the diversification nonce", func() {
+		for v, usesDivNonce := range map[protocol.VersionNumber]bool{
+			30: false,
+			32: false,
+			33: true,
+			34: true,
+		} {
+			Expect(protocol.VersionUsesDiversificationNonce(v)).To(Equal(usesDivNonce), fmt.Sprintf("version %d", v))
+		}
+	})
+
+	It("chooses the highest version both sides support", func() {
+		v, ok := protocol.ChooseSupportedVersion([]protocol.VersionNumber{31, 32, 33}, []protocol.VersionNumber{33, 30, 32})
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(protocol.VersionNumber(33)))
+		v, ok = protocol.ChooseSupportedVersion([]protocol.VersionNumber{31, 32, 33}, []protocol.VersionNumber{30, 32})
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(protocol.VersionNumber(32)))
+	})
+
+	It("doesn't choose a version if there's none in common", func() {
+		_, ok := protocol.ChooseSupportedVersion([]protocol.VersionNumber{31, 32}, []protocol.VersionNumber{30, 33})
+		Expect(ok).To(BeFalse())
+	})
+
 	It("recognizes supported versions", func() {
 		Expect(protocol.IsSupportedVersion(0)).To(BeFalse())
 		Expect(protocol.IsSupportedVersion(protocol.SupportedVersions[0])).To(BeTrue())
@@ -2,9 +2,15 @@ package quic
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/handshake"
@@ -17,6 +23,7 @@ import (
 type packetHandler interface {
 	handlePacket(addr interface{}, hdr *publicHeader, data []byte)
 	run()
+	Close(error) error
 }
 
 // A Server of QUIC
@@ -24,24 +31,66 @@ type Server struct {
 	conns      []*net.UDPConn
 	connsMutex sync.Mutex
 
-	signer crypto.Signer
-	scfg   *handshake.ServerConfig
+	signer  crypto.Signer
+	scfg    *handshake.ServerConfig
+	kexPool *crypto.KeyExchangePool
+	// if set, sessions are run on a bounded number of goroutines
+	sessionPool *sessionPool
+	// if set, it limits the number of new sessions per IP address
+	sessionRateLimiter *ipRateLimiter
+	// limits the number of public resets sent for packets of unknown connections
+	publicResetLimiter *ipRateLimiter
+
+	// the versions this server accepts, a subset of protocol.SupportedVersions
+	supportedVersions       []protocol.VersionNumber
+	supportedVersionsAsTags []byte
 
 	sessions      map[protocol.ConnectionID]packetHandler
 	sessionsMutex sync.RWMutex
+	// the time closed sessions are kept in the sessions map
+	drainingPeriod time.Duration
+	// packets of unknown connections smaller than this are dropped
+	minInitialPacketSize protocol.ByteCount
+	// the source of time for the timeouts of the server and all sessions
+	clock utils.Clock
+
+	streamCallback  StreamCallback
+	receivePolicy   ReceivePolicy
+	packetTransform PacketTransform
+	tracer          Tracer
 
-	streamCallback StreamCallback
+	// if non-zero, sessions send a PING when they didn't send any packet for this long
+	keepAliveInterval time.Duration
 
-	newSession func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error)
+	newSession func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, receivePolicy ReceivePolicy, keepAliveInterval time.Duration, clock utils.Clock) (packetHandler, error)
 }
 
 // NewServer makes a new server
+// Depending on the key of the first certificate of the tls.Config, the server proof is signed with RSA or ECDSA.
 func NewServer(tlsConfig *tls.Config, cb StreamCallback) (*Server, error) {
-	signer, err := crypto.NewRSASigner(tlsConfig)
+	signer, err := newSigner(tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	return newServer(signer, cb)
+}
+
+func newSigner(tlsConfig *tls.Config) (crypto.Signer, error) {
+	if len(tlsConfig.Certificates) > 0 {
+		if _, ok := tlsConfig.Certificates[0].PrivateKey.(*ecdsa.PrivateKey); ok {
+			return crypto.NewECDSASigner(tlsConfig)
+		}
+	}
+	return crypto.NewRSASigner(tlsConfig)
+}
 
+// NewServerWithProofSource makes a new server that delegates signing the server proof to a ProofSource
+// This way, the server never needs access to the private key.
+func NewServerWithProofSource(source crypto.ProofSource, cb StreamCallback) (*Server, error) {
+	return newServer(crypto.NewProofSourceSigner(source), cb)
+}
+
+func newServer(signer crypto.Signer, cb StreamCallback) (*Server, error) {
 	kex, err := crypto.NewCurve25519KEX()
 	if err != nil {
 		return nil, err
@@ -50,33 +99,167 @@ func NewServer(tlsConfig *tls.Config, cb StreamCallback) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	// some clients only support P-256
+	p256, err := crypto.NewP256KEX()
+	if err != nil {
+		return nil, err
+	}
+	if err := scfg.AddKeyExchange([]byte("P256"), p256, crypto.NewP256KEX); err != nil {
+		return nil, err
+	}
 
+	clock := utils.DefaultClock{}
 	return &Server{
-		signer:         signer,
-		scfg:           scfg,
-		streamCallback: cb,
-		sessions:       map[protocol.ConnectionID]packetHandler{},
-		newSession:     newSession,
+		signer:                  signer,
+		scfg:                    scfg,
+		supportedVersions:       protocol.SupportedVersions,
+		supportedVersionsAsTags: protocol.SupportedVersionsAsTags,
+		streamCallback:          cb,
+		sessions:                map[protocol.ConnectionID]packetHandler{},
+		drainingPeriod:          protocol.ClosedSessionDrainingPeriod,
+		minInitialPacketSize:    protocol.MinInitialPacketSize,
+		publicResetLimiter:      newIPRateLimiter(protocol.MaxPublicResetsPerSecond, time.Second, clock),
+		clock:                   clock,
+		tracer:                  noopTracer{},
+		newSession:              newSession,
 	}, nil
 }
 
+// SetSupportedVersions restricts the versions the server accepts to a subset of protocol.SupportedVersions
+// Clients offering any other version receive a version negotiation packet listing only these versions. The SHLO announces the same versions.
+func (s *Server) SetSupportedVersions(versions []protocol.VersionNumber) error {
+	if len(versions) == 0 {
+		return errors.New("no versions given")
+	}
+	for _, v := range versions {
+		if !protocol.IsSupportedVersion(v) {
+			return fmt.Errorf("unsupported version %d", v)
+		}
+	}
+	s.supportedVersions = versions
+	s.supportedVersionsAsTags = protocol.VersionsAsTags(versions)
+	if s.scfg != nil {
+		s.scfg.SetSupportedVersions(versions)
+	}
+	return nil
+}
+
 // ListenAndServe listens and serves a connection
+// If the server can't listen on the address, a *BindError is returned.
 func (s *Server) ListenAndServe(address string) error {
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		return err
+		return newBindError(address, err)
+	}
+
+	conn, err := s.listen(addr)
+	if err != nil {
+		return newBindError(address, err)
+	}
+	return s.serve(conn)
+}
+
+// SetPreferredAddress listens on an additional address and advertises it to clients in the SHLO.
+// Clients may migrate to it after the handshake.
+// Packets received on this address are served in a separate goroutine until the server is closed.
+func (s *Server) SetPreferredAddress(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return newBindError(address, err)
+	}
+
+	conn, err := s.listen(addr)
+	if err != nil {
+		return newBindError(address, err)
+	}
+	// advertise the port we actually listen on, in case the address didn't specify one
+	addr.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	s.scfg.SetPreferredAddress(addr)
+
+	go func() {
+		if err := s.serve(conn); err != nil {
+			utils.Debugf("Stopped serving preferred address %s: %s", addr, err.Error())
+		}
+	}()
+	return nil
+}
+
+// SetStrictCHLOParsing sets if CHLOs with unknown tags are rejected, instead of ignoring these tags
+// It is meant for debugging interop with experimental clients, and must be called before serving.
+func (s *Server) SetStrictCHLOParsing(strict bool) {
+	s.scfg.SetStrictTagParsing(strict)
+}
+
+// EnableKeyExchangePool pre-generates up to size ephemeral keys in the background, instead of generating them during each handshake
+// This reduces the handshake latency at high connection rates. It must be called before serving.
+func (s *Server) EnableKeyExchangePool(size int) {
+	s.kexPool = crypto.NewKeyExchangePool(size, crypto.NewCurve25519KEX)
+	s.scfg.SetKeyExchangePool(s.kexPool)
+}
+
+// EnableSessionPool runs sessions on at most size goroutines, instead of one goroutine per session
+// This bounds the number of goroutines under connection floods. New sessions are queued until a running session is closed,
+// so size must be larger than the number of connections expected to be open at the same time.
+// At most maxQueued sessions are queued, further new sessions are closed right away. It must be called before serving.
+func (s *Server) EnableSessionPool(size, maxQueued int) {
+	s.sessionPool = newSessionPool(size, maxQueued)
+}
+
+// SetNewSessionRateLimit limits the number of new sessions a single IP address can create within the window
+// Initial packets exceeding the limit are dropped without a response. A limit of 0 disables rate limiting.
+// It must be called before serving.
+func (s *Server) SetNewSessionRateLimit(limit int, window time.Duration) {
+	if limit <= 0 {
+		s.sessionRateLimiter = nil
+		return
 	}
+	s.sessionRateLimiter = newIPRateLimiter(limit, window, s.clock)
+}
 
+// SetReceivePolicy sets what sessions do with stream data the StreamCallback doesn't read fast enough.
+// It only applies to sessions created afterwards, and defaults to ReceivePolicyBlock.
+func (s *Server) SetReceivePolicy(policy ReceivePolicy) {
+	s.receivePolicy = policy
+}
+
+// SetKeepAliveInterval makes sessions send a PING frame when they didn't send any packet for the interval, e.g. to keep NAT bindings open.
+// It only applies to sessions created afterwards. An interval of 0 disables keep-alives, which is the default.
+func (s *Server) SetKeepAliveInterval(interval time.Duration) {
+	s.keepAliveInterval = interval
+}
+
+// SetPacketTransform sets a function that is applied to all packets before they are sent
+// It is meant for testing, e.g. to simulate packet loss, and only applies to sessions created afterwards.
+func (s *Server) SetPacketTransform(transform PacketTransform) {
+	s.packetTransform = transform
+}
+
+// SetTracer sets a tracer that is notified about events of all connections, e.g. for debugging
+// It must be called before serving. Setting nil disables tracing.
+func (s *Server) SetTracer(tracer Tracer) {
+	if tracer == nil {
+		s.tracer = noopTracer{}
+		s.scfg.SetTracer(nil)
+		return
+	}
+	s.tracer = tracer
+	s.scfg.SetTracer(tracer)
+}
+
+func (s *Server) listen(addr *net.UDPAddr) (*net.UDPConn, error) {
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	s.connsMutex.Lock()
 	s.conns = append(s.conns, conn)
 	s.connsMutex.Unlock()
+	return conn, nil
+}
 
+func (s *Server) serve(conn *net.UDPConn) error {
 	for {
-		data := make([]byte, protocol.MaxPacketSize)
+		data := make([]byte, protocol.MaxReceivePacketSize)
 		n, remoteAddr, err := conn.ReadFromUDP(data)
 		if err != nil {
 			return err
@@ -88,8 +271,24 @@ func (s *Server) ListenAndServe(address string) error {
 	}
 }
 
-// Close the server
+// Close closes all sessions and then the server
+// It waits at most protocol.ServerCloseTimeout for the sessions to close, use CloseWithTimeout to choose a different timeout.
 func (s *Server) Close() error {
+	return s.CloseWithTimeout(protocol.ServerCloseTimeout)
+}
+
+// CloseWithTimeout closes all sessions with a PeerGoingAway CONNECTION_CLOSE, and then closes the server
+// Sessions send the packets they already queued before the CONNECTION_CLOSE. The sockets are closed after
+// all sessions are closed, but at most after the timeout.
+func (s *Server) CloseWithTimeout(timeout time.Duration) error {
+	// sessions waiting in the session pool never ran, they are closed by the pool
+	if s.sessionPool != nil {
+		s.sessionPool.close()
+	}
+	s.closeSessions(timeout)
+	if s.kexPool != nil {
+		s.kexPool.Close()
+	}
 	s.connsMutex.Lock()
 	defer s.connsMutex.Unlock()
 	for _, c := range s.conns {
@@ -101,8 +300,50 @@ func (s *Server) Close() error {
 	return nil
 }
 
+func (s *Server) closeSessions(timeout time.Duration) {
+	s.sessionsMutex.RLock()
+	sessions := make([]packetHandler, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		// sessions that are already closed don't need to be notified
+		if _, ok := session.(*closedSession); ok {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	s.sessionsMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(sessions))
+	for _, session := range sessions {
+		// Close calls the closeCallback, which needs the sessionsMutex
+		go func(session packetHandler) {
+			defer wg.Done()
+			if err := session.Close(nil); err != nil {
+				utils.Errorf("Error closing session: %s", err.Error())
+			}
+		}(session)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := s.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.Chan():
+		utils.Errorf("Closing the server before all sessions were closed")
+	}
+}
+
 func (s *Server) handlePacket(conn *net.UDPConn, remoteAddr *net.UDPAddr, packet []byte) error {
-	if protocol.ByteCount(len(packet)) > protocol.MaxPacketSize {
+	var remoteIP net.IP
+	if remoteAddr != nil {
+		remoteIP = remoteAddr.IP
+	}
+	if protocol.ByteCount(len(packet)) > protocol.MaxReceivePacketSizeForIP(remoteIP) {
 		return qerr.PacketTooLarge
 	}
 
@@ -113,54 +354,120 @@ func (s *Server) handlePacket(conn *net.UDPConn, remoteAddr *net.UDPAddr, packet
 		return qerr.Error(qerr.InvalidPacketHeader, err.Error())
 	}
 	hdr.Raw = packet[:len(packet)-r.Len()]
+	s.tracer.PacketReceived(hdr.ConnectionID, protocol.ByteCount(len(packet)))
+
+	s.sessionsMutex.RLock()
+	session, ok := s.sessions[hdr.ConnectionID]
+	s.sessionsMutex.RUnlock()
+
+	// Drop undersized initial packets without responding, so that the server can't be used for amplification attacks
+	// This has to happen before sending a Version Negotiation Packet, which would be a response as well.
+	if !ok && hdr.VersionFlag && protocol.ByteCount(len(packet)) < s.minInitialPacketSize {
+		utils.Debugf("Dropping initial packet of %d bytes for connection %x from %v", len(packet), hdr.ConnectionID, remoteAddr)
+		return nil
+	}
 
 	// Send Version Negotiation Packet if the client is speaking a different protocol version
-	if hdr.VersionFlag && !protocol.IsSupportedVersion(hdr.VersionNumber) {
+	if hdr.VersionFlag && !s.isSupportedVersion(hdr.VersionNumber) {
 		utils.Infof("Client offered version %d, sending VersionNegotiationPacket", hdr.VersionNumber)
-		_, err = conn.WriteToUDP(composeVersionNegotiation(hdr.ConnectionID), remoteAddr)
+		err = writeTransformed(conn, remoteAddr, composeVersionNegotiation(hdr.ConnectionID, s.supportedVersionsAsTags), s.packetTransform)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	s.sessionsMutex.RLock()
-	session, ok := s.sessions[hdr.ConnectionID]
-	s.sessionsMutex.RUnlock()
-
 	if !ok {
+		// Only the first packets of a connection carry the version. Any other packet belongs to a connection we don't know (anymore).
+		if !hdr.VersionFlag {
+			s.maybeSendPublicReset(conn, remoteAddr, hdr)
+			return nil
+		}
+		if s.sessionRateLimiter != nil && !s.sessionRateLimiter.allow(remoteIP) {
+			utils.Debugf("Dropping initial packet for connection %x from %v, too many new sessions", hdr.ConnectionID, remoteAddr)
+			return nil
+		}
 		utils.Infof("Serving new connection: %x, version %d from %v", hdr.ConnectionID, hdr.VersionNumber, remoteAddr)
 		session, err = s.newSession(
-			&udpConn{conn: conn, currentAddr: remoteAddr},
+			&udpConn{conn: conn, currentAddr: remoteAddr, transform: s.packetTransform, connID: hdr.ConnectionID, tracer: s.tracer},
 			hdr.VersionNumber,
 			hdr.ConnectionID,
 			s.scfg,
 			s.streamCallback,
 			s.closeCallback,
+			s.receivePolicy,
+			s.keepAliveInterval,
+			s.clock,
 		)
 		if err != nil {
 			return err
 		}
-		go session.run()
+		// register the session before running it, so that the closeCallback of a session that is closed right away takes effect
 		s.sessionsMutex.Lock()
 		s.sessions[hdr.ConnectionID] = session
 		s.sessionsMutex.Unlock()
+		if s.sessionPool != nil {
+			s.sessionPool.run(session)
+		} else {
+			go session.run()
+		}
 	}
-	if session == nil {
-		// Late packet for closed session
-		return nil
-	}
-	session.handlePacket(remoteAddr, hdr, packet[len(packet)-r.Len():])
+	session.handlePacket(&udpRemoteAddr{conn: conn, addr: remoteAddr}, hdr, packet[len(packet)-r.Len():])
 	return nil
 }
 
-func (s *Server) closeCallback(id protocol.ConnectionID) {
+// maybeSendPublicReset sends a public reset for a packet of an unknown connection, so that the peer stops sending packets
+// Public resets are never sent in response to public resets, and are rate-limited per IP address.
+func (s *Server) maybeSendPublicReset(conn *net.UDPConn, remoteAddr *net.UDPAddr, hdr *publicHeader) {
+	if hdr.ResetFlag {
+		return
+	}
+	if s.publicResetLimiter != nil && remoteAddr != nil && !s.publicResetLimiter.allow(remoteAddr.IP) {
+		utils.Debugf("Not sending public reset for unknown connection %x to %v, rate limit exceeded", hdr.ConnectionID, remoteAddr)
+		return
+	}
+	// We don't know the client nonce of an unknown connection, so the nonce proof can't prove anything, and is random
+	nonceProof := make([]byte, 8)
+	if _, err := rand.Read(nonceProof); err != nil {
+		utils.Errorf("error generating nonce proof for connection %x: %s", hdr.ConnectionID, err.Error())
+		return
+	}
+	utils.Infof("Sending public reset for unknown connection %x, packet number %d", hdr.ConnectionID, hdr.PacketNumber)
+	packet := composePublicReset(hdr.ConnectionID, hdr.PacketNumber, binary.LittleEndian.Uint64(nonceProof))
+	if err := writeTransformed(conn, remoteAddr, packet, s.packetTransform); err != nil {
+		utils.Errorf("error sending public reset for connection %x: %s", hdr.ConnectionID, err.Error())
+	}
+}
+
+func (s *Server) closeCallback(id protocol.ConnectionID, closed *closedSession) {
+	s.tracer.ConnectionClosed(id)
+
 	s.sessionsMutex.Lock()
-	s.sessions[id] = nil
+	s.sessions[id] = closed
 	s.sessionsMutex.Unlock()
+
+	s.clock.AfterFunc(s.drainingPeriod, func() {
+		s.sessionsMutex.Lock()
+		delete(s.sessions, id)
+		s.sessionsMutex.Unlock()
+	})
+}
+
+func (s *Server) isSupportedVersion(v protocol.VersionNumber) bool {
+	for _, t := range s.supportedVersions {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// composePublicReset composes a public reset packet for a packet of a connection that we don't know (anymore)
+func composePublicReset(connectionID protocol.ConnectionID, rejectedPacketNumber protocol.PacketNumber, nonceProof uint64) []byte {
+	return writePublicReset(connectionID, rejectedPacketNumber, nonceProof)
 }
 
-func composeVersionNegotiation(connectionID protocol.ConnectionID) []byte {
+func composeVersionNegotiation(connectionID protocol.ConnectionID, versionTags []byte) []byte {
 	fullReply := &bytes.Buffer{}
 	responsePublicHeader := publicHeader{
 		ConnectionID: connectionID,
@@ -172,6 +479,6 @@ func composeVersionNegotiation(connectionID protocol.ConnectionID) []byte {
 	if err != nil {
 		utils.Errorf("error composing version negotiation packet: %s", err.Error())
 	}
-	fullReply.Write(protocol.SupportedVersionsAsTags)
+	fullReply.Write(versionTags)
 	return fullReply.Bytes()
 }
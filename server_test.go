@@ -1,36 +1,220 @@
 package quic
 
 import (
+	"bytes"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/handshake"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/testdata"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 type mockSession struct {
+	conn         connection
 	connectionID protocol.ConnectionID
 	packetCount  int
+	lastAddr     interface{}
+	closed       bool
+	closeReason  error
 }
 
 func (s *mockSession) handlePacket(addr interface{}, hdr *publicHeader, data []byte) {
 	s.packetCount++
+	s.lastAddr = addr
 }
 
 func (s *mockSession) run() {
 }
 
-func newMockSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error) {
+func (s *mockSession) Close(e error) error {
+	s.closed = true
+	s.closeReason = e
+	return nil
+}
+
+func newMockSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, receivePolicy ReceivePolicy, keepAliveInterval time.Duration, clock utils.Clock) (packetHandler, error) {
 	return &mockSession{
+		conn:         conn,
 		connectionID: connectionID,
 	}, nil
 }
 
+// addrRecordingSession passes the remote address of every packet to a channel
+type addrRecordingSession struct {
+	remoteAddrs chan interface{}
+}
+
+func (s *addrRecordingSession) handlePacket(addr interface{}, hdr *publicHeader, data []byte) {
+	s.remoteAddrs <- addr
+}
+
+func (s *addrRecordingSession) run() {
+}
+
+func (s *addrRecordingSession) Close(error) error { return nil }
+
+// hangingSession blocks in Close until unblock is closed
+type hangingSession struct {
+	closeCalled chan struct{}
+	unblock     chan struct{}
+}
+
+func (s *hangingSession) handlePacket(addr interface{}, hdr *publicHeader, data []byte) {}
+func (s *hangingSession) run()                                                          {}
+
+func (s *hangingSession) Close(error) error {
+	close(s.closeCalled)
+	<-s.unblock
+	return nil
+}
+
+type mockProofSource struct {
+	chain     [][]byte
+	signedSNI string
+}
+
+func (s *mockProofSource) SignProof(sni string, data []byte) ([]byte, error) {
+	s.signedSNI = sni
+	return []byte("proof"), nil
+}
+
+func (s *mockProofSource) GetCertChain(sni string) ([][]byte, error) {
+	return s.chain, nil
+}
+
+type mockTracer struct {
+	noopTracer
+	received []protocol.ByteCount
+	sent     []protocol.ByteCount
+	closed   []protocol.ConnectionID
+}
+
+func (t *mockTracer) PacketReceived(connID protocol.ConnectionID, size protocol.ByteCount) {
+	t.received = append(t.received, size)
+}
+
+func (t *mockTracer) PacketSent(connID protocol.ConnectionID, size protocol.ByteCount) {
+	t.sent = append(t.sent, size)
+}
+
+func (t *mockTracer) ConnectionClosed(connID protocol.ConnectionID) {
+	t.closed = append(t.closed, connID)
+}
+
+// mockClock is a utils.Clock that only advances when told to
+type mockClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+	// the number of times timers were reset, to find out when a session has gone through its run loop
+	resets int
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Unix(1000000, 0)}
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *mockClock) NewTimer(d time.Duration) utils.Timer {
+	return c.addTimer(d, nil)
+}
+
+func (c *mockClock) AfterFunc(d time.Duration, f func()) utils.Timer {
+	return c.addTimer(d, f)
+}
+
+func (c *mockClock) addTimer(d time.Duration, f func()) *mockTimer {
+	t := &mockTimer{clock: c, c: make(chan time.Time, 1), f: f}
+	c.mutex.Lock()
+	c.timers = append(c.timers, t)
+	c.mutex.Unlock()
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward and fires all timers that expire
+func (c *mockClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.fire()
+		}
+	}
+}
+
+func (c *mockClock) numResets() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.resets
+}
+
+type mockTimer struct {
+	clock    *mockClock
+	deadline time.Time
+	active   bool
+	c        chan time.Time
+	f        func()
+}
+
+// fire must be called with the clock's mutex held
+func (t *mockTimer) fire() {
+	t.active = false
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+func (t *mockTimer) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.clock.resets++
+	wasActive := t.active
+	t.active = true
+	t.deadline = t.clock.now.Add(d)
+	if d <= 0 {
+		t.fire()
+	}
+	return wasActive
+}
+
+// padInitialPacket pads a packet to the minimum size of initial packets, so that the server responds to it
+func padInitialPacket(packet []byte) []byte {
+	return append(packet, make([]byte, protocol.MinInitialPacketSize-len(packet))...)
+}
+
 var _ = Describe("Server", func() {
 	Describe("with mock session", func() {
 		var (
@@ -39,8 +223,13 @@ var _ = Describe("Server", func() {
 
 		BeforeEach(func() {
 			server = &Server{
-				sessions:   map[protocol.ConnectionID]packetHandler{},
-				newSession: newMockSession,
+				supportedVersions:       protocol.SupportedVersions,
+				supportedVersionsAsTags: protocol.SupportedVersionsAsTags,
+				sessions:                map[protocol.ConnectionID]packetHandler{},
+				drainingPeriod:          protocol.ClosedSessionDrainingPeriod,
+				tracer:                  noopTracer{},
+				clock:                   utils.DefaultClock{},
+				newSession:              newMockSession,
 			}
 		})
 
@@ -49,40 +238,565 @@ var _ = Describe("Server", func() {
 				[]byte{0x01 | 0x08 | 0x04, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 				protocol.SupportedVersionsAsTags...,
 			)
-			Expect(composeVersionNegotiation(1)).To(Equal(expected))
+			Expect(composeVersionNegotiation(1, protocol.SupportedVersionsAsTags)).To(Equal(expected))
+		})
+
+		It("composes public reset packets", func() {
+			packet := composePublicReset(0x4cfa9f9b668619f6, 0x1337, 0xdecafbad)
+			// public flags: public reset, 8 byte connection ID
+			Expect(packet[0]).To(Equal(byte(0x02 | 0x08)))
+			hdr, err := parsePublicHeader(bytes.NewReader(packet))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.ResetFlag).To(BeTrue())
+			Expect(hdr.VersionFlag).To(BeFalse())
+			Expect(hdr.ConnectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
+			tag, tagMap, err := handshake.ParseHandshakeMessage(bytes.NewReader(packet[9:]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag).To(Equal(handshake.TagPRST))
+			Expect(tagMap).To(Equal(map[handshake.Tag][]byte{
+				handshake.TagRNON: {0xad, 0xfb, 0xca, 0xde, 0, 0, 0, 0},
+				handshake.TagRSEQ: {0x37, 0x13, 0, 0, 0, 0, 0, 0},
+			}))
+		})
+
+		It("restricts the supported versions", func() {
+			err := server.SetSupportedVersions([]protocol.VersionNumber{31, 33})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.isSupportedVersion(31)).To(BeTrue())
+			Expect(server.isSupportedVersion(32)).To(BeFalse())
+			Expect(server.supportedVersionsAsTags).To(Equal([]byte("Q031Q033")))
+		})
+
+		It("doesn't restrict the supported versions to versions it doesn't support", func() {
+			err := server.SetSupportedVersions([]protocol.VersionNumber{33, 1337})
+			Expect(err).To(MatchError("unsupported version 1337"))
+			err = server.SetSupportedVersions(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(server.supportedVersions).To(Equal(protocol.SupportedVersions))
 		})
 
 		It("creates new sessions", func() {
-			err := server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).connectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(1))
 		})
 
+		It("rejects packets larger than the max receive packet size of the address family", func() {
+			packet := append([]byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}, make([]byte, protocol.MaxReceivePacketSizeIPv6)...)
+			packet = packet[:protocol.MaxReceivePacketSizeIPv6+1]
+			err := server.handlePacket(nil, &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, packet)
+			Expect(err).To(MatchError(qerr.PacketTooLarge))
+			err = server.handlePacket(nil, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4)}, packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(HaveLen(1))
+		})
+
+		It("runs new sessions on the session pool, if enabled", func() {
+			session := newBlockingSession()
+			server.newSession = func(connection, protocol.VersionNumber, protocol.ConnectionID, *handshake.ServerConfig, StreamCallback, closeCallback, ReceivePolicy, time.Duration, utils.Clock) (packetHandler, error) {
+				return session, nil
+			}
+			server.EnableSessionPool(1, 1)
+			defer server.sessionPool.close()
+			err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(session.running).Should(BeClosed())
+			close(session.closed)
+		})
+
+		It("passes the keep-alive interval to new sessions", func() {
+			var keepAlive time.Duration
+			server.newSession = func(conn connection, _ protocol.VersionNumber, connID protocol.ConnectionID, _ *handshake.ServerConfig, _ StreamCallback, _ closeCallback, _ ReceivePolicy, keepAliveInterval time.Duration, _ utils.Clock) (packetHandler, error) {
+				keepAlive = keepAliveInterval
+				return &mockSession{conn: conn, connectionID: connID}, nil
+			}
+			server.SetKeepAliveInterval(15 * time.Second)
+			err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keepAlive).To(Equal(15 * time.Second))
+		})
+
+		It("silently drops undersized initial packets", func() {
+			server.minInitialPacketSize = protocol.MinInitialPacketSize
+			packet := append([]byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}, make([]byte, protocol.MinInitialPacketSize)...)
+			err := server.handlePacket(nil, nil, packet[:protocol.MinInitialPacketSize-1])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(BeEmpty())
+			err = server.handlePacket(nil, nil, packet[:protocol.MinInitialPacketSize])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(HaveLen(1))
+			// packets of existing sessions may be smaller
+			err = server.handlePacket(nil, nil, packet[:14])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(2))
+		})
+
+		It("drops initial packets of IP addresses exceeding the new session rate limit", func() {
+			server.clock = newMockClock()
+			server.SetNewSessionRateLimit(2, time.Minute)
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+			for i := byte(1); i <= 3; i++ {
+				err := server.handlePacket(nil, addr, []byte{0x09, i, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x30, 0x33, 0x32, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(server.sessions).To(HaveLen(2))
+			Expect(server.sessions).ToNot(HaveKey(protocol.ConnectionID(3)))
+			// packets of existing sessions are not affected
+			err := server.handlePacket(nil, addr, []byte{0x09, 1, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions[1].(*mockSession).packetCount).To(Equal(2))
+			// other IP addresses can still create sessions
+			err = server.handlePacket(nil, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 1234}, []byte{0x09, 4, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(HaveLen(3))
+		})
+
+		It("doesn't rate limit new sessions if the limit is 0", func() {
+			server.SetNewSessionRateLimit(1, time.Minute)
+			server.SetNewSessionRateLimit(0, time.Minute)
+			Expect(server.sessionRateLimiter).To(BeNil())
+		})
+
+		Context("packets of unknown connections", func() {
+			var (
+				serverConn, client *net.UDPConn
+				clientAddr         *net.UDPAddr
+			)
+
+			BeforeEach(func() {
+				var err error
+				serverConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				Expect(err).ToNot(HaveOccurred())
+				client, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				Expect(err).ToNot(HaveOccurred())
+				clientAddr = client.LocalAddr().(*net.UDPAddr)
+			})
+
+			AfterEach(func() {
+				serverConn.Close()
+				client.Close()
+			})
+
+			// readPacket reads a packet sent to the client, and returns nil if none arrives
+			readPacket := func() []byte {
+				data := make([]byte, protocol.MaxPacketSize)
+				client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				n, _, err := client.ReadFromUDP(data)
+				if err != nil {
+					return nil
+				}
+				return data[:n]
+			}
+
+			It("sends a public reset", func() {
+				err := server.handlePacket(serverConn, clientAddr, []byte{0x18, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x37, 0x13})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions).To(BeEmpty())
+				packet := readPacket()
+				Expect(packet).ToNot(BeNil())
+				r := bytes.NewReader(packet)
+				hdr, err := parsePublicHeader(r)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdr.ResetFlag).To(BeTrue())
+				Expect(hdr.VersionFlag).To(BeFalse())
+				Expect(packet[0]).To(Equal(byte(0x0a)))
+				Expect(hdr.ConnectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
+				tag, tagMap, err := handshake.ParseHandshakeMessage(bytes.NewReader(packet[9:]))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tag).To(Equal(handshake.TagPRST))
+				Expect(tagMap).To(HaveLen(2))
+				Expect(tagMap[handshake.TagRNON]).To(HaveLen(8))
+				Expect(tagMap[handshake.TagRSEQ]).To(Equal([]byte{0x37, 0x13, 0, 0, 0, 0, 0, 0}))
+			})
+
+			It("uses a random nonce proof", func() {
+				var nonceProofs [][]byte
+				for i := 0; i < 2; i++ {
+					err := server.handlePacket(serverConn, clientAddr, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+					Expect(err).ToNot(HaveOccurred())
+					packet := readPacket()
+					Expect(packet).ToNot(BeNil())
+					_, tagMap, err := handshake.ParseHandshakeMessage(bytes.NewReader(packet[9:]))
+					Expect(err).ToNot(HaveOccurred())
+					nonceProofs = append(nonceProofs, tagMap[handshake.TagRNON])
+				}
+				Expect(nonceProofs[0]).ToNot(Equal(nonceProofs[1]))
+			})
+
+			It("doesn't send a version negotiation packet in response to an undersized initial packet", func() {
+				server.minInitialPacketSize = protocol.MinInitialPacketSize
+				packet := append([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01}, make([]byte, protocol.MinInitialPacketSize)...)
+				err := server.handlePacket(serverConn, clientAddr, packet[:protocol.MinInitialPacketSize-1])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readPacket()).To(BeNil())
+				err = server.handlePacket(serverConn, clientAddr, packet[:protocol.MinInitialPacketSize])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readPacket()).ToNot(BeNil())
+				Expect(server.sessions).To(BeEmpty())
+			})
+
+			It("doesn't send a public reset in response to a public reset", func() {
+				err := server.handlePacket(serverConn, clientAddr, writePublicReset(0x4cfa9f9b668619f6, 1, 0))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readPacket()).To(BeNil())
+			})
+
+			It("rate-limits public resets", func() {
+				server.publicResetLimiter = newIPRateLimiter(1, time.Second, newMockClock())
+				for i := 0; i < 2; i++ {
+					err := server.handlePacket(serverConn, clientAddr, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(readPacket()).ToNot(BeNil())
+				Expect(readPacket()).To(BeNil())
+			})
+
+			It("rate-limits public resets by default", func() {
+				s, err := NewServer(testdata.GetTLSConfig(), nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.publicResetLimiter).ToNot(BeNil())
+				Expect(s.publicResetLimiter.limit).To(Equal(protocol.MaxPublicResetsPerSecond))
+			})
+		})
+
+		It("enforces the minimum initial packet size by default", func() {
+			s, err := NewServer(testdata.GetTLSConfig(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.minInitialPacketSize).To(Equal(protocol.ByteCount(protocol.MinInitialPacketSize)))
+		})
+
+		It("advertises Curve25519 and P-256 in the server config", func() {
+			s, err := NewServer(testdata.GetTLSConfig(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			tag, scfg, err := handshake.ParseHandshakeMessage(bytes.NewReader(s.scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag).To(Equal(handshake.TagSCFG))
+			Expect(scfg).To(HaveKeyWithValue(handshake.TagKEXS, []byte("C255P256")))
+		})
+
+		It("signs the server proof with ECDSA for ECDSA certificates", func() {
+			config := testdata.GetECDSATLSConfig()
+			s, err := NewServer(config, nil)
+			Expect(err).ToNot(HaveOccurred())
+			proof, err := s.signer.SignServerProof("quic.clemente.io", []byte("CHLO"), []byte("SCFG"))
+			Expect(err).ToNot(HaveOccurred())
+			err = crypto.VerifyServerProof(config.Certificates[0].Certificate[0], []byte("CHLO"), []byte("SCFG"), proof)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("signs the server proof with RSA for RSA certificates", func() {
+			config := testdata.GetTLSConfig()
+			s, err := NewServer(config, nil)
+			Expect(err).ToNot(HaveOccurred())
+			proof, err := s.signer.SignServerProof("quic.clemente.io", []byte("CHLO"), []byte("SCFG"))
+			Expect(err).ToNot(HaveOccurred())
+			err = crypto.VerifyServerProof(config.Certificates[0].Certificate[0], []byte("CHLO"), []byte("SCFG"), proof)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
 		It("assigns packets to existing sessions", func() {
-			err := server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
 			Expect(err).ToNot(HaveOccurred())
-			err = server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err = server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).connectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(2))
 		})
 
+		Context("tracing", func() {
+			var tracer *mockTracer
+
+			BeforeEach(func() {
+				kex, err := crypto.NewCurve25519KEX()
+				Expect(err).ToNot(HaveOccurred())
+				server.scfg, err = handshake.NewServerConfig(kex, nil)
+				Expect(err).ToNot(HaveOccurred())
+				tracer = &mockTracer{}
+				server.SetTracer(tracer)
+			})
+
+			It("traces received packets", func() {
+				err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tracer.received).To(Equal([]protocol.ByteCount{14}))
+			})
+
+			It("passes the tracer to the connections of new sessions", func() {
+				err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				conn := server.sessions[0x4cfa9f9b668619f6].(*mockSession).conn.(*udpConn)
+				Expect(conn.tracer).To(Equal(tracer))
+				Expect(conn.connID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
+			})
+
+			It("traces closed connections", func() {
+				server.closeCallback(0x1337, newClosedSession(&mockConnection{}, nil))
+				Expect(tracer.closed).To(Equal([]protocol.ConnectionID{0x1337}))
+			})
+
+			It("uses a no-op tracer when the tracer is unset", func() {
+				server.SetTracer(nil)
+				Expect(server.tracer).To(Equal(noopTracer{}))
+				err := server.handlePacket(nil, nil, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tracer.received).To(BeEmpty())
+			})
+		})
+
+		It("passes the socket a packet was received on to the session", func() {
+			conn1 := &net.UDPConn{}
+			conn2 := &net.UDPConn{}
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1337}
+			err := server.handlePacket(conn1, addr, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			session := server.sessions[0x4cfa9f9b668619f6].(*mockSession)
+			Expect(session.lastAddr).To(Equal(&udpRemoteAddr{conn: conn1, addr: addr}))
+			// the client migrated to the preferred address
+			err = server.handlePacket(conn2, addr, []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(HaveLen(1))
+			Expect(session.packetCount).To(Equal(2))
+			Expect(session.lastAddr.(*udpRemoteAddr).conn).To(BeIdenticalTo(conn2))
+		})
+
 		It("closes and deletes sessions", func() {
 			pheader := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}
 			err := server.handlePacket(nil, nil, append(pheader, (&crypto.NullAEAD{}).Seal(0, pheader, nil)...))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
-			server.closeCallback(0x4cfa9f9b668619f6)
-			// The server should now have closed the session, leaving a nil value in the sessions map
+			server.drainingPeriod = 10 * time.Millisecond
+			closed := newClosedSession(&mockConnection{}, []byte("close"))
+			server.closeCallback(0x4cfa9f9b668619f6, closed)
+			// The closed session now handles the packets during the draining period
+			server.sessionsMutex.RLock()
 			Expect(server.sessions).To(HaveLen(1))
-			Expect(server.sessions[0x4cfa9f9b668619f6]).To(BeNil())
+			Expect(server.sessions[0x4cfa9f9b668619f6]).To(Equal(closed))
+			server.sessionsMutex.RUnlock()
+			err = server.handlePacket(nil, nil, append(pheader, (&crypto.NullAEAD{}).Seal(0, pheader, nil)...))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(closed.packetCount).To(Equal(uint64(1)))
+			// afterwards, it is deleted
+			Eventually(func() int {
+				server.sessionsMutex.RLock()
+				defer server.sessionsMutex.RUnlock()
+				return len(server.sessions)
+			}).Should(BeZero())
+		})
+
+		It("keeps the number of sessions bounded after many sessions were closed", func() {
+			clock := newMockClock()
+			server.clock = clock
+			for i := 1; i <= 1000; i++ {
+				id := protocol.ConnectionID(i)
+				err := server.handlePacket(nil, nil, []byte{0x09, byte(id), byte(id >> 8), 0, 0, 0, 0, 0, 0, 0x51, 0x30, 0x33, 0x32, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				server.closeCallback(id, newClosedSession(&mockConnection{}, nil))
+				clock.Advance(protocol.ClosedSessionDrainingPeriod / 10)
+			}
+			numSessions := func() int {
+				server.sessionsMutex.RLock()
+				defer server.sessionsMutex.RUnlock()
+				return len(server.sessions)
+			}
+			// only the sessions closed during the last draining period are kept
+			Eventually(numSessions).Should(BeNumerically("<=", 10))
+			clock.Advance(protocol.ClosedSessionDrainingPeriod)
+			Eventually(numSessions).Should(BeZero())
 		})
 
+		It("closes all active sessions when closing", func() {
+			session := &mockSession{}
+			closed := newClosedSession(&mockConnection{}, []byte("close"))
+			server.sessions[1] = session
+			server.sessions[2] = closed
+			err := server.Close()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.closed).To(BeTrue())
+			// the session sends a PeerGoingAway CONNECTION_CLOSE after sending the queued packets
+			Expect(session.closeReason).To(BeNil())
+		})
+
+		It("doesn't wait longer than the timeout for sessions to close", func() {
+			session := &hangingSession{closeCalled: make(chan struct{}), unblock: make(chan struct{})}
+			defer close(session.unblock)
+			server.sessions[1] = session
+			start := time.Now()
+			err := server.CloseWithTimeout(20 * time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(session.closeCalled).Should(BeClosed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	It("sends a CONNECTION_CLOSE to active sessions before closing the sockets", func() {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err := server.listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+
+		pheader := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}
+		packet := append(pheader, (&crypto.NullAEAD{}).Seal(1, pheader, make([]byte, protocol.MinInitialPacketSize))...)
+		err = server.handlePacket(serverConn, client.LocalAddr().(*net.UDPAddr), packet)
+		Expect(err).ToNot(HaveOccurred())
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+
+		// the session may send an ACK before the CONNECTION_CLOSE
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		var connectionClose []byte
+		for connectionClose == nil {
+			data := make([]byte, protocol.MaxPacketSize)
+			n, _, err := client.ReadFromUDP(data)
+			Expect(err).ToNot(HaveOccurred())
+			if bytes.HasSuffix(data[:n], []byte{0x02, byte(qerr.PeerGoingAway), 0, 0, 0, 0, 0}) {
+				connectionClose = data[:n]
+			}
+		}
+		server.sessionsMutex.RLock()
+		Expect(server.sessions[0x4cfa9f9b668619f6]).To(BeAssignableToTypeOf(&closedSession{}))
+		server.sessionsMutex.RUnlock()
+		// the socket was closed afterwards
+		_, err = serverConn.WriteToUDP([]byte("foobar"), client.LocalAddr().(*net.UDPAddr))
+		Expect(err).To(HaveOccurred())
 	})
 
+	It("uses the same clock for the idle timeout of sessions and the draining period", func() {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		clock := newMockClock()
+		server.clock = clock
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		pheader := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}
+		packet := append(pheader, (&crypto.NullAEAD{}).Seal(1, pheader, make([]byte, protocol.MinInitialPacketSize))...)
+		err = server.handlePacket(conn, conn.LocalAddr().(*net.UDPAddr), packet)
+		Expect(err).ToNot(HaveOccurred())
+		getSession := func() packetHandler {
+			server.sessionsMutex.RLock()
+			defer server.sessionsMutex.RUnlock()
+			return server.sessions[0x4cfa9f9b668619f6]
+		}
+		Expect(getSession()).To(BeAssignableToTypeOf(&Session{}))
+		// wait until the session has handled the packet and set its timer again
+		Eventually(clock.numResets).Should(BeNumerically(">=", 2))
+
+		clock.Advance(protocol.InitialIdleConnectionStateLifetime - time.Second)
+		Consistently(getSession).Should(BeAssignableToTypeOf(&Session{}))
+		// the session is closed once it was idle for too long
+		clock.Advance(2 * time.Second)
+		Eventually(getSession).Should(BeAssignableToTypeOf(&closedSession{}))
+		// and deleted after the draining period
+		clock.Advance(protocol.ClosedSessionDrainingPeriod)
+		Eventually(getSession).Should(BeNil())
+	})
+
+	It("uses a proof source for signing", func() {
+		source := &mockProofSource{chain: [][]byte{[]byte("leaf")}}
+		server, err := NewServerWithProofSource(source, nil)
+		Expect(err).ToNot(HaveOccurred())
+		leaf, err := server.signer.GetLeafCert("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leaf).To(Equal([]byte("leaf")))
+		proof, err := server.scfg.Sign("quic.clemente.io", []byte("CHLO"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proof).To(Equal([]byte("proof")))
+		Expect(source.signedSNI).To(Equal("quic.clemente.io"))
+	})
+
+	It("listens on the preferred address and advertises it", func() {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		err = server.SetPreferredAddress("127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.conns).To(HaveLen(1))
+		preferredAddr := server.scfg.PreferredAddress()
+		Expect(preferredAddr.IP.Equal(net.IPv4(127, 0, 0, 1))).To(BeTrue())
+		Expect(preferredAddr.Port).To(Equal(server.conns[0].LocalAddr().(*net.UDPAddr).Port))
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("errors when setting an invalid preferred address", func() {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		err = server.SetPreferredAddress("127.0.0.1")
+		Expect(err).To(HaveOccurred())
+		Expect(server.scfg.PreferredAddress()).To(BeNil())
+		Expect(server.conns).To(BeEmpty())
+	})
+
+	It("serves clients that migrate to the preferred address", func(done Done) {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		sessionConn := make(chan connection, 1)
+		remoteAddrs := make(chan interface{}, 2)
+		server.newSession = func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, receivePolicy ReceivePolicy, keepAliveInterval time.Duration, clock utils.Clock) (packetHandler, error) {
+			sessionConn <- conn
+			return &addrRecordingSession{remoteAddrs: remoteAddrs}, nil
+		}
+
+		err = server.SetPreferredAddress("127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		preferredAddr := server.scfg.PreferredAddress()
+		go func() {
+			defer GinkgoRecover()
+			err := server.ListenAndServe("127.0.0.1:0")
+			Expect(err).To(HaveOccurred())
+			close(done)
+		}()
+		var serverAddr *net.UDPAddr
+		Eventually(func() int {
+			server.connsMutex.Lock()
+			defer server.connsMutex.Unlock()
+			if len(server.conns) == 2 {
+				serverAddr = server.conns[1].LocalAddr().(*net.UDPAddr)
+			}
+			return len(server.conns)
+		}).Should(Equal(2))
+
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+		packet := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}
+		// the initial packet has to be padded
+		initialPacket := append(packet, make([]byte, protocol.MinInitialPacketSize)...)
+
+		_, err = client.WriteToUDP(initialPacket, serverAddr)
+		Expect(err).ToNot(HaveOccurred())
+		var remoteAddr interface{}
+		Eventually(remoteAddrs).Should(Receive(&remoteAddr))
+		Expect(remoteAddr.(*udpRemoteAddr).conn.LocalAddr().String()).To(Equal(serverAddr.String()))
+
+		// the client migrates to the preferred address
+		_, err = client.WriteToUDP(packet, preferredAddr)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(remoteAddrs).Should(Receive(&remoteAddr))
+		Expect(remoteAddr.(*udpRemoteAddr).conn.LocalAddr().String()).To(Equal(preferredAddr.String()))
+
+		// replies are sent from the preferred address
+		var conn connection
+		Expect(sessionConn).To(Receive(&conn))
+		conn.setCurrentRemoteAddr(remoteAddr)
+		err = conn.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		data := make([]byte, 100)
+		n, addr, err := client.ReadFromUDP(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data[:n]).To(Equal([]byte("foobar")))
+		Expect(addr.String()).To(Equal(preferredAddr.String()))
+
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+	}, 1)
+
 	It("setups and responds with version negotiation", func(done Done) {
 		server, err := NewServer(testdata.GetTLSConfig(), nil)
 		Expect(err).ToNot(HaveOccurred())
@@ -99,7 +813,7 @@ var _ = Describe("Server", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(func() error {
-			_, err = conn.Write([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01})
+			_, err = conn.Write(padInitialPacket([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01}))
 			if err != nil {
 				return err
 			}
@@ -122,6 +836,124 @@ var _ = Describe("Server", func() {
 		Expect(err).ToNot(HaveOccurred())
 	}, 1)
 
+	It("replies from the socket a packet was received on, when listening on multiple addresses", func(done Done) {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		addresses := []string{"127.0.0.1:13371", "127.0.0.1:13372"}
+		var wg sync.WaitGroup
+		wg.Add(len(addresses))
+		for _, address := range addresses {
+			go func(address string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				err := server.ListenAndServe(address)
+				Expect(err).To(HaveOccurred())
+			}(address)
+		}
+
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+		for _, address := range addresses {
+			addr, err := net.ResolveUDPAddr("udp", address)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() error {
+				// this triggers a version negotiation packet
+				_, err = client.WriteToUDP(padInitialPacket([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01}), addr)
+				if err != nil {
+					return err
+				}
+				client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				data := make([]byte, 1000)
+				_, remoteAddr, err := client.ReadFromUDP(data)
+				if err != nil {
+					return err
+				}
+				if remoteAddr.String() != addr.String() {
+					return fmt.Errorf("received a reply from %s, expected %s", remoteAddr, addr)
+				}
+				return nil
+			}).ShouldNot(HaveOccurred())
+		}
+
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+		wg.Wait()
+		close(done)
+	}, 2)
+
+	It("only lists its enabled versions in version negotiation packets", func(done Done) {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		err = server.SetSupportedVersions([]protocol.VersionNumber{33})
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			err := server.ListenAndServe("127.0.0.1:13370")
+			Expect(err).To(HaveOccurred())
+			close(done)
+		}()
+
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:13370")
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := net.DialUDP("udp", nil, addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(func() error {
+			// Q032 is supported by the implementation, but not enabled on this server
+			_, err = conn.Write(padInitialPacket([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 'Q', '0', '3', '2', 0x01}))
+			if err != nil {
+				return err
+			}
+			data := make([]byte, 1000)
+			var n int
+			n, _, err = conn.ReadFromUDP(data)
+			if err != nil {
+				return err
+			}
+			Expect(data[:n]).To(Equal(append([]byte{0xd, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, []byte("Q033")...)))
+			return nil
+		}).ShouldNot(HaveOccurred())
+
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+	}, 1)
+
+	It("applies the packet transform to version negotiation packets", func(done Done) {
+		server, err := NewServer(testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		transformed := make(chan []byte, 100)
+		server.SetPacketTransform(func(p []byte, write func([]byte) error) error {
+			// drop all packets
+			transformed <- p
+			return nil
+		})
+		go func() {
+			defer GinkgoRecover()
+			err := server.ListenAndServe("127.0.0.1:13370")
+			Expect(err).To(HaveOccurred())
+			close(done)
+		}()
+
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:13370")
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := net.DialUDP("udp", nil, addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(func() int {
+			// writing fails until the server listens
+			conn.Write(padInitialPacket([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01}))
+			return len(transformed)
+		}).ShouldNot(BeZero())
+		Expect(<-transformed).To(Equal(composeVersionNegotiation(1, protocol.SupportedVersionsAsTags)))
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1000))
+		Expect(err).To(HaveOccurred())
+
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+	}, 1)
+
 	It("setups and responds with error on invalid frame", func(done Done) {
 		server, err := NewServer(testdata.GetTLSConfig(), nil)
 		Expect(err).ToNot(HaveOccurred())
@@ -138,7 +970,7 @@ var _ = Describe("Server", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		Eventually(func() error {
-			_, err = conn.Write([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01, 0x00})
+			_, err = conn.Write(padInitialPacket([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01, 0x00}))
 			if err != nil {
 				return err
 			}
@@ -27,13 +27,26 @@ var (
 	errRstStreamOnInvalidStream    = errors.New("RST_STREAM received for unknown stream")
 	errWindowUpdateOnInvalidStream = qerr.Error(qerr.InvalidWindowUpdateData, "WINDOW_UPDATE received for unknown stream")
 	errWindowUpdateOnClosedStream  = errors.New("WINDOW_UPDATE received for an already closed stream")
+	errHandshakeComplete           = errors.New("handshake already complete")
 )
 
 // StreamCallback gets a stream frame and returns a reply frame
 type StreamCallback func(*Session, utils.Stream)
 
 // closeCallback is called when a session is closed
-type closeCallback func(id protocol.ConnectionID)
+// The closedSession handles the packets of the connection during the draining period.
+type closeCallback func(id protocol.ConnectionID, closed *closedSession)
+
+// A ReceivePolicy determines what happens to incoming stream data that the application doesn't read fast enough
+type ReceivePolicy int
+
+const (
+	// ReceivePolicyBlock buffers the data and relies on flow control to slow down the peer. This is the default.
+	ReceivePolicyBlock ReceivePolicy = iota
+	// ReceivePolicyDrop buffers at most protocol.MaxUnreadStreamData bytes per stream.
+	// If the buffer is full, the data is dropped and the stream is reset.
+	ReceivePolicyDrop
+)
 
 // A Session is a QUIC session
 type Session struct {
@@ -41,12 +54,17 @@ type Session struct {
 
 	streamCallback StreamCallback
 	closeCallback  closeCallback
+	receivePolicy  ReceivePolicy
 
 	conn connection
 
 	streams      map[protocol.StreamID]*stream
 	streamsMutex sync.RWMutex
 
+	// the number of open dynamic streams, protected by the streamsMutex
+	openIncomingStreams uint32
+	openOutgoingStreams uint32
+
 	sentPacketHandler     ackhandler.SentPacketHandler
 	receivedPacketHandler ackhandler.ReceivedPacketHandler
 	stopWaitingManager    ackhandler.StopWaitingManager
@@ -55,6 +73,21 @@ type Session struct {
 
 	flowController flowcontrol.FlowController // connection level flow controller
 
+	// control frames queued outside of the run loop, e.g. RST_STREAMs for streams reset by the application
+	queuedControlFrames      []frames.Frame
+	queuedControlFramesMutex sync.Mutex
+
+	// the statistics are updated by the run loop, and read by Stats
+	stats      SessionStats
+	statsMutex sync.Mutex
+
+	// after sending a GOAWAY, new incoming streams above lastGoodStream are refused
+	// both are protected by the streamsMutex
+	goawaySent     bool
+	lastGoodStream protocol.StreamID
+	// the highest offset received on every stream refused after the GOAWAY, only accessed by the run loop
+	refusedStreams map[protocol.StreamID]protocol.ByteCount
+
 	unpacker *packetUnpacker
 	packer   *packetPacker
 
@@ -63,7 +96,8 @@ type Session struct {
 	receivedPackets  chan receivedPacket
 	sendingScheduled chan struct{}
 	closeChan        chan struct{}
-	closed           uint32 // atomic bool
+	closed           uint32        // atomic bool
+	runStopped       chan struct{} // closed when the run loop returns
 
 	undecryptablePackets []receivedPacket
 	aeadChanged          chan struct{}
@@ -78,12 +112,20 @@ type Session struct {
 
 	lastNetworkActivityTime time.Time
 
-	timer     *time.Timer
+	// if non-zero, a PING is sent when no packet was sent for this long, to keep NAT bindings open
+	keepAliveInterval  time.Duration
+	lastPacketSentTime time.Time
+	// set while a keep-alive PING is waiting in the packer, so that only one PING is queued at a time
+	pingQueued bool
+
+	// the source of time for all timeouts
+	clock     utils.Clock
+	timer     utils.Timer
 	timerRead bool
 }
 
 // newSession makes a new session
-func newSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error) {
+func newSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, receivePolicy ReceivePolicy, keepAliveInterval time.Duration, clock utils.Clock) (packetHandler, error) {
 	stopWaitingManager := ackhandler.NewStopWaitingManager()
 	connectionParametersManager := handshake.NewConnectionParamatersManager()
 
@@ -92,6 +134,7 @@ func newSession(conn connection, v protocol.VersionNumber, connectionID protocol
 		conn:                        conn,
 		streamCallback:              streamCallback,
 		closeCallback:               closeCallback,
+		receivePolicy:               receivePolicy,
 		streams:                     make(map[protocol.StreamID]*stream),
 		sentPacketHandler:           ackhandler.NewSentPacketHandler(stopWaitingManager),
 		receivedPacketHandler:       ackhandler.NewReceivedPacketHandler(),
@@ -101,17 +144,23 @@ func newSession(conn connection, v protocol.VersionNumber, connectionID protocol
 		blockedManager:              newBlockedManager(),
 		receivedPackets:             make(chan receivedPacket, protocol.MaxSessionUnprocessedPackets),
 		closeChan:                   make(chan struct{}, 1),
+		runStopped:                  make(chan struct{}),
 		sendingScheduled:            make(chan struct{}, 1),
 		connectionParametersManager: connectionParametersManager,
 		undecryptablePackets:        make([]receivedPacket, 0, protocol.MaxUndecryptablePackets),
 		aeadChanged:                 make(chan struct{}, 1),
-		timer:                       time.NewTimer(0),
-		lastNetworkActivityTime: time.Now(),
+		clock:                       clock,
+		timer:                       clock.NewTimer(0),
+		lastNetworkActivityTime:     clock.Now(),
+		keepAliveInterval:           keepAliveInterval,
+		refusedStreams:              make(map[protocol.StreamID]protocol.ByteCount),
+		lastPacketSentTime:          clock.Now(),
 	}
+	session.updateCongestionStats()
 
 	cryptoStream, _ := session.OpenStream(1)
 	var err error
-	session.cryptoSetup, err = handshake.NewCryptoSetup(connectionID, conn.IP(), v, sCfg, cryptoStream, session.connectionParametersManager, session.aeadChanged)
+	session.cryptoSetup, err = handshake.NewCryptoSetup(connectionID, conn.IP(), v, sCfg, cryptoStream, session.connectionParametersManager, session.aeadChanged, handshake.WithClock(clock))
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +173,8 @@ func newSession(conn connection, v protocol.VersionNumber, connectionID protocol
 
 // run the session main loop
 func (s *Session) run() {
+	defer close(s.runStopped)
+
 	go func() {
 		if err := s.cryptoSetup.HandleCryptoStream(); err != nil {
 			s.Close(err)
@@ -140,7 +191,7 @@ func (s *Session) run() {
 
 		// Calculate the minimum of all timeouts
 
-		now := time.Now()
+		now := s.clock.Now()
 		firstTimeout := utils.InfDuration
 		// Some timeouts are only set when we can actually send
 		// Note: if a packet arrives, we go through this again afterwards.
@@ -151,14 +202,18 @@ func (s *Session) run() {
 			}
 			// RTOs
 			firstTimeout = utils.MinDuration(firstTimeout, s.sentPacketHandler.TimeToFirstRTO())
+			// Keep-alive
+			if s.keepAliveInterval > 0 && !s.pingQueued {
+				firstTimeout = utils.MinDuration(firstTimeout, s.lastPacketSentTime.Add(s.keepAliveInterval).Sub(now))
+			}
 		}
-		// Idle connection timeout
-		firstTimeout = utils.MinDuration(firstTimeout, s.lastNetworkActivityTime.Add(s.connectionParametersManager.GetIdleConnectionStateLifetime()).Sub(now))
+		// Idle connection timeout, as negotiated with the client
+		firstTimeout = utils.MinDuration(firstTimeout, s.lastNetworkActivityTime.Add(s.connectionParametersManager.GetIdleTimeout()).Sub(now))
 
 		// We need to drain the timer if the value from its channel was not read yet.
 		// See https://groups.google.com/forum/#!topic/golang-dev/c9UUfASVPoU
 		if !s.timer.Stop() && !s.timerRead {
-			<-s.timer.C
+			<-s.timer.Chan()
 		}
 		s.timer.Reset(firstTimeout)
 		s.timerRead = false
@@ -167,7 +222,7 @@ func (s *Session) run() {
 		select {
 		case <-s.closeChan:
 			return
-		case <-s.timer.C:
+		case <-s.timer.Chan():
 			s.timerRead = true
 			// We do all the interesting stuff after the switch statement, so
 			// nothing to see here.
@@ -201,7 +256,10 @@ func (s *Session) run() {
 		if err := s.maybeSendPacket(); err != nil {
 			s.Close(err)
 		}
-		if time.Now().Sub(s.lastNetworkActivityTime) > s.connectionParametersManager.GetIdleConnectionStateLifetime() {
+		if err := s.maybeSendKeepAlive(); err != nil {
+			s.Close(err)
+		}
+		if s.clock.Now().Sub(s.lastNetworkActivityTime) > s.connectionParametersManager.GetIdleTimeout() {
 			s.Close(qerr.Error(qerr.NetworkIdleTimeout, "No recent network activity."))
 		}
 		s.garbageCollectStreams()
@@ -209,7 +267,7 @@ func (s *Session) run() {
 }
 
 func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, data []byte) error {
-	s.lastNetworkActivityTime = time.Now()
+	s.lastNetworkActivityTime = s.clock.Now()
 	r := bytes.NewReader(data)
 
 	// Calculate packet number
@@ -221,14 +279,15 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 	s.lastRcvdPacketNumber = hdr.PacketNumber
 	utils.Debugf("<- Reading packet 0x%x (%d bytes) for connection %x", hdr.PacketNumber, r.Size(), hdr.ConnectionID)
 
-	// TODO: Only do this after authenticating
-	s.conn.setCurrentRemoteAddr(remoteAddr)
-
 	packet, err := s.unpacker.Unpack(hdr.Raw, hdr, r)
 	if err != nil {
 		return err
 	}
 
+	// Only update the remote address after the packet was authenticated,
+	// otherwise a spoofed packet could redirect all our packets
+	s.conn.setCurrentRemoteAddr(remoteAddr)
+
 	s.receivedPacketHandler.ReceivedPacket(hdr.PacketNumber, packet.entropyBit)
 
 	for _, ff := range packet.frames {
@@ -252,6 +311,8 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 		case *frames.WindowUpdateFrame:
 			utils.Debugf("\t<- %#v", frame)
 			err = s.handleWindowUpdateFrame(frame)
+		case *frames.GoawayFrame:
+			utils.Infof("GOAWAY received for connection %x: %s", s.connectionID, frame.ReasonPhrase)
 		case *frames.BlockedFrame:
 			utils.Infof("BLOCKED frame received for connection %x stream %d", s.connectionID, frame.StreamID)
 		case *frames.PingFrame:
@@ -263,9 +324,32 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 			return err
 		}
 	}
+
+	s.statsMutex.Lock()
+	s.stats.PacketsReceived++
+	s.stats.BytesReceived += protocol.ByteCount(len(hdr.Raw) + len(data))
+	s.updateCongestionStats()
+	s.statsMutex.Unlock()
 	return nil
 }
 
+// Stats returns a snapshot of the statistics of the connection
+func (s *Session) Stats() SessionStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	return s.stats
+}
+
+// updateCongestionStats copies the RTT estimates and the congestion window to the stats
+// The statsMutex must be held when calling it.
+func (s *Session) updateCongestionStats() {
+	rttStats := s.sentPacketHandler.GetRTTStats()
+	s.stats.SmoothedRTT = rttStats.SmoothedRTT()
+	s.stats.RTTVariance = rttStats.MeanDeviation()
+	s.stats.MinRTT = rttStats.MinRTT()
+	s.stats.CongestionWindow = s.sentPacketHandler.GetCongestionWindow()
+}
+
 // handlePacket handles a packet
 func (s *Session) handlePacket(remoteAddr interface{}, hdr *publicHeader, data []byte) {
 	// Discard packets once the amount of queued packets is larger than
@@ -286,7 +370,17 @@ func (s *Session) handleStreamFrame(frame *frames.StreamFrame) error {
 			return qerr.InvalidStreamID
 		}
 
-		ss, _ := s.OpenStream(frame.StreamID)
+		s.streamsMutex.RLock()
+		refused := s.goawaySent && frame.StreamID > s.lastGoodStream
+		s.streamsMutex.RUnlock()
+		if refused {
+			return s.handleRefusedStreamFrame(frame)
+		}
+
+		ss, err := s.OpenStream(frame.StreamID)
+		if err != nil {
+			return err
+		}
 		str = ss.(*stream)
 	}
 	if str == nil {
@@ -294,6 +388,17 @@ func (s *Session) handleStreamFrame(frame *frames.StreamFrame) error {
 		return nil
 	}
 	err := str.AddStreamFrame(frame)
+	if err == errStreamReceiveBufferFull {
+		// Only the stream is reset, the connection stays open
+		utils.Infof("Resetting stream %d of connection %x: %s", frame.StreamID, s.connectionID, err.Error())
+		finalOffset := str.Reset(rstStreamErrorCodeCancelled)
+		s.queueControlFrame(&frames.RstStreamFrame{
+			StreamID:   frame.StreamID,
+			ByteOffset: finalOffset,
+			ErrorCode:  rstStreamErrorCodeCancelled,
+		})
+		err = nil
+	}
 	if err != nil {
 		return err
 	}
@@ -303,6 +408,41 @@ func (s *Session) handleStreamFrame(frame *frames.StreamFrame) error {
 	return nil
 }
 
+// handleRefusedStreamFrame handles a STREAM frame for a stream that was refused after the GOAWAY
+// The stream is reset once, and the data is only counted up to the highest offset seen, since frames may be retransmitted.
+func (s *Session) handleRefusedStreamFrame(frame *frames.StreamFrame) error {
+	highestOffset, alreadyRefused := s.refusedStreams[frame.StreamID]
+	if !alreadyRefused {
+		utils.Debugf("Refusing stream %d of connection %x after GOAWAY", frame.StreamID, s.connectionID)
+		// we never sent any data on this stream, so our final offset is 0
+		s.queueControlFrame(&frames.RstStreamFrame{
+			StreamID:  frame.StreamID,
+			ErrorCode: rstStreamErrorCodePeerGoingAway,
+		})
+		s.refusedStreams[frame.StreamID] = highestOffset
+	}
+	newHighestOffset := frame.Offset + protocol.ByteCount(len(frame.Data))
+	if newHighestOffset <= highestOffset {
+		return nil
+	}
+	s.refusedStreams[frame.StreamID] = newHighestOffset
+	return s.discardConnectionLevelData(newHighestOffset - highestOffset)
+}
+
+// discardConnectionLevelData counts data received on a stream that we don't keep as received and read
+// The peer charged it against the connection flow control window, so we have to give it back.
+func (s *Session) discardConnectionLevelData(n protocol.ByteCount) error {
+	s.flowController.IncrementHighestReceived(n)
+	if s.flowController.CheckFlowControlViolation() {
+		return errConnectionFlowControlViolation
+	}
+	s.flowController.AddBytesRead(n)
+	if doUpdate, byteOffset := s.flowController.MaybeTriggerWindowUpdate(); doUpdate {
+		s.updateReceiveFlowControlWindow(0, byteOffset)
+	}
+	return nil
+}
+
 func (s *Session) isValidStreamID(streamID protocol.StreamID) bool {
 	if streamID%2 != 1 {
 		return false
@@ -344,7 +484,6 @@ func (s *Session) handleWindowUpdateFrame(frame *frames.WindowUpdateFrame) error
 	return nil
 }
 
-// TODO: Handle frame.byteOffset
 func (s *Session) handleRstStreamFrame(frame *frames.RstStreamFrame) error {
 	s.streamsMutex.RLock()
 	str, streamExists := s.streams[frame.StreamID]
@@ -352,10 +491,75 @@ func (s *Session) handleRstStreamFrame(frame *frames.RstStreamFrame) error {
 	if !streamExists || str == nil {
 		return errRstStreamOnInvalidStream
 	}
-	str.RegisterError(fmt.Errorf("RST_STREAM received with code %d", frame.ErrorCode))
+	return str.RegisterRemoteReset(frame.ErrorCode, frame.ByteOffset)
+}
+
+// ResetStream aborts a stream by sending a RST_STREAM frame with the error code
+// All further reads and writes on the stream fail.
+func (s *Session) ResetStream(id protocol.StreamID, errorCode uint32) error {
+	s.streamsMutex.RLock()
+	str, streamExists := s.streams[id]
+	s.streamsMutex.RUnlock()
+	if !streamExists || str == nil {
+		return fmt.Errorf("stream %d doesn't exist", id)
+	}
+	finalOffset := str.Reset(errorCode)
+	s.queueControlFrame(&frames.RstStreamFrame{
+		StreamID:   id,
+		ByteOffset: finalOffset,
+		ErrorCode:  errorCode,
+	})
 	return nil
 }
 
+// GoAway tells the client to stop opening new streams, e.g. before the server shuts down
+// Streams that are already open can be completed. Incoming streams opened later are refused with a RST_STREAM.
+func (s *Session) GoAway(errorCode qerr.ErrorCode, reason string) {
+	s.streamsMutex.Lock()
+	if s.goawaySent {
+		s.streamsMutex.Unlock()
+		return
+	}
+	s.goawaySent = true
+	for id := range s.streams {
+		if s.isValidStreamID(id) && id > s.lastGoodStream {
+			s.lastGoodStream = id
+		}
+	}
+	lastGoodStream := s.lastGoodStream
+	s.streamsMutex.Unlock()
+
+	utils.Infof("Sending GOAWAY for connection %x, last good stream: %d", s.connectionID, lastGoodStream)
+	s.queueControlFrame(&frames.GoawayFrame{
+		ErrorCode:      errorCode,
+		LastGoodStream: lastGoodStream,
+		ReasonPhrase:   reason,
+	})
+}
+
+// queueControlFrame queues a control frame to be sent with the next packet
+// It can be called from outside of the run loop.
+func (s *Session) queueControlFrame(frame frames.Frame) {
+	s.queuedControlFramesMutex.Lock()
+	s.queuedControlFrames = append(s.queuedControlFrames, frame)
+	s.queuedControlFramesMutex.Unlock()
+	s.scheduleSending()
+}
+
+func (s *Session) getQueuedControlFrames() []frames.Frame {
+	s.queuedControlFramesMutex.Lock()
+	defer s.queuedControlFramesMutex.Unlock()
+	queuedControlFrames := s.queuedControlFrames
+	s.queuedControlFrames = nil
+	return queuedControlFrames
+}
+
+func (s *Session) hasQueuedControlFrames() bool {
+	s.queuedControlFramesMutex.Lock()
+	defer s.queuedControlFramesMutex.Unlock()
+	return len(s.queuedControlFrames) > 0
+}
+
 func (s *Session) handleAckFrame(frame *frames.AckFrame) error {
 
 	if err := s.sentPacketHandler.ReceivedAck(frame); err != nil {
@@ -366,6 +570,16 @@ func (s *Session) handleAckFrame(frame *frames.AckFrame) error {
 	return nil
 }
 
+// AbortHandshake refuses the client during the handshake, e.g. due to overload or a policy decision
+// The CONNECTION_CLOSE sent to the client carries the error code and the reason.
+// It fails once the handshake is complete, use Close to close an established connection.
+func (s *Session) AbortHandshake(code qerr.ErrorCode, reason string) error {
+	if s.cryptoSetup.HandshakeState() == handshake.HandshakeStateForwardSecure {
+		return errHandshakeComplete
+	}
+	return s.Close(qerr.Error(code, reason))
+}
+
 // Close the connection
 func (s *Session) Close(e error) error {
 	return s.closeImpl(e, false)
@@ -378,23 +592,52 @@ func (s *Session) closeImpl(e error, remoteClose bool) error {
 	}
 	s.closeChan <- struct{}{}
 
+	graceful := e == nil && !remoteClose
 	if e == nil {
 		e = qerr.PeerGoingAway
 	}
 
 	utils.Errorf("Closing session with error: %s", e.Error())
 	s.closeStreamsWithError(e)
-	s.closeCallback(s.connectionID)
 
 	if remoteClose {
+		s.closeCallback(s.connectionID, newClosedSession(s.conn, nil))
 		return nil
 	}
 
+	if graceful {
+		s.drain()
+	}
+
+	var closePacket []byte
+	var err error
 	quicErr := qerr.ToQuicError(e)
 	if quicErr.ErrorCode == qerr.DecryptionFailure {
-		return s.sendPublicReset(s.lastRcvdPacketNumber)
+		closePacket, err = s.sendPublicReset(s.lastRcvdPacketNumber)
+	} else {
+		closePacket, err = s.sendConnectionClose(quicErr)
+	}
+	s.closeCallback(s.connectionID, newClosedSession(s.conn, closePacket))
+	return err
+}
+
+// drain sends out the packets that were queued before a graceful close
+// It waits for the run loop to stop first, so that we are the only ones sending, but at most for protocol.SessionDrainTimeout
+func (s *Session) drain() {
+	timer := s.clock.NewTimer(protocol.SessionDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.runStopped:
+	case <-timer.Chan():
+		utils.Errorf("Not draining session %x, the run loop didn't stop", s.connectionID)
+		return
+	}
+	for i := 0; i < protocol.MaxSessionDrainPackets && !s.packer.Empty(); i++ {
+		if err := s.sendPacket(); err != nil {
+			utils.Errorf("Error draining session %x: %s", s.connectionID, err.Error())
+			return
+		}
 	}
-	return s.sendConnectionClose(quicErr)
 }
 
 func (s *Session) closeStreamsWithError(err error) {
@@ -410,7 +653,7 @@ func (s *Session) closeStreamsWithError(err error) {
 
 // TODO: try sending more than one packet
 func (s *Session) maybeSendPacket() error {
-	if time.Now().Sub(s.smallPacketDelayedOccurranceTime) > protocol.SmallPacketSendDelay {
+	if s.clock.Now().Sub(s.smallPacketDelayedOccurranceTime) > protocol.SmallPacketSendDelay {
 		return s.sendPacket()
 	}
 
@@ -423,6 +666,11 @@ func (s *Session) maybeSendPacket() error {
 		return s.sendPacket()
 	}
 
+	// the application is waiting for streams to be reset, don't delay the RST_STREAMs or the GOAWAY
+	if s.hasQueuedControlFrames() {
+		return s.sendPacket()
+	}
+
 	var maxPacketSize protocol.ByteCount // the maximum size of a packet we could send out at this moment
 
 	// we only estimate the size of the StopWaitingFrame here
@@ -454,12 +702,25 @@ func (s *Session) maybeSendPacket() error {
 	}
 
 	if s.smallPacketDelayedOccurranceTime.IsZero() {
-		s.smallPacketDelayedOccurranceTime = time.Now()
+		s.smallPacketDelayedOccurranceTime = s.clock.Now()
 	}
 
 	return nil
 }
 
+// maybeSendKeepAlive sends a PING if no packet was sent for the keep-alive interval
+func (s *Session) maybeSendKeepAlive() error {
+	if s.keepAliveInterval == 0 || s.clock.Now().Sub(s.lastPacketSentTime) < s.keepAliveInterval {
+		return nil
+	}
+	if !s.pingQueued {
+		utils.Debugf("Sending keep-alive PING for connection %x", s.connectionID)
+		s.packer.AddPing()
+		s.pingQueued = true
+	}
+	return s.sendPacket()
+}
+
 func (s *Session) sendPacket() error {
 	s.smallPacketDelayedOccurranceTime = time.Time{} // zero
 
@@ -479,6 +740,9 @@ func (s *Session) sendPacket() error {
 	retransmitPacket := s.sentPacketHandler.DequeuePacketForRetransmission()
 	if retransmitPacket != nil {
 		utils.Debugf("\tDequeueing retransmission for packet 0x%x", retransmitPacket.PacketNumber)
+		s.statsMutex.Lock()
+		s.stats.Retransmissions++
+		s.statsMutex.Unlock()
 		s.stopWaitingManager.RegisterPacketForRetransmission(retransmitPacket)
 		// resend the frames that were in the packet
 		controlFrames = append(controlFrames, retransmitPacket.GetControlFramesForRetransmission()...)
@@ -492,6 +756,7 @@ func (s *Session) sendPacket() error {
 	for _, wuf := range windowUpdateFrames {
 		controlFrames = append(controlFrames, wuf)
 	}
+	controlFrames = append(controlFrames, s.getQueuedControlFrames()...)
 
 	ack, err := s.receivedPacketHandler.GetAckFrame(true)
 	if err != nil {
@@ -529,6 +794,18 @@ func (s *Session) sendPacket() error {
 	if err != nil {
 		return err
 	}
+	s.lastPacketSentTime = s.clock.Now()
+	for _, f := range packet.frames {
+		if _, ok := f.(*frames.PingFrame); ok {
+			s.pingQueued = false
+		}
+	}
+
+	s.statsMutex.Lock()
+	s.stats.PacketsSent++
+	s.stats.BytesSent += protocol.ByteCount(len(packet.raw))
+	s.updateCongestionStats()
+	s.statsMutex.Unlock()
 
 	if !s.packer.Empty() {
 		s.scheduleSending()
@@ -537,16 +814,17 @@ func (s *Session) sendPacket() error {
 	return nil
 }
 
-func (s *Session) sendConnectionClose(quicErr *qerr.QuicError) error {
+// sendConnectionClose sends a CONNECTION_CLOSE frame and returns the packet it was sent in
+func (s *Session) sendConnectionClose(quicErr *qerr.QuicError) ([]byte, error) {
 	packet, err := s.packer.PackConnectionClose(&frames.ConnectionCloseFrame{ErrorCode: quicErr.ErrorCode, ReasonPhrase: quicErr.ErrorMessage})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if packet == nil {
-		return errors.New("Session BUG: expected packet not to be nil")
+		return nil, errors.New("Session BUG: expected packet not to be nil")
 	}
 	s.logPacket(packet)
-	return s.conn.write(packet.raw)
+	return packet.raw, s.conn.write(packet.raw)
 }
 
 func (s *Session) logPacket(packet *packedPacket) {
@@ -599,13 +877,58 @@ func (s *Session) newStreamImpl(id protocol.StreamID) (*stream, error) {
 	if err != nil {
 		return nil, err
 	}
+	stream.receivePolicy = s.receivePolicy
 	if s.streams[id] != nil {
 		return nil, fmt.Errorf("Session: stream with ID %d already exists", id)
 	}
+	if countsTowardsStreamLimit(id) {
+		if s.isValidStreamID(id) {
+			if s.openIncomingStreams >= s.connectionParametersManager.GetMaxIncomingStreams() {
+				return nil, qerr.TooManyOpenStreams
+			}
+			s.openIncomingStreams++
+		} else {
+			if s.openOutgoingStreams >= s.connectionParametersManager.GetMaxOutgoingStreams() {
+				return nil, qerr.TooManyOpenStreams
+			}
+			s.openOutgoingStreams++
+		}
+	}
 	s.streams[id] = stream
 	return stream, nil
 }
 
+// countsTowardsStreamLimit says if a stream is a dynamic stream
+// The crypto stream and the headers stream don't count towards the stream limits
+func countsTowardsStreamLimit(id protocol.StreamID) bool {
+	return id != 1 && id != 3
+}
+
+// MaxHeaderListSize gets the maximum size of an uncompressed HTTP/2 header list the client may send
+func (s *Session) MaxHeaderListSize() uint32 {
+	return s.connectionParametersManager.GetMaxHeaderListSize()
+}
+
+// SupportsMaxHeaderListSize says if the client negotiated SMHL, i.e. if it accepts SETTINGS_MAX_HEADER_LIST_SIZE on the headers stream
+func (s *Session) SupportsMaxHeaderListSize() bool {
+	return s.connectionParametersManager.SupportsMaxHeaderListSize()
+}
+
+// MaxStreamsPerConnection gets the negotiated maximum number of streams per connection
+func (s *Session) MaxStreamsPerConnection() uint32 {
+	return s.connectionParametersManager.GetMaxStreamsPerConnection()
+}
+
+// SendStreamFlowControlWindow gets the stream-level flow control window the peer announced for the data we send
+func (s *Session) SendStreamFlowControlWindow() protocol.ByteCount {
+	return s.connectionParametersManager.GetSendStreamFlowControlWindow()
+}
+
+// IdleTimeout gets the negotiated idle timeout, after which the session is closed if no packets are received
+func (s *Session) IdleTimeout() time.Duration {
+	return s.connectionParametersManager.GetIdleTimeout()
+}
+
 // garbageCollectStreams goes through all streams and removes EOF'ed streams
 // from the streams map.
 func (s *Session) garbageCollectStreams() {
@@ -620,13 +943,22 @@ func (s *Session) garbageCollectStreams() {
 		}
 		if v.finished() {
 			s.streams[k] = nil
+			if countsTowardsStreamLimit(k) {
+				if s.isValidStreamID(k) {
+					s.openIncomingStreams--
+				} else {
+					s.openOutgoingStreams--
+				}
+			}
 		}
 	}
 }
 
-func (s *Session) sendPublicReset(rejectedPacketNumber protocol.PacketNumber) error {
+// sendPublicReset sends a public reset and returns the packet
+func (s *Session) sendPublicReset(rejectedPacketNumber protocol.PacketNumber) ([]byte, error) {
 	utils.Infof("Sending public reset for connection %x, packet number %d", s.connectionID, rejectedPacketNumber)
-	return s.conn.write(writePublicReset(s.connectionID, rejectedPacketNumber, 0))
+	packet := writePublicReset(s.connectionID, rejectedPacketNumber, 0)
+	return packet, s.conn.write(packet)
 }
 
 // scheduleSending signals that we have data for sending
@@ -0,0 +1,102 @@
+package quic
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+var (
+	errSessionPoolFull   = qerr.Error(qerr.PeerGoingAway, "too many sessions waiting to be run")
+	errSessionPoolClosed = qerr.Error(qerr.PeerGoingAway, "server closed")
+)
+
+// A sessionPool runs sessions on a fixed number of goroutines
+// Sessions that are added while all goroutines are busy are queued until a running session returns.
+// A session occupies its goroutine until it is closed, so the pool limits the number of sessions running at the same time.
+type sessionPool struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	queue     []packetHandler
+	maxQueued int
+	closed    bool
+	workers   sync.WaitGroup
+}
+
+func newSessionPool(size, maxQueued int) *sessionPool {
+	p := &sessionPool{maxQueued: maxQueued}
+	p.cond = sync.NewCond(&p.mutex)
+	p.workers.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// run queues a session to be run by the pool. It never blocks.
+// If the queue is full, or the pool was closed, the session is closed instead.
+func (p *sessionPool) run(session packetHandler) {
+	p.mutex.Lock()
+	var err error
+	if p.closed {
+		err = errSessionPoolClosed
+	} else if len(p.queue) >= p.maxQueued {
+		err = errSessionPoolFull
+	} else {
+		p.queue = append(p.queue, session)
+		p.cond.Signal()
+	}
+	p.mutex.Unlock()
+
+	if err != nil {
+		closeSession(session, err)
+	}
+}
+
+// queued returns the number of sessions waiting for a free goroutine
+func (p *sessionPool) queued() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.queue)
+}
+
+// close stops the pool. Queued sessions are closed without being run, running sessions are not interrupted.
+func (p *sessionPool) close() {
+	p.mutex.Lock()
+	p.closed = true
+	queue := p.queue
+	p.queue = nil
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+
+	for _, session := range queue {
+		closeSession(session, errSessionPoolClosed)
+	}
+}
+
+func (p *sessionPool) work() {
+	defer p.workers.Done()
+	for {
+		p.mutex.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mutex.Unlock()
+			return
+		}
+		session := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mutex.Unlock()
+
+		session.run()
+	}
+}
+
+func closeSession(session packetHandler, err error) {
+	if err := session.Close(err); err != nil {
+		utils.Errorf("Error closing session: %s", err.Error())
+	}
+}
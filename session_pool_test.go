@@ -0,0 +1,193 @@
+package quic
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/handshake"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// blockingSession runs until it is closed
+type blockingSession struct {
+	running chan struct{}
+	closed  chan struct{}
+	// receives the error passed to Close
+	closeErr chan error
+}
+
+func newBlockingSession() *blockingSession {
+	return &blockingSession{
+		running:  make(chan struct{}),
+		closed:   make(chan struct{}),
+		closeErr: make(chan error, 1),
+	}
+}
+
+func (s *blockingSession) handlePacket(addr interface{}, hdr *publicHeader, data []byte) {}
+
+func (s *blockingSession) run() {
+	close(s.running)
+	<-s.closed
+}
+
+func (s *blockingSession) Close(err error) error {
+	select {
+	case s.closeErr <- err:
+	default:
+	}
+	return nil
+}
+
+var _ = Describe("Session pool", func() {
+	var pool *sessionPool
+
+	BeforeEach(func() {
+		pool = newSessionPool(2, 2)
+	})
+
+	AfterEach(func() {
+		pool.close()
+	})
+
+	It("runs sessions", func() {
+		session := newBlockingSession()
+		pool.run(session)
+		Eventually(session.running).Should(BeClosed())
+		close(session.closed)
+	})
+
+	It("queues sessions while all goroutines are busy", func() {
+		sessions := []*blockingSession{newBlockingSession(), newBlockingSession(), newBlockingSession()}
+		for _, s := range sessions[:2] {
+			pool.run(s)
+		}
+		Eventually(sessions[0].running).Should(BeClosed())
+		Eventually(sessions[1].running).Should(BeClosed())
+		pool.run(sessions[2])
+		Consistently(sessions[2].running).ShouldNot(BeClosed())
+		Expect(pool.queued()).To(Equal(1))
+		close(sessions[0].closed)
+		Eventually(sessions[2].running).Should(BeClosed())
+		Expect(pool.queued()).To(BeZero())
+		close(sessions[1].closed)
+		close(sessions[2].closed)
+	})
+
+	It("stops the goroutines when closed", func() {
+		session := newBlockingSession()
+		pool.run(session)
+		Eventually(session.running).Should(BeClosed())
+		pool.run(newBlockingSession())
+		pool.close()
+		Expect(pool.queued()).To(BeZero())
+		close(session.closed)
+		pool.workers.Wait()
+	})
+
+	It("doesn't run sessions after being closed", func() {
+		pool.close()
+		session := newBlockingSession()
+		pool.run(session)
+		Consistently(session.running).ShouldNot(BeClosed())
+		Expect(session.closeErr).To(Receive(Equal(errSessionPoolClosed)))
+	})
+
+	It("closes new sessions when the queue is full", func() {
+		var sessions []*blockingSession
+		for i := 0; i < 4; i++ {
+			sessions = append(sessions, newBlockingSession())
+		}
+		pool.run(sessions[0])
+		pool.run(sessions[1])
+		Eventually(sessions[0].running).Should(BeClosed())
+		Eventually(sessions[1].running).Should(BeClosed())
+		pool.run(sessions[2])
+		pool.run(sessions[3])
+		Expect(pool.queued()).To(Equal(2))
+		rejected := newBlockingSession()
+		pool.run(rejected)
+		Expect(rejected.closeErr).To(Receive(Equal(errSessionPoolFull)))
+		Expect(pool.queued()).To(Equal(2))
+		for _, s := range sessions[2:] {
+			Expect(s.closeErr).ToNot(Receive())
+		}
+		close(sessions[0].closed)
+		Eventually(sessions[2].running).Should(BeClosed())
+		close(sessions[1].closed)
+		close(sessions[2].closed)
+		Eventually(sessions[3].running).Should(BeClosed())
+		close(sessions[3].closed)
+	})
+
+	It("closes the queued sessions when closed", func() {
+		running := newBlockingSession()
+		pool.run(running)
+		other := newBlockingSession()
+		pool.run(other)
+		Eventually(running.running).Should(BeClosed())
+		Eventually(other.running).Should(BeClosed())
+		queued := newBlockingSession()
+		pool.run(queued)
+		Eventually(pool.queued).Should(Equal(1))
+		pool.close()
+		Expect(queued.closeErr).To(Receive(Equal(errSessionPoolClosed)))
+		Expect(queued.running).ToNot(BeClosed())
+		// running sessions are not interrupted
+		Expect(running.closeErr).ToNot(Receive())
+		close(running.closed)
+		close(other.closed)
+	})
+})
+
+// BenchmarkServerSessionGoroutines compares the number of goroutines when many connections are opened
+// with one goroutine per session and with a session pool.
+func BenchmarkServerSessionGoroutines(b *testing.B) {
+	const connections = 10000
+	for _, poolSize := range []int{0, 100} {
+		b.Run(fmt.Sprintf("pool size %d", poolSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var sessions []*blockingSession
+				server := &Server{
+					supportedVersions:       protocol.SupportedVersions,
+					supportedVersionsAsTags: protocol.SupportedVersionsAsTags,
+					sessions:                map[protocol.ConnectionID]packetHandler{},
+					drainingPeriod:          protocol.ClosedSessionDrainingPeriod,
+					minInitialPacketSize:    protocol.MinInitialPacketSize,
+					tracer:                  noopTracer{},
+					clock:                   utils.DefaultClock{},
+					newSession: func(connection, protocol.VersionNumber, protocol.ConnectionID, *handshake.ServerConfig, StreamCallback, closeCallback, ReceivePolicy, time.Duration, utils.Clock) (packetHandler, error) {
+						s := newBlockingSession()
+						sessions = append(sessions, s)
+						return s, nil
+					},
+				}
+				goroutinesBefore := runtime.NumGoroutine()
+				if poolSize > 0 {
+					server.EnableSessionPool(poolSize, connections)
+				}
+				for c := 0; c < connections; c++ {
+					// the first packet of a connection carries the version, and is padded to the minimum initial packet size
+					packet := append([]byte{0x09, 0, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x30, 0x33, 0x32, 0x01}, make([]byte, protocol.MinInitialPacketSize)...)
+					packet[1], packet[2], packet[3] = byte(c), byte(c>>8), 1
+					if err := server.handlePacket(nil, nil, packet); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(runtime.NumGoroutine()-goroutinesBefore), "goroutines")
+				for _, s := range sessions {
+					close(s.closed)
+				}
+				if server.sessionPool != nil {
+					server.sessionPool.close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package quic
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// SessionStats is a snapshot of the statistics of a connection
+type SessionStats struct {
+	// the RTT estimates, updated with every ACK received
+	SmoothedRTT time.Duration
+	RTTVariance time.Duration
+	MinRTT      time.Duration
+
+	// sizes and counts of the authenticated packets received, and of all packets sent
+	BytesSent       protocol.ByteCount
+	BytesReceived   protocol.ByteCount
+	PacketsSent     uint64
+	PacketsReceived uint64
+	// the number of packets whose frames had to be retransmitted
+	Retransmissions uint64
+
+	CongestionWindow protocol.ByteCount
+}
+
+// sessionStatsJSON is the JSON representation of the SessionStats
+// Durations are encoded in microseconds, so that the format doesn't depend on the Go representation of time.Duration.
+type sessionStatsJSON struct {
+	SmoothedRTTUs    int64  `json:"smoothed_rtt_us"`
+	RTTVarianceUs    int64  `json:"rtt_variance_us"`
+	MinRTTUs         int64  `json:"min_rtt_us"`
+	BytesSent        uint64 `json:"bytes_sent"`
+	BytesReceived    uint64 `json:"bytes_received"`
+	PacketsSent      uint64 `json:"packets_sent"`
+	PacketsReceived  uint64 `json:"packets_received"`
+	Retransmissions  uint64 `json:"retransmissions"`
+	CongestionWindow uint64 `json:"congestion_window"`
+}
+
+// MarshalJSON encodes the statistics as JSON, e.g. for monitoring tools
+func (s SessionStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&sessionStatsJSON{
+		SmoothedRTTUs:    int64(s.SmoothedRTT / time.Microsecond),
+		RTTVarianceUs:    int64(s.RTTVariance / time.Microsecond),
+		MinRTTUs:         int64(s.MinRTT / time.Microsecond),
+		BytesSent:        uint64(s.BytesSent),
+		BytesReceived:    uint64(s.BytesReceived),
+		PacketsSent:      s.PacketsSent,
+		PacketsReceived:  s.PacketsReceived,
+		Retransmissions:  s.Retransmissions,
+		CongestionWindow: uint64(s.CongestionWindow),
+	})
+}
@@ -2,6 +2,7 @@ package quic
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
@@ -23,7 +24,8 @@ import (
 )
 
 type mockConnection struct {
-	written [][]byte
+	written    [][]byte
+	remoteAddr interface{}
 }
 
 func (m *mockConnection) write(p []byte) error {
@@ -31,14 +33,25 @@ func (m *mockConnection) write(p []byte) error {
 	return nil
 }
 
-func (*mockConnection) setCurrentRemoteAddr(addr interface{}) {}
-func (*mockConnection) IP() net.IP                            { return nil }
+func (m *mockConnection) setCurrentRemoteAddr(addr interface{}) { m.remoteAddr = addr }
+func (*mockConnection) IP() net.IP                              { return nil }
+
+// congestionBlockedSentPacketHandler is a SentPacketHandler whose congestion controller doesn't allow sending
+type congestionBlockedSentPacketHandler struct {
+	ackhandler.SentPacketHandler
+	blocked bool
+}
+
+func (h *congestionBlockedSentPacketHandler) CongestionAllowsSending() bool {
+	return !h.blocked && h.SentPacketHandler.CongestionAllowsSending()
+}
 
 var _ = Describe("Session", func() {
 	var (
 		session              *Session
 		streamCallbackCalled bool
 		closeCallbackCalled  bool
+		closedSess           *closedSession
 		conn                 *mockConnection
 	)
 
@@ -46,6 +59,7 @@ var _ = Describe("Session", func() {
 		conn = &mockConnection{}
 		streamCallbackCalled = false
 		closeCallbackCalled = false
+		closedSess = nil
 
 		signer, err := crypto.NewRSASigner(testdata.GetTLSConfig())
 		Expect(err).ToNot(HaveOccurred())
@@ -59,7 +73,13 @@ var _ = Describe("Session", func() {
 			0,
 			scfg,
 			func(*Session, utils.Stream) { streamCallbackCalled = true },
-			func(protocol.ConnectionID) { closeCallbackCalled = true },
+			func(_ protocol.ConnectionID, closed *closedSession) {
+				closeCallbackCalled = true
+				closedSess = closed
+			},
+			ReceivePolicyBlock,
+			0,
+			utils.DefaultClock{},
 		)
 		Expect(err).NotTo(HaveOccurred())
 		session = pSession.(*Session)
@@ -235,6 +255,89 @@ var _ = Describe("Session", func() {
 		})
 	})
 
+	Context("updating the remote address", func() {
+		var hdr *publicHeader
+
+		BeforeEach(func() {
+			hdr = &publicHeader{
+				PacketNumber:    1,
+				PacketNumberLen: protocol.PacketNumberLen1,
+				Raw:             []byte{0x04, 0x01},
+			}
+		})
+
+		It("updates the remote address after unpacking a packet", func() {
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1337}
+			err := session.handlePacketImpl(addr, hdr, (&crypto.NullAEAD{}).Seal(1, hdr.Raw, []byte{0}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.remoteAddr).To(Equal(addr))
+		})
+
+		It("does not update the remote address if the packet can't be unpacked", func() {
+			addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1337}
+			err := session.handlePacketImpl(addr, hdr, []byte("spoofed packet"))
+			Expect(err).To(HaveOccurred())
+			Expect(conn.remoteAddr).To(BeNil())
+		})
+	})
+
+	Context("stream limits", func() {
+		BeforeEach(func() {
+			err := session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+				handshake.TagMSPC: {2, 0, 0, 0},
+				handshake.TagMIDS: {1, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("errors when the client opens too many streams", func() {
+			err := session.handleStreamFrame(&frames.StreamFrame{StreamID: 5})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{StreamID: 7})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{StreamID: 9})
+			Expect(err).To(MatchError(qerr.TooManyOpenStreams))
+			Expect(session.streams).ToNot(HaveKey(protocol.StreamID(9)))
+		})
+
+		It("does not count the headers stream", func() {
+			_, err := session.OpenStream(3)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(7)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not allow us to open too many streams", func() {
+			_, err := session.OpenStream(2)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(4)
+			Expect(err).To(MatchError(qerr.TooManyOpenStreams))
+		})
+
+		It("counts incoming and outgoing streams separately", func() {
+			_, err := session.OpenStream(2)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(3)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not count closed streams", func() {
+			str, err := session.OpenStream(2)
+			Expect(err).ToNot(HaveOccurred())
+			str.(*stream).RegisterError(errors.New("closed"))
+			_, err = str.Read([]byte{0})
+			Expect(err).To(MatchError("closed"))
+			session.garbageCollectStreams()
+			Expect(session.streams[2]).To(BeNil())
+			_, err = session.OpenStream(4)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
 	Context("handling RST_STREAM frames", func() {
 		It("closes the receiving streams for writing and reading", func() {
 			s, err := session.OpenStream(5)
@@ -252,6 +355,18 @@ var _ = Describe("Session", func() {
 			Expect(err).To(MatchError("RST_STREAM received with code 42"))
 		})
 
+		It("counts the final offset towards connection flow control", func() {
+			_, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleRstStreamFrame(&frames.RstStreamFrame{
+				StreamID:   5,
+				ByteOffset: 0x1337,
+				ErrorCode:  42,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.flowController.GetHighestReceived()).To(Equal(protocol.ByteCount(0x1337)))
+		})
+
 		It("errors when the stream is not known", func() {
 			err := session.handleRstStreamFrame(&frames.RstStreamFrame{
 				StreamID:  5,
@@ -261,6 +376,80 @@ var _ = Describe("Session", func() {
 		})
 	})
 
+	Context("receive policies", func() {
+		frameData := bytes.Repeat([]byte{'f'}, int(protocol.MaxUnreadStreamData/2))
+
+		It("buffers data for a slow consumer when blocking", func() {
+			for i := 0; i < 4; i++ {
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Offset:   protocol.ByteCount(i * len(frameData)),
+					Data:     frameData,
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(session.hasQueuedControlFrames()).To(BeFalse())
+			p := make([]byte, 4*len(frameData))
+			n, err := io.ReadFull(session.streams[5], p)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(4 * len(frameData)))
+		})
+
+		It("drops data and resets the stream for a slow consumer when dropping", func() {
+			session.receivePolicy = ReceivePolicyDrop
+			for i := 0; i < 4; i++ {
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Offset:   protocol.ByteCount(i * len(frameData)),
+					Data:     frameData,
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			// we never sent any data on this stream, so our final offset is 0
+			Expect(session.getQueuedControlFrames()).To(Equal([]frames.Frame{&frames.RstStreamFrame{
+				StreamID:   5,
+				ByteOffset: 0,
+				ErrorCode:  rstStreamErrorCodeCancelled,
+			}}))
+			Expect(session.closed).To(BeZero())
+			_, err := io.ReadFull(session.streams[5], make([]byte, 4*len(frameData)))
+			Expect(err).To(MatchError("RST_STREAM sent with code 6"))
+		})
+
+		It("gives the connection flow control window back when streams are reset for slow consumers", func() {
+			session.receivePolicy = ReceivePolicyDrop
+			// more data than the connection flow control window is sent on streams that are reset
+			var streamID protocol.StreamID
+			for streamID = 5; protocol.ByteCount(streamID/2)*4*protocol.ByteCount(len(frameData)) < 2*protocol.ReceiveConnectionFlowControlWindow; streamID += 2 {
+				for i := 0; i < 4; i++ {
+					err := session.handleStreamFrame(&frames.StreamFrame{
+						StreamID: streamID,
+						Offset:   protocol.ByteCount(i * len(frameData)),
+						Data:     frameData,
+					})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}
+			var connectionWindowUpdate *frames.WindowUpdateFrame
+			for _, f := range session.windowUpdateManager.GetWindowUpdateFrames() {
+				if f.StreamID == 0 {
+					connectionWindowUpdate = f
+				}
+			}
+			Expect(connectionWindowUpdate).ToNot(BeNil())
+			Expect(connectionWindowUpdate.ByteOffset).To(BeNumerically(">", protocol.ReceiveConnectionFlowControlWindow))
+			// other streams can still use the whole connection flow control window
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: streamID,
+				Data:     frameData,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			n, err := io.ReadFull(session.streams[streamID], make([]byte, len(frameData)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(frameData)))
+		})
+	})
+
 	Context("handling WINDOW_UPDATE frames", func() {
 		It("updates the Flow Control Windows of a stream", func() {
 			_, err := session.OpenStream(5)
@@ -300,6 +489,87 @@ var _ = Describe("Session", func() {
 		})
 	})
 
+	Context("negotiated parameters", func() {
+		BeforeEach(func() {
+			b := &bytes.Buffer{}
+			handshake.WriteHandshakeMessage(b, handshake.TagCHLO, map[handshake.Tag][]byte{
+				handshake.TagMSPC: {10, 0, 0, 0},
+				handshake.TagSFCW: {0, 0x80, 0, 0},
+				handshake.TagICSL: {5, 0, 0, 0},
+			})
+			chlo, err := handshake.ParseCHLO(b.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			err = session.connectionParametersManager.SetFromMap(chlo)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("has the max streams per connection negotiated in the CHLO", func() {
+			Expect(session.MaxStreamsPerConnection()).ToNot(Equal(uint32(protocol.MaxStreamsPerConnection)))
+			Expect(session.MaxStreamsPerConnection()).To(Equal(uint32(10)))
+		})
+
+		It("has the send stream flow control window announced in the CHLO", func() {
+			Expect(session.SendStreamFlowControlWindow()).ToNot(Equal(protocol.InitialStreamFlowControlWindow))
+			Expect(session.SendStreamFlowControlWindow()).To(Equal(protocol.ByteCount(0x8000)))
+		})
+
+		It("has the idle timeout negotiated in the CHLO", func() {
+			Expect(session.IdleTimeout()).ToNot(Equal(protocol.InitialIdleConnectionStateLifetime))
+			Expect(session.IdleTimeout()).To(Equal(5 * time.Second))
+		})
+	})
+
+	Context("idle timeout", func() {
+		newSessionWithIdleTimeout := func(icsl uint8, conn connection, closed chan<- protocol.ConnectionID) *Session {
+			signer, err := crypto.NewRSASigner(testdata.GetTLSConfig())
+			Expect(err).ToNot(HaveOccurred())
+			kex, err := crypto.NewCurve25519KEX()
+			Expect(err).NotTo(HaveOccurred())
+			scfg, err := handshake.NewServerConfig(kex, signer)
+			Expect(err).NotTo(HaveOccurred())
+			pSession, err := newSession(
+				conn,
+				0,
+				protocol.ConnectionID(icsl),
+				scfg,
+				func(*Session, utils.Stream) {},
+				func(id protocol.ConnectionID, _ *closedSession) { closed <- id },
+				ReceivePolicyBlock,
+				0,
+				utils.DefaultClock{},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			sess := pSession.(*Session)
+			err = sess.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+				handshake.TagICSL: {icsl, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return sess
+		}
+
+		It("closes each session after its negotiated idle timeout", func() {
+			closed := make(chan protocol.ConnectionID, 2)
+			conn1 := &mockConnection{}
+			conn2 := &mockConnection{}
+			sess1 := newSessionWithIdleTimeout(10, conn1, closed)
+			sess2 := newSessionWithIdleTimeout(30, conn2, closed)
+			Expect(sess1.connectionParametersManager.GetIdleTimeout()).To(Equal(10 * time.Second))
+			Expect(sess2.connectionParametersManager.GetIdleTimeout()).To(Equal(30 * time.Second))
+			// both sessions have been idle for 20 seconds
+			sess1.lastNetworkActivityTime = time.Now().Add(-20 * time.Second)
+			sess2.lastNetworkActivityTime = time.Now().Add(-20 * time.Second)
+			go sess1.run()
+			go sess2.run()
+			Eventually(closed).Should(Receive(Equal(protocol.ConnectionID(10))))
+			Consistently(closed, 50*time.Millisecond).ShouldNot(Receive())
+			Expect(conn1.written).To(HaveLen(1))
+			Expect(conn1.written[0]).To(ContainSubstring(string([]byte{0x02, byte(qerr.NetworkIdleTimeout), 0, 0, 0})))
+			Expect(conn2.written).To(BeEmpty())
+			sess2.Close(nil)
+			Eventually(closed).Should(Receive(Equal(protocol.ConnectionID(30))))
+		})
+	})
+
 	Context("closing", func() {
 		var (
 			nGoRoutinesBefore int
@@ -320,6 +590,69 @@ var _ = Describe("Session", func() {
 			Expect(conn.written[0][len(conn.written[0])-7:]).To(Equal([]byte{0x02, byte(qerr.PeerGoingAway), 0, 0, 0, 0, 0}))
 		})
 
+		It("sends queued packets before closing gracefully", func() {
+			// the handshake isn't done, so the application data can only be sent unencrypted
+			session.packer.aead = &crypto.NullAEAD{}
+			// don't schedule sending, so that the frame is still queued when closing
+			session.packer.AddStreamFrame(frames.StreamFrame{
+				StreamID: 5,
+				Data:     []byte("foobar"),
+			})
+			session.Close(nil)
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(HaveLen(2))
+			Expect(conn.written[0]).To(ContainSubstring("foobar"))
+			Expect(conn.written[1][len(conn.written[1])-7:]).To(Equal([]byte{0x02, byte(qerr.PeerGoingAway), 0, 0, 0, 0, 0}))
+		})
+
+		It("doesn't send queued packets when closing with an error", func() {
+			session.packer.AddStreamFrame(frames.StreamFrame{
+				StreamID: 5,
+				Data:     []byte("foobar"),
+			})
+			session.Close(qerr.Error(qerr.InternalError, "test error"))
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).ToNot(ContainSubstring("foobar"))
+		})
+
+		It("hands over to a closed session that resends the CONNECTION_CLOSE", func() {
+			session.Close(nil)
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(HaveLen(1))
+			Expect(closedSess).ToNot(BeNil())
+			Expect(closedSess.closePacket).To(Equal(conn.written[0]))
+		})
+
+		It("doesn't resend anything after the peer closed the connection", func() {
+			session.closeImpl(qerr.Error(qerr.PeerGoingAway, ""), true)
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(BeEmpty())
+			Expect(closedSess).ToNot(BeNil())
+			Expect(closedSess.closePacket).To(BeNil())
+		})
+
+		It("aborts the handshake after the inchoate CHLO", func() {
+			var chlo bytes.Buffer
+			handshake.WriteHandshakeMessage(&chlo, handshake.TagCHLO, map[handshake.Tag][]byte{
+				handshake.TagSNI: []byte("quic.clemente.io"),
+				handshake.TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := session.handleStreamFrame(&frames.StreamFrame{StreamID: 1, Data: chlo.Bytes()})
+			Expect(err).ToNot(HaveOccurred())
+			// wait for the REJ
+			Eventually(func() int { return len(conn.written) }).ShouldNot(BeZero())
+			Expect(conn.written[0]).To(ContainSubstring("REJ"))
+			err = session.AbortHandshake(qerr.CryptoTooManyRejects, "policy: refusing quic.clemente.io")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(closeCallbackCalled).To(BeTrue())
+			closePacket := conn.written[len(conn.written)-1]
+			reason := "policy: refusing quic.clemente.io"
+			Expect(closePacket).To(ContainSubstring(string([]byte{0x02, byte(qerr.CryptoTooManyRejects), 0, 0, 0, byte(len(reason)), 0})))
+			Expect(closePacket).To(ContainSubstring(reason))
+		})
+
 		It("only closes once", func() {
 			session.Close(nil)
 			session.Close(nil)
@@ -344,6 +677,11 @@ var _ = Describe("Session", func() {
 	})
 
 	Context("sending packets", func() {
+		BeforeEach(func() {
+			// the handshake isn't done in these tests, so application data can only be sent unencrypted
+			session.packer.aead = &crypto.NullAEAD{}
+		})
+
 		It("sends ack frames", func() {
 			packetNumber := protocol.PacketNumber(0x0135)
 			var entropy ackhandler.EntropyAccumulator
@@ -398,12 +736,259 @@ var _ = Describe("Session", func() {
 		})
 
 		It("sends public reset", func() {
-			err := session.sendPublicReset(1)
+			_, err := session.sendPublicReset(1)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(conn.written).To(HaveLen(1))
 			Expect(conn.written[0]).To(ContainSubstring(string([]byte("PRST"))))
 		})
 
+		It("retransmits the STREAM frames of a packet that was NACKed often enough", func() {
+			err := session.sentPacketHandler.SentPacket(&ackhandler.Packet{
+				PacketNumber: 1,
+				Length:       1,
+				Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			for p := protocol.PacketNumber(2); p <= 2+protocol.PacketNumber(protocol.RetransmissionThreshold); p++ {
+				err = session.sentPacketHandler.SentPacket(&ackhandler.Packet{PacketNumber: p, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			session.packer.lastPacketNumber = 2 + protocol.PacketNumber(protocol.RetransmissionThreshold)
+			// every ACK reports packet 1 as missing
+			for p := protocol.PacketNumber(2); p <= 2+protocol.PacketNumber(protocol.RetransmissionThreshold); p++ {
+				Expect(session.sentPacketHandler.HasPacketForRetransmission()).To(BeFalse())
+				err = session.handleAckFrame(&frames.AckFrame{
+					LargestObserved: p,
+					NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(session.sentPacketHandler.HasPacketForRetransmission()).To(BeTrue())
+			err = session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).To(ContainSubstring("foobar"))
+		})
+
+		It("sends a RST_STREAM when the application resets a stream", func() {
+			str, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			session.streams[5].flowController.UpdateSendWindow(1000)
+			session.flowController.UpdateSendWindow(1000)
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			err = session.ResetStream(5, 7)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).To(MatchError("RST_STREAM sent with code 7"))
+			err = session.maybeSendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).To(ContainSubstring(string([]byte{0x01, 5, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0})))
+		})
+
+		It("errors when resetting an unknown stream", func() {
+			err := session.ResetStream(5, 7)
+			Expect(err).To(MatchError("stream 5 doesn't exist"))
+		})
+
+		Context("GOAWAY", func() {
+			BeforeEach(func() {
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Data:     []byte("foo"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				streamCallbackCalled = false
+			})
+
+			It("sends a GOAWAY with the highest open stream as the last good stream", func() {
+				session.GoAway(qerr.PeerGoingAway, "shutting down")
+				Expect(session.hasQueuedControlFrames()).To(BeTrue())
+				err := session.maybeSendPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+				Expect(conn.written[0]).To(ContainSubstring(string([]byte{0x03, byte(qerr.PeerGoingAway), 0, 0, 0, 5, 0, 0, 0, 13, 0})))
+				Expect(conn.written[0]).To(ContainSubstring("shutting down"))
+			})
+
+			It("sends the GOAWAY only once", func() {
+				session.GoAway(qerr.PeerGoingAway, "")
+				session.GoAway(qerr.PeerGoingAway, "")
+				Expect(session.getQueuedControlFrames()).To(HaveLen(1))
+			})
+
+			It("refuses new streams, but completes the streams opened before", func() {
+				session.GoAway(qerr.PeerGoingAway, "")
+				session.getQueuedControlFrames()
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 7,
+					Data:     []byte("foobar"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.streams).ToNot(HaveKey(protocol.StreamID(7)))
+				Expect(streamCallbackCalled).To(BeFalse())
+				Expect(session.getQueuedControlFrames()).To(Equal([]frames.Frame{&frames.RstStreamFrame{
+					StreamID:   7,
+					ByteOffset: 0,
+					ErrorCode:  rstStreamErrorCodePeerGoingAway,
+				}}))
+				err = session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Offset:   3,
+					Data:     []byte("bar"),
+					FinBit:   true,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				data := make([]byte, 6)
+				_, err = io.ReadFull(session.streams[5], data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte("foobar")))
+			})
+
+			It("resets a refused stream only once", func() {
+				session.GoAway(qerr.PeerGoingAway, "")
+				session.getQueuedControlFrames()
+				for i := 0; i < 3; i++ {
+					err := session.handleStreamFrame(&frames.StreamFrame{
+						StreamID: 7,
+						Offset:   protocol.ByteCount(3 * i),
+						Data:     []byte("foo"),
+					})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(session.getQueuedControlFrames()).To(HaveLen(1))
+			})
+
+			It("counts retransmitted data on refused streams only once against the connection flow control window", func() {
+				session.GoAway(qerr.PeerGoingAway, "")
+				highestReceived := session.flowController.GetHighestReceived()
+				data := bytes.Repeat([]byte{'a'}, int(protocol.ReceiveConnectionFlowControlWindow/2))
+				for i := 0; i < 4; i++ {
+					err := session.handleStreamFrame(&frames.StreamFrame{
+						StreamID: 7,
+						Data:     data,
+					})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				// overlapping with the data received before
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: 7,
+					Offset:   protocol.ByteCount(len(data) - 10),
+					Data:     []byte("foobarfoobarfoobar"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.flowController.GetHighestReceived()).To(Equal(highestReceived + protocol.ByteCount(len(data)+8)))
+			})
+
+			It("gives the connection flow control window back for refused streams", func() {
+				session.GoAway(qerr.PeerGoingAway, "")
+				data := bytes.Repeat([]byte{'a'}, int(protocol.MaxPacketSize))
+				var streamID protocol.StreamID
+				for streamID = 7; protocol.ByteCount(streamID/2)*protocol.ByteCount(len(data)) < 2*protocol.ReceiveConnectionFlowControlWindow; streamID += 2 {
+					err := session.handleStreamFrame(&frames.StreamFrame{
+						StreamID: streamID,
+						Data:     data,
+					})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				var connectionWindowUpdate *frames.WindowUpdateFrame
+				for _, f := range session.windowUpdateManager.GetWindowUpdateFrames() {
+					if f.StreamID == 0 {
+						connectionWindowUpdate = f
+					}
+				}
+				Expect(connectionWindowUpdate).ToNot(BeNil())
+				Expect(connectionWindowUpdate.ByteOffset).To(BeNumerically(">", protocol.ReceiveConnectionFlowControlWindow))
+			})
+		})
+
+		Context("keep-alive", func() {
+			BeforeEach(func() {
+				session.keepAliveInterval = 50 * time.Millisecond
+			})
+
+			It("sends a PING when no packet was sent for the keep-alive interval", func() {
+				session.lastPacketSentTime = time.Now().Add(-50 * time.Millisecond)
+				err := session.maybeSendKeepAlive()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+				Expect(conn.written[0][len(conn.written[0])-1]).To(Equal(byte(0x07)))
+			})
+
+			It("doesn't send a PING before the keep-alive interval", func() {
+				session.lastPacketSentTime = time.Now().Add(-40 * time.Millisecond)
+				err := session.maybeSendKeepAlive()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.written).To(BeEmpty())
+			})
+
+			It("resets the keep-alive interval when a packet is sent", func() {
+				session.lastPacketSentTime = time.Now().Add(-time.Hour)
+				session.queueStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+				err := session.sendPacket()
+				Expect(err).NotTo(HaveOccurred())
+				err = session.maybeSendKeepAlive()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+			})
+
+			It("doesn't send PINGs when keep-alives are disabled", func() {
+				session.keepAliveInterval = 0
+				session.lastPacketSentTime = time.Now().Add(-time.Hour)
+				err := session.maybeSendKeepAlive()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.written).To(BeEmpty())
+			})
+
+			It("queues only one PING while congestion blocks sending", func() {
+				sph := &congestionBlockedSentPacketHandler{SentPacketHandler: session.sentPacketHandler, blocked: true}
+				session.sentPacketHandler = sph
+				session.lastPacketSentTime = time.Now().Add(-time.Hour)
+				for i := 0; i < 3; i++ {
+					err := session.maybeSendKeepAlive()
+					Expect(err).NotTo(HaveOccurred())
+				}
+				Expect(conn.written).To(BeEmpty())
+				var pings int
+				for _, f := range session.packer.controlFrames {
+					if _, ok := f.(*frames.PingFrame); ok {
+						pings++
+					}
+				}
+				Expect(pings).To(Equal(1))
+				sph.blocked = false
+				err := session.maybeSendKeepAlive()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+				Expect(session.pingQueued).To(BeFalse())
+				Expect(session.packer.controlFrames).To(BeEmpty())
+			})
+
+			It("doesn't spin in the run loop while congestion blocks sending", func() {
+				clock := newMockClock()
+				session.clock = clock
+				session.timer = clock.NewTimer(0)
+				session.lastNetworkActivityTime = clock.Now()
+				session.lastPacketSentTime = clock.Now().Add(-time.Hour)
+				session.sentPacketHandler = &congestionBlockedSentPacketHandler{SentPacketHandler: session.sentPacketHandler, blocked: true}
+				go session.run()
+				session.scheduleSending()
+				Eventually(clock.numResets).Should(BeNumerically(">=", 3))
+				Consistently(clock.numResets).Should(BeNumerically("<", 10))
+				session.Close(errors.New("test done"))
+				Eventually(session.runStopped).Should(BeClosed())
+				Expect(conn.written).To(HaveLen(1)) // only the CONNECTION_CLOSE
+			})
+
+			It("sends PINGs from the run loop when the connection is idle", func() {
+				go session.run()
+				Eventually(func() int { return len(conn.written) }).ShouldNot(BeZero())
+				session.Close(nil)
+				Expect(conn.written[0][len(conn.written[0])-1]).To(Equal(byte(0x07)))
+			})
+		})
+
 		Context("Blocked", func() {
 			It("queues a Blocked frames", func() {
 				len := 500
@@ -447,7 +1032,127 @@ var _ = Describe("Session", func() {
 		})
 	})
 
+	Context("statistics", func() {
+		var hdr *publicHeader
+
+		BeforeEach(func() {
+			session.packer.aead = &crypto.NullAEAD{}
+			hdr = &publicHeader{
+				PacketNumber:    1,
+				PacketNumberLen: protocol.PacketNumberLen1,
+				Raw:             []byte{0x04, 0x01},
+			}
+		})
+
+		It("starts with the initial congestion window", func() {
+			stats := session.Stats()
+			Expect(stats.CongestionWindow).To(Equal(protocol.ByteCount(protocol.InitialCongestionWindow) * protocol.DefaultTCPMSS))
+			Expect(stats.PacketsSent).To(BeZero())
+			Expect(stats.PacketsReceived).To(BeZero())
+		})
+
+		It("counts the packets sent", func() {
+			for i := 0; i < 2; i++ {
+				session.receivedPacketHandler.ReceivedPacket(protocol.PacketNumber(i+1), false)
+				err := session.sendPacket()
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(conn.written).To(HaveLen(2))
+			stats := session.Stats()
+			Expect(stats.PacketsSent).To(Equal(uint64(2)))
+			Expect(stats.BytesSent).To(Equal(protocol.ByteCount(len(conn.written[0]) + len(conn.written[1]))))
+		})
+
+		It("counts the packets received", func() {
+			data := (&crypto.NullAEAD{}).Seal(1, hdr.Raw, []byte{0})
+			err := session.handlePacketImpl(nil, hdr, data)
+			Expect(err).ToNot(HaveOccurred())
+			stats := session.Stats()
+			Expect(stats.PacketsReceived).To(Equal(uint64(1)))
+			Expect(stats.BytesReceived).To(Equal(protocol.ByteCount(len(hdr.Raw) + len(data))))
+		})
+
+		It("doesn't count packets that can't be unpacked", func() {
+			err := session.handlePacketImpl(nil, hdr, []byte("spoofed packet"))
+			Expect(err).To(HaveOccurred())
+			Expect(session.Stats().PacketsReceived).To(BeZero())
+		})
+
+		It("updates the RTT estimate when an ACK is received", func() {
+			err := session.sentPacketHandler.SentPacket(&ackhandler.Packet{PacketNumber: 1, Length: 1})
+			Expect(err).ToNot(HaveOccurred())
+			time.Sleep(10 * time.Millisecond)
+			b := bytes.NewBuffer([]byte{0}) // private flags
+			err = (&frames.AckFrame{LargestObserved: 1}).Write(b, 0)
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handlePacketImpl(nil, hdr, (&crypto.NullAEAD{}).Seal(1, hdr.Raw, b.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			stats := session.Stats()
+			Expect(stats.SmoothedRTT).To(BeNumerically(">=", 10*time.Millisecond))
+			Expect(stats.MinRTT).To(BeNumerically(">=", 10*time.Millisecond))
+			Expect(stats.RTTVariance).ToNot(BeZero())
+		})
+
+		It("counts retransmissions", func() {
+			err := session.sentPacketHandler.SentPacket(&ackhandler.Packet{
+				PacketNumber: 1,
+				Length:       1,
+				Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			for p := protocol.PacketNumber(2); p <= 2+protocol.PacketNumber(protocol.RetransmissionThreshold); p++ {
+				err = session.sentPacketHandler.SentPacket(&ackhandler.Packet{PacketNumber: p, Length: 1})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			session.packer.lastPacketNumber = 2 + protocol.PacketNumber(protocol.RetransmissionThreshold)
+			for p := protocol.PacketNumber(2); p <= 2+protocol.PacketNumber(protocol.RetransmissionThreshold); p++ {
+				err = session.handleAckFrame(&frames.AckFrame{
+					LargestObserved: p,
+					NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			err = session.sendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			stats := session.Stats()
+			Expect(stats.Retransmissions).To(Equal(uint64(1)))
+			Expect(stats.PacketsSent).To(Equal(uint64(1)))
+		})
+
+		It("marshals the stats to JSON", func() {
+			stats := SessionStats{
+				SmoothedRTT:      25 * time.Millisecond,
+				RTTVariance:      5 * time.Millisecond,
+				MinRTT:           20 * time.Millisecond,
+				BytesSent:        1000,
+				BytesReceived:    2000,
+				PacketsSent:      3,
+				PacketsReceived:  4,
+				Retransmissions:  1,
+				CongestionWindow: 14600,
+			}
+			data, err := json.Marshal(stats)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(MatchJSON(`{
+				"smoothed_rtt_us": 25000,
+				"rtt_variance_us": 5000,
+				"min_rtt_us": 20000,
+				"bytes_sent": 1000,
+				"bytes_received": 2000,
+				"packets_sent": 3,
+				"packets_received": 4,
+				"retransmissions": 1,
+				"congestion_window": 14600
+			}`))
+		})
+	})
+
 	Context("scheduling sending", func() {
+		BeforeEach(func() {
+			// the handshake isn't done in these tests, so application data can only be sent unencrypted
+			session.packer.aead = &crypto.NullAEAD{}
+		})
+
 		It("sends after queuing a stream frame", func() {
 			Expect(session.sendingScheduled).NotTo(Receive())
 			err := session.queueStreamFrame(&frames.StreamFrame{StreamID: 1})
@@ -1,6 +1,8 @@
 package quic
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -22,6 +24,15 @@ type streamHandler interface {
 var (
 	errFlowControlViolation           = qerr.FlowControlReceivedTooMuchData
 	errConnectionFlowControlViolation = qerr.FlowControlReceivedTooMuchData
+	errStreamReceiveBufferFull        = errors.New("stream receive buffer full")
+)
+
+// error codes sent in RST_STREAM frames
+const (
+	// rstStreamErrorCodePeerGoingAway is the QUIC_STREAM_PEER_GOING_AWAY error code, used to refuse streams after a GOAWAY
+	rstStreamErrorCodePeerGoingAway uint32 = 5
+	// rstStreamErrorCodeCancelled is the QUIC_STREAM_CANCELLED error code
+	rstStreamErrorCodeCancelled uint32 = 6
 )
 
 // A Stream assembles the data from StreamFrames and provides a super-convenient Read-Interface
@@ -30,8 +41,9 @@ type stream struct {
 	session  streamHandler
 
 	readPosInFrame int
-	writeOffset    protocol.ByteCount
-	readOffset     protocol.ByteCount
+	// writeOffset is protected by the mutex, since Reset is called from other goroutines than Write
+	writeOffset protocol.ByteCount
+	readOffset  protocol.ByteCount
 
 	// Once set, err must not be changed!
 	err   error
@@ -44,6 +56,9 @@ type stream struct {
 
 	frameQueue        streamFrameSorter
 	newFrameOrErrCond sync.Cond
+	receivePolicy     ReceivePolicy
+	// set when the stream was reset, all further data is dropped
+	receivedDataAbandoned bool
 
 	flowController                     flowcontrol.FlowController
 	connectionFlowController           flowcontrol.FlowController
@@ -126,10 +141,14 @@ func (s *stream) Read(p []byte) (int, error) {
 
 		s.readPosInFrame += m
 		bytesRead += m
+		s.mutex.Lock()
 		s.readOffset += protocol.ByteCount(m)
+		// if the received data was abandoned in the meantime, the connection flow controller already counted these bytes
+		abandoned := s.receivedDataAbandoned
+		s.mutex.Unlock()
 
 		s.flowController.AddBytesRead(protocol.ByteCount(m))
-		if s.contributesToConnectionFlowControl {
+		if s.contributesToConnectionFlowControl && !abandoned {
 			s.connectionFlowController.AddBytesRead(protocol.ByteCount(m))
 		}
 
@@ -138,7 +157,10 @@ func (s *stream) Read(p []byte) (int, error) {
 		if s.readPosInFrame >= len(frame.Data) {
 			fin := frame.FinBit
 			s.mutex.Lock()
-			s.frameQueue.Pop()
+			// the frame queue is cleared when the received data is abandoned
+			if s.frameQueue.Head() == frame {
+				s.frameQueue.Pop()
+			}
 			s.mutex.Unlock()
 			if fin {
 				atomic.StoreInt32(&s.eof, 1)
@@ -203,11 +225,21 @@ func (s *stream) Write(p []byte) (int, error) {
 		dataLen := utils.Min(len(p), int(remainingBytesInWindow))
 		data := make([]byte, dataLen)
 		copy(data, p)
+		// queue the frame and advance the writeOffset atomically, so that the final offset of a concurrent Reset covers all queued data
+		s.mutex.Lock()
+		if s.err != nil {
+			s.mutex.Unlock()
+			return dataWritten, s.err
+		}
 		err := s.session.queueStreamFrame(&frames.StreamFrame{
 			StreamID: s.streamID,
 			Offset:   s.writeOffset,
 			Data:     data,
 		})
+		if err == nil {
+			s.writeOffset += protocol.ByteCount(dataLen)
+		}
+		s.mutex.Unlock()
 
 		if err != nil {
 			return 0, err
@@ -218,7 +250,6 @@ func (s *stream) Write(p []byte) (int, error) {
 		if s.contributesToConnectionFlowControl {
 			s.connectionFlowController.AddBytesSent(protocol.ByteCount(dataLen))
 		}
-		s.writeOffset += protocol.ByteCount(dataLen)
 
 		s.maybeTriggerBlocked()
 	}
@@ -229,6 +260,8 @@ func (s *stream) Write(p []byte) (int, error) {
 // Close implements io.Closer
 func (s *stream) Close() error {
 	atomic.StoreInt32(&s.closed, 1)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.session.queueStreamFrame(&frames.StreamFrame{
 		StreamID: s.streamID,
 		Offset:   s.writeOffset,
@@ -251,6 +284,16 @@ func (s *stream) AddStreamFrame(frame *frames.StreamFrame) error {
 	}
 
 	s.mutex.Lock()
+	if s.receivedDataAbandoned {
+		// the stream was already reset, drop all further data
+		s.mutex.Unlock()
+		s.addConnectionBytesRead(increment)
+		return nil
+	}
+	if s.receivePolicy == ReceivePolicyDrop && s.frameQueue.bytes+protocol.ByteCount(len(frame.Data)) > protocol.MaxUnreadStreamData {
+		s.mutex.Unlock()
+		return errStreamReceiveBufferFull
+	}
 	s.frameQueue.Push(frame)
 	s.mutex.Unlock()
 	s.newFrameOrErrCond.Signal()
@@ -280,7 +323,10 @@ func (s *stream) maybeTriggerBlocked() {
 	streamBlocked := s.flowController.MaybeTriggerBlocked()
 
 	if streamBlocked {
-		s.session.streamBlocked(s.streamID, s.writeOffset)
+		s.mutex.Lock()
+		writeOffset := s.writeOffset
+		s.mutex.Unlock()
+		s.session.streamBlocked(s.streamID, writeOffset)
 	}
 
 	if s.contributesToConnectionFlowControl {
@@ -294,6 +340,65 @@ func (s *stream) maybeTriggerBlocked() {
 	}
 }
 
+// Reset resets the stream locally. It returns the final offset of the data sent.
+// The stream fails all further reads and writes.
+func (s *stream) Reset(errorCode uint32) protocol.ByteCount {
+	s.RegisterError(fmt.Errorf("RST_STREAM sent with code %d", errorCode))
+	s.abandonReceivedData()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeOffset
+}
+
+// RegisterRemoteReset is called by the session when the peer resets the stream
+// The final offset of the peer's data counts towards flow control, even if that data never arrives.
+func (s *stream) RegisterRemoteReset(errorCode uint32, finalOffset protocol.ByteCount) error {
+	// the peer can't have sent less data than we already received
+	if highestReceived := s.flowController.GetHighestReceived(); finalOffset < highestReceived {
+		return qerr.Error(qerr.StreamDataAfterTermination, fmt.Sprintf("RST_STREAM final offset %d is smaller than the highest offset received %d", finalOffset, highestReceived))
+	}
+	increment := s.flowController.UpdateHighestReceived(finalOffset)
+	if s.contributesToConnectionFlowControl {
+		s.connectionFlowController.IncrementHighestReceived(increment)
+	}
+	if s.flowController.CheckFlowControlViolation() {
+		return errFlowControlViolation
+	}
+	if s.connectionFlowController.CheckFlowControlViolation() {
+		return errConnectionFlowControlViolation
+	}
+	s.RegisterError(fmt.Errorf("RST_STREAM received with code %d", errorCode))
+	s.abandonReceivedData()
+	return nil
+}
+
+// abandonReceivedData drops all data received on a reset stream
+// The data that was received but not read, and all data arriving later, is counted as read by the connection flow controller.
+// Otherwise a reset stream would use up the connection flow control window.
+func (s *stream) abandonReceivedData() {
+	s.mutex.Lock()
+	if s.receivedDataAbandoned {
+		s.mutex.Unlock()
+		return
+	}
+	s.receivedDataAbandoned = true
+	s.frameQueue = streamFrameSorter{}
+	unread := s.flowController.GetHighestReceived() - s.readOffset
+	s.mutex.Unlock()
+	s.addConnectionBytesRead(unread)
+}
+
+func (s *stream) addConnectionBytesRead(n protocol.ByteCount) {
+	if !s.contributesToConnectionFlowControl || n == 0 {
+		return
+	}
+	s.connectionFlowController.AddBytesRead(n)
+	doUpdate, byteOffset := s.connectionFlowController.MaybeTriggerWindowUpdate()
+	if doUpdate {
+		s.session.updateReceiveFlowControlWindow(0, byteOffset)
+	}
+}
+
 // RegisterError is called by session to indicate that an error occurred and the
 // stream should be closed.
 func (s *stream) RegisterError(err error) {
@@ -1,13 +1,19 @@
 package quic
 
-import "github.com/lucas-clemente/quic-go/frames"
+import (
+	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/protocol"
+)
 
 // TODO: This is currently quite inefficient
 type streamFrameSorter struct {
 	items []*frames.StreamFrame
+	// the number of bytes in all queued frames
+	bytes protocol.ByteCount
 }
 
 func (s *streamFrameSorter) Push(val *frames.StreamFrame) {
+	s.bytes += protocol.ByteCount(len(val.Data))
 	for i, f := range s.items {
 		if f.Offset > val.Offset {
 			// Insert here
@@ -24,6 +30,7 @@ func (s *streamFrameSorter) Push(val *frames.StreamFrame) {
 func (s *streamFrameSorter) Pop() *frames.StreamFrame {
 	res := s.items[0]
 	s.items = s.items[1:]
+	s.bytes -= protocol.ByteCount(len(res.Data))
 	return res
 }
 
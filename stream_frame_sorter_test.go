@@ -2,6 +2,7 @@ package quic
 
 import (
 	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/protocol"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -27,6 +28,14 @@ var _ = Describe("StreamFrame sorter", func() {
 		Expect(s.Head()).To(BeNil())
 	})
 
+	It("counts the bytes of the queued frames", func() {
+		s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foo")})
+		s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("bar")})
+		Expect(s.bytes).To(Equal(protocol.ByteCount(6)))
+		s.Pop()
+		Expect(s.bytes).To(Equal(protocol.ByteCount(3)))
+	})
+
 	It("inserts two frames in order", func() {
 		f1 := &frames.StreamFrame{Offset: 1}
 		f2 := &frames.StreamFrame{Offset: 2}
@@ -410,6 +410,34 @@ var _ = Describe("Stream", func() {
 				Expect(err).ToNot(HaveOccurred())
 			})
 
+			It("blocks a stream when another stream used up the connection flow control window", func() {
+				cpm := handshake.NewConnectionParamatersManager()
+				str2, err := newStream(handler, cpm, str.connectionFlowController, 1339)
+				Expect(err).ToNot(HaveOccurred())
+				str.contributesToConnectionFlowControl = true
+				str2.contributesToConnectionFlowControl = true
+				str.flowController.UpdateSendWindow(1000)
+				str2.flowController.UpdateSendWindow(1000)
+				str.connectionFlowController.UpdateSendWindow(2)
+
+				_, err = str.Write([]byte{0xde, 0xad})
+				Expect(err).ToNot(HaveOccurred())
+
+				done := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					n, err := str2.Write([]byte{0x13, 0x37})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(n).To(Equal(2))
+					close(done)
+				}()
+				// str2 still has room in its stream flow control window, but the connection window is used up
+				Consistently(done).ShouldNot(BeClosed())
+				str.connectionFlowController.UpdateSendWindow(4)
+				str2.ConnectionFlowControlWindowUpdated()
+				Eventually(done).Should(BeClosed())
+			})
+
 			It("splits writing of frames when given more data than the flow control windows size", func() {
 				updated := str.flowController.UpdateSendWindow(2)
 				Expect(updated).To(BeTrue())
@@ -704,4 +732,92 @@ var _ = Describe("Stream", func() {
 			})
 		})
 	})
+
+	Context("resetting", func() {
+		It("fails writes after a local reset, and returns the final offset", func() {
+			str.flowController.UpdateSendWindow(1000)
+			str.connectionFlowController.UpdateSendWindow(1000)
+			_, err := str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.Reset(7)).To(Equal(protocol.ByteCount(6)))
+			n, err := str.Write([]byte("foobar"))
+			Expect(n).To(BeZero())
+			Expect(err).To(MatchError("RST_STREAM sent with code 7"))
+		})
+
+		It("returns a final offset that covers all data written concurrently", func() {
+			str.flowController.UpdateSendWindow(1 << 20)
+			str.connectionFlowController.UpdateSendWindow(1 << 20)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				for {
+					if _, err := str.Write([]byte("foobar")); err != nil {
+						Expect(err).To(MatchError("RST_STREAM sent with code 7"))
+						close(done)
+						return
+					}
+				}
+			}()
+			Eventually(func() protocol.ByteCount {
+				str.mutex.Lock()
+				defer str.mutex.Unlock()
+				return str.writeOffset
+			}).ShouldNot(BeZero())
+			finalOffset := str.Reset(7)
+			Eventually(done).Should(BeClosed())
+			lastFrame := handler.frames[len(handler.frames)-1].(*frames.StreamFrame)
+			Expect(lastFrame.Offset + protocol.ByteCount(len(lastFrame.Data))).To(Equal(finalOffset))
+		})
+
+		It("unblocks a blocked reader after a remote reset", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				_, err := str.Read(make([]byte, 4))
+				Expect(err).To(MatchError("RST_STREAM received with code 42"))
+				close(done)
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			err := str.RegisterRemoteReset(42, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("unblocks a writer blocked by flow control after a remote reset", func() {
+			str.flowController.UpdateSendWindow(1)
+			_, err := str.Write([]byte{0x42})
+			Expect(err).ToNot(HaveOccurred())
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				_, err := str.Write([]byte("foobar"))
+				Expect(err).To(MatchError("RST_STREAM received with code 42"))
+				close(done)
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			err = str.RegisterRemoteReset(42, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("counts the final offset of a remote reset towards flow control", func() {
+			err := str.RegisterRemoteReset(42, 100)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.flowController.GetHighestReceived()).To(Equal(protocol.ByteCount(100)))
+			Expect(str.connectionFlowController.GetHighestReceived()).To(Equal(protocol.ByteCount(100)))
+		})
+
+		It("errors when the final offset of a remote reset is smaller than the data received", func() {
+			err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			err = str.RegisterRemoteReset(42, 3)
+			Expect(err).To(MatchError("StreamDataAfterTermination: RST_STREAM final offset 3 is smaller than the highest offset received 6"))
+		})
+
+		It("errors when the final offset of a remote reset violates flow control", func() {
+			err := str.RegisterRemoteReset(42, 1<<40)
+			Expect(err).To(MatchError(errFlowControlViolation))
+		})
+	})
 })
@@ -1,8 +1,14 @@
 package testdata
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
 )
 
 // GetTLSConfig returns a tls config for quic.clemente.io
@@ -24,6 +30,31 @@ func GetCertificate() tls.Certificate {
 	}
 }
 
+// GetECDSATLSConfig returns a tls config with a self-signed ECDSA P-256 certificate for quic.clemente.io
+func GetECDSATLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "quic.clemente.io"},
+		DNSNames:     []string{"quic.clemente.io"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{certDer},
+			PrivateKey:  key,
+		}},
+	}
+}
+
 var certDer = []byte("0\x82\x05\x040\x82\x03\xec\xa0\x03\x02\x01\x02\x02\x12\x03\xde)\r\xc6N\xfd\x11*Z\xd5\xf3\xce\xf5\x8c:F\x970\r\x06\t*\x86H\x86\xf7\r\x01\x01\v\x05\x000J1\v0\t\x06\x03U\x04\x06\x13\x02US1\x160\x14\x06\x03U\x04\n\x13\rLet's Encrypt1#0!\x06\x03U\x04\x03\x13\x1aLet's Encrypt Authority X30\x1e\x17\r160415160800Z\x17\r160714160800Z0\x1b1\x190\x17\x06\x03U\x04\x03\x13\x10quic.clemente.io0\x82\x01\"0\r\x06\t*\x86H\x86\xf7\r\x01\x01\x01\x05\x00\x03\x82\x01\x0f\x000\x82\x01\n\x02\x82\x01\x01\x00\xb7D\x11dAY0\x02\"u(HfCT\xb7\xc6E\x9e\xbfz\x80\x04\x14\xa3\xff`\xb1{\u02c8\v\xab\xfc\xa3/\xe7W\xb1c\xf4\x91e\xbd\xee\xd2\xdeBC\xfd\"f\xed\x01S\x17\x8d\xaf2C\xd5\x04m\xb1?\x88&\x8b\b\x02\xd1\xdc\x1e?\x80U=\xf3\x8f\xea\bL\xa7=\xa2\xc0NhY\xa4I_\xc8TV\x04\x86\x85.\x0e\x1a8\x12\x86v\v\xce\xdb%v{\xf3\xd3\xfb\xe4\x02\x8e\xd6\xf7\xe0\x98\x99E]W\xbe\xced\x10\xfaJcx\x1f\xa5t\x0f\xa0]\x8d\xb7\xa5\x96\xe6TT\x8e\xa3p!\xbd\x04\x9cR\x84I\xae\x88*[\x04<3:\u3e92<\u060c\x97\xe5:\xa9\x8a\xc1\x9b\xbdV~|\xc4k\x97\x8f.\u008d\u04db\xed\x02_\u33c6\u01c4\xac\xbd_\x9b\x8a\xc5\xfcn\xb8\x9cH\xb0Ug\xa5R\xc2i\u0082x\xad>\xb4\\\xcbl\u007f\xe4h0\xbd\x1e\x87\x8a\xd7\xd4yf\x95\x1d9\x9f\xfam\xf9e\t\x80n\xf4yr\xabz$o\xbf\x02\x03\x01\x00\x01\xa3\x82\x02\x110\x82\x02\r0\x0e\x06\x03U\x1d\x0f\x01\x01\xff\x04\x04\x03\x02\x05\xa00\x1d\x06\x03U\x1d%\x04\x160\x14\x06\b+\x06\x01\x05\x05\a\x03\x01\x06\b+\x06\x01\x05\x05\a\x03\x020\f\x06\x03U\x1d\x13\x01\x01\xff\x04\x020\x000\x1d\x06\x03U\x1d\x0e\x04\x16\x04\x14\x890\x12\x12\u0379\u68190\x0f\xac\x13\x98\x80\xd2?\xfc\x8f\xa60\x1f\x06\x03U\x1d#\x04\x180\x16\x80\x14\xa8Jjc\x04}\u077a\xe6\xd19\xb7\xa6Ee\xef\xf3\xa8\xec\xa10p\x06\b+\x06\x01\x05\x05\a\x01\x01\x04d0b0/\x06\b+\x06\x01\x05\x05\a0\x01\x86#http://ocsp.int-x3.letsencrypt.org/0/\x06\b+\x06\x01\x05\x05\a0\x02\x86#http://cert.int-x3.letsencrypt.org/0\x1b\x06\x03U\x1d\x11\x04\x140\x12\x82\x10quic.clemente.io0\x81\xfe\x06\x03U\x1d \x04\x81\xf60\x81\xf30\b\x06\x06g\x81\f\x01\x02\x010\x81\xe6\x06\v+\x06\x01\x04\x01\x82\xdf\x13\x01\x01\x010\x81\xd60&\x06\b+\x06\x01\x05\x05\a\x02\x01\x16\x1ahttp://cps.letsencrypt.org0\x81\xab\x06\b+\x06\x01\x05\x05\a\x02\x020\x81\x9e\f\x81\x9bThis Certificate may only be relied upon by Relying Parties and only in accordance with the Certificate Policy found at https://letsencrypt.org/repository/0\r\x06\t*\x86H\x86\xf7\r\x01\x01\v\x05\x00\x03\x82\x01\x01\x00\x1bo\xf3U\azq\xd6OUG\xa1K`\x81\x8b\xb5c\xf3\xb0\xa3Q\x05\xd9\xf8\xa7\x9aU\u0202\x96\xfc\xec\xcc^\xcc\xe1P\xd8j\xfeg\xf4\xab\x97\xe7v\x98\x1f>P\x1cPX\xc0Z\xef\x05Gf\xff\x81\xd9q\x96\xe2\x12\fM\xb2\xf2#\x1d\xee\xd7\xf7\xc8f\x11\ud5bcw(\x83\xc90\xbb\xba\x1aA\r\r\x1b\xa9\xc9\x19t\xa9bIEd\x8a\xdf\x19\u0154^\xb7\x95a_\xe2\x00\xaa\xfa\xf1Tk\xfb\xd2F\xa2l\xf2\xbdj\xdb\xe6q\x1d\x9d\xce\\G\x93='?\x89\xa5\x12\xecY\xf8\u9949<\x90\xbd\xc3\xf1\xb8\xbf&\xd1!\xc3%\u019353S7I\xf9Q\xb3RyY\xb3j\x81\xf6\rv\u007fY\x9a\xc4\x14\xa1\xf2\xd0\xe9\f\xf6W]\xf0\x8a\xad\x02\xediqlx\xc8\xd5\x18i\xc3\u0452\xbcw\x83\x9f\xb7\xb8'H@\x0f\xbd8\xb4v\x94\xac\xa2(]I\xa4\x91\xd0\x05i\xc9FS\xb8\xf7~ \xac\xba!\x94{YB\x93\u0469&J}E%")
 
 var chainDer = []byte("0\x82\x04\x920\x82\x03z\xa0\x03\x02\x01\x02\x02\x10\n\x01AB\x00\x00\x01S\x85sj\v\x85\xec\xa7\b0\r\x06\t*\x86H\x86\xf7\r\x01\x01\v\x05\x000?1$0\"\x06\x03U\x04\n\x13\x1bDigital Signature Trust Co.1\x170\x15\x06\x03U\x04\x03\x13\x0eDST Root CA X30\x1e\x17\r160317164046Z\x17\r210317164046Z0J1\v0\t\x06\x03U\x04\x06\x13\x02US1\x160\x14\x06\x03U\x04\n\x13\rLet's Encrypt1#0!\x06\x03U\x04\x03\x13\x1aLet's Encrypt Authority X30\x82\x01\"0\r\x06\t*\x86H\x86\xf7\r\x01\x01\x01\x05\x00\x03\x82\x01\x0f\x000\x82\x01\n\x02\x82\x01\x01\x00\x9c\xd3\f\xf0Z\xe5.G\xb7r]7\x83\xb3hc0\xea\xd75&\x19%\u1f7e5\xf1p\x92/\xb7\xb8KA\x05\xab\xa9\x9e5\bX\xec\xb1*\xc4h\x87\v\xa3\xe3u\xe4\xe6\xf3\xa7bq\xbay\x81`\x1f\u05d1\x9a\x9f\xf3\xd0xgq\xc8i\x0e\x95\x91\xcf\xfe\xe6\x99\xe9`<H\xcc~\xcaMw\x12$\x9dG\x1bZ\xeb\xb9\xec\x1e7\x00\x1c\x9c\xac{\xa7\x05\xea\xceJ\xeb\xbdA\xe56\x98\xb9\xcb\xfdm<\x96h\xdf#*B\x90\f\x86tg\xc8\u007f\xa5\x9a\xb8Ra\x14\x13?e\u9087\xcb\xdb\xfa\x0eV\xf6\x86\x89\xf3\x85?\x97\x86\xaf\xb0\xdc\x1a\xefk\r\x95\x16}\xc4+\xa0e\xb2\x99\x046u\x80k\xacJ\xf3\x1b\x90Ix/\xa2\x96O* %)\x04\xc6t\xc0\xd01\u034f18\x95\x16\xba\xa83\xb8C\xf1\xb1\x1f\xc30\u007f\xa2y1\x13=-6\xf8\xe3\xfc\xf23j\xb991\u016f\u010d\r\x1dd\x163\xaa\xfa\x84)\xb6\xd4\v\xc0\xd8}\u00d3\x02\x03\x01\x00\x01\xa3\x82\x01}0\x82\x01y0\x12\x06\x03U\x1d\x13\x01\x01\xff\x04\b0\x06\x01\x01\xff\x02\x01\x000\x0e\x06\x03U\x1d\x0f\x01\x01\xff\x04\x04\x03\x02\x01\x860\u007f\x06\b+\x06\x01\x05\x05\a\x01\x01\x04s0q02\x06\b+\x06\x01\x05\x05\a0\x01\x86&http://isrg.trustid.ocsp.identrust.com0;\x06\b+\x06\x01\x05\x05\a0\x02\x86/http://apps.identrust.com/roots/dstrootcax3.p7c0\x1f\x06\x03U\x1d#\x04\x180\x16\x80\x14\u0127\xb1\xa4{,q\xfa\xdb\xe1K\x90u\xff\xc4\x15`\x85\x89\x100T\x06\x03U\x1d \x04M0K0\b\x06\x06g\x81\f\x01\x02\x010?\x06\v+\x06\x01\x04\x01\x82\xdf\x13\x01\x01\x01000.\x06\b+\x06\x01\x05\x05\a\x02\x01\x16\"http://cps.root-x1.letsencrypt.org0<\x06\x03U\x1d\x1f\x0450301\xa0/\xa0-\x86+http://crl.identrust.com/DSTROOTCAX3CRL.crl0\x1d\x06\x03U\x1d\x0e\x04\x16\x04\x14\xa8Jjc\x04}\u077a\xe6\xd19\xb7\xa6Ee\xef\xf3\xa8\xec\xa10\r\x06\t*\x86H\x86\xf7\r\x01\x01\v\x05\x00\x03\x82\x01\x01\x00\xdd3\xd7\x11\xf3cX8\xdd\x18\x15\xfb\tU\xbevV\xb9pH\xa5iG'{\xc2$\b\x92\xf1Z\x1fJ\x12)7$tQ\x1cbh\xb8\u0355pg\xe5\xf7\xa4\xbcN(Q\u035b\u8b87\x9d\xea\u063aZ\xa1\x01\x9a\xdc\xf0\xddj\x1dj\xd8>W#\x9e\xa6\x1e\x04b\x9a\xff\xd7\x05\u02b7\x1f?\xc0\nH\xbc\x94\xb0\xb6eb\xe0\xc1T\xe5\xa3*\xad \xc4\xe9\xe6\xbb\xdc\xc8\xf6\xb5\xc32\xa3\x98\xccw\xa8\xe6ye\a+\xcb(\xfe:\x16R\x81\xceR\f._\x83\xe8\xd5\x063\xfbwl\xce@\xea2\x9e\x1f\x92\\A\xc1tl[]\n_3\xccM\x9f\xac8\xf0/{,b\x9d\u0663\x91o%\x1b/\x90\xb1\x19F=\xf6~\x1b\xa6z\x87\xb9\xa3zm\x18\xfa%\xa5\x91\x87\x15\xe0\xf2\x16/X\xb0\x06/,h&\xc6K\x98\xcd\u069f\f\xf9\u007f\x90\xedCJ\x12DNosz(\ua92an{L}\x87\xdd\xe0\xc9\x02D\xa7\x87\xaf\xc34[\xb4B")
@@ -0,0 +1,32 @@
+package quic
+
+import (
+	"github.com/lucas-clemente/quic-go/handshake"
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// A Tracer is notified about events of the connections of a server, for debugging
+// The callbacks are called synchronously, so they have to return quickly.
+type Tracer interface {
+	// PacketReceived is called for every packet received for a connection
+	PacketReceived(connID protocol.ConnectionID, size protocol.ByteCount)
+	// PacketSent is called for every packet sent for a connection
+	PacketSent(connID protocol.ConnectionID, size protocol.ByteCount)
+	// ConnectionClosed is called when a connection is closed, by us or by the peer
+	ConnectionClosed(connID protocol.ConnectionID)
+	// the events of the handshake are reported by the crypto setup
+	handshake.Tracer
+}
+
+type noopTracer struct{}
+
+var _ Tracer = noopTracer{}
+
+func (noopTracer) PacketReceived(protocol.ConnectionID, protocol.ByteCount)     {}
+func (noopTracer) PacketSent(protocol.ConnectionID, protocol.ByteCount)         {}
+func (noopTracer) ConnectionClosed(protocol.ConnectionID)                       {}
+func (noopTracer) ReceivedCHLO(protocol.ConnectionID, map[handshake.Tag][]byte) {}
+func (noopTracer) SentREJ(protocol.ConnectionID)                                {}
+func (noopTracer) SentSHLO(protocol.ConnectionID)                               {}
+func (noopTracer) KeysInstalled(protocol.ConnectionID, bool)                    {}
+func (noopTracer) HandshakeComplete(protocol.ConnectionID)                      {}
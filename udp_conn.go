@@ -1,6 +1,10 @@
 package quic
 
-import "net"
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
 
 type connection interface {
 	write([]byte) error
@@ -8,22 +12,55 @@ type connection interface {
 	IP() net.IP
 }
 
+// udpRemoteAddr is the address a packet was received from, together with the
+// socket it arrived on. The socket changes when a client migrates to the
+// server's preferred address.
+type udpRemoteAddr struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+// A PacketTransform is applied to every packet the server sends, e.g. to simulate network conditions in tests.
+// It decides what is actually sent by calling write: not at all to drop the packet, multiple times to duplicate it,
+// from a different goroutine to delay it, or with modified data to corrupt it.
+type PacketTransform func(packet []byte, write func([]byte) error) error
+
 type udpConn struct {
 	conn        *net.UDPConn
 	currentAddr *net.UDPAddr
+	transform   PacketTransform
+
+	connID protocol.ConnectionID
+	tracer Tracer
 }
 
 var _ connection = &udpConn{}
 
 func (c *udpConn) write(p []byte) error {
-	_, err := c.conn.WriteToUDP(p, c.currentAddr)
-	return err
+	if c.tracer != nil {
+		c.tracer.PacketSent(c.connID, protocol.ByteCount(len(p)))
+	}
+	return writeTransformed(c.conn, c.currentAddr, p, c.transform)
 }
 
 func (c *udpConn) setCurrentRemoteAddr(addr interface{}) {
-	c.currentAddr = addr.(*net.UDPAddr)
+	remote := addr.(*udpRemoteAddr)
+	c.conn = remote.conn
+	c.currentAddr = remote.addr
 }
 
 func (c *udpConn) IP() net.IP {
 	return c.currentAddr.IP
 }
+
+// writeTransformed writes a packet, applying the transform if there is one
+func writeTransformed(conn *net.UDPConn, addr *net.UDPAddr, p []byte, transform PacketTransform) error {
+	write := func(b []byte) error {
+		_, err := conn.WriteToUDP(b, addr)
+		return err
+	}
+	if transform == nil {
+		return write(p)
+	}
+	return transform(p, write)
+}
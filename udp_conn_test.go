@@ -0,0 +1,151 @@
+package quic
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UDP connection", func() {
+	var (
+		client *net.UDPConn
+		sock1  *net.UDPConn
+		sock2  *net.UDPConn
+		c      *udpConn
+	)
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	BeforeEach(func() {
+		client = listen()
+		sock1 = listen()
+		sock2 = listen()
+		c = &udpConn{conn: sock1, currentAddr: client.LocalAddr().(*net.UDPAddr)}
+	})
+
+	AfterEach(func() {
+		client.Close()
+		sock1.Close()
+		sock2.Close()
+	})
+
+	receive := func() (string, net.Addr) {
+		b := make([]byte, 100)
+		n, addr, err := client.ReadFrom(b)
+		Expect(err).ToNot(HaveOccurred())
+		return string(b[:n]), addr
+	}
+
+	It("writes to the current address", func() {
+		err := c.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		data, addr := receive()
+		Expect(data).To(Equal("foobar"))
+		Expect(addr.String()).To(Equal(sock1.LocalAddr().String()))
+	})
+
+	It("traces sent packets", func() {
+		tracer := &mockTracer{}
+		c.tracer = tracer
+		err := c.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tracer.sent).To(Equal([]protocol.ByteCount{6}))
+	})
+
+	It("writes to the new address when the client's address changes", func() {
+		newClient := listen()
+		defer newClient.Close()
+		c.setCurrentRemoteAddr(&udpRemoteAddr{conn: sock1, addr: newClient.LocalAddr().(*net.UDPAddr)})
+		err := c.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 100)
+		n, addr, err := newClient.ReadFrom(b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b[:n]).To(Equal([]byte("foobar")))
+		Expect(addr.String()).To(Equal(sock1.LocalAddr().String()))
+		Expect(c.IP()).To(Equal(newClient.LocalAddr().(*net.UDPAddr).IP))
+	})
+
+	It("switches the socket when the client migrates to the preferred address", func() {
+		c.setCurrentRemoteAddr(&udpRemoteAddr{conn: sock2, addr: client.LocalAddr().(*net.UDPAddr)})
+		err := c.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		data, addr := receive()
+		Expect(data).To(Equal("foobar"))
+		Expect(addr.String()).To(Equal(sock2.LocalAddr().String()))
+	})
+
+	Context("transforming packets", func() {
+		It("drops packets", func() {
+			c.transform = func(p []byte, write func([]byte) error) error {
+				if bytes.HasPrefix(p, []byte("drop")) {
+					return nil
+				}
+				return write(p)
+			}
+			for i := 0; i < 10; i++ {
+				err := c.write([]byte("drop me"))
+				Expect(err).ToNot(HaveOccurred())
+				err = c.write([]byte("foobar"))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			err := c.write([]byte("done"))
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 10; i++ {
+				data, _ := receive()
+				Expect(data).To(Equal("foobar"))
+			}
+			data, _ := receive()
+			Expect(data).To(Equal("done"))
+		})
+
+		It("duplicates and corrupts packets", func() {
+			c.transform = func(p []byte, write func([]byte) error) error {
+				if err := write(p); err != nil {
+					return err
+				}
+				return write(bytes.ToUpper(p))
+			}
+			err := c.write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			data, _ := receive()
+			Expect(data).To(Equal("foobar"))
+			data, _ = receive()
+			Expect(data).To(Equal("FOOBAR"))
+		})
+
+		It("delays packets", func() {
+			c.transform = func(p []byte, write func([]byte) error) error {
+				if bytes.Equal(p, []byte("first")) {
+					go func() {
+						time.Sleep(10 * time.Millisecond)
+						write(p)
+					}()
+					return nil
+				}
+				return write(p)
+			}
+			err := c.write([]byte("first"))
+			Expect(err).ToNot(HaveOccurred())
+			err = c.write([]byte("second"))
+			Expect(err).ToNot(HaveOccurred())
+			data, _ := receive()
+			Expect(data).To(Equal("second"))
+			data, _ = receive()
+			Expect(data).To(Equal("first"))
+		})
+	})
+
+	It("returns the IP of the current address", func() {
+		Expect(c.IP().Equal(net.IPv4(127, 0, 0, 1))).To(BeTrue())
+	})
+})
@@ -1,11 +1,56 @@
 package utils
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ErrBufferLimitExceeded is returned by a CachingReader if caching more data would exceed the limit of its BufferLimiter
+var ErrBufferLimitExceeded = errors.New("CachingReader: buffer limit exceeded")
+
+// A BufferLimiter limits the total number of bytes cached by multiple CachingReaders
+type BufferLimiter struct {
+	maxBytes  int
+	usedBytes int
+	mutex     sync.Mutex
+}
+
+// NewBufferLimiter creates a new BufferLimiter
+func NewBufferLimiter(maxBytes int) *BufferLimiter {
+	return &BufferLimiter{maxBytes: maxBytes}
+}
+
+func (l *BufferLimiter) reserve(n int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.usedBytes+n > l.maxBytes {
+		return false
+	}
+	l.usedBytes += n
+	return true
+}
+
+func (l *BufferLimiter) release(n int) {
+	l.mutex.Lock()
+	l.usedBytes -= n
+	l.mutex.Unlock()
+}
+
+// Used returns the number of bytes currently cached by all CachingReaders using this BufferLimiter
+func (l *BufferLimiter) Used() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.usedBytes
+}
 
 // CachingReader wraps a reader and saves all data it reads
 type CachingReader struct {
 	buf bytes.Buffer
 	r   ReadStream
+
+	limiter       *BufferLimiter
+	reservedBytes int
 }
 
 // NewCachingReader returns a new CachingReader
@@ -13,9 +58,29 @@ func NewCachingReader(r ReadStream) *CachingReader {
 	return &CachingReader{r: r}
 }
 
+// NewLimitedCachingReader returns a new CachingReader that only caches as much data as the limiter allows
+// The data is accounted for until Release is called.
+func NewLimitedCachingReader(r ReadStream, limiter *BufferLimiter) *CachingReader {
+	return &CachingReader{r: r, limiter: limiter}
+}
+
+func (r *CachingReader) reserve(n int) bool {
+	if r.limiter == nil {
+		return true
+	}
+	if !r.limiter.reserve(n) {
+		return false
+	}
+	r.reservedBytes += n
+	return true
+}
+
 // Read implements io.Reader
 func (r *CachingReader) Read(p []byte) (int, error) {
 	n, err := r.r.Read(p)
+	if !r.reserve(n) {
+		return 0, ErrBufferLimitExceeded
+	}
 	r.buf.Write(p[:n])
 	return n, err
 }
@@ -24,12 +89,33 @@ func (r *CachingReader) Read(p []byte) (int, error) {
 func (r *CachingReader) ReadByte() (byte, error) {
 	b, err := r.r.ReadByte()
 	if err == nil {
+		if !r.reserve(1) {
+			return 0, ErrBufferLimitExceeded
+		}
 		r.buf.WriteByte(b)
 	}
 	return b, err
 }
 
-// Get the data cached
+// Get the data cached since the last reset
 func (r *CachingReader) Get() []byte {
 	return r.buf.Bytes()
 }
+
+// Release returns the cached data to the BufferLimiter, if there is one
+// The data remains available via Get, but is not accounted for any more.
+func (r *CachingReader) Release() {
+	if r.limiter == nil {
+		return
+	}
+	r.limiter.release(r.reservedBytes)
+	r.reservedBytes = 0
+}
+
+// Reset releases the cached data, and continues with caching the data read from rd
+// The buffer is reused, so the data returned by Get before is overwritten by subsequent reads.
+func (r *CachingReader) Reset(rd ReadStream) {
+	r.Release()
+	r.buf.Reset()
+	r.r = rd
+}
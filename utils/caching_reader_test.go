@@ -2,6 +2,8 @@ package utils
 
 import (
 	"bytes"
+	"io"
+	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -34,3 +36,99 @@ var _ = Describe("Caching reader", func() {
 		Expect(cr.Get()).To(Equal([]byte("foo")))
 	})
 })
+
+var _ = Describe("Limited caching reader", func() {
+	It("releases the cached data", func() {
+		limiter := NewBufferLimiter(10)
+		cr := NewLimitedCachingReader(bytes.NewReader([]byte("foobar")), limiter)
+		p := make([]byte, 6)
+		_, err := cr.Read(p)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(limiter.Used()).To(Equal(6))
+		cr.Release()
+		Expect(limiter.Used()).To(BeZero())
+		Expect(cr.Get()).To(Equal([]byte("foobar")))
+	})
+
+	It("releases the cached data on reset", func() {
+		limiter := NewBufferLimiter(100)
+		cr := NewLimitedCachingReader(bytes.NewReader([]byte("foobar")), limiter)
+		_, err := cr.Read(make([]byte, 6))
+		Expect(err).ToNot(HaveOccurred())
+		cr.Reset(bytes.NewReader(nil))
+		Expect(limiter.Used()).To(BeZero())
+		Expect(cr.Get()).To(BeEmpty())
+	})
+
+	It("caches the data read from the new reader after a reset", func() {
+		limiter := NewBufferLimiter(100)
+		cr := NewLimitedCachingReader(bytes.NewReader([]byte("foobar")), limiter)
+		_, err := cr.Read(make([]byte, 6))
+		Expect(err).ToNot(HaveOccurred())
+		cr.Reset(bytes.NewReader([]byte("raboof")))
+		_, err = cr.Read(make([]byte, 3))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cr.Get()).To(Equal([]byte("rab")))
+		Expect(limiter.Used()).To(Equal(3))
+	})
+
+	It("refuses to cache more data than the limit across many readers", func() {
+		limiter := NewBufferLimiter(100)
+		var readers []*CachingReader
+		var err error
+		for i := 0; i < 100; i++ {
+			cr := NewLimitedCachingReader(bytes.NewReader([]byte("foobar")), limiter)
+			readers = append(readers, cr)
+			for j := 0; j < 3; j++ {
+				if _, err = cr.ReadByte(); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		Expect(err).To(MatchError(ErrBufferLimitExceeded))
+		Expect(readers).To(HaveLen(34))
+		Expect(limiter.Used()).To(Equal(100))
+		// once a handshake is done, its buffer can be used by others
+		readers[0].Release()
+		Expect(limiter.Used()).To(Equal(97))
+		p := make([]byte, 3)
+		_, err = NewLimitedCachingReader(bytes.NewReader([]byte("foobar")), limiter).Read(p)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(limiter.Used()).To(Equal(100))
+	})
+})
+
+// benchmarkMessage is the size of a padded CHLO
+var benchmarkMessage = make([]byte, 1024)
+
+// BenchmarkCachingReaderNew measures caching one message per CachingReader, as before Reset took a reader
+func BenchmarkCachingReaderNew(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(benchmarkMessage)
+	p := make([]byte, len(benchmarkMessage))
+	for i := 0; i < b.N; i++ {
+		r.Reset(benchmarkMessage)
+		cr := NewCachingReader(r)
+		if _, err := io.ReadFull(cr, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCachingReaderReset measures caching many messages with a single CachingReader
+func BenchmarkCachingReaderReset(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(benchmarkMessage)
+	p := make([]byte, len(benchmarkMessage))
+	cr := NewCachingReader(r)
+	for i := 0; i < b.N; i++ {
+		r.Reset(benchmarkMessage)
+		cr.Reset(r)
+		if _, err := io.ReadFull(cr, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package utils
+
+import "time"
+
+// A Timer is a timer created by a Clock, see time.Timer
+type Timer interface {
+	// Chan returns the channel the current time is sent on when the timer fires
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// A Clock is the source of time for timeouts
+// All timeouts of a server and its sessions use the same Clock, so that tests can control them.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// DefaultClock implements the Clock interface using the Go stdlib clock
+type DefaultClock struct{}
+
+var _ Clock = DefaultClock{}
+
+// Now gets the current time
+func (DefaultClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a timer that fires after d
+func (DefaultClock) NewTimer(d time.Duration) Timer {
+	return stdlibTimer{time.NewTimer(d)}
+}
+
+// AfterFunc calls f in its own goroutine after d
+func (DefaultClock) AfterFunc(d time.Duration, f func()) Timer {
+	return stdlibTimer{time.AfterFunc(d, f)}
+}
+
+type stdlibTimer struct {
+	*time.Timer
+}
+
+func (t stdlibTimer) Chan() <-chan time.Time {
+	return t.C
+}
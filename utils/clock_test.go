@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Default clock", func() {
+	It("returns the current time", func() {
+		Expect(DefaultClock{}.Now()).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("creates timers", func() {
+		timer := DefaultClock{}.NewTimer(time.Millisecond)
+		Eventually(timer.Chan()).Should(Receive())
+		Expect(timer.Stop()).To(BeFalse())
+		timer.Reset(time.Hour)
+		Expect(timer.Stop()).To(BeTrue())
+	})
+
+	It("calls functions after a duration", func() {
+		called := make(chan struct{})
+		DefaultClock{}.AfterFunc(time.Millisecond, func() { close(called) })
+		Eventually(called).Should(BeClosed())
+	})
+})
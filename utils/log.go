@@ -32,6 +32,13 @@ func SetLogLevel(level LogLevel) {
 	logLevel = level
 }
 
+// SetLogWriter sets the writer the logs are written to
+func SetLogWriter(w io.Writer) {
+	mutex.Lock()
+	out = w
+	mutex.Unlock()
+}
+
 // Debugf logs something
 func Debugf(format string, args ...interface{}) {
 	if logLevel == LogLevelDebug {
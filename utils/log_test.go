@@ -47,6 +47,15 @@ var _ = Describe("Log", func() {
 		Expect(b.Bytes()).To(Equal([]byte("info\nerr\n")))
 	})
 
+	It("sets the log writer", func() {
+		w := bytes.NewBuffer([]byte{})
+		SetLogWriter(w)
+		SetLogLevel(LogLevelInfo)
+		Infof("info")
+		Expect(w.Bytes()).To(Equal([]byte("info\n")))
+		Expect(b.Bytes()).To(BeEmpty())
+	})
+
 	It("log level debug", func() {
 		SetLogLevel(LogLevelDebug)
 		Debugf("debug")